@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/cli"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+/*
+ * Access control list file format. Empty lines and lines starting with
+ * '#' are ignored. Every other line is one of
+ *
+ *     list <name> <cidr> [<cidr> ...]
+ *     profile <name> <routing_table>
+ *     sip <list> <action>
+ *     cli <list> <action>
+ *
+ * The "list" lines define the named lists of IP networks, a list may be
+ * extended by several lines. The predefined list "any" matches any
+ * address. The "profile" lines define the routing profiles, each of them
+ * is the routing table in the -routing_table format that is used instead
+ * of the default one for the calls it has been applied to.
+ *
+ * The "sip" rules are applied to the source of the new incoming SIP
+ * requests and the "cli" rules to the remote address of the TCP
+ * connections to the command socket. The rules are tried in the order
+ * they appear in the file and the first rule the source matches decides.
+ * The source that does not match any rule is rejected, unless there are
+ * no rules of that kind at all. Without the "cli" rules only the
+ * connections from the loopback addresses are accepted.
+ *
+ * Actions:
+ *
+ *     accept            accept the request or the connection
+ *     reject            reject the request with 403 or close the connection
+ *     auth              challenge the request unless it has valid digest credentials (sip only)
+ *     route=<profile>   accept the call and route it with the routing profile (sip only)
+ *
+ * Example:
+ *
+ *     list     office     192.168.0.0/16 10.1.2.3
+ *     list     carriers   203.0.113.0/24 2001:db8::/32
+ *     list     blocked    198.51.100.0/24
+ *     profile  wholesale  /etc/b2bua/routes-wholesale.txt
+ *     sip      blocked    reject
+ *     sip      office     accept
+ *     sip      carriers   route=wholesale
+ *     sip      any        auth
+ *     cli      office     accept
+ */
+
+const (
+	ACL_ACCEPT = iota
+	ACL_REJECT
+	ACL_AUTH
+	ACL_ROUTE
+)
+
+const (
+	ACL_SIP = "sip"
+	ACL_CLI = "cli"
+	ACL_ANY = "any"
+)
+
+var acl_actions = map[string]int{
+	"accept": ACL_ACCEPT,
+	"reject": ACL_REJECT,
+	"auth":   ACL_AUTH,
+}
+
+type aclRule struct {
+	list    string
+	nets    []*net.IPNet // nil matches any address
+	action  int
+	profile string
+	routing *routingEngine
+}
+
+var (
+	acl_accept_all = &aclRule{list: ACL_ANY, action: ACL_ACCEPT}
+	acl_reject_all = &aclRule{list: ACL_ANY, action: ACL_REJECT}
+)
+
+func (s *aclRule) matches(ip net.IP) bool {
+	if s.nets == nil {
+		return true
+	}
+	for _, ipnet := range s.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *aclRule) String() string {
+	switch s.action {
+	case ACL_REJECT:
+		return s.list + " reject"
+	case ACL_AUTH:
+		return s.list + " auth"
+	case ACL_ROUTE:
+		return s.list + " route=" + s.profile
+	}
+	return s.list + " accept"
+}
+
+type accessList struct {
+	fname    string
+	lists    map[string][]*net.IPNet
+	profiles map[string]*routingEngine
+	rules    map[string][]*aclRule
+}
+
+func NewAccessList(fname string, global_config *myConfigParser) (*accessList, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	s := &accessList{
+		fname:    fname,
+		lists:    make(map[string][]*net.IPNet),
+		profiles: make(map[string]*routingEngine),
+		rules:    make(map[string][]*aclRule),
+	}
+	type ruleLine struct {
+		lineno int
+		kind   string
+		fields []string
+	}
+	rule_lines := []*ruleLine{}
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "list":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%s:%d: syntax error: list <name> <cidr> [<cidr> ...]", fname, lineno)
+			}
+			if fields[1] == ACL_ANY {
+				return nil, fmt.Errorf("%s:%d: the list \"%s\" is predefined", fname, lineno, ACL_ANY)
+			}
+			for _, cidr := range fields[2:] {
+				ipnet, err := parseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %s: %s", fname, lineno, cidr, err.Error())
+				}
+				s.lists[fields[1]] = append(s.lists[fields[1]], ipnet)
+			}
+		case "profile":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: syntax error: profile <name> <routing_table>", fname, lineno)
+			}
+			if _, ok := s.profiles[fields[1]]; ok {
+				return nil, fmt.Errorf("%s:%d: duplicate profile %s", fname, lineno, fields[1])
+			}
+			routing, err := NewRoutingEngine(fields[2], global_config)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: profile %s: %s", fname, lineno, fields[1], err.Error())
+			}
+			s.profiles[fields[1]] = routing
+		case ACL_SIP, ACL_CLI:
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: syntax error: %s <list> <action>", fname, lineno, fields[0])
+			}
+			// The rules are resolved once all the lists and the
+			// profiles are known
+			rule_lines = append(rule_lines, &ruleLine{lineno, fields[0], fields})
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown keyword '%s'", fname, lineno, fields[0])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, rl := range rule_lines {
+		rule, err := s.parseRule(rl.kind, rl.fields[1], rl.fields[2], global_config)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, rl.lineno, err.Error())
+		}
+		s.rules[rl.kind] = append(s.rules[rl.kind], rule)
+	}
+	return s, nil
+}
+
+func (s *accessList) parseRule(kind, list, action string, global_config *myConfigParser) (*aclRule, error) {
+	rule := &aclRule{list: list}
+	if list != ACL_ANY {
+		nets, ok := s.lists[list]
+		if !ok {
+			return nil, errors.New("unknown list " + list)
+		}
+		rule.nets = nets
+	}
+	if strings.HasPrefix(action, "route=") {
+		rule.action = ACL_ROUTE
+		rule.profile = action[6:]
+		if rule.routing = s.profiles[rule.profile]; rule.routing == nil {
+			return nil, errors.New("unknown profile " + rule.profile)
+		}
+	} else if a, ok := acl_actions[action]; ok {
+		rule.action = a
+	} else {
+		return nil, errors.New("unknown action '" + action + "'")
+	}
+	if kind == ACL_CLI && rule.action != ACL_ACCEPT && rule.action != ACL_REJECT {
+		return nil, errors.New("only accept and reject are allowed for the cli rules")
+	}
+	if rule.action == ACL_AUTH && global_config.Acl_users == "" {
+		return nil, errors.New("the auth action requires the -acl_users option")
+	}
+	return rule, nil
+}
+
+// Check returns the rule that decides on the source. The nil list
+// accepts everything.
+func (s *accessList) Check(kind string, ip net.IP) *aclRule {
+	if s == nil || len(s.rules[kind]) == 0 {
+		return acl_accept_all
+	}
+	if ip == nil {
+		return acl_reject_all
+	}
+	for _, rule := range s.rules[kind] {
+		if rule.matches(ip) {
+			return rule
+		}
+	}
+	return acl_reject_all
+}
+
+type aclUserStore interface {
+	sippy_types.DigestUserStore
+	PrepareReload() (func(), error)
+}
+
+// aclEngine holds the current access control list and allows it to be
+// replaced atomically together with the routing profiles.
+type aclEngine struct {
+	global_config *myConfigParser
+	fname         string
+	acl           *accessList
+	lock          sync.RWMutex
+	users         aclUserStore
+	auth          sippy_types.DigestAuth
+}
+
+// NewAclEngine loads the ACL file. The listener is notified when the
+// caller challenged by the "auth" rule fails the authentication.
+func NewAclEngine(fname string, global_config *myConfigParser, listener sippy_types.AuthFailureListener) (*aclEngine, error) {
+	acl, err := NewAccessList(fname, global_config)
+	if err != nil {
+		return nil, err
+	}
+	s := &aclEngine{
+		global_config: global_config,
+		fname:         fname,
+		acl:           acl,
+	}
+	if global_config.Acl_users != "" {
+		users, err := sippy.NewDigestFileStore(global_config.Acl_users)
+		if err != nil {
+			return nil, err
+		}
+		auth := sippy.NewDigestAuth(users, global_config.Acl_realm)
+		if listener != nil {
+			auth.SetAuthFailureListener(listener)
+		}
+		s.users = users
+		s.auth = auth
+	}
+	return s, nil
+}
+
+func (s *aclEngine) Get() *accessList {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.acl
+}
+
+// AcceptCLI tells whether the TCP connection to the command socket from
+// the IP address is allowed.
+func (s *aclEngine) AcceptCLI(ip net.IP) bool {
+	acl := s.Get()
+	if acl == nil || len(acl.rules[ACL_CLI]) == 0 {
+		// The command socket is not open to the network by default
+		return ip != nil && ip.IsLoopback()
+	}
+	return acl.Check(ACL_CLI, ip).action == ACL_ACCEPT
+}
+
+// CheckSIP returns the rule applied to the new incoming request or the
+// response to be sent back if the request is not allowed. The REGISTER
+// requests handled by the registrar are authenticated by the registrar
+// itself.
+func (s *aclEngine) CheckSIP(req sippy_types.SipRequest, has_registrar bool) (*aclRule, sippy_types.SipResponse) {
+	ip := net.ParseIP(strings.Trim(req.GetSource().Host.String(), "[]"))
+	rule := s.Get().Check(ACL_SIP, ip)
+	switch rule.action {
+	case ACL_REJECT:
+		return rule, req.GenResponse(403, "Forbidden", nil, nil)
+	case ACL_AUTH:
+		if req.GetMethod() == "REGISTER" && has_registrar {
+			break
+		}
+		if _, resp := s.auth.Authenticate(req); resp != nil {
+			return rule, resp
+		}
+	}
+	return rule, nil
+}
+
+// Reload re-reads the ACL file, the routing profiles and the digest
+// credentials. The old list remains active when the new one cannot be
+// loaded.
+func (s *aclEngine) Reload() error {
+	commit, err := s.PrepareReload()
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload loads the ACL file and the digest credentials, the
+// returned function replaces both of them at once.
+func (s *aclEngine) PrepareReload() (func(), error) {
+	acl, err := NewAccessList(s.fname, s.global_config)
+	if err != nil {
+		return nil, err
+	}
+	commit_users := func() {}
+	if s.users != nil {
+		if commit_users, err = s.users.PrepareReload(); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		commit_users()
+		s.lock.Lock()
+		s.acl = acl
+		s.lock.Unlock()
+	}, nil
+}
+
+func (s *aclEngine) String() string {
+	acl := s.Get()
+	return fmt.Sprintf("%s: %d lists, %d profiles, %d sip rules, %d cli rules", s.fname, len(acl.lists),
+		len(acl.profiles), len(acl.rules[ACL_SIP]), len(acl.rules[ACL_CLI]))
+}
+
+// aclCommand handles the "acl [<ip>]" CLI command that shows the lists
+// or the rules applied to the IP address.
+func (s *CallMap) aclCommand(clim sippy_cli.CLIManagerIface, args []string) {
+	if s.acl == nil {
+		clim.Send("ERROR: the access control lists are not configured\n")
+		return
+	}
+	switch {
+	case len(args) == 0:
+		clim.Send(s.acl.String() + "\n")
+	case len(args) == 1 && net.ParseIP(args[0]) != nil:
+		acl := s.acl.Get()
+		ip := net.ParseIP(args[0])
+		clim.Send(fmt.Sprintf("sip: %s\ncli: %s\n", acl.Check(ACL_SIP, ip).String(), acl.Check(ACL_CLI, ip).String()))
+	default:
+		clim.Send("ERROR: syntax error: acl [<ip>]\n")
+	}
+}
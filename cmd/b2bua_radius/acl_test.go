@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+)
+
+func TestAccessList(t *testing.T) {
+	dir := t.TempDir()
+	routes := filepath.Join(dir, "routes-wholesale")
+	if err := os.WriteFile(routes, []byte("*  192.0.2.10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "acl")
+	acl_data := strings.Join([]string{
+		"# test lists",
+		"list     office     192.168.0.0/16 10.1.2.3",
+		"list     carriers   203.0.113.0/24",
+		"list     carriers   2001:db8::/32",
+		"list     blocked    192.168.66.0/24",
+		"profile  wholesale  " + routes,
+		"sip      blocked    reject",
+		"sip      office     accept",
+		"sip      carriers   route=wholesale",
+		"cli      office     accept",
+		"",
+	}, "\n")
+	if err := os.WriteFile(fname, []byte(acl_data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	acl, err := NewAclEngine(fname, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		kind   string
+		ip     string
+		result string
+	}{
+		{ACL_SIP, "192.168.66.1", "blocked reject"},
+		{ACL_SIP, "192.168.1.1", "office accept"},
+		{ACL_SIP, "10.1.2.3", "office accept"},
+		{ACL_SIP, "10.1.2.4", "any reject"},
+		{ACL_SIP, "2001:db8::1", "carriers route=wholesale"},
+		{ACL_SIP, "203.0.113.7", "carriers route=wholesale"},
+		{ACL_CLI, "192.168.66.1", "office accept"},
+		{ACL_CLI, "203.0.113.7", "any reject"},
+	} {
+		if res := acl.Get().Check(tc.kind, net.ParseIP(tc.ip)).String(); res != tc.result {
+			t.Errorf("%s %s: expected %q, got %q", tc.kind, tc.ip, tc.result, res)
+		}
+	}
+	rule := acl.Get().Check(ACL_SIP, net.ParseIP("203.0.113.7"))
+	if r := rule.routing.Lookup("123", ""); len(r) != 1 || r[0].hostPort != "192.0.2.10" {
+		t.Errorf("Bad route of the profile: %v", r)
+	}
+	if !acl.AcceptCLI(net.ParseIP("10.1.2.3")) || acl.AcceptCLI(net.ParseIP("10.1.2.4")) || acl.AcceptCLI(nil) {
+		t.Error("Bad decision on the CLI connection")
+	}
+	// The kind without the rules accepts any source
+	if res := (&accessList{}).Check(ACL_CLI, net.ParseIP("10.1.2.4")); res.action != ACL_ACCEPT {
+		t.Error("The source has been rejected with no rules")
+	}
+	// The command socket is only open to the loopback addresses without
+	// the cli rules or the ACL at all
+	for _, engine := range []*aclEngine{{acl: &accessList{}}, nil} {
+		if !engine.AcceptCLI(net.ParseIP("127.0.0.1")) || !engine.AcceptCLI(net.ParseIP("::1")) ||
+			engine.AcceptCLI(net.ParseIP("10.1.2.4")) || engine.AcceptCLI(nil) {
+			t.Error("Bad decision on the CLI connection without the cli rules")
+		}
+	}
+
+	cmap := &CallMap{global_config: config}
+	clim := &testCLI{}
+	cmap.aclCommand(clim, nil)
+	if !strings.HasPrefix(clim.out, "ERROR") {
+		t.Errorf("ACL shown with no ACL configured: %s", clim.out)
+	}
+	cmap.acl = acl
+	clim.out = ""
+	cmap.aclCommand(clim, []string{"192.168.66.1"})
+	if clim.out != "sip: blocked reject\ncli: office accept\n" {
+		t.Errorf("Bad output of the acl command: %q", clim.out)
+	}
+
+	for _, buf := range []string{
+		"list office 10.0.0.0/33\n",
+		"list any 10.0.0.0/8\n",
+		"sip office accept\n",
+		"list office 10.0.0.0/8\nsip office route=foo\n",
+		"list office 10.0.0.0/8\ncli office auth\n",
+		"sip any auth\n",
+		"sip any drop\n",
+		"allow 10.0.0.0/8\n",
+	} {
+		if err = os.WriteFile(fname, []byte(buf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = acl.Reload(); err == nil {
+			t.Errorf("Bad ACL %q has been accepted", buf)
+		}
+	}
+	if acl.Get().Check(ACL_SIP, net.ParseIP("192.168.66.1")).action != ACL_REJECT {
+		t.Error("The ACL has been lost on failed reload")
+	}
+	if err = os.WriteFile(fname, []byte("sip any accept\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Get().Check(ACL_SIP, net.ParseIP("192.168.66.1")).action != ACL_ACCEPT {
+		t.Error("The ACL has not been reloaded")
+	}
+}
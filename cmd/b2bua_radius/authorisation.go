@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+)
+
+// authorisation is implemented by the external AAA backends that are
+// able to authorise a call and to provide the routing information for it.
+// The DoAuth() should not block, the result is delivered through the
+// res_cb asynchronously.
+type authorisation interface {
+	DoAuth(req *authRequest, res_cb func(*authResult)) authProcess
+}
+
+type authProcess interface {
+	Cancel()
+}
+
+type authDigest struct {
+	Username  string `json:"username"`
+	Realm     string `json:"realm"`
+	Nonce     string `json:"nonce"`
+	Uri       string `json:"uri"`
+	Response  string `json:"response"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Qop       string `json:"qop,omitempty"`
+	NC        string `json:"nc,omitempty"`
+	CNonce    string `json:"cnonce,omitempty"`
+	Opaque    string `json:"opaque,omitempty"`
+}
+
+type authRequest struct {
+	Username   string      `json:"username"`
+	CLI        string      `json:"cli"`
+	CLD        string      `json:"cld"`
+	CallerName string      `json:"caller_name,omitempty"`
+	CallId     string      `json:"call_id"`
+	CiscoGUID  string      `json:"h323_conf_id,omitempty"`
+	RemoteIP   string      `json:"remote_ip"`
+	Source     string      `json:"source"`
+	SessionId  string      `json:"session_id,omitempty"`
+	Digest     *authDigest `json:"digest,omitempty"`
+}
+
+// authResult is the outcome of the authorisation. The nil CLI and
+// CallerName mean that the values from the incoming call leg are
+// kept intact. The zero RejectCode means that the call is accepted.
+type authResult struct {
+	Routes       []string `json:"routes"`
+	CLI          *string  `json:"cli"`
+	CallerName   *string  `json:"caller_name"`
+	CreditTime   int      `json:"credit_time"`
+	RejectCode   int      `json:"reject_code"`
+	RejectReason string   `json:"reject_reason"`
+}
+
+func newAuthRequest(cc *callController, auth sippy_header.SipAuthorizationHeader) *authRequest {
+	req := &authRequest{
+		Username:   cc.remote_ip.String(),
+		CLI:        cc.cli,
+		CLD:        cc.cld,
+		CallerName: cc.caller_name,
+		CallId:     cc.cId.CallId,
+		RemoteIP:   cc.remote_ip.String(),
+		Source:     cc.source.String(),
+	}
+	if cc.cGUID != nil {
+		req.CiscoGUID = cc.cGUID.StringBody()
+	}
+	if cc.session_uuids != nil {
+		req.SessionId = cc.session_uuids.GetCaller()
+	}
+	if auth == nil {
+		return req
+	}
+	body, err := auth.GetBody()
+	if err != nil || body.GetUsername() == "" {
+		return req
+	}
+	req.Username = body.GetUsername()
+	req.Digest = &authDigest{
+		Username:  body.GetUsername(),
+		Realm:     body.GetRealm(),
+		Nonce:     body.GetNonce(),
+		Uri:       body.GetUri(),
+		Response:  body.GetResponse(),
+		Algorithm: body.GetAlgorithm(),
+		Qop:       body.GetQop(),
+		NC:        body.GetNC(),
+		CNonce:    body.GetCNonce(),
+		Opaque:    body.GetOpaque(),
+	}
+	return req
+}
@@ -44,6 +44,12 @@ type B2BRoute struct {
 	rtpp                bool
 	outbound_proxy      *sippy_net.HostPort
 	rnum                int
+	tr_sets             []string
+	rdi_mode            string
+	scode_map           map[int]int
+	scode_from_reason   bool
+	path                []*sippy_header.SipRoute
+	trunk               string
 }
 
 /*
@@ -201,6 +207,25 @@ func NewB2BRoute(sroute string, global_config sippy_conf.Config) (*B2BRoute, err
 			} else {
 				r.outbound_proxy = sippy_net.NewHostPort(host_port[0], host_port[1])
 			}
+		case "tr":
+			for _, set := range strings.Split(av[1], ",") {
+				if set = strings.TrimSpace(set); set != "" {
+					r.tr_sets = append(r.tr_sets, set)
+				}
+			}
+		case "rdi":
+			if err = checkRdiMode(av[1]); err != nil {
+				return nil, err
+			}
+			r.rdi_mode = av[1]
+		case "scode_map":
+			if r.scode_map, err = parseCodeMap(av[1]); err != nil {
+				return nil, errors.New("Error parsing the scode_map '" + av[1] + "': " + err.Error())
+			}
+		case "scode_from_reason":
+			r.scode_from_reason = true
+		case "trunk":
+			r.trunk = av[1]
 			//default:
 			//    s.params[a] = v
 		}
@@ -249,6 +274,11 @@ func (s *B2BRoute) getCopy() *B2BRoute {
 	cself.extra_headers = make([]sippy_header.SipHeader, len(s.extra_headers))
 	copy(cself.extra_headers, s.extra_headers)
 
+	cself.path = make([]*sippy_header.SipRoute, len(s.path))
+	for i, route := range s.path {
+		cself.path[i] = route.GetCopy()
+	}
+
 	return &cself
 }
 
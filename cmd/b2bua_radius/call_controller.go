@@ -2,11 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/egovorukhin/go-b2bua/sippy"
 	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/isup"
 	"github.com/egovorukhin/go-b2bua/sippy/net"
 	"github.com/egovorukhin/go-b2bua/sippy/time"
 	"github.com/egovorukhin/go-b2bua/sippy/types"
@@ -36,6 +39,23 @@ type callController struct {
 	proxied           bool
 	sdp_session       *sippy.SdpSession
 	cmap              *CallMap
+	auth_proc         authProcess
+	username          string
+	translator        *numberTranslator
+	req_hfs           map[string]bool
+	loop_hf           sippy_header.SipHeader
+	pais              []*sippy_header.SipPAssertedIdentity
+	privacy           *sippy_header.SipPrivacy
+	session_uuids     *sippy_types.SessionUUIDs
+	isup_iam          *sippy_isup.Message
+	isup_variant      sippy_isup.Variant
+	isup_acm_sent     bool
+	merged_tid        *sippy_header.TID
+	oroute            *B2BRoute
+	hmr               *headerRules
+	ruri_host         string
+	routing           *routingEngine
+	fraud_call        *fraudCall
 }
 
 /*
@@ -69,13 +89,26 @@ func NewCallController(id int64, remote_ip *sippy_net.MyAddress, source *sippy_n
 		cGUID:           cguid,
 		cmap:            cmap,
 	}
-	s.uaA = sippy.NewUA(sip_tm, global_config, nil, s, s.lock, nil)
+	s.hmr = cmap.hmr.Get()
+	if s.hmr != nil {
+		s.uaA = newHmrUA(HMR_LEG_A, s.hmr, s, nil)
+	} else {
+		s.uaA = sippy.NewUA(sip_tm, global_config, nil, s, s.lock, nil)
+	}
 	s.uaA.SetKaInterval(s.global_config.keepalive_ans)
-	s.uaA.SetLocalUA(sippy_header.NewSipUserAgent(s.global_config.GetMyUAName()))
+	if cmap.th == nil {
+		s.uaA.SetLocalUA(sippy_header.NewSipUserAgent(s.global_config.GetMyUAName()))
+	} else {
+		s.uaA.SetNoLocalUA(true)
+	}
 	s.uaA.SetConnCb(s.aConn)
 	s.uaA.SetDiscCb(s.aDisc)
 	s.uaA.SetFailCb(s.aFail)
 	s.uaA.SetDeadCb(s.aDead)
+	if global_config.Session_id {
+		s.session_uuids = sippy_types.NewSessionUUIDs("", "")
+		s.uaA.SetSessionUUIDs(s.session_uuids)
+	}
 	return s
 }
 
@@ -98,6 +131,23 @@ func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 				s.state = CCStateDead
 				return
 			}
+			if ev_try.GetMaxForwards() != nil {
+				max_forwards, err := ev_try.GetMaxForwards().GetBody()
+				if err != nil {
+					s.uaA.RecvEvent(sippy.NewCCEventFail(400, "Malformed Max-Forwards", event.GetRtime(), ""))
+					s.state = CCStateDead
+					return
+				}
+				if max_forwards.Number <= 0 {
+					s.uaA.RecvEvent(sippy.NewCCEventFail(483, "Too Many Hops", event.GetRtime(), ""))
+					s.state = CCStateDead
+					return
+				}
+			}
+			s.isup_iam, s.isup_variant = isupFromBody(ev_try.GetBody())
+			if s.session_uuids != nil && s.session_uuids.GetCaller() == "" {
+				s.session_uuids.SetCaller(sippy_header.GenerateSessionUUID())
+			}
 			/*
 			   if body != nil && s.global_config.has_key('_allowed_pts') {
 			       try:
@@ -118,6 +168,18 @@ func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 			           if old_len > len(mbody.formats) {
 			               body.content.sections[0].optimize_a()
 			*/
+			if s.global_config.isTrustedPeer(s.source.Host.String()) {
+				// The identity asserted by the trust domain takes
+				// precedence over the From
+				s.pais = ev_try.GetAssertedIdentity()
+				for _, pai := range s.pais {
+					if cli := identityUser(pai, s.global_config); cli != "" {
+						s.cli = cli
+						break
+					}
+				}
+			}
+			s.privacy = ev_try.GetPrivacy()
 			if strings.HasPrefix(s.cld, "nat-") {
 				s.cld = s.cld[4:]
 				if ev_try.GetBody() != nil {
@@ -125,17 +187,27 @@ func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 				}
 				event, _ = sippy.NewCCEventTry(s.cId, s.cli, s.cld, ev_try.GetBody(), ev_try.GetSipAuthorizationHF(), s.caller_name, nil, "")
 			}
-			/*
-			   if s.global_config.has_key('static_tr_in') {
-			       s.cld = re_replace(s.global_config['static_tr_in'], s.cld)
-			       event = sippy.NewCCEventTry(s.cId, s.cGUID, s.cli, s.cld, body, auth, s.caller_name)
-			   }
-			*/
+			if s.translator != nil {
+				ctx := s.trContext("")
+				s.cld = s.translator.Apply(TR_SET_IN, "cld", s.cld, ctx)
+				s.cli = s.translator.Apply(TR_SET_IN, "cli", s.cli, ctx)
+			}
+			if s.cmap.fraud != nil {
+				call := s.newFraudCall()
+				verdict := s.cmap.fraud.CheckCall(call, event.GetRtime().Monot())
+				if verdict.Action == FRAUD_BLOCK {
+					s.global_config.ErrorLogger().Debug("Call " + call.CallId + " blocked: " + verdict.Reason)
+					s.failCall(403, "Forbidden", event.GetRtime())
+					s.state = CCStateDead
+					return
+				}
+				s.fraud_call = call
+			}
 			if len(s.cmap.rtp_proxy_clients) > 0 {
 				var err error
 				s.rtp_proxy_session, err = sippy.NewRtp_proxy_session(s.global_config, s.cmap.rtp_proxy_clients, s.cId.CallId, "", "", s.global_config.B2bua_socket /*notify_tag*/, fmt.Sprintf("r%%20%d", s.id), s.lock)
 				if err != nil {
-					s.uaA.RecvEvent(sippy.NewCCEventFail(500, "Internal Server Error (4)", event.GetRtime(), ""))
+					s.failCall(500, "Internal Server Error (4)", event.GetRtime())
 					s.state = CCStateDead
 					return
 				}
@@ -144,9 +216,17 @@ func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 			}
 			s.eTry = ev_try
 			s.state = CCStateWaitRoute
+			if s.cmap.auth == nil {
+				s.username = s.remote_ip.String()
+				s.rDone(nil)
+				return
+			}
+			auth_req := newAuthRequest(s, ev_try.GetSipAuthorizationHF())
+			s.username = auth_req.Username
+			s.auth_proc = s.cmap.auth.DoAuth(auth_req, s.authDone)
 			//if ! s.global_config['auth_enable'] {
 			//s.username = s.remote_ip
-			s.rDone()
+			//s.rDone()
 			//} else if auth == nil || auth.username == nil || len(auth.username) == 0 {
 			//    s.username = s.remote_ip
 			//    s.auth_proc = s.global_config['_radius_client'].do_auth(s.remote_ip, s.cli, s.cld, s.cGUID, \
@@ -161,8 +241,18 @@ func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 		if (s.state != CCStateARComplete && s.state != CCStateConnected && s.state != CCStateDisconnecting) || s.uaO == nil {
 			return
 		}
+		if s.global_config.Reason_header {
+			if _, ok := event.(*sippy.CCEventDisconnect); ok {
+				s.global_config.causes.addReason(event)
+			}
+		}
 		s.uaO.RecvEvent(event)
 	} else {
+		if ev_redirect, ok := event.(*sippy.CCEventRedirect); ok && s.cmap.th != nil {
+			// The Contacts of the redirect would reveal the addresses
+			// on the egress side
+			event = sippy.NewCCEventFail(480, "Temporarily Unavailable", ev_redirect.GetRtime(), ev_redirect.GetOrigin())
+		}
 		ev_fail, is_ev_fail := event.(*sippy.CCEventFail)
 		_, is_ev_disconnect := event.(*sippy.CCEventFail)
 		if (is_ev_fail || is_ev_disconnect) && s.state == CCStateARComplete &&
@@ -184,12 +274,36 @@ func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 				return
 			}
 		}
+		s.translateResult(event)
+		s.isupIngress(event)
 		s.sdp_session.FixupVersion(event.GetBody())
 		s.uaA.RecvEvent(event)
 	}
 }
 
-func (s *callController) rDone( /*results*/ ) {
+func (s *callController) authDone(results *authResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state != CCStateWaitRoute || s.auth_proc == nil {
+		// the call has been disconnected while waiting for the result
+		return
+	}
+	s.auth_proc = nil
+	s.rDone(results)
+}
+
+func (s *callController) rDone(results *authResult) {
+	if results != nil && results.RejectCode != 0 {
+		if s.uaA.GetState() == sippy_types.UAS_STATE_TRYING {
+			reason := results.RejectReason
+			if reason == "" {
+				reason = "Auth Failed"
+			}
+			s.failCall(results.RejectCode, reason, nil)
+		}
+		s.state = CCStateDead
+		return
+	}
 	/*
 	   // Check that we got necessary result from Radius
 	   if len(results) != 2 || results[1] != 0:
@@ -211,11 +325,24 @@ func (s *callController) rDone( /*results*/ ) {
 	   else:
 	*/
 	s.acctA = NewFakeAccounting()
+	if s.session_uuids != nil {
+		s.acctA.session_id = s.session_uuids.GetCaller()
+	}
 	// Check that uaA is still in a valid state, send acct stop
 	if s.uaA.GetState() != sippy_types.UAS_STATE_TRYING {
 		//s.acctA.disc(s.uaA, time(), "caller")
 		return
 	}
+	if s.fraud_call != nil {
+		now, _ := sippy_time.NewMonoTime()
+		verdict := s.cmap.fraud.CheckAccount(s.fraud_call, s.username, now.Monot())
+		if verdict.Action == FRAUD_BLOCK {
+			s.global_config.ErrorLogger().Debug("Call " + s.fraud_call.CallId + " blocked: " + verdict.Reason)
+			s.failCall(403, "Forbidden", nil)
+			s.state = CCStateDead
+			return
+		}
+	}
 	/*
 	   cli = [x[1][4:] for x in results[0] if x[0] == "h323-ivr-in" && x[1].startswith("CLI:")]
 	   if len(cli) > 0:
@@ -241,12 +368,63 @@ func (s *callController) rDone( /*results*/ ) {
 	       routing = [B2BRoute(x[1][8:]) for x in routing]
 	   else {
 	*/
-	routing := []*B2BRoute{s.cmap.static_route.getCopy()}
+	credit_time := time.Duration(0)
+	var routing []*B2BRoute
+	if results != nil {
+		if results.CLI != nil {
+			s.cli = *results.CLI
+		}
+		if results.CallerName != nil {
+			s.caller_name = *results.CallerName
+		}
+		if results.CreditTime > 0 {
+			credit_time = time.Duration(results.CreditTime) * time.Second
+		}
+		for _, sroute := range results.Routes {
+			oroute, err := NewB2BRoute(sroute, s.global_config)
+			if err != nil {
+				s.global_config.ErrorLogger().Error("Cannot parse the route '" + sroute + "': " + err.Error())
+				continue
+			}
+			routing = append(routing, oroute)
+		}
+	}
+	if len(routing) == 0 {
+		routing = s.cmap.registeredRoutes(s.cld, s.ruri_host)
+	}
+	switch {
+	case len(routing) > 0:
+		// the routes supplied by the AAA backend or to the registered
+		// contacts take precedence
+	case s.routing != nil:
+		routing = s.routing.Lookup(s.cld, s.cli)
+		if len(routing) == 0 {
+			s.failCall(404, "Not Found", nil)
+			s.state = CCStateDead
+			return
+		}
+	case s.cmap.static_route != nil:
+		routing = []*B2BRoute{s.cmap.static_route.getCopy()}
+	default:
+		s.failCall(500, "Internal Server Error (2)", nil)
+		s.state = CCStateDead
+		return
+	}
 	//    }
 	rnum := 0
 	for _, oroute := range routing {
+		if oroute.trunk != "" {
+			t := s.cmap.trunks.Get(oroute.trunk)
+			if t == nil || !t.agent.IsRegistered() {
+				s.global_config.ErrorLogger().Debug("Skipping the route via unregistered trunk " + oroute.trunk)
+				continue
+			}
+			if oroute.user == "" {
+				oroute.user, oroute.passw = t.user, t.passw
+			}
+		}
 		rnum += 1
-		oroute.customize(rnum, s.cld, s.cli, 0, s.pass_headers, 0)
+		oroute.customize(rnum, s.cld, s.cli, credit_time, s.pass_headers, 0)
 		//oroute.customize(rnum, s.cld, s.cli, credit_time, s.pass_headers, s.global_config.max_credit_time)
 		//if oroute.credit_time == 0 || oroute.expires == 0 {
 		//    continue
@@ -255,7 +433,7 @@ func (s *callController) rDone( /*results*/ ) {
 		//println "Got route:", oroute.hostPort, oroute.cld
 	}
 	if len(s.routes) == 0 {
-		s.uaA.RecvEvent(sippy.NewCCEventFail(500, "Internal Server Error (3)", nil, ""))
+		s.failCall(500, "Internal Server Error (3)", nil)
 		s.state = CCStateDead
 		return
 	}
@@ -267,11 +445,16 @@ func (s *callController) rDone( /*results*/ ) {
 
 func (s *callController) placeOriginate(oroute *B2BRoute) {
 	//cId, cGUID, cli, cld, body, auth, caller_name = s.eTry.getData()
-	cld := oroute.cld
+	cld, cli := oroute.cld, oroute.cli
 	s.huntstop_scodes = oroute.huntstop_scodes
-	//if s.global_config.has_key('static_tr_out') {
-	//    cld = re_replace(s.global_config['static_tr_out'], cld)
-	//}
+	s.oroute = oroute
+	if s.translator != nil {
+		ctx := s.trContext(oroute.hostonly)
+		for _, set := range append([]string{TR_SET_OUT}, oroute.tr_sets...) {
+			cld = s.translator.Apply(set, "cld", cld, ctx)
+			cli = s.translator.Apply(set, "cli", cli, ctx)
+		}
+	}
 	var nh_address *sippy_net.HostPort
 	if oroute.hostPort == "sip-ua" {
 		//host = s.source[0]
@@ -295,29 +478,59 @@ func (s *callController) placeOriginate(oroute *B2BRoute) {
 	//if ! oroute.forward_on_fail && s.global_config['acct_enable'] {
 	//    disc_handlers.append(s.acctO.disc)
 	//}
-	s.uaO = sippy.NewUA(s.sip_tm, s.global_config, nh_address, s, s.lock, nil)
+	if s.hmr != nil {
+		s.uaO = newHmrUA(HMR_LEG_O, s.hmr, s, nh_address)
+	} else {
+		s.uaO = sippy.NewUA(s.sip_tm, s.global_config, nh_address, s, s.lock, nil)
+	}
 	// oroute.user, oroute.passw, nh_address, oroute.credit_time,
 	//  /*expire_time*/ oroute.expires, /*no_progress_time*/ oroute.no_progress_expires, /*extra_headers*/ oroute.extra_headers)
 	//s.uaO.SetConnCbs([]sippy_types.OnConnectListener{ s.oConn })
 	extra_headers := []sippy_header.SipHeader{s.cGUID, s.cGUID.AsH323ConfId()}
-	extra_headers = append(extra_headers, oroute.extra_headers...)
+	rdi_mode := oroute.rdi_mode
+	if rdi_mode == "" {
+		rdi_mode = s.global_config.Redirect_info
+	}
+	for _, eh := range oroute.extra_headers {
+		switch eh.(type) {
+		case *sippy_header.SipDiversion, *sippy_header.SipHistoryInfo:
+			if rdi_mode != RDI_NONE {
+				// will be added according to the rdi_mode
+				continue
+			}
+		}
+		extra_headers = append(extra_headers, eh)
+	}
+	if s.loop_hf != nil {
+		extra_headers = append(extra_headers, s.loop_hf)
+	}
 	s.uaO.SetExtraHeaders(extra_headers)
+	if oroute.user != "" {
+		s.uaO.SetUsername(oroute.user)
+		s.uaO.SetPassword(oroute.passw)
+	}
 	s.uaO.SetDeadCb(s.oDead)
-	s.uaO.SetLocalUA(sippy_header.NewSipUserAgent(s.global_config.GetMyUAName()))
+	s.uaO.SetSessionUUIDs(s.session_uuids)
+	if s.cmap.th == nil {
+		s.uaO.SetLocalUA(sippy_header.NewSipUserAgent(s.global_config.GetMyUAName()))
+	} else {
+		s.uaO.SetNoLocalUA(true)
+	}
 	if oroute.outbound_proxy != nil && s.source.String() != oroute.outbound_proxy.String() {
 		s.uaO.SetOutboundProxy(oroute.outbound_proxy)
 	}
-	var body sippy_types.MsgBody
-	if s.rtp_proxy_session != nil && oroute.rtpp {
+	proxied := s.rtp_proxy_session != nil && oroute.rtpp
+	if proxied {
 		s.uaO.SetOnLocalSdpChange(s.rtp_proxy_session.OnCallerSdpChange)
 		s.uaO.SetOnRemoteSdpChange(s.rtp_proxy_session.OnCalleeSdpChange)
 		s.rtp_proxy_session.SetCallerRaddress(nh_address)
-		if s.eTry.GetBody() != nil {
-			body = s.eTry.GetBody().GetCopy()
-		}
 		s.proxied = true
 	}
+	body := s.originateBody(proxied, cli, cld)
 	s.uaO.SetKaInterval(s.global_config.keepalive_orig)
+	if oroute.credit_time > 0 {
+		s.uaO.SetCreditTime(oroute.credit_time)
+	}
 	//if oroute.params.has_key('group_timeout') {
 	//    timeout, skipto = oroute.params['group_timeout']
 	//    Timeout(s.group_expires, timeout, 1, skipto)
@@ -327,23 +540,159 @@ func (s *callController) placeOriginate(oroute *B2BRoute) {
 	//} else {
 	cId := sippy_header.NewSipCallIdFromString(s.eTry.GetSipCallId().CallId + fmt.Sprintf("-b2b_%d", oroute.rnum))
 	//}
+	if s.cmap.th != nil {
+		hidden := s.cmap.th.HideCallId(cId.CallId)
+		// Let the both legs be correlated in the SIP log
+		msg := "topology hiding: " + cId.CallId + " <-> " + hidden + "\n"
+		s.global_config.SipLogger().Write(nil, s.eTry.GetSipCallId().CallId, msg)
+		s.global_config.SipLogger().Write(nil, hidden, msg)
+		cId = sippy_header.NewSipCallIdFromString(hidden)
+	}
 	caller_name := oroute.caller_name
 	if caller_name == "" {
 		caller_name = s.caller_name
 	}
-	event, _ := sippy.NewCCEventTry(cId, oroute.cli, cld, body, s.eTry.GetSipAuthorizationHF(), caller_name, nil, "")
-	//if s.eTry.max_forwards != nil {
-	//    event.max_forwards = s.eTry.max_forwards - 1
-	//    if event.max_forwards <= 0 {
-	//        s.uaA.RecvEvent(sippy.NewCCEventFail(483, "Too Many Hops", nil, ""))
-	//        s.state = CCStateDead
-	//        return
-	//    }
-	//}
+	var pais []*sippy_header.SipPAssertedIdentity
+	if s.global_config.isTrustedPeer(nh_address.Host.String()) {
+		pais = s.assertedIdentity(cli, caller_name)
+	}
+	anonymous := s.privacy != nil && s.privacy.HasValue(sippy_header.PRIVACY_ID)
+	if anonymous {
+		// RFC 3325: the identity is only revealed to the trust domain
+		cli, caller_name = ANONYMOUS_USER, "Anonymous"
+	}
+	event, _ := sippy.NewCCEventTry(cId, cli, cld, body, s.eTry.GetSipAuthorizationHF(), caller_name, nil, "")
+	if anonymous {
+		// RFC 3323 4.1.1.3: the host of the From must not reveal us either
+		event.SetFromHost(ANONYMOUS_HOST)
+	}
+	event.SetAssertedIdentity(pais)
+	s.setRedirectionInfo(event, rdi_mode, nh_address)
+	event.SetPrivacy(s.privacy)
+	if s.eTry.GetMaxForwards() != nil {
+		// The value has been validated when the call came in
+		max_forwards, _ := s.eTry.GetMaxForwards().GetBody()
+		event.SetMaxForwards(sippy_header.NewSipMaxForwards(max_forwards.Number - 1))
+	}
 	event.SetReason(s.eTry.GetReason())
+	if len(oroute.path) > 0 {
+		event.SetRoutes(oroute.path)
+	}
 	s.uaO.RecvEvent(event)
 }
 
+// originateBody returns the body of the INVITE sent on the outgoing call
+// leg. The SDP is only relayed through the rtpproxy while the IAM of
+// SIP-I/SIP-T is relayed regardless of it.
+func (s *callController) originateBody(proxied bool, cli, cld string) sippy_types.MsgBody {
+	var body sippy_types.MsgBody
+	if proxied && s.eTry.GetBody() != nil {
+		body = s.eTry.GetBody().GetCopy()
+	} else if !proxied && s.isup_iam != nil {
+		body = setIsup(nil, s.isup_iam, s.isup_variant)
+	}
+	return s.isupEgress(body, cli, cld)
+}
+
+// failCall rejects the incoming call with the failure of the B2BUA
+// itself.
+func (s *callController) failCall(scode int, reason string, rtime *sippy_time.MonoTime) {
+	event := sippy.NewCCEventFail(scode, reason, rtime, "")
+	s.isupIngress(event)
+	s.uaA.RecvEvent(event)
+}
+
+// translateResult prepares the final result of the far end to be relayed
+// to the caller. The failure is translated before the Reason is added so
+// that only the Reason sent by the far end may affect the code.
+func (s *callController) translateResult(event sippy_types.CCEvent) {
+	if ev_fail, ok := event.(*sippy.CCEventFail); ok {
+		s.translateFailure(ev_fail)
+	}
+	if s.global_config.Reason_header {
+		s.global_config.causes.addReason(event)
+	}
+}
+
+// translateFailure changes the failure code of the far end according to
+// the route before it is relayed to the caller.
+func (s *callController) translateFailure(event *sippy.CCEventFail) {
+	if s.oroute == nil {
+		return
+	}
+	if s.oroute.scode_from_reason {
+		if cause := reasonQ850Cause(event.GetReason()); cause != 0 {
+			code, reason := s.global_config.causes.ToSip(cause)
+			event.SetScode(code)
+			event.SetScodeReason(reason)
+		}
+	}
+	if code, ok := s.oroute.scode_map[event.GetScode()]; ok {
+		event.SetScode(code)
+		event.SetScodeReason(sipReasonPhrase(code))
+	}
+}
+
+func (s *callController) setRedirectionInfo(event *sippy.CCEventTry, rdi_mode string, nh_address *sippy_net.HostPort) {
+	diversions, hist_infos := s.eTry.GetDiversion(), s.eTry.GetHistoryInfo()
+	switch rdi_mode {
+	case RDI_PASS:
+		event.SetDiversion(diversions)
+		event.SetHistoryInfo(hist_infos)
+	case RDI_DIVERSION:
+		if len(diversions) == 0 {
+			diversions = redirectionsToDiversion(historyInfoToRedirections(hist_infos, s.global_config))
+		}
+		event.SetDiversion(diversions)
+	case RDI_HISTORY_INFO:
+		if len(hist_infos) == 0 {
+			url := sippy_header.NewSipURL(event.GetCLD(), sippy_net.NewMyAddress(nh_address.Host.String()), nil, false)
+			hist_infos = redirectionsToHistoryInfo(diversionToRedirections(diversions, s.global_config),
+				sippy_header.NewSipAddress("", url), s.global_config)
+		}
+		event.SetHistoryInfo(hist_infos)
+	}
+}
+
+func (s *callController) trContext(route string) *trContext {
+	return &trContext{
+		source:  net.ParseIP(s.source.Host.String()),
+		route:   route,
+		headers: s.req_hfs,
+	}
+}
+
+// newFraudCall describes the call for the fraud detection. The call is
+// checked before it is authenticated so the account is filled in later
+// by CheckAccount() with the verified username.
+func (s *callController) newFraudCall() *fraudCall {
+	return &fraudCall{
+		CallId:    s.cId.CallId,
+		CLI:       s.cli,
+		CLD:       s.cld,
+		UserAgent: s.uaA.GetRemoteUA(),
+		Source:    s.source.String(),
+	}
+}
+
+// fraudCallEnded reports the end of the call to the fraud detection,
+// only once.
+func (s *callController) fraudCallEnded(rtime *sippy_time.MonoTime) {
+	if s.fraud_call == nil || s.cmap == nil {
+		return
+	}
+	if rtime == nil {
+		rtime, _ = sippy_time.NewMonoTime()
+	}
+	var duration time.Duration
+	connect_ts := s.uaA.GetConnectTs()
+	if connect_ts != nil {
+		duration = rtime.Sub(connect_ts)
+	}
+	s.cmap.fraud.CallEnded(s.fraud_call, connect_ts != nil, duration, rtime.Monot())
+	s.fraud_call = nil
+}
+
 func (s *callController) disconnect(rtime *sippy_time.MonoTime) {
 	s.uaA.Disconnect(rtime, "")
 }
@@ -364,10 +713,11 @@ func (s *callController) aFail(rtime *sippy_time.MonoTime, origin string, result
 }
 
 func (s *callController) aDisc(rtime *sippy_time.MonoTime, origin string, result int, inreq sippy_types.SipRequest) {
-	//if s.state == CCStateWaitRoute && s.auth_proc != nil {
-	//    s.auth_proc.cancel()
-	//    s.auth_proc = nil
-	//}
+	s.fraudCallEnded(rtime)
+	if s.state == CCStateWaitRoute && s.auth_proc != nil {
+		s.auth_proc.Cancel()
+		s.auth_proc = nil
+	}
 	if s.uaO != nil && s.state != CCStateDead {
 		s.state = CCStateDisconnecting
 	} else {
@@ -383,6 +733,7 @@ func (s *callController) aDisc(rtime *sippy_time.MonoTime, origin string, result
 }
 
 func (s *callController) aDead() {
+	s.fraudCallEnded(nil)
 	if s.uaO == nil || s.uaO.GetState() == sippy_types.UA_STATE_DEAD {
 		if s.cmap.debug_mode {
 			println("garbadge collecting", s)
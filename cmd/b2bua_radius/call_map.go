@@ -13,6 +13,7 @@ import (
 
 	"github.com/egovorukhin/go-b2bua/sippy/cli"
 	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
 	"github.com/egovorukhin/go-b2bua/sippy/time"
 	"github.com/egovorukhin/go-b2bua/sippy/types"
 )
@@ -21,15 +22,27 @@ type CallMap struct {
 	global_config     *myConfigParser
 	ccmap             map[int64]*callController
 	ccmap_lock        sync.Mutex
+	merged            map[sippy_header.TID]string
 	gc_timeout        time.Duration
 	debug_mode        bool
 	safe_restart      bool
 	Sip_tm            sippy_types.SipTransactionManager
 	Proxy             sippy_types.StatefulProxy
+	registrar         sippy_types.Registrar
+	trunks            *trunks
 	cc_id             int64
 	cc_id_lock        sync.Mutex
 	rtp_proxy_clients []sippy_types.RtpProxyClient
 	static_route      *B2BRoute
+	routing           *routingEngine
+	translation       *translationEngine
+	auth              authorisation
+	loop              *loopDetector
+	th                *topologyHiding
+	hmr               *headerRulesEngine
+	rate_limiter      sippy_types.RateLimiter
+	acl               *aclEngine
+	fraud             fraudDetector
 }
 
 /*
@@ -42,15 +55,22 @@ class CallMap(object):
 */
 
 func NewCallMap(global_config *myConfigParser, rtp_proxy_clients []sippy_types.RtpProxyClient,
-	static_route *B2BRoute) *CallMap {
+	static_route *B2BRoute, routing *routingEngine, translation *translationEngine, auth authorisation) *CallMap {
 	s := &CallMap{
 		global_config:     global_config,
 		ccmap:             make(map[int64]*callController),
+		merged:            make(map[sippy_header.TID]string),
 		gc_timeout:        time.Minute,
 		debug_mode:        false,
 		safe_restart:      false,
 		rtp_proxy_clients: rtp_proxy_clients,
 		static_route:      static_route,
+		routing:           routing,
+		translation:       translation,
+		auth:              auth,
+	}
+	if global_config.Loop_detect {
+		s.loop = NewLoopDetector(global_config.Loop_detect_id)
 	}
 	go func() {
 		sighup_ch := make(chan os.Signal, 1)
@@ -64,7 +84,11 @@ func NewCallMap(global_config *myConfigParser, rtp_proxy_clients []sippy_types.R
 		for {
 			select {
 			case <-sighup_ch:
-				s.discAll(syscall.SIGHUP)
+				if s.routing != nil || s.translation != nil || s.hmr != nil || s.acl != nil || s.fraud != nil {
+					s.reloadTables(syscall.SIGHUP)
+				} else {
+					s.discAll(syscall.SIGHUP)
+				}
 			/*case <-sigusr2_ch:
 				s.toggleDebug()
 			case <-sigprof_ch:
@@ -98,10 +122,21 @@ func (s *CallMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.Serv
 	//println("-" * 70)
 	//sys.stdout.flush()
 	//return (nil, nil, nil)
+	if s.Proxy != nil && s.Proxy.HasOurRoute(req) {
+		// Request within dialog record-routed by the proxy
+		return nil, s.Proxy, nil
+	}
 	if to_body.GetTag() != "" {
 		// Request within dialog, but no such dialog
 		return nil, nil, req.GenResponse(481, "Call Leg/Transaction Does Not Exist", nil, nil)
 	}
+	acl_rule := acl_accept_all
+	if s.acl != nil {
+		var resp sippy_types.SipResponse
+		if acl_rule, resp = s.acl.CheckSIP(req, s.registrar != nil); resp != nil {
+			return nil, nil, resp
+		}
+	}
 	if req.GetMethod() == "INVITE" {
 		// New dialog
 		var via *sippy_header.SipViaBody
@@ -142,11 +177,30 @@ func (s *CallMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.Serv
 		       }
 		   }
 		*/
+		merged_tid, err := req.GetTId(true /*wCSM*/, false /*wBRN*/, false /*wTTG*/)
+		if err != nil {
+			s.global_config.ErrorLogger().Error("CallMap::OnNewDialog: #3: " + err.Error())
+			return nil, nil, req.GenResponse(500, "Internal Server Error", nil, nil)
+		}
+		if s.isMergedRequest(merged_tid, req) {
+			return nil, nil, req.GenResponse(482, "Loop Detected", nil, nil)
+		}
+		var loop_fps []string
+		if s.loop != nil {
+			var looped bool
+			loop_fps, looped = s.loop.Check(req)
+			if looped {
+				return nil, nil, req.GenResponse(482, "Loop Detected", nil, nil)
+			}
+		}
 		pass_headers := []sippy_header.SipHeader{}
 		for _, header := range s.global_config.pass_headers {
 			hfs := req.GetHFs(header)
 			pass_headers = append(pass_headers, hfs...)
 		}
+		if s.th != nil {
+			pass_headers = s.th.Scrub(pass_headers)
+		}
 		s.cc_id_lock.Lock()
 		id := s.cc_id
 		s.cc_id++
@@ -158,14 +212,37 @@ func (s *CallMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.Serv
 		if cguid == nil {
 			cguid = sippy_header.NewSipCiscoGUID()
 		}
+		translator := s.translation.Get()
+		req_hfs := make(map[string]bool)
+		for _, name := range translator.HeaderNames() {
+			if req.GetFirstHF(name) != nil {
+				req_hfs[name] = true
+			}
+		}
 		cc := NewCallController(id, remote_ip, source, s.global_config, pass_headers, s.Sip_tm, cguid, s)
+		cc.translator = translator
+		cc.routing = s.routing
+		if acl_rule.action == ACL_ROUTE {
+			cc.routing = acl_rule.routing
+		}
+		cc.ruri_host = req.GetRURI().Host.String()
+		cc.req_hfs = req_hfs
+		if s.loop != nil && s.th == nil {
+			// The fingerprints would reveal the B2BUAs on the path
+			cc.loop_hf = s.loop.Header(loop_fps, req.GetRURI().Username)
+		}
 		//cc.challenge = challenge
 		//rval := cc.uaA.RecvRequest(req, sip_t)
+		cc.merged_tid = merged_tid
 		s.ccmap_lock.Lock()
 		s.ccmap[id] = cc
+		s.merged[*merged_tid] = s.branch(req)
 		s.ccmap_lock.Unlock()
 		return cc.uaA, cc.uaA, nil
 	}
+	if s.registrar != nil && req.GetMethod() == "REGISTER" {
+		return nil, s.registrar, nil
+	}
 	if s.Proxy != nil && (req.GetMethod() == "REGISTER" || req.GetMethod() == "SUBSCRIBE") {
 		return nil, s.Proxy, nil
 	}
@@ -176,8 +253,9 @@ func (s *CallMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.Serv
 	return nil, nil, req.GenResponse(501, "Not Implemented", nil, nil)
 }
 
-func (s CallMap) safeStop() {
+func (s *CallMap) safeStop() {
 	s.discAll(0)
+	s.trunks.Stop()
 	time.Sleep(time.Second)
 	os.Exit(0)
 }
@@ -197,6 +275,53 @@ func (s *CallMap) discAll(signum syscall.Signal) {
 	}
 }
 
+// reloadTables loads all the tables first and puts them in place only if
+// every one of them has been loaded, so that the tables referring to each
+// other are never out of sync.
+func (s *CallMap) reloadTables(signum syscall.Signal) error {
+	if signum > 0 {
+		println(fmt.Sprintf("Signal %d received, reloading the routing table and the rules", signum))
+	}
+	type tableLoader struct {
+		name    string
+		prepare func() (func(), error)
+	}
+	loaders := []*tableLoader{}
+	if s.routing != nil {
+		loaders = append(loaders, &tableLoader{"the routing table", s.routing.PrepareReload})
+	}
+	if s.translation != nil {
+		loaders = append(loaders, &tableLoader{"the translation rules", s.translation.PrepareReload})
+	}
+	if s.hmr != nil {
+		loaders = append(loaders, &tableLoader{"the header manipulation rules", s.hmr.PrepareReload})
+	}
+	if s.acl != nil {
+		loaders = append(loaders, &tableLoader{"the access control lists", s.acl.PrepareReload})
+	}
+	if detector, ok := s.fraud.(*fraudRulesDetector); ok {
+		loaders = append(loaders, &tableLoader{"the fraud detection rules", detector.PrepareReload})
+	}
+	if s.global_config.Nonce_keys != "" {
+		loaders = append(loaders, &tableLoader{"the nonce keys", func() (func(), error) {
+			return sippy_security.HashOracle.PrepareKeys(s.global_config.Nonce_keys)
+		}})
+	}
+	commits := []func(){}
+	for _, loader := range loaders {
+		commit, err := loader.prepare()
+		if err != nil {
+			s.global_config.ErrorLogger().Error("Cannot reload " + loader.name + ", nothing has been reloaded: " + err.Error())
+			return err
+		}
+		commits = append(commits, commit)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	return nil
+}
+
 func (s *CallMap) toggleDebug() {
 	if s.debug_mode {
 		println("Signal received, toggling extra debug output off")
@@ -256,6 +381,9 @@ func (s *CallMap) RecvCommand(clim sippy_cli.CLIManagerIface, data string) {
 		for _, cc := range s.ccmap {
 			cc.lock.Lock()
 			res += fmt.Sprintf("%s: %s (", cc.cId.CallId, cc.state.String())
+			if cc.session_uuids != nil {
+				res += fmt.Sprintf("session %s ", cc.session_uuids.GetCaller())
+			}
 			if cc.uaA != nil {
 				res += fmt.Sprintf("%s %s %s %s -> ", cc.uaA.GetStateName(), cc.uaA.GetRAddr0().String(),
 					cc.uaA.GetCLD(), cc.uaA.GetCLI())
@@ -263,8 +391,12 @@ func (s *CallMap) RecvCommand(clim sippy_cli.CLIManagerIface, data string) {
 				res += "N/A -> "
 			}
 			if cc.uaO != nil {
-				res += fmt.Sprintf("%s %s %s %s)\n", cc.uaO.GetStateName(), cc.uaO.GetRAddr0().String(),
+				res += fmt.Sprintf("%s %s %s %s", cc.uaO.GetStateName(), cc.uaO.GetRAddr0().String(),
 					cc.uaO.GetCLI(), cc.uaO.GetCLD())
+				if s.th != nil {
+					res += " " + cc.uaO.GetCallId().CallId
+				}
+				res += ")\n"
 			} else {
 				res += "N/A)\n"
 			}
@@ -313,10 +445,19 @@ func (s *CallMap) RecvCommand(clim sippy_cli.CLIManagerIface, data string) {
 			clim.Send("OK\n")
 			return
 		}
+		call_id := args[0]
+		if s.th != nil {
+			// Accept the egress Call-ID as well
+			if orig, err := s.th.RevealCallId(call_id); err == nil {
+				if idx := strings.LastIndex(orig, "-b2b_"); idx > 0 {
+					call_id = orig[:idx]
+				}
+			}
+		}
 		dlist := []*callController{}
 		s.ccmap_lock.Lock()
 		for _, cc := range s.ccmap {
-			if cc.cId.CallId != args[0] {
+			if cc.cId.CallId != call_id {
 				continue
 			}
 			dlist = append(dlist, cc)
@@ -359,6 +500,53 @@ func (s *CallMap) RecvCommand(clim sippy_cli.CLIManagerIface, data string) {
 		}
 		clim.Send("OK\n")
 		return
+	case "th":
+		if s.th == nil {
+			clim.Send("ERROR: topology hiding is disabled\n")
+			return
+		}
+		if len(args) != 1 {
+			clim.Send("ERROR: syntax error: th <hidden-call-id>\n")
+			return
+		}
+		orig, err := s.th.RevealCallId(args[0])
+		if err != nil {
+			clim.Send("ERROR: " + err.Error() + "\n")
+			return
+		}
+		clim.Send(orig + "\n")
+		return
+	case "trunks":
+		if s.trunks == nil {
+			clim.Send("ERROR: no trunks are configured\n")
+			return
+		}
+		clim.Send(s.trunks.String())
+		return
+	case "bans", "ban", "unban":
+		s.banCommand(clim, cmd, args)
+		return
+	case "acl":
+		s.aclCommand(clim, args)
+		return
+	case "fraud":
+		s.fraudCommand(clim, args)
+		return
+	case "rr":
+		if s.routing == nil && s.translation == nil && s.hmr == nil && s.acl == nil && s.fraud == nil {
+			clim.Send("ERROR: neither the routing table nor the rules are configured\n")
+			return
+		}
+		if err := s.reloadTables(0); err != nil {
+			clim.Send("ERROR: " + err.Error() + "\n")
+			return
+		}
+		if s.routing != nil {
+			clim.Send("OK: " + s.routing.String() + "\n")
+		} else {
+			clim.Send("OK\n")
+		}
+		return
 	default:
 		clim.Send("ERROR: unknown command\n")
 	}
@@ -366,6 +554,28 @@ func (s *CallMap) RecvCommand(clim sippy_cli.CLIManagerIface, data string) {
 
 func (s *CallMap) DropCC(cc_id int64) {
 	s.ccmap_lock.Lock()
+	if cc, ok := s.ccmap[cc_id]; ok && cc.merged_tid != nil {
+		delete(s.merged, *cc.merged_tid)
+	}
 	delete(s.ccmap, cc_id)
 	s.ccmap_lock.Unlock()
 }
+
+// isMergedRequest tells whether the INVITE matches the one of an existing
+// call except for the branch, i.e. the same request has arrived via a
+// different path (RFC 3261 8.2.2.2). The check only applies to the UAS so
+// it is not done by the transaction manager, which the proxy shares.
+func (s *CallMap) isMergedRequest(merged_tid *sippy_header.TID, req sippy_types.SipRequest) bool {
+	s.ccmap_lock.Lock()
+	defer s.ccmap_lock.Unlock()
+	branch, ok := s.merged[*merged_tid]
+	return ok && branch != s.branch(req)
+}
+
+func (s *CallMap) branch(req sippy_types.SipRequest) string {
+	via0, err := req.GetVias()[0].GetBody()
+	if err != nil {
+		return ""
+	}
+	return via0.GetBranch()
+}
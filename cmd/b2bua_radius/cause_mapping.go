@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/isup"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+// Q.850 cause sent in the Reason of the BYE and CANCEL
+const Q850_NORMAL_CLEARING = 16
+
+// Reason phrases of the status codes the failures can be translated to
+var sip_reason_phrases = map[int]string{
+	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	410: "Gone",
+	413: "Request Entity Too Large",
+	414: "Request-URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Unsupported URI Scheme",
+	420: "Bad Extension",
+	480: "Temporarily Unavailable",
+	481: "Call/Transaction Does Not Exist",
+	482: "Loop Detected",
+	483: "Too Many Hops",
+	484: "Address Incomplete",
+	485: "Ambiguous",
+	486: "Busy Here",
+	487: "Request Terminated",
+	488: "Not Acceptable Here",
+	500: "Server Internal Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Server Time-out",
+	505: "Version Not Supported",
+	513: "Message Too Large",
+	600: "Busy Everywhere",
+	603: "Decline",
+	604: "Does Not Exist Anywhere",
+	606: "Not Acceptable",
+}
+
+func sipReasonPhrase(code int) string {
+	if reason, ok := sip_reason_phrases[code]; ok {
+		return reason
+	}
+	return "Unknown"
+}
+
+// parseCodeMap parses the comma-separated list of the "from:to" pairs of
+// the status codes or causes.
+func parseCodeMap(s string) (map[int]int, error) {
+	ret := make(map[int]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		arr := strings.SplitN(pair, ":", 2)
+		if len(arr) != 2 {
+			return nil, errors.New("malformed code mapping '" + pair + "'")
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(arr[0]))
+		if err != nil {
+			return nil, errors.New("malformed code mapping '" + pair + "': " + err.Error())
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(arr[1]))
+		if err != nil {
+			return nil, errors.New("malformed code mapping '" + pair + "': " + err.Error())
+		}
+		ret[from] = to
+	}
+	return ret, nil
+}
+
+// causeMapping is the bidirectional mapping between the SIP status codes
+// and the Q.850 causes. The RFC 3398 tables are used unless overridden in
+// the configuration.
+type causeMapping struct {
+	sip2q850 map[int]int
+	q8502sip map[int]int
+}
+
+func NewCauseMapping(sip2q850, q8502sip string) (*causeMapping, error) {
+	var err error
+	s := &causeMapping{}
+	if s.sip2q850, err = parseCodeMap(sip2q850); err != nil {
+		return nil, err
+	}
+	if s.q8502sip, err = parseCodeMap(q8502sip); err != nil {
+		return nil, err
+	}
+	for _, code := range s.q8502sip {
+		if code < 400 || code > 699 {
+			return nil, errors.New("bad SIP failure code " + strconv.Itoa(code))
+		}
+	}
+	return s, nil
+}
+
+func (s *causeMapping) ToQ850(code int) int {
+	if cause, ok := s.sip2q850[code]; ok {
+		return cause
+	}
+	return sippy_isup.SipToCause(code)
+}
+
+func (s *causeMapping) ToSip(cause int) (int, string) {
+	if code, ok := s.q8502sip[cause]; ok {
+		return code, sipReasonPhrase(code)
+	}
+	return sippy_isup.CauseToSip(cause)
+}
+
+// reasonQ850Cause returns the Q.850 cause of the Reason header or 0 if it
+// is not the Q.850 one.
+func reasonQ850Cause(reason *sippy_header.SipReason) int {
+	if reason == nil || strings.ToUpper(reason.GetProtocol()) != "Q.850" {
+		return 0
+	}
+	cause, err := strconv.Atoi(reason.GetCause())
+	if err != nil {
+		return 0
+	}
+	return cause
+}
+
+// addReason inserts the Q.850 Reason (RFC 3326) into the failure or
+// disconnect event unless it already carries one.
+func (s *causeMapping) addReason(event sippy_types.CCEvent) {
+	if event.GetReason() != nil {
+		return
+	}
+	switch ev := event.(type) {
+	case *sippy.CCEventFail:
+		ev.SetReason(sippy_header.NewSipReason("Q.850", strconv.Itoa(s.ToQ850(ev.GetScode())), ""))
+	case *sippy.CCEventDisconnect:
+		ev.SetReason(sippy_header.NewSipReason("Q.850", strconv.Itoa(Q850_NORMAL_CLEARING), ""))
+	}
+}
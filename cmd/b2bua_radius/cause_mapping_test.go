@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+)
+
+func TestCauseMapping(t *testing.T) {
+	causes, err := NewCauseMapping("486:21", "34:486")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cause := causes.ToQ850(486); cause != 21 {
+		t.Errorf("Bad overridden cause for 486: %d", cause)
+	}
+	if cause := causes.ToQ850(404); cause != 1 {
+		t.Errorf("Bad cause for 404: %d", cause)
+	}
+	if code, reason := causes.ToSip(34); code != 486 || reason != "Busy Here" {
+		t.Errorf("Bad overridden code for cause 34: %d %s", code, reason)
+	}
+	if code, _ := causes.ToSip(17); code != 486 {
+		t.Errorf("Bad code for cause 17: %d", code)
+	}
+	if _, err = NewCauseMapping("", "34:200"); err == nil {
+		t.Errorf("Non-failure code has been accepted")
+	}
+
+	event := sippy.NewCCEventFail(404, "Not Found", nil, "")
+	causes.addReason(event)
+	if reasonQ850Cause(event.GetReason()) != 1 {
+		t.Errorf("Bad Reason: %s", event.GetReason().String())
+	}
+}
+
+func TestTranslateResult(t *testing.T) {
+	causes, err := NewCauseMapping("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil), Reason_header: true, causes: causes}
+	cc := &callController{global_config: config, lock: new(sync.Mutex), oroute: &B2BRoute{scode_from_reason: true}}
+	// The code of the far end is kept unless it has sent the Reason
+	for _, scode := range []int{488, 407, 401, 415, 400} {
+		event := sippy.NewCCEventFail(scode, sipReasonPhrase(scode), nil, "")
+		cc.translateResult(event)
+		if event.GetScode() != scode {
+			t.Errorf("%d has been translated to %d", scode, event.GetScode())
+		}
+		if event.GetReason() == nil {
+			t.Errorf("No Reason has been added to %d", scode)
+		}
+	}
+	event := sippy.NewCCEventFail(500, "Server Internal Error", nil, "")
+	event.SetReason(sippy_header.NewSipReason("Q.850", "17", ""))
+	cc.translateResult(event)
+	if event.GetScode() != 486 || reasonQ850Cause(event.GetReason()) != 17 {
+		t.Errorf("The Reason of the far end has not been translated: %d %s", event.GetScode(), event.GetReason().String())
+	}
+}
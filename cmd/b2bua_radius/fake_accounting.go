@@ -1,6 +1,7 @@
 package main
 
 type fakeAccounting struct {
+	session_id string
 }
 
 func NewFakeAccounting() *fakeAccounting {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/cli"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const (
+	FLOOD_DROP   = "drop"
+	FLOOD_REJECT = "reject"
+)
+
+// parseMethodRateLimits parses the comma-separated list of
+// METHOD=rate[/burst] entries.
+func parseMethodRateLimits(buf string) (map[string]*sippy.RateLimit, error) {
+	ret := make(map[string]*sippy.RateLimit)
+	for _, entry := range strings.Split(buf, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		arr := strings.SplitN(entry, "=", 2)
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, errors.New("bad entry: " + entry)
+		}
+		limit, err := sippy.ParseRateLimit(arr[1])
+		if err != nil {
+			return nil, err
+		}
+		ret[strings.ToUpper(arr[0])] = limit
+	}
+	return ret, nil
+}
+
+// newRateLimiter returns nil if neither the limits nor the automatic bans
+// are configured.
+func newRateLimiter(config *myConfigParser) sippy_types.RateLimiter {
+	if config.source_rate_limit == nil && len(config.method_rate_limits) == 0 &&
+		config.invite_rate_limit == nil && config.Ban_auth_failures <= 0 {
+		return nil
+	}
+	rl := sippy.NewRateLimiter()
+	rl.SetSourceLimit(config.source_rate_limit)
+	for method, limit := range config.method_rate_limits {
+		rl.SetMethodLimit(method, limit)
+	}
+	rl.SetInviteLimit(config.invite_rate_limit)
+	rl.SetReject(config.Flood_action == FLOOD_REJECT, config.Flood_retry_after)
+	rl.SetBanPolicy(config.Ban_auth_failures, config.Ban_window, config.Ban_time)
+	return rl
+}
+
+// banCommand handles the "bans", "ban <ip> [<seconds>]" and "unban <ip>"
+// CLI commands.
+func (s *CallMap) banCommand(clim sippy_cli.CLIManagerIface, cmd string, args []string) {
+	if s.rate_limiter == nil {
+		clim.Send("ERROR: the flood protection is disabled\n")
+		return
+	}
+	now, _ := sippy_time.NewMonoTime()
+	switch cmd {
+	case "bans":
+		res := ""
+		bans := s.rate_limiter.Bans(now.Monot())
+		for _, ban := range bans {
+			res += fmt.Sprintf("%s: %d seconds left, %s\n", ban.Ip, int(ban.Until.Sub(now.Monot()).Round(time.Second).Seconds()), ban.Reason)
+		}
+		clim.Send(res + fmt.Sprintf("Total: %d\n", len(bans)))
+	case "ban":
+		if len(args) < 1 || len(args) > 2 || net.ParseIP(args[0]) == nil {
+			clim.Send("ERROR: syntax error: ban <ip> [<seconds>]\n")
+			return
+		}
+		duration := s.global_config.Ban_time
+		if len(args) == 2 {
+			secs, err := strconv.Atoi(args[1])
+			if err != nil || secs <= 0 {
+				clim.Send("ERROR: bad number of seconds: " + args[1] + "\n")
+				return
+			}
+			duration = time.Duration(secs) * time.Second
+		}
+		s.rate_limiter.Ban(net.ParseIP(args[0]).String(), duration, "manual", now.Monot())
+		clim.Send("OK\n")
+	case "unban":
+		if len(args) != 1 || net.ParseIP(args[0]) == nil {
+			clim.Send("ERROR: syntax error: unban <ip>\n")
+			return
+		}
+		if !s.rate_limiter.Unban(net.ParseIP(args[0]).String()) {
+			clim.Send("ERROR: " + args[0] + " is not banned\n")
+			return
+		}
+		clim.Send("OK\n")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCLI struct {
+	out string
+}
+
+func (s *testCLI) Close()               {}
+func (s *testCLI) Send(data string)     { s.out += data }
+func (s *testCLI) RemoteAddr() net.Addr { return nil }
+
+func TestFloodProtection(t *testing.T) {
+	limits, err := parseMethodRateLimits("register=1/5, OPTIONS=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["REGISTER"].Burst != 5 || limits["OPTIONS"].Rate != 2 {
+		t.Fatalf("Bad method limits: %v", limits)
+	}
+	for _, buf := range []string{"INVITE", "=1", "INVITE=x"} {
+		if _, err = parseMethodRateLimits(buf); err == nil {
+			t.Errorf("Bad method limits %q have been accepted", buf)
+		}
+	}
+
+	config := &myConfigParser{Ban_time: time.Minute}
+	cmap := &CallMap{global_config: config}
+	clim := &testCLI{}
+	cmap.banCommand(clim, "bans", nil)
+	if !strings.HasPrefix(clim.out, "ERROR") {
+		t.Errorf("Bans listed with the flood protection disabled: %s", clim.out)
+	}
+	if newRateLimiter(config) != nil {
+		t.Fatal("The rate limiter has been created with nothing configured")
+	}
+	config.Ban_auth_failures = 3
+	cmap.rate_limiter = newRateLimiter(config)
+	for _, cmd := range []string{"ban 203.0.113.1", "ban 2001:db8::1 120", "ban foo", "ban 203.0.113.2 x", "unban 203.0.113.3", "bans"} {
+		args := strings.Split(cmd, " ")
+		cmap.banCommand(clim, args[0], args[1:])
+	}
+	for _, line := range []string{
+		"ERROR: syntax error: ban <ip> [<seconds>]\n",
+		"ERROR: bad number of seconds: x\n",
+		"ERROR: 203.0.113.3 is not banned\n",
+		"2001:db8::1: 120 seconds left, manual\n",
+		"203.0.113.1: 60 seconds left, manual\n",
+		"Total: 2\n",
+	} {
+		if !strings.Contains(clim.out, line) {
+			t.Errorf("%q not found in the output: %s", line, clim.out)
+		}
+	}
+	clim.out = ""
+	cmap.banCommand(clim, "unban", []string{"203.0.113.1"})
+	cmap.banCommand(clim, "bans", nil)
+	if clim.out != "OK\n2001:db8::1: 120 seconds left, manual\nTotal: 1\n" {
+		t.Errorf("Bad output after unban: %s", clim.out)
+	}
+}
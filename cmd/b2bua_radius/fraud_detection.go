@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/cli"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+)
+
+/*
+ * Fraud detection rules file format. Empty lines and lines starting with
+ * '#' are ignored. Every other line is a rule in the form
+ *
+ *     scanner  <regexp>
+ *     number   <regexp> flag|block
+ *     limit    cli|account [concurrent=<n>] [rate=<n>/<seconds>]
+ *     burst    cli|account calls=<n> duration=<seconds> window=<seconds> [block=<seconds>]
+ *
+ * The "scanner" rules block the calls with the User-Agent matching the
+ * regexp. The "number" rules flag or block the calls to the numbers
+ * matching the regexp, the number is matched after the "in" translation.
+ * The "limit" rules reject the calls over the number of the calls in
+ * progress or over the call rate of the same CLI or account. The "burst"
+ * rules detect the bursts of the short calls: once the CLI or the account
+ * makes the given number of the answered calls shorter than the duration
+ * within the window, the alert is raised and the new calls of it are
+ * blocked for the block time, if any.
+ *
+ * The scanner, the number and the cli rules are checked before the call
+ * is authenticated. The account rules are checked once the call has been
+ * authenticated: the account is the verified username of the digest
+ * credentials or the source IP address of the call when no authentication
+ * is configured. The flagged and blocked numbers and the bursts raise the
+ * alerts that are logged and passed to the -fraud_hook command, the
+ * commands are run one at a time and the alerts are dropped when too many
+ * of them are waiting.
+ *
+ * Example:
+ *
+ *     scanner  (?i)^(friendly-scanner|sipvicious|sipcli|sip-scan)
+ *     number   ^(\+|00)(881|882|883)       block
+ *     number   ^(\+|00)(53|252|675)        flag
+ *     limit    account  concurrent=30 rate=10/60
+ *     limit    cli      concurrent=2
+ *     burst    cli      calls=5 duration=6 window=300 block=3600
+ */
+
+const (
+	FRAUD_PASS = iota
+	FRAUD_FLAG
+	FRAUD_BLOCK
+)
+
+const (
+	FRAUD_KEY_CLI     = "cli"
+	FRAUD_KEY_ACCOUNT = "account"
+	FRAUD_IDLE_TIME   = 5 * time.Minute
+	FRAUD_HOOK_QUEUE  = 100
+)
+
+// fraudCall is the new incoming call as seen by the fraud detection. The
+// Account is empty until the call has passed CheckAccount().
+type fraudCall struct {
+	CallId    string
+	CLI       string
+	CLD       string
+	Account   string
+	UserAgent string
+	Source    string
+}
+
+func (s *fraudCall) key(kind string) string {
+	if kind == FRAUD_KEY_CLI {
+		return FRAUD_KEY_CLI + ":" + s.CLI
+	}
+	return FRAUD_KEY_ACCOUNT + ":" + s.Account
+}
+
+type fraudVerdict struct {
+	Action int
+	Reason string
+}
+
+var fraud_pass = &fraudVerdict{Action: FRAUD_PASS}
+
+// fraudAlert is passed to the alert hook. The Key is the blocked CLI or
+// account in the "cli:<cli>" or "account:<account>" form.
+type fraudAlert struct {
+	Kind    string
+	Key     string
+	Action  int
+	Reason  string
+	Call    *fraudCall
+	Blocked time.Duration
+}
+
+// fraudDetector is consulted for every new incoming call with CheckCall()
+// before it is authenticated and with CheckAccount() once the account is
+// known. Every call that has passed CheckCall() is reported back with
+// CallEnded() once it is over.
+type fraudDetector interface {
+	CheckCall(call *fraudCall, now time.Time) *fraudVerdict
+	CheckAccount(call *fraudCall, account string, now time.Time) *fraudVerdict
+	CallEnded(call *fraudCall, connected bool, duration time.Duration, now time.Time)
+}
+
+type fraudLimit struct {
+	kind        string
+	concurrent  int
+	rate_calls  int
+	rate_period time.Duration
+}
+
+type fraudBurst struct {
+	kind     string
+	calls    int
+	duration time.Duration
+	window   time.Duration
+	block    time.Duration
+}
+
+type fraudNumber struct {
+	re     *regexp.Regexp
+	action int
+}
+
+type fraudRules struct {
+	scanners []*regexp.Regexp
+	numbers  []*fraudNumber
+	limits   []*fraudLimit
+	bursts   []*fraudBurst
+	// the longest periods the history has to be kept for
+	max_rate_period time.Duration
+	max_window      time.Duration
+}
+
+func NewFraudRules(fname string) (*fraudRules, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	s := &fraudRules{}
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err = s.parseRule(strings.Fields(line)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, lineno, err.Error())
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fraudRules) parseRule(fields []string) error {
+	switch fields[0] {
+	case "scanner":
+		if len(fields) != 2 {
+			return errors.New("syntax error: scanner <regexp>")
+		}
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return err
+		}
+		s.scanners = append(s.scanners, re)
+	case "number":
+		if len(fields) != 3 || (fields[2] != "flag" && fields[2] != "block") {
+			return errors.New("syntax error: number <regexp> flag|block")
+		}
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return err
+		}
+		number := &fraudNumber{re: re, action: FRAUD_FLAG}
+		if fields[2] == "block" {
+			number.action = FRAUD_BLOCK
+		}
+		s.numbers = append(s.numbers, number)
+	case "limit":
+		if len(fields) < 3 || !isFraudKeyKind(fields[1]) {
+			return errors.New("syntax error: limit cli|account [concurrent=<n>] [rate=<n>/<seconds>]")
+		}
+		limit := &fraudLimit{kind: fields[1]}
+		for _, opt := range fields[2:] {
+			av := strings.SplitN(opt, "=", 2)
+			if len(av) != 2 {
+				return errors.New("bad option '" + opt + "'")
+			}
+			var err error
+			switch av[0] {
+			case "concurrent":
+				limit.concurrent, err = parsePositiveInt(av[1])
+			case "rate":
+				arr := strings.SplitN(av[1], "/", 2)
+				if len(arr) != 2 {
+					return errors.New("bad rate '" + av[1] + "'")
+				}
+				if limit.rate_calls, err = parsePositiveInt(arr[0]); err == nil {
+					limit.rate_period, err = parseSeconds(arr[1])
+				}
+				if limit.rate_period > s.max_rate_period {
+					s.max_rate_period = limit.rate_period
+				}
+			default:
+				return errors.New("unknown option '" + av[0] + "'")
+			}
+			if err != nil {
+				return errors.New(av[0] + ": " + err.Error())
+			}
+		}
+		s.limits = append(s.limits, limit)
+	case "burst":
+		if len(fields) < 3 || !isFraudKeyKind(fields[1]) {
+			return errors.New("syntax error: burst cli|account calls=<n> duration=<seconds> window=<seconds> [block=<seconds>]")
+		}
+		burst := &fraudBurst{kind: fields[1]}
+		for _, opt := range fields[2:] {
+			av := strings.SplitN(opt, "=", 2)
+			if len(av) != 2 {
+				return errors.New("bad option '" + opt + "'")
+			}
+			var err error
+			switch av[0] {
+			case "calls":
+				burst.calls, err = parsePositiveInt(av[1])
+			case "duration":
+				burst.duration, err = parseSeconds(av[1])
+			case "window":
+				burst.window, err = parseSeconds(av[1])
+			case "block":
+				burst.block, err = parseSeconds(av[1])
+			default:
+				return errors.New("unknown option '" + av[0] + "'")
+			}
+			if err != nil {
+				return errors.New(av[0] + ": " + err.Error())
+			}
+		}
+		if burst.calls == 0 || burst.duration == 0 || burst.window == 0 {
+			return errors.New("calls, duration and window should be specified")
+		}
+		if burst.window > s.max_window {
+			s.max_window = burst.window
+		}
+		s.bursts = append(s.bursts, burst)
+	default:
+		return errors.New("unknown rule '" + fields[0] + "'")
+	}
+	return nil
+}
+
+func isFraudKeyKind(kind string) bool {
+	return kind == FRAUD_KEY_CLI || kind == FRAUD_KEY_ACCOUNT
+}
+
+func parsePositiveInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errors.New("should be a positive integer")
+	}
+	return n, nil
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	n, err := parsePositiveInt(s)
+	return time.Duration(n) * time.Second, err
+}
+
+type fraudKeyState struct {
+	active      int
+	attempts    []time.Time
+	short_calls []time.Time
+	last        time.Time
+}
+
+type fraudBlock struct {
+	until  time.Time
+	reason string
+}
+
+/*
+ * fraudRulesDetector is the built-in fraudDetector driven by the rules
+ * file. The counters of the CLIs and the accounts survive the reload of
+ * the rules.
+ */
+type fraudRulesDetector struct {
+	fname      string
+	rules      *fraudRules
+	lock       sync.Mutex
+	keys       map[string]*fraudKeyState
+	blocks     map[string]*fraudBlock
+	last_purge time.Time
+	alert_hook func(*fraudAlert)
+}
+
+func NewFraudRulesDetector(fname string) (*fraudRulesDetector, error) {
+	rules, err := NewFraudRules(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &fraudRulesDetector{
+		fname:  fname,
+		rules:  rules,
+		keys:   make(map[string]*fraudKeyState),
+		blocks: make(map[string]*fraudBlock),
+	}, nil
+}
+
+// SetAlertHook sets the function the alerts are passed to. It is called
+// without the detector locked.
+func (s *fraudRulesDetector) SetAlertHook(hook func(*fraudAlert)) {
+	s.lock.Lock()
+	s.alert_hook = hook
+	s.lock.Unlock()
+}
+
+// Reload re-reads the rules file. The old rules remain active when the
+// new ones cannot be loaded.
+func (s *fraudRulesDetector) Reload() error {
+	commit, err := s.PrepareReload()
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload parses the rules file, the returned function puts the new
+// rules in place. The counters are not touched.
+func (s *fraudRulesDetector) PrepareReload() (func(), error) {
+	rules, err := NewFraudRules(s.fname)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		s.lock.Lock()
+		s.rules = rules
+		s.lock.Unlock()
+	}, nil
+}
+
+func (s *fraudRulesDetector) getKey(key string, now time.Time) *fraudKeyState {
+	state, ok := s.keys[key]
+	if !ok {
+		state = &fraudKeyState{}
+		s.keys[key] = state
+	}
+	state.last = now
+	return state
+}
+
+func (s *fraudRulesDetector) CheckCall(call *fraudCall, now time.Time) *fraudVerdict {
+	var alerts []*fraudAlert
+
+	verdict := s.checkCall(call, now, &alerts)
+	s.raise(alerts)
+	return verdict
+}
+
+func (s *fraudRulesDetector) checkCall(call *fraudCall, now time.Time, alerts *[]*fraudAlert) *fraudVerdict {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.purge(now)
+	if verdict := s.checkBlock(call.key(FRAUD_KEY_CLI), now); verdict != nil {
+		return verdict
+	}
+	rules := s.rules
+	for _, re := range rules.scanners {
+		if re.MatchString(call.UserAgent) {
+			return &fraudVerdict{Action: FRAUD_BLOCK, Reason: "scanner " + call.UserAgent}
+		}
+	}
+	verdict := fraud_pass
+	for _, number := range rules.numbers {
+		if !number.re.MatchString(call.CLD) {
+			continue
+		}
+		verdict = &fraudVerdict{Action: number.action, Reason: "suspicious number " + call.CLD}
+		*alerts = append(*alerts, &fraudAlert{
+			Kind:   "number",
+			Key:    call.key(FRAUD_KEY_CLI),
+			Action: number.action,
+			Reason: verdict.Reason,
+			Call:   call,
+		})
+		if number.action == FRAUD_BLOCK {
+			return verdict
+		}
+		break
+	}
+	if limited := s.checkLimits(call.key(FRAUD_KEY_CLI), FRAUD_KEY_CLI, now); limited != nil {
+		return limited
+	}
+	return verdict
+}
+
+// CheckAccount checks the authenticated account of the call that has
+// passed CheckCall().
+func (s *fraudRulesDetector) CheckAccount(call *fraudCall, account string, now time.Time) *fraudVerdict {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := FRAUD_KEY_ACCOUNT + ":" + account
+	if verdict := s.checkBlock(key, now); verdict != nil {
+		return verdict
+	}
+	if verdict := s.checkLimits(key, FRAUD_KEY_ACCOUNT, now); verdict != nil {
+		return verdict
+	}
+	call.Account = account
+	return fraud_pass
+}
+
+func (s *fraudRulesDetector) checkBlock(key string, now time.Time) *fraudVerdict {
+	if block, ok := s.blocks[key]; ok && now.Before(block.until) {
+		return &fraudVerdict{Action: FRAUD_BLOCK, Reason: key + " is blocked: " + block.reason}
+	}
+	return nil
+}
+
+// checkLimits applies the limits of the kind to the key and counts the
+// call against them unless it is over any of them.
+func (s *fraudRulesDetector) checkLimits(key, kind string, now time.Time) *fraudVerdict {
+	state := s.getKey(key, now)
+	state.attempts = pruneTimes(state.attempts, now, s.rules.max_rate_period)
+	for _, limit := range s.rules.limits {
+		if limit.kind != kind {
+			continue
+		}
+		if limit.concurrent > 0 && state.active >= limit.concurrent {
+			return &fraudVerdict{Action: FRAUD_BLOCK, Reason: fmt.Sprintf("%s has %d calls in progress", key, state.active)}
+		}
+		if limit.rate_calls > 0 && len(pruneTimes(state.attempts, now, limit.rate_period)) >= limit.rate_calls {
+			return &fraudVerdict{Action: FRAUD_BLOCK, Reason: key + " is over the call rate"}
+		}
+	}
+	state.active++
+	state.attempts = append(state.attempts, now)
+	return nil
+}
+
+func (s *fraudRulesDetector) CallEnded(call *fraudCall, connected bool, duration time.Duration, now time.Time) {
+	var alerts []*fraudAlert
+
+	s.lock.Lock()
+	rules := s.rules
+	for _, kind := range []string{FRAUD_KEY_CLI, FRAUD_KEY_ACCOUNT} {
+		if kind == FRAUD_KEY_ACCOUNT && call.Account == "" {
+			// the account has not been counted
+			continue
+		}
+		key := call.key(kind)
+		state := s.getKey(key, now)
+		if state.active > 0 {
+			state.active--
+		}
+		state.short_calls = pruneTimes(state.short_calls, now, rules.max_window)
+		if !connected {
+			continue
+		}
+		var short_calls []time.Time
+		for _, burst := range rules.bursts {
+			if burst.kind != kind || duration >= burst.duration {
+				continue
+			}
+			if short_calls == nil {
+				state.short_calls = append(state.short_calls, now)
+				short_calls = state.short_calls
+			}
+			if len(pruneTimes(short_calls, now, burst.window)) < burst.calls {
+				continue
+			}
+			alert := &fraudAlert{
+				Kind:    "burst",
+				Key:     key,
+				Action:  FRAUD_FLAG,
+				Reason:  fmt.Sprintf("%d calls shorter than %s within %s", burst.calls, burst.duration, burst.window),
+				Call:    call,
+				Blocked: burst.block,
+			}
+			if burst.block > 0 {
+				alert.Action = FRAUD_BLOCK
+				s.blocks[key] = &fraudBlock{until: now.Add(burst.block), reason: "short call burst"}
+			}
+			// Start over so that the same burst is not reported twice
+			state.short_calls = nil
+			alerts = append(alerts, alert)
+			break
+		}
+	}
+	s.lock.Unlock()
+	s.raise(alerts)
+}
+
+func (s *fraudRulesDetector) raise(alerts []*fraudAlert) {
+	s.lock.Lock()
+	hook := s.alert_hook
+	s.lock.Unlock()
+	if hook == nil {
+		return
+	}
+	for _, alert := range alerts {
+		hook(alert)
+	}
+}
+
+// Block blocks the calls of the key in the "cli:<cli>" or the
+// "account:<account>" form.
+func (s *fraudRulesDetector) Block(key string, duration time.Duration, reason string, now time.Time) error {
+	arr := strings.SplitN(key, ":", 2)
+	if len(arr) != 2 || !isFraudKeyKind(arr[0]) {
+		return errors.New("bad key, should be either cli:<cli> or account:<account>")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blocks[key] = &fraudBlock{until: now.Add(duration), reason: reason}
+	return nil
+}
+
+// Unblock returns false if the key has not been blocked.
+func (s *fraudRulesDetector) Unblock(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.blocks[key]
+	delete(s.blocks, key)
+	return ok
+}
+
+// Blocks returns the active blocks sorted by the key.
+func (s *fraudRulesDetector) Blocks(now time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := []string{}
+	for key, block := range s.blocks {
+		if now.Before(block.until) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	res := ""
+	for _, key := range keys {
+		block := s.blocks[key]
+		res += fmt.Sprintf("%s: %d seconds left, %s\n", key, int(block.until.Sub(now).Round(time.Second).Seconds()), block.reason)
+	}
+	return res + fmt.Sprintf("Total: %d\n", len(keys))
+}
+
+// purge forgets the keys that have no calls in progress and have not
+// been seen for a while and the expired blocks.
+func (s *fraudRulesDetector) purge(now time.Time) {
+	if now.Sub(s.last_purge) < FRAUD_IDLE_TIME {
+		return
+	}
+	s.last_purge = now
+	keep := s.rules.max_rate_period
+	if s.rules.max_window > keep {
+		keep = s.rules.max_window
+	}
+	if keep < FRAUD_IDLE_TIME {
+		keep = FRAUD_IDLE_TIME
+	}
+	for key, state := range s.keys {
+		if state.active == 0 && now.Sub(state.last) > keep {
+			delete(s.keys, key)
+		}
+	}
+	for key, block := range s.blocks {
+		if !now.Before(block.until) {
+			delete(s.blocks, key)
+		}
+	}
+}
+
+// pruneTimes returns the tail of the sorted times that are within the
+// period before now.
+func pruneTimes(times []time.Time, now time.Time, period time.Duration) []time.Time {
+	for i, ts := range times {
+		if now.Sub(ts) < period {
+			return times[i:]
+		}
+	}
+	return nil
+}
+
+// newFraudAlertHook logs the alerts and runs the command, if any, with
+// the details of the alert in the environment. The commands are run one
+// at a time so that a burst of the alerts does not spawn a process per
+// call.
+func newFraudAlertHook(command string, logger sippy_log.ErrorLogger) func(*fraudAlert) {
+	var queue chan []string
+	if command != "" {
+		queue = make(chan []string, FRAUD_HOOK_QUEUE)
+		go runFraudHook(command, queue, logger)
+	}
+	return func(alert *fraudAlert) {
+		action := "flagged"
+		if alert.Action == FRAUD_BLOCK {
+			action = "blocked"
+		}
+		logger.Error(fmt.Sprintf("Fraud alert: %s %s (%s), Call-ID %s from %s", alert.Key, action, alert.Reason,
+			alert.Call.CallId, alert.Call.Source))
+		if queue == nil {
+			return
+		}
+		env := []string{
+			"FRAUD_KIND=" + alert.Kind,
+			"FRAUD_KEY=" + alert.Key,
+			"FRAUD_ACTION=" + action,
+			"FRAUD_REASON=" + alert.Reason,
+			fmt.Sprintf("FRAUD_BLOCK_TIME=%d", int(alert.Blocked.Seconds())),
+			"FRAUD_CALL_ID=" + alert.Call.CallId,
+			"FRAUD_CLI=" + alert.Call.CLI,
+			"FRAUD_CLD=" + alert.Call.CLD,
+			"FRAUD_ACCOUNT=" + alert.Call.Account,
+			"FRAUD_SOURCE=" + alert.Call.Source,
+		}
+		select {
+		case queue <- env:
+		default:
+			logger.Error("Fraud alert hook " + command + ": too many alerts queued, the alert on " + alert.Key + " is dropped")
+		}
+	}
+}
+
+func runFraudHook(command string, queue chan []string, logger sippy_log.ErrorLogger) {
+	for env := range queue {
+		cmd := exec.Command(command)
+		cmd.Env = append(os.Environ(), env...)
+		if err := cmd.Run(); err != nil {
+			logger.Error("Fraud alert hook " + command + ": " + err.Error())
+		}
+	}
+}
+
+// fraudCommand handles the "fraud", "fraud block <key> <seconds>" and
+// "fraud unblock <key>" CLI commands.
+func (s *CallMap) fraudCommand(clim sippy_cli.CLIManagerIface, args []string) {
+	detector, ok := s.fraud.(*fraudRulesDetector)
+	if !ok {
+		clim.Send("ERROR: the fraud detection rules are not configured\n")
+		return
+	}
+	now, _ := sippy_time.NewMonoTime()
+	switch {
+	case len(args) == 0:
+		clim.Send(detector.Blocks(now.Monot()))
+	case len(args) == 3 && args[0] == "block":
+		duration, err := parseSeconds(args[2])
+		if err != nil {
+			clim.Send("ERROR: bad number of seconds: " + args[2] + "\n")
+			return
+		}
+		if err = detector.Block(args[1], duration, "manual", now.Monot()); err != nil {
+			clim.Send("ERROR: " + err.Error() + "\n")
+			return
+		}
+		clim.Send("OK\n")
+	case len(args) == 2 && args[0] == "unblock":
+		if !detector.Unblock(args[1]) {
+			clim.Send("ERROR: " + args[1] + " is not blocked\n")
+			return
+		}
+		clim.Send("OK\n")
+	default:
+		clim.Send("ERROR: syntax error: fraud [block <key> <seconds> | unblock <key>]\n")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+)
+
+func TestFraudDetection(t *testing.T) {
+	rules := `# test rules
+scanner  (?i)^(friendly-scanner|sipvicious)
+number   ^(\+|00)882   block
+number   ^(\+|00)53    flag
+limit    cli      concurrent=2
+limit    account  rate=3/60
+burst    cli      calls=2 duration=6 window=300 block=3600
+`
+	fname := filepath.Join(t.TempDir(), "fraud.rules")
+	if err := os.WriteFile(fname, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := NewFraudRulesDetector(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := []*fraudAlert{}
+	fd.SetAlertHook(func(alert *fraudAlert) { alerts = append(alerts, alert) })
+
+	mono_now, _ := sippy_time.NewMonoTime()
+	now := mono_now.Monot()
+	newCall := func(cli, cld, ua string) *fraudCall {
+		return &fraudCall{CallId: "1", CLI: cli, CLD: cld, UserAgent: ua, Source: "203.0.113.1:5060"}
+	}
+	// check runs the call through the detector the way the call
+	// controller does: the account is checked after the authentication
+	// and the call blocked there is reported as ended.
+	check := func(call *fraudCall, account string, expected int) {
+		t.Helper()
+		verdict := fd.CheckCall(call, now)
+		if verdict.Action != FRAUD_BLOCK {
+			if account_verdict := fd.CheckAccount(call, account, now); account_verdict.Action == FRAUD_BLOCK {
+				fd.CallEnded(call, false, 0, now)
+				verdict = account_verdict
+			}
+		}
+		if verdict.Action != expected {
+			t.Errorf("%s -> %s: expected %d, got %d (%s)", call.CLI, call.CLD, expected, verdict.Action, verdict.Reason)
+		}
+	}
+	check(newCall("100", "200", "friendly-scanner"), "alice", FRAUD_BLOCK)
+	check(newCall("100", "+88212345", "phone"), "alice", FRAUD_BLOCK)
+	if len(alerts) != 1 || alerts[0].Kind != "number" || alerts[0].Action != FRAUD_BLOCK {
+		t.Fatalf("Bad alerts: %v", alerts)
+	}
+	// The flagged calls pass and count against the limits
+	c1 := newCall("100", "0053123", "phone")
+	check(c1, "alice", FRAUD_FLAG)
+	if len(alerts) != 2 || alerts[1].Action != FRAUD_FLAG {
+		t.Fatalf("The flagged number has not been alerted: %v", alerts)
+	}
+	c2 := newCall("100", "200", "phone")
+	check(c2, "bob", FRAUD_PASS)
+	c := newCall("100", "200", "phone")
+	check(c, "carol", FRAUD_BLOCK)
+	if c.Account != "" {
+		t.Errorf("The account of the call blocked before the authentication has been counted: %s", c.Account)
+	}
+	fd.CallEnded(c1, false, 0, now)
+	check(newCall("100", "200", "phone"), "alice", FRAUD_PASS)
+	// The account has made 2 calls out of 3 per minute so far
+	check(newCall("101", "200", "phone"), "alice", FRAUD_PASS)
+	check(newCall("102", "200", "phone"), "alice", FRAUD_BLOCK)
+	now = now.Add(time.Minute)
+	check(newCall("102", "200", "phone"), "alice", FRAUD_PASS)
+	// The CLI of the call blocked by the account limit has been released
+	check(newCall("102", "200", "phone"), "frank", FRAUD_PASS)
+	check(newCall("102", "200", "phone"), "grace", FRAUD_BLOCK)
+
+	// The burst of the short calls blocks the CLI
+	alerts = alerts[:0]
+	c3 := newCall("300", "200", "phone")
+	c4 := newCall("300", "200", "phone")
+	check(c3, "dave", FRAUD_PASS)
+	check(c4, "dave", FRAUD_PASS)
+	fd.CallEnded(c3, true, 2*time.Second, now)
+	fd.CallEnded(c4, true, 10*time.Second, now)
+	if len(alerts) != 0 {
+		t.Fatalf("The long call has been counted as short: %v", alerts)
+	}
+	c5 := newCall("300", "200", "phone")
+	check(c5, "dave", FRAUD_PASS)
+	fd.CallEnded(c5, true, time.Second, now.Add(time.Second))
+	if len(alerts) != 1 || alerts[0].Kind != "burst" || alerts[0].Key != "cli:300" || alerts[0].Blocked != time.Hour {
+		t.Fatalf("The burst has not been alerted: %v", alerts)
+	}
+	check(newCall("300", "200", "phone"), "erin", FRAUD_BLOCK)
+
+	cmap := &CallMap{}
+	clim := &testCLI{}
+	cmap.fraudCommand(clim, nil)
+	if !strings.HasPrefix(clim.out, "ERROR") {
+		t.Errorf("Blocks listed with no fraud detection: %s", clim.out)
+	}
+	cmap.fraud = fd
+	for _, cmd := range []string{"block foo 60", "block account:eve x", "block account:eve 3600", "unblock cli:301", "unblock cli:300"} {
+		cmap.fraudCommand(clim, strings.Split(cmd, " "))
+	}
+	for _, line := range []string{
+		"ERROR: bad key, should be either cli:<cli> or account:<account>\n",
+		"ERROR: bad number of seconds: x\n",
+		"ERROR: cli:301 is not blocked\n",
+	} {
+		if !strings.Contains(clim.out, line) {
+			t.Errorf("%q not found in the output: %s", line, clim.out)
+		}
+	}
+	check(newCall("300", "200", "phone"), "erin", FRAUD_PASS)
+	check(newCall("301", "200", "phone"), "eve", FRAUD_BLOCK)
+	// The CLI commands use the current time
+	mono_now, _ = sippy_time.NewMonoTime()
+	if blocks := fd.Blocks(mono_now.Monot()); blocks != "account:eve: 3600 seconds left, manual\nTotal: 1\n" {
+		t.Errorf("Bad blocks: %q", blocks)
+	}
+
+	for _, buf := range []string{
+		"scanner (\n",
+		"number ^1 drop\n",
+		"limit ip concurrent=1\n",
+		"limit cli rate=3\n",
+		"limit cli concurrent=0\n",
+		"burst cli calls=2 window=60\n",
+		"whitelist 123\n",
+	} {
+		if err = os.WriteFile(fname, []byte(buf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = fd.Reload(); err == nil {
+			t.Errorf("Bad rules %q have been accepted", buf)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+/*
+ * Header manipulation rules file format. Empty lines and lines starting
+ * with '#' are ignored. Every other line is a rule in the form
+ *
+ *     <leg> <action> [msg=<request|response>] [method=<m>[,<m>]] [scode=<code>[,<code>]]
+ *           [header=<name>] [!header=<name>] [route=<host>] [last]
+ *
+ * The leg is either "a" for the messages sent to the caller or "o" for
+ * the messages sent to the callee. The rules of the leg are applied in
+ * the order they appear in the file to every request and response right
+ * before it is sent. All conditions of a rule should be met for the
+ * action to be taken. The method= condition is matched against the
+ * method of the request or the CSeq method of the response, the scode=
+ * condition only matches the responses with the given codes ("486") or
+ * classes ("4xx"). The header= condition tests presence of a header in
+ * the message and the route= condition is matched against the host part
+ * of the current route. The "last" flag stops processing of the leg
+ * rules when the action has been applied.
+ *
+ * Actions:
+ *
+ *     add:<name>:<value>                        append the header
+ *     remove:<name>                             remove all headers with the name
+ *     replace:<name>:<value>                    replace all headers with the name
+ *     rewrite:<name>:s/<regexp>/<repl>/[g]      regexp substitution in the header value
+ *     set:<part>:<value>                        set the URI part
+ *     rewrite:<part>:s/<regexp>/<repl>/[g]      regexp substitution in the URI part
+ *
+ * The URI parts are ruri.user, ruri.host, from.name, from.user, to.name
+ * and to.user. The values are URL-encoded, i.e. %20 stands for space.
+ * The headers that identify the dialog and the transaction can only be
+ * changed through the URI parts.
+ *
+ * Example:
+ *
+ *     o  remove:P-Charging-Vector
+ *     o  add:X-Trunk:gw1                        route=gw1.example.com
+ *     o  set:from.name:ACME%20Corp              msg=request method=INVITE
+ *     a  rewrite:Warning:s/^399 [^ ]+/399 b2bua/  scode=4xx,5xx
+ *     o  rewrite:ruri.user:s/^00/+/
+ */
+
+const (
+	HMR_LEG_A = "a"
+	HMR_LEG_O = "o"
+)
+
+// The headers that are managed by the transaction layer or identify
+// the dialog
+var hmr_protected_hfs = map[string]bool{
+	"via":            true,
+	"v":              true,
+	"route":          true,
+	"max-forwards":   true,
+	"content-length": true,
+	"l":              true,
+	"content-type":   true,
+	"c":              true,
+	"call-id":        true,
+	"i":              true,
+	"cseq":           true,
+	"from":           true,
+	"f":              true,
+	"to":             true,
+	"t":              true,
+}
+
+var hmr_uri_parts = map[string]bool{
+	"ruri.user": true,
+	"ruri.host": true,
+	"from.name": true,
+	"from.user": true,
+	"to.name":   true,
+	"to.user":   true,
+}
+
+type hmrMessage struct {
+	msg    sippy_types.SipMsg
+	req    sippy_types.SipRequest
+	resp   sippy_types.SipResponse
+	method string
+	route  string
+	config sippy_conf.Config
+}
+
+type hmrCondition interface {
+	matches(m *hmrMessage) bool
+}
+
+type hmrMsgCondition struct {
+	request bool
+}
+
+func (s *hmrMsgCondition) matches(m *hmrMessage) bool {
+	return (m.req != nil) == s.request
+}
+
+type hmrMethodCondition struct {
+	methods []string
+}
+
+func (s *hmrMethodCondition) matches(m *hmrMessage) bool {
+	for _, method := range s.methods {
+		if strings.EqualFold(method, m.method) {
+			return true
+		}
+	}
+	return false
+}
+
+type hmrScodeCondition struct {
+	codes []string
+}
+
+func (s *hmrScodeCondition) matches(m *hmrMessage) bool {
+	if m.resp == nil {
+		return false
+	}
+	scode := strconv.Itoa(m.resp.GetSCodeNum())
+	for _, code := range s.codes {
+		if code == scode || (strings.HasSuffix(code, "xx") && code[0] == scode[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+type hmrHeaderCondition struct {
+	name   string
+	negate bool
+}
+
+func (s *hmrHeaderCondition) matches(m *hmrMessage) bool {
+	return (m.msg.GetFirstHF(s.name) != nil) != s.negate
+}
+
+type hmrRouteCondition struct {
+	route string
+}
+
+func (s *hmrRouteCondition) matches(m *hmrMessage) bool {
+	return strings.EqualFold(s.route, m.route)
+}
+
+// hmrAction modifies the message and returns whether the action has been
+// applicable to it.
+type hmrAction func(m *hmrMessage) bool
+
+type hmrRule struct {
+	action hmrAction
+	conds  []hmrCondition
+	last   bool
+}
+
+type headerRules struct {
+	legs map[string][]*hmrRule
+}
+
+func NewHeaderRules(fname string) (*headerRules, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	s := &headerRules{
+		legs: make(map[string][]*hmrRule),
+	}
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		leg, rule, err := parseHmrRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, lineno, err.Error())
+		}
+		s.legs[leg] = append(s.legs[leg], rule)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseHmrRule(line string) (string, *hmrRule, error) {
+	var err error
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", nil, errors.New("the leg and the action are expected")
+	}
+	leg := strings.ToLower(fields[0])
+	if leg != HMR_LEG_A && leg != HMR_LEG_O {
+		return "", nil, errors.New("unknown leg '" + fields[0] + "'")
+	}
+	rule := &hmrRule{}
+	rule.action, err = parseHmrAction(fields[1])
+	if err != nil {
+		return "", nil, err
+	}
+	for _, opt := range fields[2:] {
+		if opt == "last" {
+			rule.last = true
+			continue
+		}
+		av := strings.SplitN(opt, "=", 2)
+		if len(av) != 2 {
+			return "", nil, errors.New("bad condition '" + opt + "'")
+		}
+		switch av[0] {
+		case "msg":
+			switch av[1] {
+			case "request", "response":
+				rule.conds = append(rule.conds, &hmrMsgCondition{av[1] == "request"})
+			default:
+				return "", nil, errors.New("msg=request or msg=response expected")
+			}
+		case "method":
+			rule.conds = append(rule.conds, &hmrMethodCondition{strings.Split(av[1], ",")})
+		case "scode":
+			codes := strings.Split(av[1], ",")
+			for _, code := range codes {
+				if len(code) != 3 || (code[1:] != "xx" && !isDigits(code)) {
+					return "", nil, errors.New("bad status code '" + code + "'")
+				}
+			}
+			rule.conds = append(rule.conds, &hmrScodeCondition{codes})
+		case "header", "!header":
+			rule.conds = append(rule.conds, &hmrHeaderCondition{
+				name:   av[1],
+				negate: av[0][0] == '!',
+			})
+		case "route":
+			rule.conds = append(rule.conds, &hmrRouteCondition{av[1]})
+		default:
+			return "", nil, errors.New("unknown condition '" + av[0] + "'")
+		}
+	}
+	return leg, rule, nil
+}
+
+func parseHmrAction(s string) (hmrAction, error) {
+	av := strings.SplitN(s, ":", 3)
+	if len(av) < 2 || av[1] == "" {
+		return nil, errors.New("bad action '" + s + "'")
+	}
+	target := strings.ToLower(av[1])
+	is_part := hmr_uri_parts[target]
+	if !is_part && hmr_protected_hfs[target] {
+		return nil, errors.New("the " + av[1] + " header cannot be manipulated")
+	}
+	value := ""
+	if len(av) == 3 {
+		value = av[2]
+	}
+	switch av[0] {
+	case "add", "replace":
+		if is_part || len(av) != 3 {
+			return nil, errors.New(av[0] + ":<name>:<value> expected")
+		}
+		value, err := url.QueryUnescape(value)
+		if err != nil {
+			return nil, errors.New("Error parsing the value '" + av[2] + "': " + err.Error())
+		}
+		hfs, err := sippy.ParseSipHeader(av[1] + ": " + value)
+		if err != nil {
+			return nil, errors.New("Error parsing the header '" + av[1] + "': " + err.Error())
+		}
+		replace := av[0] == "replace"
+		return func(m *hmrMessage) bool {
+			if replace {
+				m.msg.RemoveHeaders(av[1])
+			}
+			for _, hf := range hfs {
+				m.msg.AppendHeader(hf.GetCopyAsIface())
+			}
+			return true
+		}, nil
+	case "remove":
+		if is_part || len(av) != 2 {
+			return nil, errors.New("remove:<name> expected")
+		}
+		return func(m *hmrMessage) bool {
+			if m.msg.GetFirstHF(av[1]) == nil {
+				return false
+			}
+			m.msg.RemoveHeaders(av[1])
+			return true
+		}, nil
+	case "set":
+		if !is_part || len(av) != 3 {
+			return nil, errors.New("set:<part>:<value> expected")
+		}
+		value, err := url.QueryUnescape(value)
+		if err != nil {
+			return nil, errors.New("Error parsing the value '" + av[2] + "': " + err.Error())
+		}
+		return func(m *hmrMessage) bool {
+			return m.setPart(target, func(string) (string, bool) { return value, true })
+		}, nil
+	case "rewrite":
+		if len(av) != 3 {
+			return nil, errors.New("rewrite:<name>:s/<regexp>/<replacement>/[g] expected")
+		}
+		if len(value) < 3 || value[0] != 's' || isAlnum(value[1]) {
+			return nil, errors.New("rewrite:<name>:s/<regexp>/<replacement>/[g] expected")
+		}
+		subst, err := parseTrRegexp(value)
+		if err != nil {
+			return nil, err
+		}
+		if is_part {
+			return func(m *hmrMessage) bool {
+				return m.setPart(target, subst)
+			}, nil
+		}
+		return func(m *hmrMessage) bool {
+			return m.rewriteHeaders(av[1], subst)
+		}, nil
+	}
+	return nil, errors.New("unknown action '" + av[0] + "'")
+}
+
+func (m *hmrMessage) rewriteHeaders(name string, subst trAction) bool {
+	applied := false
+	for _, hf := range m.msg.GetHFs(name) {
+		value, ok := subst(hf.StringBody())
+		if !ok {
+			continue
+		}
+		hfs, err := sippy.ParseSipHeader(hf.Name() + ": " + value)
+		if err != nil || len(hfs) == 0 {
+			continue
+		}
+		m.msg.ReplaceHeader(hf, hfs[0])
+		for _, extra := range hfs[1:] {
+			m.msg.AppendHeader(extra)
+		}
+		applied = true
+	}
+	return applied
+}
+
+func (m *hmrMessage) setPart(part string, subst trAction) bool {
+	arr := strings.SplitN(part, ".", 2)
+	if arr[0] == "ruri" {
+		if m.req == nil || m.req.GetRURI() == nil {
+			return false
+		}
+		ruri := m.req.GetRURI().GetCopy()
+		if !setUrlPart(ruri, arr[1], subst) {
+			return false
+		}
+		m.req.SetRURI(ruri)
+		return true
+	}
+	// The From/To of the UA should stay intact so the copy is modified
+	var old, hf sippy_header.SipHeader
+	var addr *sippy_header.SipAddress
+	if arr[0] == "from" && m.msg.GetFrom() != nil {
+		from := m.msg.GetFrom().GetCopy()
+		addr, _ = from.GetBody(m.config)
+		old, hf = m.msg.GetFrom(), from
+	} else if arr[0] == "to" && m.msg.GetTo() != nil {
+		to := m.msg.GetTo().GetCopy()
+		addr, _ = to.GetBody(m.config)
+		old, hf = m.msg.GetTo(), to
+	}
+	if addr == nil {
+		return false
+	}
+	ok := false
+	if arr[1] == "name" {
+		var name string
+		if name, ok = subst(addr.GetName()); ok {
+			addr.SetName(name)
+		}
+	} else {
+		ok = setUrlPart(addr.GetUrl(), arr[1], subst)
+	}
+	if ok {
+		m.msg.ReplaceHeader(old, hf)
+	}
+	return ok
+}
+
+func setUrlPart(url *sippy_header.SipURL, part string, subst trAction) bool {
+	switch part {
+	case "user":
+		user, ok := subst(url.Username)
+		if ok {
+			url.Username = user
+		}
+		return ok
+	case "host":
+		host, ok := subst(url.Host.String())
+		if ok {
+			url.Host = sippy_net.NewMyAddress(host)
+		}
+		return ok
+	}
+	return false
+}
+
+// Apply runs the message through the rules of the leg
+func (s *headerRules) Apply(leg string, msg sippy_types.SipMsg, route string, config sippy_conf.Config) {
+	if s == nil || len(s.legs[leg]) == 0 {
+		return
+	}
+	m := &hmrMessage{
+		msg:    msg,
+		route:  route,
+		config: config,
+	}
+	switch t := msg.(type) {
+	case sippy_types.SipRequest:
+		m.req = t
+		m.method = t.GetMethod()
+	case sippy_types.SipResponse:
+		m.resp = t
+		if cseq, err := t.GetCSeq().GetBody(); err == nil {
+			m.method = cseq.Method
+		}
+	}
+	for _, rule := range s.legs[leg] {
+		matched := true
+		for _, cond := range rule.conds {
+			if !cond.matches(m) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if rule.action(m) && rule.last {
+			break
+		}
+	}
+}
+
+// headerRulesEngine holds the current header manipulation rules and
+// allows them to be replaced atomically.
+type headerRulesEngine struct {
+	fname string
+	rules *headerRules
+	lock  sync.RWMutex
+}
+
+func NewHeaderRulesEngine(fname string) (*headerRulesEngine, error) {
+	rules, err := NewHeaderRules(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &headerRulesEngine{
+		fname: fname,
+		rules: rules,
+	}, nil
+}
+
+func (s *headerRulesEngine) Get() *headerRules {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.rules
+}
+
+func (s *headerRulesEngine) Reload() error {
+	commit, err := s.PrepareReload()
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload parses the header manipulation rules without applying
+// them, the returned function swaps them in.
+func (s *headerRulesEngine) PrepareReload() (func(), error) {
+	rules, err := NewHeaderRules(s.fname)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		s.lock.Lock()
+		s.rules = rules
+		s.lock.Unlock()
+	}, nil
+}
+
+// hmrUA applies the header manipulation rules to every message the UA
+// sends.
+type hmrUA struct {
+	*sippy.Ua
+	leg   string
+	rules *headerRules
+	cc    *callController
+}
+
+func newHmrUA(leg string, rules *headerRules, cc *callController, nh_address *sippy_net.HostPort) *hmrUA {
+	s := &hmrUA{
+		leg:   leg,
+		rules: rules,
+		cc:    cc,
+	}
+	s.Ua = sippy.NewUA(cc.sip_tm, cc.global_config, nh_address, cc, cc.lock, s)
+	return s
+}
+
+func (s *hmrUA) route() string {
+	if s.cc.oroute == nil {
+		return ""
+	}
+	return s.cc.oroute.hostonly
+}
+
+func (s *hmrUA) BeforeRequestSent(req sippy_types.SipRequest) {
+	s.Ua.BeforeRequestSent(req)
+	s.rules.Apply(s.leg, req, s.route(), s.cc.global_config)
+}
+
+func (s *hmrUA) BeforeResponseSent(resp sippy_types.SipResponse) {
+	s.Ua.BeforeResponseSent(resp)
+	s.rules.Apply(s.leg, resp, s.route(), s.cc.global_config)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+func TestHeaderRules(t *testing.T) {
+	rules := `# test rules
+o  remove:P-Charging-Vector
+o  add:X-Trunk:gw1                 route=gw1.example.com
+o  set:from.name:ACME%20Corp       msg=request method=INVITE
+o  rewrite:ruri.user:s/^00/+/
+a  add:X-Busy:yes                  scode=4xx last
+a  add:X-Never:yes                 scode=4xx
+`
+	fname := filepath.Join(t.TempDir(), "hmr.rules")
+	if err := os.WriteFile(fname, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hmr, err := NewHeaderRules(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The headers that identify the dialog are protected
+	if _, _, err = parseHmrRule("o replace:Call-ID:foo"); err == nil {
+		t.Error("Replacing the Call-ID should not be allowed")
+	}
+
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	rtime, _ := sippy_time.NewMonoTime()
+	buf := strings.Join([]string{
+		"INVITE sip:0044123@1.2.3.4 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK1",
+		"From: \"Alice\" <sip:alice@1.1.1.1>;tag=1",
+		"To: <sip:0044123@1.2.3.4>",
+		"Call-ID: abc@1.1.1.1",
+		"CSeq: 1 INVITE",
+		"Contact: <sip:alice@1.1.1.1>",
+		"P-Charging-Vector: icid-value=1",
+		"Max-Forwards: 70",
+		"Content-Length: 0",
+		"", "",
+	}, "\r\n")
+	req, err := sippy.ParseSipRequest([]byte(buf), rtime, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmr.Apply(HMR_LEG_O, req, "gw1.example.com", config)
+	if len(req.GetHFs("P-Charging-Vector")) != 0 {
+		t.Error("P-Charging-Vector has not been removed")
+	}
+	if hfs := req.GetHFs("X-Trunk"); len(hfs) != 1 || hfs[0].StringBody() != "gw1" {
+		t.Error("X-Trunk has not been added")
+	}
+	from, _ := req.GetFrom().GetBody(config)
+	if from.GetName() != "ACME Corp" {
+		t.Errorf("Bad From display name: %s (want ACME Corp)", from.GetName())
+	}
+	if req.GetRURI().Username != "+44123" {
+		t.Errorf("Bad R-URI user: %s (want +44123)", req.GetRURI().Username)
+	}
+
+	resp := req.GenResponse(486, "Busy Here", nil, nil)
+	hmr.Apply(HMR_LEG_A, resp, "", config)
+	if len(resp.GetHFs("X-Busy")) != 1 {
+		t.Error("X-Busy has not been added")
+	}
+	if len(resp.GetHFs("X-Never")) != 0 {
+		t.Error("The rule after the last one has been applied")
+	}
+	resp = req.GenResponse(200, "OK", nil, nil)
+	hmr.Apply(HMR_LEG_A, resp, "", config)
+	if len(resp.GetHFs("X-Busy")) != 0 {
+		t.Error("The scode condition has matched 200 OK")
+	}
+}
+
+// testSipTransport captures the data sent by the transaction manager.
+type testSipTransport struct {
+	recv_cb sippy_net.DataPacketReceiver
+	data_ch chan []byte
+}
+
+func newTestSipTransport() *testSipTransport {
+	return &testSipTransport{data_ch: make(chan []byte, 100)}
+}
+
+func (s *testSipTransport) NewSipTransport(addr *sippy_net.HostPort, recv_cb sippy_net.DataPacketReceiver) (sippy_net.Transport, error) {
+	s.recv_cb = recv_cb
+	return s, nil
+}
+
+func (s *testSipTransport) GetLAddress() *sippy_net.HostPort {
+	return sippy_net.NewHostPort("0.0.0.0", "5060")
+}
+
+func (s *testSipTransport) SendTo(data []byte, dest *sippy_net.HostPort) {
+	s.data_ch <- data
+}
+
+func (s *testSipTransport) SendToWithCb(data []byte, dest *sippy_net.HostPort, cb func()) {
+	s.SendTo(data, dest)
+	if cb != nil {
+		cb()
+	}
+}
+
+func (s *testSipTransport) Shutdown() {
+}
+
+func (s *testSipTransport) feed(lines []string) {
+	rtime, _ := sippy_time.NewMonoTime()
+	s.recv_cb([]byte(strings.Join(lines, "\r\n")), sippy_net.NewHostPort("1.1.1.1", "5060"), s, rtime)
+}
+
+func (s *testSipTransport) get() string {
+	return string(<-s.data_ch)
+}
+
+type testSipLogger struct{}
+
+func (testSipLogger) Write(*sippy_time.MonoTime, string, string) {}
+
+type testHmrCallMap struct {
+	cc  *callController
+	hmr *headerRules
+	ua  *hmrUA
+}
+
+func (s *testHmrCallMap) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerTransaction) (sippy_types.UA, sippy_types.RequestReceiver, sippy_types.SipResponse) {
+	s.ua = &hmrUA{leg: HMR_LEG_A, rules: s.hmr, cc: s.cc}
+	s.ua.Ua = sippy.NewUA(s.cc.sip_tm, s.cc.global_config, nil, s, s.cc.lock, s.ua)
+	return s.ua, s.ua, nil
+}
+
+func (s *testHmrCallMap) RecvEvent(sippy_types.CCEvent, sippy_types.UA) {
+}
+
+func TestHeaderRulesOnTheWire(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "hmr.rules")
+	if err := os.WriteFile(fname, []byte("a  add:X-Leg:a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hmr, err := NewHeaderRules(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), testSipLogger{})}
+	config.SetSipAddress(config.GetMyAddress())
+	config.SetSipPort(config.GetMyPort())
+	transport := newTestSipTransport()
+	config.SetSipTransportFactory(transport)
+	cmap := &testHmrCallMap{
+		cc:  &callController{global_config: config, lock: new(sync.Mutex)},
+		hmr: hmr,
+	}
+	cmap.cc.sip_tm, err = sippy.NewSipTransactionManager(config, cmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cmap.cc.sip_tm.Run()
+	defer cmap.cc.sip_tm.Shutdown()
+	transport.feed([]string{
+		"INVITE sip:0044123@10.20.30.40 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK0b5aac35;rport",
+		"Max-Forwards: 70",
+		"From: \"Alice\" <sip:alice@1.1.1.1>;tag=1",
+		"To: <sip:0044123@10.20.30.40>",
+		"Contact: <sip:alice@1.1.1.1:5060>",
+		"Call-ID: 3f1c4a6b7d@1.1.1.1",
+		"CSeq: 1 INVITE",
+		"Content-Length: 0",
+		"", "",
+	})
+	transport.get() // 100 Trying
+	rtime, _ := sippy_time.NewMonoTime()
+	cmap.ua.RecvEvent(sippy.NewCCEventConnect(200, "OK", nil, rtime, "caller"))
+	if res := transport.get(); !strings.HasPrefix(res, "SIP/2.0 200 ") || strings.Count(res, "X-Leg: a\r\n") != 1 {
+		t.Fatalf("The rule has not been applied to the response on the wire:\n%s", res)
+	}
+	cmap.ua.Disconnect(nil, "")
+	if res := transport.get(); !strings.HasPrefix(res, "BYE ") || strings.Count(res, "X-Leg: a\r\n") != 1 {
+		t.Fatalf("The rule has not been applied to the request on the wire:\n%s", res)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/utils"
+)
+
+const (
+	// Reject the call when the backend cannot be reached
+	AUTH_FAIL_REJECT = "reject"
+	// Route the call using the local routing (routing table or
+	// static route) when the backend cannot be reached
+	AUTH_FAIL_LOCAL = "local"
+)
+
+const max_auth_response_size = 64 * 1024
+
+// httpAuthorisation POSTs the call details in JSON to the configured
+// URL and expects the authResult encoded in JSON in return.
+type httpAuthorisation struct {
+	url         string
+	timeout     time.Duration
+	fail_policy string
+	client      *http.Client
+	logger      sippy_log.ErrorLogger
+}
+
+type httpAuthProcess struct {
+	cancel context.CancelFunc
+}
+
+func (s *httpAuthProcess) Cancel() {
+	s.cancel()
+}
+
+func NewHttpAuthorisation(url string, timeout time.Duration, fail_policy string, logger sippy_log.ErrorLogger) (*httpAuthorisation, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, errors.New("http or https URL expected: " + url)
+	}
+	switch fail_policy {
+	case AUTH_FAIL_REJECT, AUTH_FAIL_LOCAL:
+	default:
+		return nil, errors.New("unknown failure policy: " + fail_policy)
+	}
+	return &httpAuthorisation{
+		url:         url,
+		timeout:     timeout,
+		fail_policy: fail_policy,
+		client:      &http.Client{},
+		logger:      logger,
+	}, nil
+}
+
+func (s *httpAuthorisation) DoAuth(req *authRequest, res_cb func(*authResult)) authProcess {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	go func() {
+		defer cancel()
+		res, err := s.query(ctx, req)
+		if ctx.Err() == context.Canceled {
+			return
+		}
+		if err != nil {
+			s.logger.Error("httpAuthorisation: Call-ID " + req.CallId + ": " + err.Error())
+			res = s.failResult()
+		}
+		sippy_utils.SafeCall(func() { res_cb(res) }, nil, s.logger)
+	}()
+	return &httpAuthProcess{cancel: cancel}
+}
+
+func (s *httpAuthorisation) query(ctx context.Context, req *authRequest) (*authResult, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	res := &authResult{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, max_auth_response_size)).Decode(res)
+	if err != nil {
+		return nil, errors.New("cannot decode the response: " + err.Error())
+	}
+	if res.RejectCode != 0 && (res.RejectCode < 400 || res.RejectCode > 699) {
+		return nil, fmt.Errorf("invalid reject_code: %d", res.RejectCode)
+	}
+	return res, nil
+}
+
+func (s *httpAuthorisation) failResult() *authResult {
+	if s.fail_policy == AUTH_FAIL_LOCAL {
+		return &authResult{}
+	}
+	return &authResult{RejectCode: 503, RejectReason: "Service Unavailable"}
+}
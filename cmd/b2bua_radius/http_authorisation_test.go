@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+)
+
+func doHttpAuth(t *testing.T, auth *httpAuthorisation, req *authRequest) *authResult {
+	res_ch := make(chan *authResult, 1)
+	auth.DoAuth(req, func(res *authResult) { res_ch <- res })
+	select {
+	case res := <-res_ch:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("No result from the authorisation backend")
+	}
+	return nil
+}
+
+func TestHttpAuthorisation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.CLD == "666" {
+			w.Write([]byte(`{"reject_code": 403, "reject_reason": "Forbidden"}`))
+			return
+		}
+		if req.Digest == nil || req.Digest.Username != "alice" {
+			http.Error(w, "no digest", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"routes": ["` + req.CLD + `@127.0.0.1:5070;np_expires=5"], "cli": "12345", "credit_time": 60}`))
+	}))
+	defer srv.Close()
+
+	auth, err := NewHttpAuthorisation(srv.URL, time.Second, AUTH_FAIL_REJECT, sippy_log.NewErrorLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &authRequest{CLI: "1000", CLD: "2000", CallId: "foo@bar", Digest: &authDigest{Username: "alice"}}
+	res := doHttpAuth(t, auth, req)
+	if res.RejectCode != 0 {
+		t.Fatalf("Unexpected rejection: %d %s", res.RejectCode, res.RejectReason)
+	}
+	if len(res.Routes) != 1 || res.Routes[0] != "2000@127.0.0.1:5070;np_expires=5" {
+		t.Errorf("Bad routes: %v", res.Routes)
+	}
+	if res.CLI == nil || *res.CLI != "12345" {
+		t.Errorf("Bad CLI override: %v", res.CLI)
+	}
+	if res.CallerName != nil {
+		t.Errorf("Unexpected CNAM override: %s", *res.CallerName)
+	}
+	if res.CreditTime != 60 {
+		t.Errorf("Bad credit time: %d", res.CreditTime)
+	}
+
+	req.CLD = "666"
+	res = doHttpAuth(t, auth, req)
+	if res.RejectCode != 403 || res.RejectReason != "Forbidden" {
+		t.Errorf("Bad rejection: %d %s", res.RejectCode, res.RejectReason)
+	}
+
+	// HTTP errors are handled according to the failure policy
+	req.CLD = "2000"
+	req.Digest = nil
+	res = doHttpAuth(t, auth, req)
+	if res.RejectCode != 503 {
+		t.Errorf("Bad rejection on HTTP error: %d (want 503)", res.RejectCode)
+	}
+}
+
+func TestHttpAuthorisationFailPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte(`{"routes": ["127.0.0.1"]}`))
+	}))
+	defer srv.Close()
+
+	for _, policy := range []string{AUTH_FAIL_REJECT, AUTH_FAIL_LOCAL} {
+		auth, err := NewHttpAuthorisation(srv.URL, 50*time.Millisecond, policy, sippy_log.NewErrorLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := doHttpAuth(t, auth, &authRequest{CLD: "2000"})
+		if len(res.Routes) != 0 {
+			t.Errorf("%s: unexpected routes on timeout: %v", policy, res.Routes)
+		}
+		if policy == AUTH_FAIL_REJECT && res.RejectCode != 503 {
+			t.Errorf("%s: bad rejection on timeout: %d (want 503)", policy, res.RejectCode)
+		}
+		if policy == AUTH_FAIL_LOCAL && res.RejectCode != 0 {
+			t.Errorf("%s: unexpected rejection on timeout: %d", policy, res.RejectCode)
+		}
+	}
+
+	if _, err := NewHttpAuthorisation(srv.URL, time.Second, "foo", sippy_log.NewErrorLogger()); err == nil {
+		t.Error("Unknown failure policy has been accepted")
+	}
+}
+
+func TestHttpAuthorisationCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	auth, err := NewHttpAuthorisation(srv.URL, time.Second, AUTH_FAIL_REJECT, sippy_log.NewErrorLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res_ch := make(chan *authResult, 1)
+	auth.DoAuth(&authRequest{CLD: "2000"}, func(res *authResult) { res_ch <- res }).Cancel()
+	select {
+	case <-res_ch:
+		t.Error("The result has been delivered for the cancelled request")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/isup"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+// What is done with the encapsulated ISUP (SIP-I/SIP-T) on the call leg
+const (
+	// The ISUP is passed as received (the default)
+	ISUP_PASS = "pass"
+	// The ISUP is removed from the bodies
+	ISUP_STRIP = "strip"
+	// The ISUP is built anew out of the SIP signalling
+	ISUP_REGENERATE = "regenerate"
+)
+
+func checkIsupMode(mode string) error {
+	switch mode {
+	case ISUP_PASS, ISUP_STRIP, ISUP_REGENERATE:
+		return nil
+	}
+	return errors.New("unknown ISUP mode: " + mode)
+}
+
+func isIsupMtype(mtype string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(mtype)), "application/isup")
+}
+
+func isupVersion(mtype string) string {
+	for _, param := range strings.Split(mtype, ";")[1:] {
+		nv := strings.SplitN(param, "=", 2)
+		if len(nv) == 2 && strings.ToLower(strings.TrimSpace(nv[0])) == "version" {
+			return strings.Trim(strings.TrimSpace(nv[1]), "\"")
+		}
+	}
+	return ""
+}
+
+// isupFromBody decodes the ISUP message carried in the body either alone
+// or as a part of the multipart body. Returns nil if there is none or it
+// cannot be decoded.
+func isupFromBody(body sippy_types.MsgBody) (*sippy_isup.Message, sippy_isup.Variant) {
+	if body == nil {
+		return nil, sippy_isup.VARIANT_ITU
+	}
+	var content, mtype string
+	if isIsupMtype(body.GetMtype()) {
+		content, mtype = body.String(), body.GetMtype()
+	} else if part := body.GetPart("application/isup"); part != nil {
+		content, mtype = part.GetBody().String(), part.GetMtype()
+	} else {
+		return nil, sippy_isup.VARIANT_ITU
+	}
+	variant := sippy_isup.ParseVariant(isupVersion(mtype))
+	msg, err := sippy_isup.Decode([]byte(content), variant)
+	if err != nil {
+		return nil, variant
+	}
+	return msg, variant
+}
+
+func stripIsup(body sippy_types.MsgBody) sippy_types.MsgBody {
+	if body == nil || isIsupMtype(body.GetMtype()) {
+		return nil
+	}
+	body = body.GetCopy()
+	if body.RemovePart("application/isup") {
+		parts, _ := body.GetParts()
+		switch len(parts) {
+		case 0:
+			return nil
+		case 1:
+			return parts[0].GetBody()
+		}
+	}
+	return body
+}
+
+func setIsup(body sippy_types.MsgBody, msg *sippy_isup.Message, variant sippy_isup.Variant) sippy_types.MsgBody {
+	data, err := msg.Encode(variant)
+	if err != nil {
+		return body
+	}
+	// The SIP entities that don't understand ISUP may ignore it (RFC 3204)
+	part := sippy.NewIsupBodyPart(data, variant.Version(), false /*required*/)
+	if body == nil || isIsupMtype(body.GetMtype()) {
+		// The Content-Disposition goes with the part
+		ret := sippy.NewMultipartMsgBody(part)
+		// nothing to do for the rtpproxy here
+		ret.SetNeedsUpdate(false)
+		return ret
+	}
+	body = body.GetCopy()
+	if !body.ReplacePart("application/isup", part) {
+		body.AddPart(part)
+	}
+	return body
+}
+
+// isupEgress applies the ISUP mode to the body of the INVITE sent on the
+// egress call leg.
+func (s *callController) isupEgress(body sippy_types.MsgBody, cli, cld string) sippy_types.MsgBody {
+	switch s.global_config.Isup_egress {
+	case ISUP_STRIP:
+		return stripIsup(body)
+	case ISUP_REGENERATE:
+		var calling *sippy_isup.Number
+		if isDigits(strings.TrimPrefix(cli, "+")) {
+			calling = sippy_isup.NewNumber(cli)
+			calling.Screening = sippy_isup.SCREENING_NETWORK
+			if s.privacy != nil && s.privacy.HasValue(sippy_header.PRIVACY_ID) {
+				calling.Presentation = sippy_isup.APRI_RESTRICTED
+			}
+		}
+		var iam *sippy_isup.Message
+		if s.isup_iam != nil {
+			// keep whatever has been received except the numbers
+			iam = s.isup_iam.GetCopy()
+			iam.SetParam(sippy_isup.PARAM_CALLED_PARTY_NUMBER, sippy_isup.NewNumber(cld).Encode())
+			iam.DelParam(sippy_isup.PARAM_CALLING_PARTY_NUM)
+			if calling != nil {
+				iam.SetParam(sippy_isup.PARAM_CALLING_PARTY_NUM, calling.Encode())
+			}
+		} else {
+			iam = sippy_isup.NewIAM(sippy_isup.NewNumber(cld), calling, s.isup_variant)
+		}
+		return setIsup(body, iam, s.isup_variant)
+	}
+	return body
+}
+
+// isupIngress applies the ISUP mode to the provisional and final
+// responses sent on the ingress call leg. The ISUP is only regenerated if
+// the call has come in as SIP-I/SIP-T, otherwise it is stripped.
+func (s *callController) isupIngress(event sippy_types.CCEvent) {
+	mode := s.global_config.Isup_ingress
+	if mode == ISUP_PASS {
+		return
+	}
+	if mode == ISUP_REGENERATE && s.isup_iam == nil {
+		mode = ISUP_STRIP
+	}
+	var msg *sippy_isup.Message
+	var set_body func(sippy_types.MsgBody)
+	switch ev := event.(type) {
+	case *sippy.CCEventRing:
+		set_body = ev.SetBody
+		alerting := ev.GetScode() == 180
+		if !s.isup_acm_sent {
+			msg = sippy_isup.NewACM(alerting, s.isup_variant)
+		} else if alerting {
+			msg = sippy_isup.NewCPG(sippy_isup.EVENT_ALERTING, s.isup_variant)
+		} else {
+			msg = sippy_isup.NewCPG(sippy_isup.EVENT_PROGRESS, s.isup_variant)
+		}
+	case *sippy.CCEventConnect:
+		set_body = ev.SetBody
+		msg = sippy_isup.NewCON(s.isup_variant)
+		if s.isup_acm_sent {
+			msg = sippy_isup.NewANM(s.isup_variant)
+		}
+	case *sippy.CCEventPreConnect:
+		set_body = ev.SetBody
+		msg = sippy_isup.NewCON(s.isup_variant)
+		if s.isup_acm_sent {
+			msg = sippy_isup.NewANM(s.isup_variant)
+		}
+	case *sippy.CCEventFail:
+		set_body = ev.SetBody
+		cause := reasonQ850Cause(ev.GetReason())
+		if cause == 0 {
+			cause = s.global_config.causes.ToQ850(ev.GetScode())
+		}
+		msg = sippy_isup.NewREL(sippy_isup.NewCause(byte(cause)), s.isup_variant)
+	default:
+		return
+	}
+	if mode == ISUP_STRIP {
+		set_body(stripIsup(event.GetBody()))
+		return
+	}
+	set_body(setIsup(event.GetBody(), msg, s.isup_variant))
+	s.isup_acm_sent = true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/isup"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+func TestIsupBody(t *testing.T) {
+	sdp := "v=0\r\no=- 1 1 IN IP4 192.168.0.1\r\ns=-\r\nc=IN IP4 192.168.0.1\r\nt=0 0\r\nm=audio 10000 RTP/AVP 0\r\n"
+	body := sippy.NewMsgBody(sdp, "application/sdp")
+	iam := sippy_isup.NewIAM(sippy_isup.NewNumber("12345"), nil, sippy_isup.VARIANT_ANSI)
+	with_isup := setIsup(body, iam, sippy_isup.VARIANT_ANSI)
+	if !with_isup.IsMultipart() || body.IsMultipart() {
+		t.Fatalf("Bad body type: %s", with_isup.GetMtype())
+	}
+	msg, variant := isupFromBody(sippy.NewMsgBody(with_isup.String(), with_isup.GetMtype()))
+	if msg == nil || variant != sippy_isup.VARIANT_ANSI || msg.Type != sippy_isup.MSG_IAM {
+		t.Fatalf("Cannot get the ISUP back: %q", with_isup.String())
+	}
+	called, _ := msg.GetNumber(sippy_isup.PARAM_CALLED_PARTY_NUMBER)
+	if called.Digits != "12345" {
+		t.Errorf("Bad called party number: %s", called.Digits)
+	}
+	stripped := stripIsup(with_isup)
+	if stripped.GetMtype() != "application/sdp" || stripped.String() != sdp {
+		t.Errorf("Bad stripped body: %s %q", stripped.GetMtype(), stripped.String())
+	}
+}
+
+func TestIsupOriginateBody(t *testing.T) {
+	sdp := "v=0\r\no=- 1 1 IN IP4 192.168.0.1\r\ns=-\r\nc=IN IP4 192.168.0.1\r\nt=0 0\r\nm=audio 10000 RTP/AVP 0\r\n"
+	iam := sippy_isup.NewIAM(sippy_isup.NewNumber("12345"), nil, sippy_isup.VARIANT_ITU)
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil), Isup_egress: ISUP_PASS}
+	newCC := func(body sippy_types.MsgBody) *callController {
+		cc := &callController{global_config: config, lock: new(sync.Mutex)}
+		cc.eTry, _ = sippy.NewCCEventTry(nil, "1000", "12345", body, nil, "", nil, "")
+		cc.isup_iam, cc.isup_variant = isupFromBody(body)
+		return cc
+	}
+	// The SDP is only relayed through the rtpproxy
+	cc := newCC(sippy.NewMsgBody(sdp, "application/sdp"))
+	if body := cc.originateBody(false, "1000", "12345"); body != nil {
+		t.Errorf("The SDP has been relayed without the rtpproxy: %q", body.String())
+	}
+	if body := cc.originateBody(true, "1000", "12345"); body == nil || body.String() != sdp {
+		t.Error("The SDP has not been relayed through the rtpproxy")
+	}
+	// The IAM is relayed regardless of the rtpproxy
+	with_isup := setIsup(sippy.NewMsgBody(sdp, "application/sdp"), iam, sippy_isup.VARIANT_ITU)
+	cc = newCC(sippy.NewMsgBody(with_isup.String(), with_isup.GetMtype()))
+	body := cc.originateBody(false, "1000", "12345")
+	if parts, _ := body.GetParts(); len(parts) != 1 || !isIsupMtype(parts[0].GetMtype()) {
+		t.Errorf("The IAM alone has not been relayed without the rtpproxy: %v", body)
+	}
+	if !strings.Contains(body.String(), "Content-Disposition: signal;handling=optional\r\n") {
+		t.Errorf("The IAM is not optional: %q", body.String())
+	}
+	body = cc.originateBody(true, "1000", "12345")
+	if msg, _ := isupFromBody(body); msg == nil || !body.IsMultipart() {
+		t.Errorf("The IAM has not been relayed through the rtpproxy: %v", body)
+	}
+}
+
+func TestIsupIngress(t *testing.T) {
+	sdp := "v=0\r\no=- 1 1 IN IP4 192.168.0.1\r\ns=-\r\nc=IN IP4 192.168.0.1\r\nt=0 0\r\nm=audio 10000 RTP/AVP 0\r\n"
+	causes, _ := NewCauseMapping("", "")
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil), Isup_ingress: ISUP_REGENERATE, causes: causes}
+	newCC := func(body sippy_types.MsgBody) *callController {
+		cc := &callController{global_config: config, lock: new(sync.Mutex)}
+		cc.isup_iam, cc.isup_variant = isupFromBody(body)
+		return cc
+	}
+	iam := sippy_isup.NewIAM(sippy_isup.NewNumber("12345"), nil, sippy_isup.VARIANT_ITU)
+	acm := sippy_isup.NewACM(true, sippy_isup.VARIANT_ITU)
+
+	// No ISUP is sent to the plain SIP caller
+	cc := newCC(sippy.NewMsgBody(sdp, "application/sdp"))
+	ring := sippy.NewCCEventRing(180, "Ringing", setIsup(sippy.NewMsgBody(sdp, "application/sdp"), acm, sippy_isup.VARIANT_ITU), nil, "")
+	cc.isupIngress(ring)
+	if ring.GetBody() == nil || ring.GetBody().String() != sdp {
+		t.Errorf("Bad body sent to the plain SIP caller: %v", ring.GetBody())
+	}
+	fail := sippy.NewCCEventFail(486, "Busy Here", nil, "")
+	cc.isupIngress(fail)
+	if fail.GetBody() != nil {
+		t.Errorf("REL has been sent to the plain SIP caller: %q", fail.GetBody().String())
+	}
+
+	// The SIP-I caller
+	cc = newCC(setIsup(sippy.NewMsgBody(sdp, "application/sdp"), iam, sippy_isup.VARIANT_ITU))
+	ring = sippy.NewCCEventRing(180, "Ringing", nil, nil, "")
+	cc.isupIngress(ring)
+	if msg, _ := isupFromBody(ring.GetBody()); msg == nil || msg.Type != sippy_isup.MSG_ACM {
+		t.Fatalf("ACM has not been sent: %v", ring.GetBody())
+	}
+	if !strings.Contains(ring.GetBody().String(), "Content-Disposition: signal;handling=optional\r\n") {
+		t.Errorf("The ACM is not optional: %q", ring.GetBody().String())
+	}
+	fail = sippy.NewCCEventFail(486, "Busy Here", nil, "")
+	cc.isupIngress(fail)
+	msg, _ := isupFromBody(fail.GetBody())
+	if msg == nil || msg.Type != sippy_isup.MSG_REL {
+		t.Fatalf("REL has not been sent: %v", fail.GetBody())
+	}
+	if cause, err := msg.GetCause(); err != nil || cause.Value != 17 {
+		t.Errorf("Bad cause of REL: %v %v", cause, err)
+	}
+	// The cause received from the far end takes precedence
+	fail = sippy.NewCCEventFail(480, "Temporarily Unavailable", nil, "")
+	fail.SetReason(sippy_header.NewSipReason("Q.850", "18", ""))
+	cc.isupIngress(fail)
+	if msg, _ = isupFromBody(fail.GetBody()); msg == nil {
+		t.Fatal("REL has not been sent")
+	}
+	if cause, err := msg.GetCause(); err != nil || cause.Value != 18 {
+		t.Errorf("Bad cause of REL: %v %v", cause, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const (
+	LOOP_HF_NAME = "X-B2B-Loop"
+	// Upper limit on the number of the fingerprints carried in the
+	// header, the oldest ones are dropped when the limit is reached.
+	max_loop_fingerprints = 16
+)
+
+// loopDetector recognises the INVITEs that have already passed
+// through this B2BUA instance with the same destination number. Every
+// outgoing INVITE carries the list of the fingerprints of all B2BUAs
+// it has passed through, so the loop between two or more instances
+// is broken on the second visit instead of running until the Max-Forwards
+// or the credit time is exhausted. Including the CLD into the fingerprint
+// lets the legitimate spirals with the rewritten number through.
+type loopDetector struct {
+	instance_id string
+}
+
+func NewLoopDetector(instance_id string) *loopDetector {
+	return &loopDetector{
+		instance_id: instance_id,
+	}
+}
+
+func (s *loopDetector) fingerprint(cld string) string {
+	sum := sha1.Sum([]byte(s.instance_id + ":" + cld))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Check returns the fingerprints found in the request and true if the
+// request has already been seen by this instance.
+func (s *loopDetector) Check(req sippy_types.SipRequest) ([]string, bool) {
+	own := s.fingerprint(req.GetRURI().Username)
+	fps := []string{}
+	for _, hf := range req.GetHFs(LOOP_HF_NAME) {
+		for _, fp := range strings.Split(hf.StringBody(), ",") {
+			fp = strings.TrimSpace(fp)
+			if fp == "" {
+				continue
+			}
+			if fp == own {
+				return nil, true
+			}
+			fps = append(fps, fp)
+		}
+	}
+	return fps, false
+}
+
+// Header builds the header for the outgoing INVITE out of the fingerprints
+// of the incoming one and our own fingerprint for the incoming CLD.
+func (s *loopDetector) Header(fps []string, cld string) sippy_header.SipHeader {
+	all := append(append([]string{}, fps...), s.fingerprint(cld))
+	if len(all) > max_loop_fingerprints {
+		all = all[len(all)-max_loop_fingerprints:]
+	}
+	return sippy_header.NewSipGenericHF(LOOP_HF_NAME, strings.Join(all, ","))
+}
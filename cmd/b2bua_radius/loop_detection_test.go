@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+func testLoopInvite(t *testing.T, config sippy_conf.Config, cld, branch, cseq string, hfs ...sippy_header.SipHeader) sippy_types.SipRequest {
+	buf := strings.Join([]string{
+		"INVITE sip:" + cld + "@1.2.3.4 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=" + branch,
+		"From: <sip:alice@1.1.1.1>;tag=1",
+		"To: <sip:" + cld + "@1.2.3.4>",
+		"Call-ID: loop@1.1.1.1",
+		"CSeq: " + cseq + " INVITE",
+		"Max-Forwards: 70",
+		"Content-Length: 0",
+		"", "",
+	}, "\r\n")
+	rtime, _ := sippy_time.NewMonoTime()
+	req, err := sippy.ParseSipRequest([]byte(buf), rtime, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hf := range hfs {
+		req.AppendHeader(hf)
+	}
+	return req
+}
+
+func TestLoopDetector(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	invite := func(cld string, hfs ...sippy_header.SipHeader) sippy_types.SipRequest {
+		return testLoopInvite(t, config, cld, "z9hG4bK1", "1", hfs...)
+	}
+	b2b1 := NewLoopDetector("b2b1")
+	b2b2 := NewLoopDetector("b2b2")
+
+	// b2b1 -> b2b2 -> b2b1 with the same CLD is a loop
+	fps, looped := b2b1.Check(invite("123"))
+	if looped || len(fps) != 0 {
+		t.Fatalf("The fresh INVITE is looped: %v", fps)
+	}
+	hf1 := b2b1.Header(fps, "123")
+	fps, looped = b2b2.Check(invite("123", hf1))
+	if looped || len(fps) != 1 {
+		t.Fatalf("The INVITE from the other instance is looped: %v", fps)
+	}
+	hf2 := b2b2.Header(fps, "123")
+	if len(strings.Split(hf2.StringBody(), ",")) != 2 {
+		t.Fatalf("Bad fingerprints: %s", hf2.StringBody())
+	}
+	if _, looped = b2b1.Check(invite("123", hf2)); !looped {
+		t.Error("The loop has not been detected")
+	}
+	// The spiral with the rewritten number is not a loop
+	if _, looped = b2b1.Check(invite("456", hf2)); looped {
+		t.Error("The spiral has been taken for the loop")
+	}
+
+	// The number of the fingerprints is limited, the oldest are dropped
+	fps = []string{}
+	for i := 0; i < max_loop_fingerprints+4; i++ {
+		fps = append(fps, NewLoopDetector(strings.Repeat("x", i+1)).fingerprint("123"))
+	}
+	all := strings.Split(b2b1.Header(fps, "123").StringBody(), ",")
+	if len(all) != max_loop_fingerprints || all[len(all)-1] != b2b1.fingerprint("123") || all[0] != fps[5] {
+		t.Errorf("Bad fingerprints: %v", all)
+	}
+}
+
+func TestMergedRequest(t *testing.T) {
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	cmap := &CallMap{
+		global_config: config,
+		ccmap:         make(map[int64]*callController),
+		merged:        make(map[sippy_header.TID]string),
+	}
+	merged := func(branch, cseq string) bool {
+		req := testLoopInvite(t, config, "123", branch, cseq)
+		tid, err := req.GetTId(true /*wCSM*/, false /*wBRN*/, false /*wTTG*/)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cmap.isMergedRequest(tid, req)
+	}
+	if merged("z9hG4bK1", "1") {
+		t.Fatal("The first INVITE is merged")
+	}
+	req := testLoopInvite(t, config, "123", "z9hG4bK1", "1")
+	tid, _ := req.GetTId(true /*wCSM*/, false /*wBRN*/, false /*wTTG*/)
+	cmap.ccmap[1] = &callController{merged_tid: tid}
+	cmap.merged[*tid] = cmap.branch(req)
+	if merged("z9hG4bK1", "1") {
+		t.Error("The retransmission is merged")
+	}
+	if !merged("z9hG4bK2", "1") {
+		t.Error("The merged request has not been detected")
+	}
+	if merged("z9hG4bK2", "2") {
+		t.Error("The new request is merged")
+	}
+	cmap.DropCC(1)
+	if merged("z9hG4bK2", "1") || len(cmap.merged) != 0 {
+		t.Error("The request is merged with the call that has gone")
+	}
+}
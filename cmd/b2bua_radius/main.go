@@ -7,6 +7,7 @@ import (
 	"github.com/egovorukhin/go-b2bua/sippy"
 	"github.com/egovorukhin/go-b2bua/sippy/cli"
 	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
 	"github.com/egovorukhin/go-b2bua/sippy/types"
 )
 
@@ -89,8 +90,39 @@ func main() {
 		return
 	}
 
+	if err = sippy_security.HashOracle.LoadKeys(global_config.Nonce_keys); err != nil {
+		println("Cannot load the nonce keys: " + err.Error())
+		return
+	}
+
 	var static_route *B2BRoute
-	if global_config.Static_route != "" {
+	var routing *routingEngine
+	var auth authorisation
+	if global_config.Http_auth_url != "" {
+		auth, err = NewHttpAuthorisation(global_config.Http_auth_url, global_config.Http_auth_timeout,
+			global_config.Http_auth_fail_policy, global_config.ErrorLogger())
+		if err != nil {
+			println("Cannot initialize the HTTP authorisation: " + err.Error())
+			return
+		}
+	}
+	var translation *translationEngine
+	if global_config.Translation_rules != "" {
+		translation, err = NewTranslationEngine(global_config.Translation_rules)
+		if err != nil {
+			println("Error loading the translation rules")
+			println(err.Error())
+			return
+		}
+	}
+	if global_config.Routing_table != "" {
+		routing, err = NewRoutingEngine(global_config.Routing_table, global_config)
+		if err != nil {
+			println("Error loading the routing table")
+			println(err.Error())
+			return
+		}
+	} else if global_config.Static_route != "" {
 		static_route, err = NewB2BRoute(global_config.Static_route, global_config)
 		if err != nil {
 			println("Error parsing the static route")
@@ -98,8 +130,8 @@ func main() {
 			return
 		}
 		//} else if ! global_config.auth_enable {
-	} else if true { // radius is not implemented
-		println("ERROR: static route should be specified when Radius auth is disabled")
+	} else if auth == nil { // radius is not implemented
+		println("ERROR: static route or routing table should be specified when HTTP auth is disabled")
 		return
 	}
 	/*
@@ -132,7 +164,22 @@ func main() {
 	*/
 	global_config.SetMyUAName("Sippy B2BUA (RADIUS)")
 
-	cmap := NewCallMap(global_config, rtp_proxy_clients, static_route)
+	cmap := NewCallMap(global_config, rtp_proxy_clients, static_route, routing, translation, auth)
+	if global_config.Header_rules != "" {
+		cmap.hmr, err = NewHeaderRulesEngine(global_config.Header_rules)
+		if err != nil {
+			println("Error loading the header manipulation rules")
+			println(err.Error())
+			return
+		}
+	}
+	if global_config.Topology_hiding {
+		cmap.th, err = NewTopologyHiding(global_config.Th_key, global_config.th_strip_headers)
+		if err != nil {
+			println("Cannot initialize topology hiding: " + err.Error())
+			return
+		}
+	}
 	/*
 	   if global_config.getdefault('xmpp_b2bua_id', nil) != nil:
 	       global_config['_xmpp_mode'] = true
@@ -144,6 +191,28 @@ func main() {
 	}
 	//sip_tm.nat_traversal = global_config.nat_traversal
 	cmap.Sip_tm = sip_tm
+	cmap.rate_limiter = newRateLimiter(global_config)
+	if cmap.rate_limiter != nil {
+		sip_tm.SetRequestFilter(cmap.rate_limiter)
+	}
+	if global_config.Fraud_rules != "" {
+		fraud, err := NewFraudRulesDetector(global_config.Fraud_rules)
+		if err != nil {
+			println("Error loading the fraud detection rules")
+			println(err.Error())
+			return
+		}
+		fraud.SetAlertHook(newFraudAlertHook(global_config.Fraud_hook, global_config.ErrorLogger()))
+		cmap.fraud = fraud
+	}
+	if global_config.Acl != "" {
+		cmap.acl, err = NewAclEngine(global_config.Acl, global_config, cmap.rate_limiter)
+		if err != nil {
+			println("Error loading the access control lists")
+			println(err.Error())
+			return
+		}
+	}
 	if global_config.Sip_proxy != "" {
 		var sip_proxy *sippy_net.HostPort
 		host_port := strings.SplitN(global_config.Sip_proxy, ":", 2)
@@ -154,12 +223,54 @@ func main() {
 		}
 		cmap.Proxy = sippy.NewStatefulProxy(sip_tm, sip_proxy, global_config)
 	}
+	if global_config.Registrar {
+		registrar := sippy.NewRegistrar(sippy.NewMemoryLocationStore(), global_config)
+		registrar.SetDomains(global_config.registrar_domains)
+		registrar.SetExpires(sippy.REGISTRAR_MIN_EXPIRES, global_config.Registrar_max_expires, sippy.REGISTRAR_DEFAULT_EXPIRES)
+		if global_config.Registrar_users != "" {
+			users, err := loadRegistrarUsers(global_config.Registrar_users)
+			if err != nil {
+				println("Cannot load the registrar users: " + err.Error())
+				return
+			}
+			err = registrar.SetAuth(global_config.Registrar_realm, "", func(username string) (string, bool) {
+				passwd, ok := users[username]
+				return passwd, ok
+			})
+			if err != nil {
+				println("Cannot set up the registrar authentication: " + err.Error())
+				return
+			}
+		}
+		if cmap.rate_limiter != nil {
+			registrar.SetAuthFailureListener(cmap.rate_limiter)
+		}
+		cmap.registrar = registrar
+	}
+	if global_config.Trunks != "" {
+		cmap.trunks, err = NewTrunks(global_config.Trunks, sip_tm, global_config)
+		if err != nil {
+			println("Error loading the trunks")
+			println(err.Error())
+			return
+		}
+		cmap.trunks.Start()
+	}
 
+	var cli_server *sippy_cli.CLIConnectionManager
 	cmdfile := global_config.B2bua_socket
-	if strings.HasPrefix(cmdfile, "unix:") {
-		cmdfile = cmdfile[5:]
+	if strings.HasPrefix(cmdfile, "tcp:") {
+		cli_server, err = sippy_cli.NewCLIConnectionManagerTcp(cmap.RecvCommand, cmdfile[4:], global_config.ErrorLogger())
+		if err == nil {
+			// Only the loopback connections without the ACL
+			cli_server.SetAcceptFilter(cmap.acl.AcceptCLI)
+		}
+	} else {
+		if strings.HasPrefix(cmdfile, "unix:") {
+			cmdfile = cmdfile[5:]
+		}
+		cli_server, err = sippy_cli.NewCLIConnectionManagerUnix(cmap.RecvCommand, cmdfile, os.Getuid(), os.Getgid(), global_config.ErrorLogger())
 	}
-	cli_server, err := sippy_cli.NewCLIConnectionManagerUnix(cmap.RecvCommand, cmdfile, os.Getuid(), os.Getgid(), global_config.ErrorLogger())
 	if err != nil {
 		println("Cannot initialize Cli_server: " + err.Error())
 		return
@@ -3,20 +3,63 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/egovorukhin/go-b2bua/sippy"
 	"github.com/egovorukhin/go-b2bua/sippy/conf"
 	"github.com/egovorukhin/go-b2bua/sippy/log"
 	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
+	"github.com/egovorukhin/go-b2bua/sippy/utils"
 )
 
 type myConfigParser struct {
 	sippy_conf.Config
-	accept_ips   map[string]bool
-	Static_route string
-	Sip_proxy    string
+	accept_ips            []*net.IPNet
+	Acl                   string
+	Acl_users             string
+	Acl_realm             string
+	Fraud_rules           string
+	Fraud_hook            string
+	Static_route          string
+	Routing_table         string
+	Translation_rules     string
+	Header_rules          string
+	Sip_proxy             string
+	Http_auth_url         string
+	Http_auth_timeout     time.Duration
+	Http_auth_fail_policy string
+	Loop_detect           bool
+	Loop_detect_id        string
+	Topology_hiding       bool
+	Th_key                string
+	th_strip_headers      []string
+	trusted_peers         []*net.IPNet
+	Redirect_info         string
+	Session_id            bool
+	Isup_ingress          string
+	Isup_egress           string
+	Reason_header         bool
+	causes                *causeMapping
+	Registrar             bool
+	registrar_domains     []string
+	Registrar_users       string
+	Registrar_realm       string
+	Registrar_max_expires int
+	Nonce_keys            string
+	source_rate_limit     *sippy.RateLimit
+	method_rate_limits    map[string]*sippy.RateLimit
+	invite_rate_limit     *sippy.RateLimit
+	Flood_action          string
+	Flood_retry_after     time.Duration
+	Ban_auth_failures     int
+	Ban_window            time.Duration
+	Ban_time              time.Duration
+	Trunks                string
 	//auth_enable         bool
 	Rtp_proxy_clients []string
 	pass_headers      []string
@@ -30,9 +73,9 @@ type myConfigParser struct {
 func NewMyConfigParser() *myConfigParser {
 	return &myConfigParser{
 		Rtp_proxy_clients: make([]string, 0),
-		accept_ips:        make(map[string]bool),
 		//auth_enable         : false,
-		pass_headers: make([]string, 0),
+		pass_headers:     make([]string, 0),
+		th_strip_headers: make([]string, 0),
 	}
 }
 
@@ -77,14 +120,128 @@ func (p *myConfigParser) Parse() error {
 
 	flag.StringVar(&p.Static_route, "s", "", "static route for all SIP calls")
 	flag.StringVar(&p.Static_route, "static_route", "", "static route for all SIP calls")
+	flag.StringVar(&p.Routing_table, "routing_table", "", "path to the file with the prefix-based routing table, "+
+		"the table is reloaded on SIGHUP or with the \"rr\" command")
 
 	var accept_ips string
 	flag.StringVar(&accept_ips, "a", "", "accept_ips")
-	flag.StringVar(&accept_ips, "accept_ips", "", "IP addresses that we will only be accepting incoming "+
+	flag.StringVar(&accept_ips, "accept_ips", "", "IP addresses or networks that we will only be accepting incoming "+
 		"calls from (comma-separated list). If the parameter "+
 		"is not specified, we will accept from any IP and "+
 		"then either try to authenticate if authentication "+
 		"is enabled, or just let them to pass through")
+	flag.StringVar(&p.Acl, "acl", "", "path to the file with the access control lists deciding whether the "+
+		"SIP requests and the TCP command connections are accepted, "+
+		"rejected, challenged or routed with a routing profile by "+
+		"the source address. The lists are reloaded on SIGHUP or "+
+		"with the \"rr\" command")
+	flag.StringVar(&p.Acl_users, "acl_users", "", "path to the htdigest file with the credentials of the callers "+
+		"challenged by the \"auth\" ACL rules")
+	flag.StringVar(&p.Acl_realm, "acl_realm", "", "realm of the digest challenges of the \"auth\" ACL rules")
+	flag.StringVar(&p.Fraud_rules, "fraud_rules", "", "path to the file with the fraud detection rules applied to "+
+		"the incoming calls before routing, the rules are reloaded "+
+		"on SIGHUP or with the \"rr\" command")
+	flag.StringVar(&p.Fraud_hook, "fraud_hook", "", "command to run on every fraud alert, the details of the alert "+
+		"are passed in the FRAUD_* environment variables")
+
+	flag.StringVar(&p.Translation_rules, "translation_rules", "", "path to the file with the CLD/CLI translation rules, "+
+		"the rules are reloaded on SIGHUP or with the \"rr\" command")
+	flag.StringVar(&p.Header_rules, "header_rules", "", "path to the file with the header manipulation rules, "+
+		"the rules are reloaded on SIGHUP or with the \"rr\" command")
+	flag.StringVar(&p.Http_auth_url, "http_auth_url", "", "URL of the HTTP/JSON backend that authorises incoming "+
+		"calls and supplies routing for them")
+	var http_auth_timeout int
+	flag.IntVar(&http_auth_timeout, "http_auth_timeout", 2000, "timeout for the HTTP/JSON authorisation backend "+
+		"requests (milliseconds)")
+	flag.StringVar(&p.Http_auth_fail_policy, "http_auth_fail_policy", AUTH_FAIL_REJECT, "what to do when the HTTP/JSON "+
+		"authorisation backend fails or times out: \"reject\" the call "+
+		"or route it using the \"local\" routing table or static route")
+
+	flag.BoolVar(&p.Loop_detect, "loop_detect", false, "reject with \"482 Loop Detected\" the INVITEs that have "+
+		"already passed through this B2BUA with the same destination number")
+	flag.StringVar(&p.Loop_detect_id, "loop_detect_id", "", "identifier of this B2BUA instance used in the loop "+
+		"detection fingerprints, random if not specified")
+
+	flag.BoolVar(&p.Session_id, "session_id", false, "add the Session-ID (RFC 7989) to the SIP messages on both "+
+		"call legs, the missing UUID of the caller is generated")
+
+	flag.BoolVar(&p.Topology_hiding, "topology_hiding", false, "obfuscate the Call-ID on the egress call leg "+
+		"and never pass the headers revealing the network topology")
+	flag.StringVar(&p.Th_key, "th_key", "", "secret key used to obfuscate the Call-ID in the topology hiding "+
+		"mode, random if not specified. Set it to be able to reveal the "+
+		"original Call-ID after the restart of the B2BUA")
+	var th_strip_headers string
+	flag.StringVar(&th_strip_headers, "th_strip_headers", "", "list of additional private SIP header field "+
+		"names that are removed in the topology hiding mode (comma-separated list)")
+
+	var trusted_peers string
+	flag.StringVar(&trusted_peers, "trusted_peers", "", "IP addresses or networks of the peers that belong to the "+
+		"trust domain: P-Asserted-Identity is accepted only from and sent "+
+		"only to these peers (comma-separated list)")
+
+	flag.StringVar(&p.Redirect_info, "redirect_info", RDI_NONE, "how to send the redirection information on the "+
+		"egress call leg: \"none\", \"pass\" as received, convert to "+
+		"\"diversion\" or to \"history-info\". The \"rdi\" route "+
+		"parameter overrides it")
+
+	flag.StringVar(&p.Isup_ingress, "isup_ingress", ISUP_PASS, "what to do with the encapsulated ISUP (SIP-I/SIP-T) "+
+		"in the responses sent to the caller: \"pass\" as received, "+
+		"\"strip\" or \"regenerate\" out of the SIP responses")
+	flag.StringVar(&p.Isup_egress, "isup_egress", ISUP_PASS, "what to do with the encapsulated ISUP (SIP-I/SIP-T) "+
+		"in the INVITE sent to the callee: \"pass\" as received, "+
+		"\"strip\" or \"regenerate\" with the translated numbers")
+
+	flag.BoolVar(&p.Reason_header, "reason_header", false, "insert the Q.850 Reason into the relayed failure "+
+		"responses, BYEs and CANCELs that don't have one")
+	var sip_to_q850, q850_to_sip string
+	flag.StringVar(&sip_to_q850, "sip_to_q850", "", "overrides of the SIP status code to Q.850 cause mapping "+
+		"(comma-separated list of code:cause pairs)")
+	flag.StringVar(&q850_to_sip, "q850_to_sip", "", "overrides of the Q.850 cause to SIP status code mapping "+
+		"(comma-separated list of cause:code pairs)")
+
+	flag.BoolVar(&p.Registrar, "registrar", false, "handle the \"REGISTER\" requests with the built-in registrar "+
+		"instead of the helper proxy and route the calls to the registered contacts")
+	var registrar_domains string
+	flag.StringVar(&registrar_domains, "registrar_domains", "", "domains the registrar is responsible for, "+
+		"any domain is accepted if not specified (comma-separated list)")
+	flag.StringVar(&p.Registrar_users, "registrar_users", "", "path to the file with the username:password pairs "+
+		"of the users allowed to register. The registrations are not "+
+		"authenticated if not specified")
+	flag.StringVar(&p.Registrar_realm, "registrar_realm", "", "realm of the registrar digest challenges, "+
+		"the domain of the registered AOR if not specified. Either the realm or "+
+		"the -registrar_domains are required with the -registrar_users")
+	flag.IntVar(&p.Registrar_max_expires, "registrar_max_expires", sippy.REGISTRAR_MAX_EXPIRES, "upper limit of the "+
+		"registration interval (seconds)")
+	flag.StringVar(&p.Nonce_keys, "nonce_keys", "", "path to the file with the id:hexkey pairs used to encrypt "+
+		"the digest nonces, the first key is used for the new nonces. "+
+		"Share it between the B2BUA instances behind a load balancer. "+
+		"The "+sippy_security.NONCE_KEYS_ENV+" environment variable is used "+
+		"if not specified, the random key otherwise. The keys are "+
+		"reloaded on SIGHUP or with the \"rr\" command")
+
+	var source_rate_limit, method_rate_limits, invite_rate_limit string
+	var flood_retry_after, ban_window, ban_time int
+	flag.StringVar(&source_rate_limit, "rate_limit", "", "limit of the incoming requests from the same IP address "+
+		"in the form rate[/burst], the rate is per second. Not limited "+
+		"if not specified. The ACKs, the CANCELs and the in-dialog requests "+
+		"are never limited")
+	flag.StringVar(&method_rate_limits, "method_rate_limits", "", "limits of the incoming requests of the method "+
+		"from the same IP address (comma-separated list of "+
+		"METHOD=rate[/burst], i.e. REGISTER=1/5,OPTIONS=2)")
+	flag.StringVar(&invite_rate_limit, "invite_rate_limit", "", "limit of the new incoming INVITEs from all the "+
+		"sources together in the form rate[/burst]")
+	flag.StringVar(&p.Flood_action, "flood_action", FLOOD_DROP, "what to do with the requests over the limits: "+
+		"\"drop\" them silently or \"reject\" with 503 and Retry-After")
+	flag.IntVar(&flood_retry_after, "flood_retry_after", 30, "Retry-After of the rejected requests (seconds)")
+	flag.IntVar(&p.Ban_auth_failures, "ban_auth_failures", 0, "ban the IP address failing the digest "+
+		"authentication this number of times within ban_window, "+
+		"the bans are managed with the \"bans\", \"ban\" and "+
+		"\"unban\" commands. Disabled if zero")
+	flag.IntVar(&ban_window, "ban_window", 60, "window the authentication failures are counted in (seconds)")
+	flag.IntVar(&ban_time, "ban_time", 600, "time the IP address remains banned for (seconds)")
+
+	flag.StringVar(&p.Trunks, "trunks", "", "path to the file with the upstream SIP trunks the B2BUA registers to, "+
+		"the trunks are unregistered on SIGTERM")
 
 	var hrtb_ival int
 	flag.IntVar(&hrtb_ival, "rtpp_hrtb_ival", 10, "rtpproxy hearbeat interval (seconds)")
@@ -152,7 +309,8 @@ func (p *myConfigParser) Parse() error {
 		"unmodified (comma-separated list)")
 	flag.StringVar(&p.B2bua_socket, "c", "/var/run/b2bua.sock", "b2bua_socket")
 	flag.StringVar(&p.B2bua_socket, "b2bua_socket", "/var/run/b2bua.sock", "path to the B2BUA command socket or address to listen "+
-		"for commands in the format \"udp:host[:port]\"")
+		"for commands in the format \"tcp:host:port\". Only the connections from the loopback addresses "+
+		"are accepted on the TCP socket unless the -acl has the \"cli\" rules")
 	/*
 	   if o == '-M':
 	       global_config.check_and_set('max_radiusclients', a)
@@ -197,9 +355,17 @@ func (p *myConfigParser) Parse() error {
 	arr = strings.Split(accept_ips, ",")
 	for _, s := range arr {
 		s = strings.TrimSpace(s)
-		if s != "" {
-			p.accept_ips[s] = true
+		if s == "" {
+			continue
 		}
+		ipnet, err := parseCIDR(s)
+		if err != nil {
+			return errors.New("accept_ips: " + s + ": " + err.Error())
+		}
+		p.accept_ips = append(p.accept_ips, ipnet)
+	}
+	if p.Acl_users != "" && p.Acl_realm == "" {
+		return errors.New("acl_realm should be specified together with acl_users")
 	}
 	pass_headers += "," + pass_header
 	arr = strings.Split(pass_headers, ",")
@@ -209,6 +375,55 @@ func (p *myConfigParser) Parse() error {
 			p.pass_headers = append(p.pass_headers, s)
 		}
 	}
+	for _, s := range strings.Split(th_strip_headers, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			p.th_strip_headers = append(p.th_strip_headers, s)
+		}
+	}
+	for _, s := range strings.Split(trusted_peers, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ipnet, err := parseCIDR(s)
+		if err != nil {
+			return errors.New("trusted_peers: " + s + ": " + err.Error())
+		}
+		p.trusted_peers = append(p.trusted_peers, ipnet)
+	}
+	for _, s := range strings.Split(registrar_domains, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			p.registrar_domains = append(p.registrar_domains, s)
+		}
+	}
+	var err error
+	if source_rate_limit != "" {
+		if p.source_rate_limit, err = sippy.ParseRateLimit(source_rate_limit); err != nil {
+			return errors.New("rate_limit: " + err.Error())
+		}
+	}
+	if p.method_rate_limits, err = parseMethodRateLimits(method_rate_limits); err != nil {
+		return errors.New("method_rate_limits: " + err.Error())
+	}
+	if invite_rate_limit != "" {
+		if p.invite_rate_limit, err = sippy.ParseRateLimit(invite_rate_limit); err != nil {
+			return errors.New("invite_rate_limit: " + err.Error())
+		}
+	}
+	if p.Flood_action != FLOOD_DROP && p.Flood_action != FLOOD_REJECT {
+		return errors.New("flood_action should be either \"" + FLOOD_DROP + "\" or \"" + FLOOD_REJECT + "\"")
+	}
+	if flood_retry_after <= 0 || ban_window <= 0 || ban_time <= 0 {
+		return errors.New("flood_retry_after, ban_window and ban_time should be more than zero")
+	}
+	p.Flood_retry_after = time.Duration(flood_retry_after) * time.Second
+	p.Ban_window = time.Duration(ban_window) * time.Second
+	p.Ban_time = time.Duration(ban_time) * time.Second
+	if p.Registrar_max_expires < sippy.REGISTRAR_MIN_EXPIRES {
+		return fmt.Errorf("registrar_max_expires should be at least %d", sippy.REGISTRAR_MIN_EXPIRES)
+	}
 	switch ka_level {
 	case 0:
 		// do nothing
@@ -233,6 +448,28 @@ func (p *myConfigParser) Parse() error {
 	if err != nil {
 		return err
 	}
+	if err = checkRdiMode(p.Redirect_info); err != nil {
+		return err
+	}
+	if p.causes, err = NewCauseMapping(sip_to_q850, q850_to_sip); err != nil {
+		return err
+	}
+	if err = checkIsupMode(p.Isup_ingress); err != nil {
+		return err
+	}
+	if err = checkIsupMode(p.Isup_egress); err != nil {
+		return err
+	}
+	if http_auth_timeout <= 0 {
+		return errors.New("http_auth_timeout should be more than zero")
+	}
+	p.Http_auth_timeout = time.Duration(http_auth_timeout) * time.Millisecond
+	if p.Loop_detect_id == "" {
+		p.Loop_detect_id = sippy_utils.GenTag()
+	}
+	if p.Th_key == "" {
+		p.Th_key = sippy_utils.GenTag()
+	}
 	p.Hrtb_ival = time.Duration(hrtb_ival) * time.Second
 	p.Hrtb_retr_ival = time.Duration(hrtb_retr_ival) * time.Second
 	p.Config = sippy_conf.NewConfig(error_logger, sip_logger)
@@ -465,6 +702,14 @@ func (p *myConfigParser) checkIP(ip string) bool {
 	if len(p.accept_ips) == 0 {
 		return true
 	}
-	_, ok := p.accept_ips[ip]
-	return ok
+	addr := net.ParseIP(strings.Trim(ip, "[]"))
+	if addr == nil {
+		return false
+	}
+	for _, ipnet := range p.accept_ips {
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
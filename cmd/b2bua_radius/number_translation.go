@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * Number translation rules file format. Empty lines and lines starting
+ * with '#' are ignored. Every other line is a rule in the form
+ *
+ *     <set> <cld|cli> <action> [src=<cidr>] [route=<host>] [header=<name>] [!header=<name>] [last]
+ *
+ * The rules are grouped into the named sets and are applied in the order
+ * they appear in the file. The "in" set is applied to the incoming call
+ * leg before routing, the "out" set is applied to every outgoing call leg
+ * and then the set(s) referenced by the "tr=<set>[,<set>]" parameter of
+ * the route are applied. All conditions of a rule should be met for the
+ * action to be taken. The src= condition is matched against the source
+ * address of the incoming INVITE, the header= condition tests presence
+ * of a header in the incoming INVITE and the route= condition is matched
+ * against the host part of the route. The "last" flag stops processing
+ * of the set when the action has been applied.
+ *
+ * Actions:
+ *
+ *     s/<regexp>/<replacement>/[g]          regexp substitution ($1 etc in the replacement)
+ *     prefix:<from>:<to>                    replace the leading <from> with <to>
+ *     strip:<n>                             remove first <n> characters
+ *     add:<prefix>                          prepend <prefix>
+ *     set:<value>                           replace the whole number
+ *     e164:<cc>[:<nat_prefix>[:<intl_prefix>]]      normalise to +E.164
+ *     national:<cc>[:<nat_prefix>[:<intl_prefix>]]  convert +E.164 to the dialled form
+ *
+ * The national and international prefixes default to "0" and "00".
+ *
+ * Example:
+ *
+ *     in   cld  s/^\+//
+ *     in   cli  e164:44                  src=10.0.0.0/8
+ *     out  cli  set:anonymous            header=Privacy last
+ *     gw1  cld  prefix:44:0
+ */
+
+const (
+	TR_SET_IN  = "in"
+	TR_SET_OUT = "out"
+)
+
+type trContext struct {
+	source  net.IP
+	route   string
+	headers map[string]bool
+}
+
+type trCondition interface {
+	matches(ctx *trContext) bool
+}
+
+type trSrcCondition struct {
+	ipnet *net.IPNet
+}
+
+func (s *trSrcCondition) matches(ctx *trContext) bool {
+	return ctx.source != nil && s.ipnet.Contains(ctx.source)
+}
+
+type trRouteCondition struct {
+	route string
+}
+
+func (s *trRouteCondition) matches(ctx *trContext) bool {
+	return strings.EqualFold(s.route, ctx.route)
+}
+
+type trHeaderCondition struct {
+	name   string
+	negate bool
+}
+
+func (s *trHeaderCondition) matches(ctx *trContext) bool {
+	return ctx.headers[s.name] != s.negate
+}
+
+// trAction returns the translated number and whether the action
+// has been applicable to the number.
+type trAction func(num string) (string, bool)
+
+type trRule struct {
+	target string
+	action trAction
+	conds  []trCondition
+	last   bool
+}
+
+type numberTranslator struct {
+	sets     map[string][]*trRule
+	hf_names []string
+}
+
+func NewNumberTranslator(fname string) (*numberTranslator, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	s := &numberTranslator{
+		sets: make(map[string][]*trRule),
+	}
+	hf_names := make(map[string]bool)
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		set, rule, err := parseTrRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, lineno, err.Error())
+		}
+		s.sets[set] = append(s.sets[set], rule)
+		for _, cond := range rule.conds {
+			if hcond, ok := cond.(*trHeaderCondition); ok && !hf_names[hcond.name] {
+				hf_names[hcond.name] = true
+				s.hf_names = append(s.hf_names, hcond.name)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseTrRule(line string) (string, *trRule, error) {
+	var err error
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return "", nil, errors.New("the set name, the target and the action are expected")
+	}
+	rule := &trRule{
+		target: strings.ToLower(fields[1]),
+	}
+	if rule.target != "cld" && rule.target != "cli" {
+		return "", nil, errors.New("unknown target '" + fields[1] + "'")
+	}
+	rule.action, err = parseTrAction(fields[2])
+	if err != nil {
+		return "", nil, err
+	}
+	for _, opt := range fields[3:] {
+		if opt == "last" {
+			rule.last = true
+			continue
+		}
+		av := strings.SplitN(opt, "=", 2)
+		if len(av) != 2 {
+			return "", nil, errors.New("bad condition '" + opt + "'")
+		}
+		switch av[0] {
+		case "src":
+			ipnet, err := parseCIDR(av[1])
+			if err != nil {
+				return "", nil, errors.New("Error parsing src '" + av[1] + "': " + err.Error())
+			}
+			rule.conds = append(rule.conds, &trSrcCondition{ipnet})
+		case "route":
+			rule.conds = append(rule.conds, &trRouteCondition{av[1]})
+		case "header", "!header":
+			rule.conds = append(rule.conds, &trHeaderCondition{
+				name:   strings.ToLower(av[1]),
+				negate: av[0][0] == '!',
+			})
+		default:
+			return "", nil, errors.New("unknown condition '" + av[0] + "'")
+		}
+	}
+	return fields[0], rule, nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.IndexRune(s, '/') == -1 {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("bad IP address")
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+func parseTrAction(s string) (trAction, error) {
+	if len(s) > 2 && s[0] == 's' && !isAlnum(s[1]) {
+		return parseTrRegexp(s)
+	}
+	av := strings.SplitN(s, ":", 2)
+	if len(av) != 2 {
+		return nil, errors.New("bad action '" + s + "'")
+	}
+	switch av[0] {
+	case "prefix":
+		ft := strings.SplitN(av[1], ":", 2)
+		if len(ft) != 2 || ft[0] == "" {
+			return nil, errors.New("prefix:<from>:<to> expected")
+		}
+		return func(num string) (string, bool) {
+			if !strings.HasPrefix(num, ft[0]) {
+				return num, false
+			}
+			return ft[1] + num[len(ft[0]):], true
+		}, nil
+	case "strip":
+		n, err := strconv.Atoi(av[1])
+		if err != nil || n <= 0 {
+			return nil, errors.New("strip:<n> expected")
+		}
+		return func(num string) (string, bool) {
+			if len(num) < n {
+				return num, false
+			}
+			return num[n:], true
+		}, nil
+	case "add":
+		return func(num string) (string, bool) {
+			return av[1] + num, true
+		}, nil
+	case "set":
+		return func(num string) (string, bool) {
+			return av[1], true
+		}, nil
+	case "e164", "national":
+		args := strings.Split(av[1], ":")
+		if len(args) > 3 || !isDigits(args[0]) {
+			return nil, errors.New(av[0] + ":<cc>[:<nat_prefix>[:<intl_prefix>]] expected")
+		}
+		cc, nat_prefix, intl_prefix := args[0], "0", "00"
+		if len(args) > 1 {
+			nat_prefix = args[1]
+		}
+		if len(args) > 2 {
+			intl_prefix = args[2]
+		}
+		if av[0] == "e164" {
+			return func(num string) (string, bool) {
+				return normaliseE164(num, cc, nat_prefix, intl_prefix)
+			}, nil
+		}
+		return func(num string) (string, bool) {
+			return e164ToNational(num, cc, nat_prefix, intl_prefix)
+		}, nil
+	}
+	return nil, errors.New("unknown action '" + av[0] + "'")
+}
+
+// parseTrRegexp parses the sed-like substitution. Any character that
+// follows the 's' can be used as a delimiter, i.e. s|^00|+|.
+func parseTrRegexp(s string) (trAction, error) {
+	delim := s[1:2]
+	parts := strings.Split(s[2:], delim)
+	if len(parts) != 3 {
+		return nil, errors.New("s" + delim + "<regexp>" + delim + "<replacement>" + delim + "[g] expected")
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	repl := parts[1]
+	switch parts[2] {
+	case "g":
+		return func(num string) (string, bool) {
+			if !re.MatchString(num) {
+				return num, false
+			}
+			return re.ReplaceAllString(num, repl), true
+		}, nil
+	case "":
+		return func(num string) (string, bool) {
+			loc := re.FindStringSubmatchIndex(num)
+			if loc == nil {
+				return num, false
+			}
+			res := re.ExpandString(nil, repl, num, loc)
+			return num[:loc[0]] + string(res) + num[loc[1]:], true
+		}, nil
+	}
+	return nil, errors.New("unknown regexp modifier '" + parts[2] + "'")
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normaliseE164 converts a number in national, international or E.164
+// format into the "+<cc><nsn>" form. The visual separators are removed.
+// The number is returned intact when it does not look like a phone number.
+func normaliseE164(num, cc, nat_prefix, intl_prefix string) (string, bool) {
+	digits := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, num)
+	plus := strings.HasPrefix(digits, "+")
+	if plus {
+		digits = digits[1:]
+	}
+	if !isDigits(digits) {
+		return num, false
+	}
+	switch {
+	case plus:
+	case intl_prefix != "" && strings.HasPrefix(digits, intl_prefix):
+		digits = digits[len(intl_prefix):]
+	case nat_prefix != "" && strings.HasPrefix(digits, nat_prefix):
+		digits = cc + digits[len(nat_prefix):]
+	default:
+		digits = cc + digits
+	}
+	return "+" + digits, true
+}
+
+// e164ToNational converts the "+<cc><nsn>" number into the form that
+// would be dialled in the country <cc>.
+func e164ToNational(num, cc, nat_prefix, intl_prefix string) (string, bool) {
+	if !strings.HasPrefix(num, "+") || !isDigits(num[1:]) {
+		return num, false
+	}
+	if strings.HasPrefix(num[1:], cc) {
+		return nat_prefix + num[1+len(cc):], true
+	}
+	return intl_prefix + num[1:], true
+}
+
+// Apply runs the number through the rules of the set that are
+// applicable to the target ("cld" or "cli").
+func (s *numberTranslator) Apply(set, target, num string, ctx *trContext) string {
+	if s == nil {
+		return num
+	}
+	for _, rule := range s.sets[set] {
+		if rule.target != target {
+			continue
+		}
+		matched := true
+		for _, cond := range rule.conds {
+			if !cond.matches(ctx) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if num, matched = rule.action(num); matched && rule.last {
+			break
+		}
+	}
+	return num
+}
+
+// HeaderNames returns the lowercase names of the headers that are
+// referenced by the header= conditions.
+func (s *numberTranslator) HeaderNames() []string {
+	if s == nil {
+		return nil
+	}
+	return s.hf_names
+}
+
+// translationEngine holds the current translation rules and allows
+// them to be replaced atomically.
+type translationEngine struct {
+	fname      string
+	translator *numberTranslator
+	lock       sync.RWMutex
+}
+
+func NewTranslationEngine(fname string) (*translationEngine, error) {
+	translator, err := NewNumberTranslator(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &translationEngine{
+		fname:      fname,
+		translator: translator,
+	}, nil
+}
+
+func (s *translationEngine) Get() *numberTranslator {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.translator
+}
+
+func (s *translationEngine) Reload() error {
+	commit, err := s.PrepareReload()
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload parses the translation rules, they take effect once the
+// returned function is called.
+func (s *translationEngine) PrepareReload() (func(), error) {
+	translator, err := NewNumberTranslator(s.fname)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		s.lock.Lock()
+		s.translator = translator
+		s.lock.Unlock()
+	}, nil
+}
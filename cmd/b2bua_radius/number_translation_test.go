@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormaliseE164(t *testing.T) {
+	tests := []struct {
+		num, cc, nat_prefix, intl_prefix string
+		want                             string
+		ok                               bool
+	}{
+		{"02071234567", "44", "0", "00", "+442071234567", true},
+		{"2071234567", "44", "0", "00", "+442071234567", true},
+		{"0033 1 23 45 67 89", "44", "0", "00", "+33123456789", true},
+		{"+1 (415) 555-1234", "44", "0", "00", "+14155551234", true},
+		{"14155551234", "1", "1", "011", "+14155551234", true},
+		{"01133123456789", "1", "1", "011", "+33123456789", true},
+		{"anonymous", "1", "1", "011", "anonymous", false},
+	}
+	for _, tt := range tests {
+		res, ok := normaliseE164(tt.num, tt.cc, tt.nat_prefix, tt.intl_prefix)
+		if res != tt.want || ok != tt.ok {
+			t.Errorf("normaliseE164(%s, %s) = %s, %v (want %s, %v)", tt.num, tt.cc, res, ok, tt.want, tt.ok)
+		}
+	}
+	res, ok := e164ToNational("+442071234567", "44", "0", "00")
+	if res != "02071234567" || !ok {
+		t.Errorf("e164ToNational() = %s, %v (want 02071234567, true)", res, ok)
+	}
+	res, ok = e164ToNational("+33123456789", "44", "0", "00")
+	if res != "0033123456789" || !ok {
+		t.Errorf("e164ToNational() = %s, %v (want 0033123456789, true)", res, ok)
+	}
+}
+
+func TestNumberTranslator(t *testing.T) {
+	rules := `# test rules
+in   cld  s/^nat-//
+in   cld  s|^00|+|
+in   cli  e164:44                   src=10.0.0.0/8
+out  cld  s/([0-9])([0-9])/$2$1/g   route=gw1.example.com
+out  cli  set:anonymous             header=Privacy last
+out  cli  add:+
+gw2  cld  prefix:+44:0
+gw2  cld  strip:1                   !header=X-Keep
+`
+	fname := filepath.Join(t.TempDir(), "tr.rules")
+	if err := os.WriteFile(fname, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewNumberTranslator(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.HeaderNames()) != 2 {
+		t.Errorf("Bad header names: %v (want privacy, x-keep)", tr.HeaderNames())
+	}
+	ctx_int := &trContext{source: net.ParseIP("10.1.2.3")}
+	ctx_ext := &trContext{source: net.ParseIP("192.168.1.1")}
+	tests := []struct {
+		set, target, num string
+		ctx              *trContext
+		want             string
+	}{
+		{TR_SET_IN, "cld", "nat-0044123", ctx_ext, "+44123"},
+		{TR_SET_IN, "cli", "0207123", ctx_int, "+44207123"},
+		{TR_SET_IN, "cli", "0207123", ctx_ext, "0207123"},
+		{TR_SET_OUT, "cld", "1234", &trContext{route: "GW1.example.com"}, "2143"},
+		{TR_SET_OUT, "cld", "1234", &trContext{route: "gw2.example.com"}, "1234"},
+		{TR_SET_OUT, "cli", "123", &trContext{headers: map[string]bool{"privacy": true}}, "anonymous"},
+		{TR_SET_OUT, "cli", "123", &trContext{}, "+123"},
+		{"gw2", "cld", "+44123", &trContext{}, "123"},
+		{"gw2", "cld", "+44123", &trContext{headers: map[string]bool{"x-keep": true}}, "0123"},
+		{"nosuchset", "cld", "123", &trContext{}, "123"},
+	}
+	for _, tt := range tests {
+		res := tr.Apply(tt.set, tt.target, tt.num, tt.ctx)
+		if res != tt.want {
+			t.Errorf("Apply(%s, %s, %s) = %s (want %s)", tt.set, tt.target, tt.num, res, tt.want)
+		}
+	}
+}
+
+func TestNumberTranslatorErrors(t *testing.T) {
+	for _, line := range []string{
+		"in cld",
+		"in foo s/a/b/",
+		"in cld s/a/b",
+		"in cld s/(/b/",
+		"in cld s/a/b/x",
+		"in cld strip:x",
+		"in cld e164:x",
+		"in cld foo:bar",
+		"in cld add:1 src=foo",
+		"in cld add:1 foo=bar",
+	} {
+		if _, _, err := parseTrRule(line); err == nil {
+			t.Errorf("Bad rule '%s' has been accepted", line)
+		}
+	}
+}
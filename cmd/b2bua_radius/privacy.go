@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+)
+
+// The From URI of the anonymous call (RFC 3323 4.1.1.3)
+const (
+	ANONYMOUS_USER = "anonymous"
+	ANONYMOUS_HOST = "anonymous.invalid"
+)
+
+// isTrustedPeer tells whether the host belongs to the trust domain
+// (RFC 3325) so that the P-Asserted-Identity can be accepted from it and
+// sent to it.
+func (p *myConfigParser) isTrustedPeer(host string) bool {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range p.trusted_peers {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// identityUser returns the user part of the asserted identity. Unlike
+// the From the P-Asserted-Identity often contains tel URI which is
+// parsed here regardless of the tel URI conversion settings.
+func identityUser(pai *sippy_header.SipPAssertedIdentity, config sippy_conf.Config) string {
+	if addr, err := pai.GetBody(config); err == nil {
+		return addr.GetUrl().Username
+	}
+	body := pai.StringBody()
+	if start := strings.IndexByte(body, '<'); start != -1 {
+		body = body[start+1:]
+		if end := strings.IndexByte(body, '>'); end != -1 {
+			body = body[:end]
+		}
+	}
+	url, err := sippy_header.ParseURL(strings.TrimSpace(body), true /* relaxedparser */)
+	if err != nil {
+		return ""
+	}
+	return url.Username
+}
+
+// assertedIdentity returns the identity to be asserted towards the
+// trusted peer: the P-Asserted-Identity received from the trust domain
+// or the one built from the CLI of the call otherwise.
+func (s *callController) assertedIdentity(cli, caller_name string) []*sippy_header.SipPAssertedIdentity {
+	if len(s.pais) > 0 {
+		return s.pais
+	}
+	if cli == "" {
+		return nil
+	}
+	url := sippy_header.NewSipURL(cli, s.global_config.GetMyAddress(), nil, false)
+	return []*sippy_header.SipPAssertedIdentity{
+		sippy_header.NewSipPAssertedIdentity(sippy_header.NewSipAddress(caller_name, url)),
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+func TestTrustedPeers(t *testing.T) {
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	for _, s := range []string{"192.0.2.0/24", "2001:db8::1"} {
+		ipnet, err := parseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.trusted_peers = append(config.trusted_peers, ipnet)
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.255", true},
+		{"192.0.3.1", false},
+		{"[2001:db8::1]", true},
+		{"2001:db8::2", false},
+		// The trust domain is defined by the addresses only
+		{"trusted.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if res := config.isTrustedPeer(tt.host); res != tt.want {
+			t.Errorf("isTrustedPeer(%s) = %v (want %v)", tt.host, res, tt.want)
+		}
+	}
+}
+
+func TestIdentityUser(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	tests := []struct {
+		body, want string
+	}{
+		{"<sip:+14155551000@192.0.2.1>", "+14155551000"},
+		{"\"Alice\" <sip:alice@192.0.2.1;user=phone>", "alice"},
+		{"<tel:+14155551000>", "+14155551000"},
+		{"tel:+14155551000", "+14155551000"},
+	}
+	for _, tt := range tests {
+		pai := sippy_header.CreateSipPAssertedIdentity(tt.body)[0].(*sippy_header.SipPAssertedIdentity)
+		if res := identityUser(pai, config); res != tt.want {
+			t.Errorf("identityUser(%s) = %q (want %q)", tt.body, res, tt.want)
+		}
+	}
+}
+
+func TestAssertedIdentity(t *testing.T) {
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	cc := &callController{global_config: config, lock: new(sync.Mutex)}
+	if pais := cc.assertedIdentity("", "Alice"); pais != nil {
+		t.Errorf("The identity has been asserted without CLI: %v", pais)
+	}
+	// The identity is built from the CLI of the call
+	pais := cc.assertedIdentity("14155551000", "Alice")
+	if len(pais) != 1 {
+		t.Fatalf("Bad number of P-Asserted-Identity: %d", len(pais))
+	}
+	addr, err := pais[0].GetBody(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.GetName() != "Alice" || addr.GetUrl().Username != "14155551000" || addr.GetUrl().Host.String() != config.GetMyAddress().String() {
+		t.Errorf("Bad P-Asserted-Identity: %s", pais[0].String())
+	}
+	// The identity received from the trust domain is passed as is
+	for _, hf := range sippy_header.CreateSipPAssertedIdentity("<sip:alice@192.0.2.1>, <tel:+14155551000>") {
+		cc.pais = append(cc.pais, hf.(*sippy_header.SipPAssertedIdentity))
+	}
+	pais = cc.assertedIdentity("14155551000", "Alice")
+	if len(pais) != 2 || identityUser(pais[0], config) != "alice" || identityUser(pais[1], config) != "+14155551000" {
+		t.Errorf("The received identity has not been passed: %v", pais)
+	}
+}
+
+func TestAnonymousFrom(t *testing.T) {
+	// RFC 3323 4.1.1.3
+	url := sippy_header.NewSipURL(ANONYMOUS_USER, sippy_net.NewMyAddress(ANONYMOUS_HOST), nil, false)
+	if res := url.String(); res != "sip:anonymous@anonymous.invalid" {
+		t.Errorf("Bad anonymous URI: %s", res)
+	}
+	// Neither the address nor the port of the B2BUA is revealed on the
+	// wire
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), testSipLogger{})}
+	config.SetSipAddress(config.GetMyAddress())
+	config.SetSipPort(config.GetMyPort())
+	transport := newTestSipTransport()
+	config.SetSipTransportFactory(transport)
+	cmap := &testHmrCallMap{cc: &callController{global_config: config, lock: new(sync.Mutex)}}
+	sip_tm, err := sippy.NewSipTransactionManager(config, cmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sip_tm.Run()
+	defer sip_tm.Shutdown()
+	ua := sippy.NewUA(sip_tm, config, sippy_net.NewHostPort("1.1.1.1", "5060"), cmap, cmap.cc.lock, nil)
+	event, _ := sippy.NewCCEventTry(sippy_header.GenerateSipCallId(config), ANONYMOUS_USER, "0044123", nil, nil, "Anonymous", nil, "")
+	event.SetFromHost(ANONYMOUS_HOST)
+	ua.RecvEvent(event)
+	if res := transport.get(); !strings.HasPrefix(res, "INVITE ") || !strings.Contains(res, "\r\nFrom: Anonymous <sip:anonymous@anonymous.invalid>;tag=") {
+		t.Errorf("Bad From of the anonymous INVITE:\n%s", res)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+)
+
+// How the redirection information is sent on the egress call leg
+const (
+	// Neither Diversion nor History-Info is sent unless listed in the
+	// pass_headers (the default)
+	RDI_NONE = "none"
+	// The headers are passed in whatever form they have been received
+	RDI_PASS = "pass"
+	// The redirection information is always sent as Diversion
+	RDI_DIVERSION = "diversion"
+	// The redirection information is always sent as History-Info
+	RDI_HISTORY_INFO = "history-info"
+)
+
+func checkRdiMode(mode string) error {
+	switch mode {
+	case RDI_NONE, RDI_PASS, RDI_DIVERSION, RDI_HISTORY_INFO:
+		return nil
+	}
+	return errors.New("unknown redirection info mode: " + mode)
+}
+
+// Mapping between the Diversion reasons and the SIP causes (RFC 6044)
+var diversion_reason2cause = map[string]int{
+	"unknown":        404,
+	"user-busy":      486,
+	"no-answer":      408,
+	"unconditional":  302,
+	"deflection":     480,
+	"unavailable":    503,
+	"out-of-service": 503,
+	"time-of-day":    404,
+	"do-not-disturb": 480,
+	"follow-me":      480,
+	"away":           480,
+}
+
+var cause2diversion_reason = map[int]string{
+	302: "unconditional",
+	404: "unknown",
+	408: "no-answer",
+	480: "deflection",
+	486: "user-busy",
+	487: "deflection",
+	503: "unavailable",
+}
+
+// redirection is a single retargeting in the chronological order: the
+// call to the "from" address has been redirected for the "cause".
+type redirection struct {
+	from  *sippy_header.SipAddress
+	cause int
+}
+
+// diversionToRedirections converts the Diversion headers (the most recent
+// one first, each one possibly with the counter parameter) into the list
+// of redirections.
+func diversionToRedirections(diversions []*sippy_header.SipDiversion, config sippy_conf.Config) []*redirection {
+	ret := []*redirection{}
+	for i := len(diversions) - 1; i >= 0; i-- {
+		addr, err := diversions[i].GetBody(config)
+		if err != nil {
+			continue
+		}
+		cause, ok := diversion_reason2cause[strings.ToLower(addr.GetParam("reason"))]
+		if !ok {
+			cause = 404
+		}
+		from := sippy_header.NewSipAddress(addr.GetName(), addr.GetUrl().GetCopy())
+		counter, err := strconv.Atoi(addr.GetParam("counter"))
+		if err != nil || counter < 1 {
+			counter = 1
+		}
+		for ; counter > 0; counter-- {
+			ret = append(ret, &redirection{from: from, cause: cause})
+		}
+	}
+	return ret
+}
+
+// historyInfoToRedirections picks the History-Info entries that the
+// request has been retargeted from. Only the chain leading to the last
+// entry is taken into account.
+func historyInfoToRedirections(hist_infos []*sippy_header.SipHistoryInfo, config sippy_conf.Config) []*redirection {
+	by_index := make(map[string]*sippy_header.SipHistoryInfo)
+	var last *sippy_header.SipHistoryInfo
+	for _, hi := range hist_infos {
+		index, err := hi.GetIndex(config)
+		if err != nil || index == "" {
+			continue
+		}
+		by_index[index] = hi
+		last = hi
+	}
+	ret := []*redirection{}
+	for hi := last; hi != nil; {
+		from_index, _, err := hi.GetTargetedFrom(config)
+		if err != nil || from_index == "" {
+			break
+		}
+		prev, ok := by_index[from_index]
+		if !ok || prev == hi {
+			break
+		}
+		addr, err := prev.GetBody(config)
+		if err != nil {
+			break
+		}
+		cause := 0
+		if reason, _ := prev.GetReason(config); reason != nil {
+			cause, _ = strconv.Atoi(reason.GetCause())
+		}
+		if cause == 0 {
+			// RFC 4458 cause URI parameter of the new target
+			if addr, err := hi.GetBody(config); err == nil {
+				cause = uriCause(addr.GetUrl())
+			}
+		}
+		url := addr.GetUrl().GetCopy()
+		url.DelHeader("Reason")
+		ret = append([]*redirection{{from: sippy_header.NewSipAddress(addr.GetName(), url), cause: cause}}, ret...)
+		delete(by_index, from_index)
+		hi = prev
+	}
+	return ret
+}
+
+func uriCause(url *sippy_header.SipURL) int {
+	for _, p := range append(url.GetParams(), url.GetUserParams()...) {
+		if strings.HasPrefix(p, "cause=") {
+			cause, _ := strconv.Atoi(p[6:])
+			return cause
+		}
+	}
+	return 0
+}
+
+func redirectionsToDiversion(rdis []*redirection) []*sippy_header.SipDiversion {
+	ret := make([]*sippy_header.SipDiversion, 0, len(rdis))
+	for i := len(rdis) - 1; i >= 0; i-- {
+		addr := sippy_header.NewSipAddress(rdis[i].from.GetName(), rdis[i].from.GetUrl().GetCopy())
+		reason, ok := cause2diversion_reason[rdis[i].cause]
+		if !ok {
+			reason = "unknown"
+		}
+		addr.SetParam("reason", reason)
+		addr.SetParam("counter", "1")
+		ret = append(ret, sippy_header.NewSipDiversion(addr))
+	}
+	return ret
+}
+
+// redirectionsToHistoryInfo builds the History-Info chain ending with
+// the current target of the request.
+func redirectionsToHistoryInfo(rdis []*redirection, target *sippy_header.SipAddress, config sippy_conf.Config) []*sippy_header.SipHistoryInfo {
+	if len(rdis) == 0 {
+		return nil
+	}
+	ret := make([]*sippy_header.SipHistoryInfo, 0, len(rdis)+1)
+	index := "1"
+	prev_index := ""
+	for _, rdi := range rdis {
+		addr := sippy_header.NewSipAddress(rdi.from.GetName(), rdi.from.GetUrl().GetCopy())
+		if prev_index != "" {
+			addr.SetParam(sippy_header.HI_MP, prev_index)
+		}
+		hi := sippy_header.NewSipHistoryInfoIndexed(addr, index)
+		if rdi.cause != 0 {
+			hi.SetReason(sippy_header.NewSipReason("SIP", strconv.Itoa(rdi.cause), ""), config)
+		}
+		ret = append(ret, hi)
+		prev_index, index = index, index+".1"
+	}
+	addr := sippy_header.NewSipAddress(target.GetName(), target.GetUrl().GetCopy())
+	addr.SetParam(sippy_header.HI_MP, prev_index)
+	return append(ret, sippy_header.NewSipHistoryInfoIndexed(addr, index))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+)
+
+func TestDiversionToHistoryInfo(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	hfs, _ := sippy.ParseSipHeader("Diversion: <sip:200@b.example.com>;reason=no-answer;counter=1, " +
+		"<sip:100@a.example.com>;reason=user-busy")
+	diversions := []*sippy_header.SipDiversion{}
+	for _, hf := range hfs {
+		diversions = append(diversions, hf.(*sippy_header.SipDiversion))
+	}
+	rdis := diversionToRedirections(diversions, config)
+	if len(rdis) != 2 || rdis[0].cause != 486 || rdis[1].cause != 408 {
+		t.Fatalf("Bad redirections: %v", rdis)
+	}
+	target, _ := sippy_header.ParseSipAddress("<sip:300@c.example.com>", false, config)
+	hist_infos := redirectionsToHistoryInfo(rdis, target, config)
+	if len(hist_infos) != 3 {
+		t.Fatalf("Bad number of History-Info entries: %d", len(hist_infos))
+	}
+	for i, want := range []string{"sip:100@a.example.com", "sip:200@b.example.com", "sip:300@c.example.com"} {
+		if !strings.Contains(hist_infos[i].StringBody(), want) {
+			t.Errorf("Bad History-Info entry %d: %s (want %s)", i, hist_infos[i].StringBody(), want)
+		}
+	}
+
+	// Parse back what has been generated and convert it to the Diversion
+	hist_infos2 := []*sippy_header.SipHistoryInfo{}
+	for _, hi := range hist_infos {
+		hfs, _ = sippy.ParseSipHeader(hi.String())
+		hist_infos2 = append(hist_infos2, hfs[0].(*sippy_header.SipHistoryInfo))
+	}
+	diversions = redirectionsToDiversion(historyInfoToRedirections(hist_infos2, config))
+	if len(diversions) != 2 {
+		t.Fatalf("Bad number of Diversion headers: %d", len(diversions))
+	}
+	for i, want := range []string{"sip:200@b.example.com", "sip:100@a.example.com"} {
+		addr, _ := diversions[i].GetBody(config)
+		if addr.GetUrl().String() != want {
+			t.Errorf("Bad Diversion %d: %s (want %s)", i, addr.GetUrl().String(), want)
+		}
+	}
+	addr, _ := diversions[0].GetBody(config)
+	if addr.GetParam("reason") != "no-answer" {
+		t.Errorf("Bad Diversion reason: %s (want no-answer)", addr.GetParam("reason"))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+// loadRegistrarUsers reads the credentials of the users allowed to
+// register. Every line of the file contains a "username:password" pair,
+// empty lines and lines starting with '#' are ignored.
+func loadRegistrarUsers(fname string) (map[string]string, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		arr := strings.SplitN(line, ":", 2)
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("%s:%d: the line should be in the form username:password", fname, lineno)
+		}
+		users[arr[0]] = arr[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// bindingToRoute builds the route to the registered contact. The call is
+// sent through the Path (RFC 3327) if there is one or to the address the
+// REGISTER has come from if the UA is behind NAT.
+func bindingToRoute(binding *sippy_types.Binding, global_config sippy_conf.Config) (*B2BRoute, error) {
+	url, err := sippy_header.ParseSipURL(binding.Contact, true /* relaxedparser */, global_config)
+	if err != nil {
+		return nil, err
+	}
+	host := url.Host.String()
+	if url.Port != nil {
+		host += ":" + url.Port.String()
+	}
+	route, err := NewB2BRoute(url.Username+"@"+host, global_config)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range binding.Path {
+		for _, hf := range sippy_header.CreateSipRoute(path) {
+			route.path = append(route.path, hf.(*sippy_header.SipRoute))
+		}
+	}
+	if len(route.path) > 0 {
+		r0, err := route.path[0].GetBody(global_config)
+		if err != nil {
+			return nil, errors.New("bad Path: " + err.Error())
+		}
+		route.outbound_proxy = r0.GetUrl().GetAddr(global_config)
+	} else if binding.Received != nil {
+		route.outbound_proxy = binding.Received.GetCopy()
+	}
+	return route, nil
+}
+
+// registeredRoutes returns the routes to the contacts registered for the
+// user in the domain or in any of the registrar domains.
+func (s *CallMap) registeredRoutes(user, domain string) []*B2BRoute {
+	if s.registrar == nil {
+		return nil
+	}
+	bindings := s.registrar.Lookup(sippy.MakeAor(user, domain))
+	for _, d := range s.global_config.registrar_domains {
+		if len(bindings) > 0 {
+			break
+		}
+		bindings = s.registrar.Lookup(sippy.MakeAor(user, d))
+	}
+	routes := []*B2BRoute{}
+	for _, binding := range bindings {
+		route, err := bindingToRoute(binding, s.global_config)
+		if err != nil {
+			s.global_config.ErrorLogger().Error("Cannot route to " + binding.Contact + ": " + err.Error())
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+func TestRegistrarUsers(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(fname, []byte("# users\nalice:secret\nbob:p:w\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadRegistrarUsers(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"] != "secret" || users["bob"] != "p:w" {
+		t.Errorf("Bad users: %v", users)
+	}
+	if err = os.WriteFile(fname, []byte("alice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadRegistrarUsers(fname); err == nil {
+		t.Error("The line without password has been accepted")
+	}
+}
+
+func TestBindingToRoute(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	binding := &sippy_types.Binding{
+		Contact:  "sip:alice@192.168.1.5:5062",
+		Received: sippy_net.NewHostPort("203.0.113.1", "40000"),
+	}
+	route, err := bindingToRoute(binding, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.cld != "alice" || route.hostPort != "192.168.1.5:5062" {
+		t.Errorf("Bad route: %s@%s", route.cld, route.hostPort)
+	}
+	if route.outbound_proxy == nil || route.outbound_proxy.String() != "203.0.113.1:40000" {
+		t.Errorf("Bad outbound proxy: %v", route.outbound_proxy)
+	}
+
+	binding.Path = []string{"<sip:10.0.0.1:5070;lr>, <sip:10.0.0.2;lr>"}
+	route, err = bindingToRoute(binding, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(route.path) != 2 {
+		t.Fatalf("Bad number of the Path routes: %d", len(route.path))
+	}
+	if route.outbound_proxy == nil || route.outbound_proxy.String() != "10.0.0.1:5070" {
+		t.Errorf("Bad outbound proxy: %v", route.outbound_proxy)
+	}
+}
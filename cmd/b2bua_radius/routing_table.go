@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Routing table file format. Empty lines and lines starting with '#' are
+ * ignored. Every other line is an entry in the form
+ *
+ *     <cld_prefix> <b2broute> [cli=<regexp>] [time=HH:MM-HH:MM] [days=<list>] [prio=N] [weight=N]
+ *
+ * The <cld_prefix> of "*" matches any CLD. The <b2broute> has the same
+ * syntax as the -static_route option. The days list is a comma-separated
+ * list of week days or day ranges, i.e. "mon-fri,sun". Several entries
+ * may share the same prefix, the entries with lower prio value are tried
+ * first and the entries with the same prio are shuffled according to
+ * their weights on each lookup.
+ *
+ * Example:
+ *
+ *     # prefix  route                                    options
+ *     1415      gw1.example.com;credit-time=3600         prio=1 weight=70
+ *     1415      gw2.example.com;credit-time=3600         prio=1 weight=30
+ *     1415      gw3.example.com                          prio=2 time=08:00-20:00 days=mon-fri
+ *     *         @reject.example.com                      cli=^anonymous$
+ */
+
+type routingEntry struct {
+	route    *B2BRoute
+	sroute   string
+	cli_re   *regexp.Regexp
+	tod_from int // minutes since midnight, -1 if any time
+	tod_to   int
+	days     map[time.Weekday]bool
+	prio     int
+	weight   int
+}
+
+func (s *routingEntry) matches(cli string, now time.Time) bool {
+	if s.cli_re != nil && !s.cli_re.MatchString(cli) {
+		return false
+	}
+	if s.days != nil && !s.days[now.Weekday()] {
+		return false
+	}
+	if s.tod_from >= 0 {
+		m := now.Hour()*60 + now.Minute()
+		if s.tod_from <= s.tod_to {
+			if m < s.tod_from || m >= s.tod_to {
+				return false
+			}
+		} else if m < s.tod_from && m >= s.tod_to {
+			// the range wraps around midnight
+			return false
+		}
+	}
+	return true
+}
+
+type routingTable struct {
+	fname   string
+	entries map[string][]*routingEntry
+	maxlen  int
+	nroutes int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func NewRoutingTable(fname string, global_config *myConfigParser) (*routingTable, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	s := &routingTable{
+		fname:   fname,
+		entries: make(map[string][]*routingEntry),
+	}
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		prefix, entry, err := parseRoutingEntry(line, global_config)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, lineno, err.Error())
+		}
+		s.entries[prefix] = append(s.entries[prefix], entry)
+		if len(prefix) > s.maxlen {
+			s.maxlen = len(prefix)
+		}
+		s.nroutes++
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, entries := range s.entries {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].prio < entries[j].prio })
+	}
+	return s, nil
+}
+
+func parseRoutingEntry(line string, global_config *myConfigParser) (string, *routingEntry, error) {
+	var err error
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", nil, errors.New("the CLD prefix and the route are expected")
+	}
+	prefix := fields[0]
+	if prefix == "*" {
+		prefix = ""
+	}
+	entry := &routingEntry{
+		sroute:   fields[1],
+		tod_from: -1,
+		tod_to:   -1,
+		weight:   1,
+	}
+	entry.route, err = NewB2BRoute(entry.sroute, global_config)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, opt := range fields[2:] {
+		av := strings.SplitN(opt, "=", 2)
+		if len(av) != 2 {
+			return "", nil, errors.New("bad option '" + opt + "'")
+		}
+		switch av[0] {
+		case "cli":
+			entry.cli_re, err = regexp.Compile(av[1])
+			if err != nil {
+				return "", nil, errors.New("Error parsing cli '" + av[1] + "': " + err.Error())
+			}
+		case "time":
+			entry.tod_from, entry.tod_to, err = parseTimeRange(av[1])
+			if err != nil {
+				return "", nil, errors.New("Error parsing time '" + av[1] + "': " + err.Error())
+			}
+		case "days":
+			entry.days, err = parseDays(av[1])
+			if err != nil {
+				return "", nil, errors.New("Error parsing days '" + av[1] + "': " + err.Error())
+			}
+		case "prio":
+			entry.prio, err = strconv.Atoi(av[1])
+			if err != nil {
+				return "", nil, errors.New("Error parsing prio '" + av[1] + "': " + err.Error())
+			}
+		case "weight":
+			entry.weight, err = strconv.Atoi(av[1])
+			if err != nil {
+				return "", nil, errors.New("Error parsing weight '" + av[1] + "': " + err.Error())
+			}
+			if entry.weight <= 0 {
+				return "", nil, errors.New("weight should be more than zero")
+			}
+		default:
+			return "", nil, errors.New("unknown option '" + av[0] + "'")
+		}
+	}
+	return prefix, entry, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	hm := strings.SplitN(s, ":", 2)
+	if len(hm) != 2 {
+		return 0, errors.New("HH:MM expected")
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.New("time is out of range")
+	}
+	return h*60 + m, nil
+}
+
+func parseTimeRange(s string) (int, int, error) {
+	ft := strings.SplitN(s, "-", 2)
+	if len(ft) != 2 {
+		return 0, 0, errors.New("HH:MM-HH:MM expected")
+	}
+	from, err := parseTimeOfDay(ft[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseTimeOfDay(ft[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+func parseDays(s string) (map[time.Weekday]bool, error) {
+	ret := make(map[time.Weekday]bool)
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		fl := strings.SplitN(item, "-", 2)
+		first, ok := weekdays[fl[0]]
+		if !ok {
+			return nil, errors.New("unknown day '" + fl[0] + "'")
+		}
+		last := first
+		if len(fl) == 2 {
+			if last, ok = weekdays[fl[1]]; !ok {
+				return nil, errors.New("unknown day '" + fl[1] + "'")
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			ret[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Lookup finds the longest CLD prefix that has at least one entry
+// matching the CLI and the time of the call and returns the copies
+// of the routes in the order they should be tried.
+func (s *routingTable) Lookup(cld, cli string, now time.Time) []*B2BRoute {
+	plen := s.maxlen
+	if plen > len(cld) {
+		plen = len(cld)
+	}
+	for ; plen >= 0; plen-- {
+		entries, ok := s.entries[cld[:plen]]
+		if !ok {
+			continue
+		}
+		matched := make([]*routingEntry, 0, len(entries))
+		for _, entry := range entries {
+			if entry.matches(cli, now) {
+				matched = append(matched, entry)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		return weightedOrder(matched)
+	}
+	return nil
+}
+
+// weightedOrder shuffles the entries of the same priority so that the
+// probability of an entry to be tried first is proportional to its weight.
+func weightedOrder(entries []*routingEntry) []*B2BRoute {
+	keys := make([]float64, len(entries))
+	for i, entry := range entries {
+		keys[i] = -math.Log(1-rand.Float64()) / float64(entry.weight)
+	}
+	idx := make([]int, len(entries))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		ei, ej := entries[idx[i]], entries[idx[j]]
+		if ei.prio != ej.prio {
+			return ei.prio < ej.prio
+		}
+		return keys[idx[i]] < keys[idx[j]]
+	})
+	ret := make([]*B2BRoute, len(idx))
+	for i, n := range idx {
+		ret[i] = entries[n].route.getCopy()
+	}
+	return ret
+}
+
+// routingEngine holds the current routing table and allows it to be
+// replaced atomically. The calls that are already in progress keep
+// their own copies of the routes and are not affected by the reload.
+type routingEngine struct {
+	global_config *myConfigParser
+	fname         string
+	table         *routingTable
+	lock          sync.RWMutex
+}
+
+func NewRoutingEngine(fname string, global_config *myConfigParser) (*routingEngine, error) {
+	table, err := NewRoutingTable(fname, global_config)
+	if err != nil {
+		return nil, err
+	}
+	return &routingEngine{
+		global_config: global_config,
+		fname:         fname,
+		table:         table,
+	}, nil
+}
+
+func (s *routingEngine) Lookup(cld, cli string) []*B2BRoute {
+	s.lock.RLock()
+	table := s.table
+	s.lock.RUnlock()
+	return table.Lookup(cld, cli, time.Now())
+}
+
+// Reload re-reads the routing table file. The old table remains
+// active when the new one cannot be loaded.
+func (s *routingEngine) Reload() error {
+	commit, err := s.PrepareReload()
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload reads the routing table file, the returned function makes
+// the new table active.
+func (s *routingEngine) PrepareReload() (func(), error) {
+	table, err := NewRoutingTable(s.fname, s.global_config)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		s.lock.Lock()
+		s.table = table
+		s.lock.Unlock()
+	}, nil
+}
+
+func (s *routingEngine) String() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return fmt.Sprintf("%s: %d prefixes, %d routes", s.fname, len(s.table.entries), s.table.nroutes)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+)
+
+func routeHosts(routes []*B2BRoute) string {
+	hosts := make([]string, len(routes))
+	for i, route := range routes {
+		hosts[i] = route.hostPort
+	}
+	return strings.Join(hosts, ",")
+}
+
+func TestRoutingTable(t *testing.T) {
+	table := `# test table
+1415      192.0.2.1   prio=1
+1415      192.0.2.2   prio=0
+14155     192.0.2.3   cli=^1650
+14155     192.0.2.4   time=22:00-06:00
+1416      192.0.2.5   time=08:00-20:00 days=mon-fri
+1416      192.0.2.6   days=sat-sun
+*         192.0.2.9
+`
+	fname := filepath.Join(t.TempDir(), "routes")
+	if err := os.WriteFile(fname, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	rt, err := NewRoutingTable(fname, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2021-03-03 is Wednesday, 2021-03-06 is Saturday
+	wed_noon := time.Date(2021, 3, 3, 12, 0, 0, 0, time.Local)
+	wed_night := time.Date(2021, 3, 3, 23, 30, 0, 0, time.Local)
+	thu_early := time.Date(2021, 3, 4, 5, 59, 0, 0, time.Local)
+	thu_six := time.Date(2021, 3, 4, 6, 0, 0, 0, time.Local)
+	sat_noon := time.Date(2021, 3, 6, 12, 0, 0, 0, time.Local)
+	wed_late := time.Date(2021, 3, 3, 20, 0, 0, 0, time.Local)
+	tests := []struct {
+		cld, cli string
+		now      time.Time
+		want     string
+	}{
+		// The entries of the same prefix are ordered by prio
+		{"14151234", "100", wed_noon, "192.0.2.2,192.0.2.1"},
+		// The longest prefix with the matching entry wins
+		{"14155123", "16501234", wed_noon, "192.0.2.3"},
+		{"14155123", "100", wed_noon, "192.0.2.2,192.0.2.1"},
+		// The time window wraps around midnight
+		{"14155123", "100", wed_night, "192.0.2.4"},
+		{"14155123", "100", thu_early, "192.0.2.4"},
+		{"14155123", "100", thu_six, "192.0.2.2,192.0.2.1"},
+		{"14161234", "100", wed_noon, "192.0.2.5"},
+		{"14161234", "100", wed_late, "192.0.2.9"},
+		{"14161234", "100", sat_noon, "192.0.2.6"},
+		{"", "100", wed_noon, "192.0.2.9"},
+		{"999", "100", wed_noon, "192.0.2.9"},
+	}
+	for _, tt := range tests {
+		if res := routeHosts(rt.Lookup(tt.cld, tt.cli, tt.now)); res != tt.want {
+			t.Errorf("Lookup(%s, %s, %s) = %s (want %s)", tt.cld, tt.cli, tt.now.Format("Mon 15:04"), res, tt.want)
+		}
+	}
+	// The routes returned are copies
+	routes := rt.Lookup("14155123", "16501234", wed_noon)
+	routes[0].hostPort = "192.0.2.99"
+	if res := routeHosts(rt.Lookup("14155123", "16501234", wed_noon)); res != "192.0.2.3" {
+		t.Errorf("The route in the table has been modified: %s", res)
+	}
+}
+
+func TestRoutingTableWeights(t *testing.T) {
+	table := `1415  192.0.2.1  weight=90
+1415  192.0.2.2  weight=10
+1415  192.0.2.3  prio=1 weight=1000
+`
+	fname := filepath.Join(t.TempDir(), "routes")
+	if err := os.WriteFile(fname, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	rt, err := NewRoutingTable(fname, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		routes := rt.Lookup("1415", "", now)
+		if len(routes) != 3 || routes[2].hostPort != "192.0.2.3" {
+			t.Fatalf("The weight has overridden the prio: %s", routeHosts(routes))
+		}
+		first[routes[0].hostPort]++
+	}
+	// 90% expected, the bounds are far enough to never fail in practice
+	if first["192.0.2.1"] < 800 || first["192.0.2.1"] > 970 {
+		t.Errorf("Bad distribution of the first route: %v", first)
+	}
+}
+
+func TestRoutingEngineReload(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "routes")
+	if err := os.WriteFile(fname, []byte("*  192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	re, err := NewRoutingEngine(fname, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range []string{
+		"1415\n",
+		"1415 192.0.2.2 cli=(\n",
+		"1415 192.0.2.2 time=25:00-26:00\n",
+		"1415 192.0.2.2 time=08:00\n",
+		"1415 192.0.2.2 days=mon-xyz\n",
+		"1415 192.0.2.2 prio=x\n",
+		"1415 192.0.2.2 weight=0\n",
+		"1415 192.0.2.2 foo=bar\n",
+		"1415 192.0.2.2 cli\n",
+	} {
+		if err = os.WriteFile(fname, []byte(buf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = re.Reload(); err == nil {
+			t.Errorf("Bad table %q has been accepted", buf)
+		}
+	}
+	// The old table remains active
+	if res := routeHosts(re.Lookup("1415", "")); res != "192.0.2.1" {
+		t.Errorf("The table has been lost on failed reload: %s", res)
+	}
+	if err = os.WriteFile(fname, []byte("1415  192.0.2.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = re.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if res := routeHosts(re.Lookup("1415", "")); res != "192.0.2.2" {
+		t.Errorf("The table has not been reloaded: %s", res)
+	}
+	if res := routeHosts(re.Lookup("999", "")); res != "" {
+		t.Errorf("The route of the old table is still in use: %s", res)
+	}
+}
+
+func TestReloadTables(t *testing.T) {
+	dir := t.TempDir()
+	routes := filepath.Join(dir, "routes")
+	rules := filepath.Join(dir, "tr.rules")
+	if err := os.WriteFile(routes, []byte("*  192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rules, []byte("in  cld  s/^nat-//\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &myConfigParser{Config: sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)}
+	cmap := &CallMap{global_config: config}
+	var err error
+	if cmap.routing, err = NewRoutingEngine(routes, config); err != nil {
+		t.Fatal(err)
+	}
+	if cmap.translation, err = NewTranslationEngine(rules); err != nil {
+		t.Fatal(err)
+	}
+	// The good routing table is not put in place while the rules are bad
+	if err = os.WriteFile(routes, []byte("*  192.0.2.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(rules, []byte("in  cld  s/(//\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = cmap.reloadTables(0); err == nil {
+		t.Fatal("The bad rules have been accepted")
+	}
+	if res := routeHosts(cmap.routing.Lookup("1415", "")); res != "192.0.2.1" {
+		t.Errorf("The routing table has been reloaded without the rules: %s", res)
+	}
+	if err = os.WriteFile(rules, []byte("in  cld  s/^nat-//\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = cmap.reloadTables(0); err != nil {
+		t.Fatal(err)
+	}
+	if res := routeHosts(cmap.routing.Lookup("1415", "")); res != "192.0.2.2" {
+		t.Errorf("The routing table has not been reloaded: %s", res)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+)
+
+const th_iv_size = aes.BlockSize
+
+// Header fields that reveal the addresses, the software or the internal
+// structure of the network on the other side of the B2BUA. They are never
+// passed between the call legs in the topology hiding mode even if listed
+// in the pass_headers.
+var th_default_strip = []string{
+	"via", "record-route", "route", "path", "contact", "server",
+	"user-agent", "warning", "p-charging-vector",
+	"p-visited-network-id", "x-b2b-loop",
+}
+
+// topologyHiding replaces the Call-ID of the egress call leg with the
+// value that is encrypted using the configured key. The encryption is
+// deterministic and authenticated, so that the original Call-ID can be
+// recovered from the logs of the both sides with the "th" command even
+// after the call has ended. The tags are generated by each call leg
+// independently and need no special treatment.
+type topologyHiding struct {
+	enc_key     []byte
+	mac_key     []byte
+	strip_names map[string]bool
+}
+
+func NewTopologyHiding(key string, strip_headers []string) (*topologyHiding, error) {
+	if key == "" {
+		return nil, errors.New("topology hiding key should not be empty")
+	}
+	s := &topologyHiding{
+		enc_key:     thDeriveKey(key, "enc"),
+		mac_key:     thDeriveKey(key, "mac"),
+		strip_names: make(map[string]bool),
+	}
+	for _, name := range th_default_strip {
+		s.strip_names[name] = true
+	}
+	for _, name := range strip_headers {
+		s.strip_names[strings.ToLower(name)] = true
+	}
+	return s, nil
+}
+
+func thDeriveKey(key, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// HideCallId returns the obfuscated Call-ID. The IV is the MAC of the
+// plaintext which makes it a synthetic IV construction: the same Call-ID
+// always gives the same result and the tampered values are detected.
+func (s *topologyHiding) HideCallId(call_id string) string {
+	mac := hmac.New(sha256.New, s.mac_key)
+	mac.Write([]byte(call_id))
+	iv := mac.Sum(nil)[:th_iv_size]
+	buf := make([]byte, th_iv_size+len(call_id))
+	copy(buf, iv)
+	s.stream(iv).XORKeyStream(buf[th_iv_size:], []byte(call_id))
+	return hex.EncodeToString(buf)
+}
+
+// RevealCallId does the reverse of the HideCallId.
+func (s *topologyHiding) RevealCallId(hidden string) (string, error) {
+	buf, err := hex.DecodeString(hidden)
+	if err != nil || len(buf) <= th_iv_size {
+		return "", errors.New("not a hidden Call-ID: " + hidden)
+	}
+	iv := buf[:th_iv_size]
+	plain := make([]byte, len(buf)-th_iv_size)
+	s.stream(iv).XORKeyStream(plain, buf[th_iv_size:])
+	mac := hmac.New(sha256.New, s.mac_key)
+	mac.Write(plain)
+	if !hmac.Equal(mac.Sum(nil)[:th_iv_size], iv) {
+		return "", errors.New("the Call-ID has not been hidden with this key: " + hidden)
+	}
+	return string(plain), nil
+}
+
+func (s *topologyHiding) stream(iv []byte) cipher.Stream {
+	// the key length is always valid here
+	block, _ := aes.NewCipher(s.enc_key)
+	return cipher.NewCTR(block, iv)
+}
+
+// Scrub drops the headers that should not cross the B2BUA.
+func (s *topologyHiding) Scrub(hfs []sippy_header.SipHeader) []sippy_header.SipHeader {
+	ret := make([]sippy_header.SipHeader, 0, len(hfs))
+	for _, hf := range hfs {
+		if s.strip_names[strings.ToLower(hf.Name())] {
+			continue
+		}
+		ret = append(ret, hf)
+	}
+	return ret
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+)
+
+func TestTopologyHidingCallId(t *testing.T) {
+	th, err := NewTopologyHiding("secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call_id := "a84b4c76e66710@pc33.example.com-b2b_1"
+	hidden := th.HideCallId(call_id)
+	if strings.Contains(hidden, "example") {
+		t.Errorf("The hidden Call-ID reveals the original one: %s", hidden)
+	}
+	if th.HideCallId(call_id) != hidden {
+		t.Error("The Call-ID obfuscation is not deterministic")
+	}
+	orig, err := th.RevealCallId(hidden)
+	if err != nil || orig != call_id {
+		t.Errorf("RevealCallId() = %s, %v (want %s)", orig, err, call_id)
+	}
+	other, _ := NewTopologyHiding("other secret", nil)
+	if _, err = other.RevealCallId(hidden); err == nil {
+		t.Error("The Call-ID has been revealed with a wrong key")
+	}
+	if _, err = th.RevealCallId("foo@bar"); err == nil {
+		t.Error("Not a hidden Call-ID has been revealed")
+	}
+}
+
+func TestTopologyHidingScrub(t *testing.T) {
+	th, _ := NewTopologyHiding("secret", []string{"X-Internal"})
+	hfs := []sippy_header.SipHeader{
+		sippy_header.NewSipGenericHF("Record-Route", "<sip:10.0.0.1;lr>"),
+		sippy_header.NewSipGenericHF("x-internal", "foo"),
+		sippy_header.NewSipGenericHF("X-Account", "123"),
+		sippy_header.NewSipUserAgent("Secret PBX 1.0"),
+	}
+	res := th.Scrub(hfs)
+	if len(res) != 1 || res[0].Name() != "X-Account" {
+		t.Errorf("Bad headers after scrubbing: %v", res)
+	}
+}
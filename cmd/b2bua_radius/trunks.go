@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const DEFAULT_TRUNK_EXPIRES = 3600
+
+/*
+ * Trunks file format. Empty lines and lines starting with '#' are
+ * ignored. Every other line defines the trunk the B2BUA registers to:
+ *
+ *     <name> <aor> [registrar=<host[:port]>] [auth=<user>:<password>]
+ *                  [expires=<seconds>] [contact=<user>]
+ *
+ * The REGISTER is sent to the domain of the AOR unless the registrar is
+ * given. The user part of the Contact is the one of the AOR by default.
+ * The route parameter "trunk=<name>" makes the route to be skipped while
+ * the trunk is not registered and the INVITE to be authenticated with
+ * the credentials of the trunk.
+ *
+ * Example:
+ *
+ *     gw1  sip:12345@sip.example.com  auth=12345:secret  expires=600
+ */
+
+type trunk struct {
+	name  string
+	aor   *sippy_header.SipURL
+	user  string
+	passw string
+	agent sippy_types.RegistrationAgent
+}
+
+type trunks struct {
+	list   []*trunk
+	byname map[string]*trunk
+}
+
+func NewTrunks(fname string, sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config) (*trunks, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	s := &trunks{
+		byname: make(map[string]*trunk),
+	}
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		t, err := parseTrunk(line, sip_tm, config)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, lineno, err.Error())
+		}
+		if _, ok := s.byname[t.name]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate trunk %s", fname, lineno, t.name)
+		}
+		s.list = append(s.list, t)
+		s.byname[t.name] = t
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseTrunk(line string, sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config) (*trunk, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("the trunk name and AOR are expected")
+	}
+	aor, err := sippy_header.ParseSipURL(fields[1], false /* relaxedparser */, config)
+	if err != nil {
+		return nil, errors.New("bad AOR " + fields[1] + ": " + err.Error())
+	}
+	t := &trunk{
+		name: fields[0],
+		aor:  aor,
+	}
+	var target *sippy_net.HostPort
+	expires := DEFAULT_TRUNK_EXPIRES
+	contact_user := aor.Username
+	for _, param := range fields[2:] {
+		av := strings.SplitN(param, "=", 2)
+		if len(av) != 2 {
+			return nil, errors.New("bad parameter " + param)
+		}
+		switch av[0] {
+		case "registrar":
+			host_port := strings.SplitN(av[1], ":", 2)
+			if len(host_port) == 1 {
+				target = sippy_net.NewHostPort(av[1], "5060")
+			} else {
+				target = sippy_net.NewHostPort(host_port[0], host_port[1])
+			}
+		case "auth":
+			tmp := strings.SplitN(av[1], ":", 2)
+			if len(tmp) != 2 {
+				return nil, errors.New("bad auth (no colon) " + av[1])
+			}
+			t.user, t.passw = tmp[0], tmp[1]
+		case "expires":
+			if expires, err = strconv.Atoi(av[1]); err != nil || expires <= 0 {
+				return nil, errors.New("bad expires " + av[1])
+			}
+		case "contact":
+			contact_user = av[1]
+		default:
+			return nil, errors.New("unknown parameter " + av[0])
+		}
+	}
+	contact := sippy_header.NewSipURL(contact_user, config.GetMyAddress(), config.GetMyPort(), false)
+	t.agent = sippy.NewSipRegistrationAgent(sip_tm, config, aor, contact, target, t.user, t.passw,
+		time.Duration(expires)*time.Second)
+	return t, nil
+}
+
+func (s *trunks) Get(name string) *trunk {
+	if s == nil {
+		return nil
+	}
+	return s.byname[name]
+}
+
+func (s *trunks) Start() {
+	for _, t := range s.list {
+		t.agent.Start()
+	}
+}
+
+// Stop unregisters all trunks
+func (s *trunks) Stop() {
+	if s == nil {
+		return
+	}
+	for _, t := range s.list {
+		t.agent.Stop()
+	}
+}
+
+func (s *trunks) String() string {
+	res := ""
+	now := time.Now()
+	for _, t := range s.list {
+		state, expires_at, last_error := t.agent.GetStatus()
+		res += fmt.Sprintf("%s: %s %s", t.name, t.aor.String(), state)
+		if state == sippy.REG_STATE_REGISTERED {
+			res += fmt.Sprintf(" (expires in %d)", int(expires_at.Sub(now).Seconds()))
+		}
+		if last_error != "" {
+			res += " last error: " + last_error
+		}
+		res += "\n"
+	}
+	return res + fmt.Sprintf("Total: %d\n", len(s.list))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+)
+
+func TestTrunks(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	fname := filepath.Join(t.TempDir(), "trunks")
+	conf := `# test trunks
+gw1  sip:12345@127.0.0.1  auth=12345:secret  expires=600
+gw2  sip:777@127.0.0.2    registrar=127.0.0.3:5070
+`
+	if err := os.WriteFile(fname, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	trs, err := NewTrunks(fname, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw1 := trs.Get("gw1")
+	if gw1 == nil || gw1.user != "12345" || gw1.passw != "secret" {
+		t.Fatalf("Bad trunk gw1: %v", gw1)
+	}
+	if trs.Get("gw3") != nil {
+		t.Error("Non-existent trunk found")
+	}
+	if gw1.agent.IsRegistered() {
+		t.Error("The trunk is registered before it is started")
+	}
+	if !strings.Contains(trs.String(), "gw2: sip:777@127.0.0.2 idle") {
+		t.Errorf("Bad status: %s", trs.String())
+	}
+
+	for _, bad := range []string{"gw1", "gw1 sip:1@127.0.0.1 expires=0", "gw1 sip:1@127.0.0.1 foo=bar"} {
+		if err = os.WriteFile(fname, []byte(bad+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = NewTrunks(fname, nil, config); err == nil {
+			t.Errorf("Bad trunk definition accepted: %s", bad)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"sync"
-	"time"
 
 	"github.com/egovorukhin/go-b2bua/sippy"
 	"github.com/egovorukhin/go-b2bua/sippy/headers"
@@ -31,7 +30,11 @@ func NewCallController(cmap *callMap, identity_hf sippy_header.SipHeader, date_h
 		identity_hf: identity_hf,
 		date_hf:     date_hf,
 	}
-	s.uaA = sippy.NewUA(cmap.Sip_tm, cmap.config, cmap.config.Nh_addr, s, s.lock, nil)
+	if cmap.Auth != nil {
+		s.uaA = newAuthUA(cmap.Auth, s)
+	} else {
+		s.uaA = sippy.NewUA(cmap.Sip_tm, cmap.config, cmap.config.Nh_addr, s, s.lock, nil)
+	}
 	s.uaA.SetDeadCb(s.aDead)
 	//s.uaA.SetCreditTime(5 * time.Second)
 	return s
@@ -44,7 +47,7 @@ func (s *callController) Error(msg string) {
 func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA) {
 	if ua == s.uaA {
 		if s.uaO == nil {
-			ev_try, ok := event.(*sippy.CCEventTry)
+			_, ok := event.(*sippy.CCEventTry)
 			if !ok {
 				s.uaA.RecvEvent(sippy.NewCCEventDisconnect(nil, event.GetRtime(), ""))
 				return
@@ -56,21 +59,6 @@ func (s *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 				s.uaO.SetUsername(s.cmap.config.Authname_out)
 				s.uaO.SetPassword(s.cmap.config.Passwd_out)
 			}
-			if s.cmap.config.Authname_in != "" {
-				entity_body := ""
-				if body := ev_try.GetBody(); body != nil {
-					entity_body = body.String()
-				}
-				sip_auth := ev_try.GetSipAuthorizationBody()
-				if sip_auth == nil {
-					www_auth := sippy_header.NewSipWWWAuthenticateWithRealm("myrealm", s.cmap.config.Hash_alg, time.Now())
-					s.uaA.RecvEvent(sippy.NewCCEventFail(401, "Unauthorized", nil, "", www_auth))
-					return
-				} else if sip_auth.GetUsername() == "" || !sip_auth.Verify(s.cmap.config.Passwd_in, "INVITE", entity_body) {
-					s.uaA.RecvEvent(sippy.NewCCEventFail(401, "Unauthorized", nil, ""))
-					return
-				}
-			}
 		}
 		s.uaO.RecvEvent(event)
 	} else {
@@ -90,6 +78,31 @@ func (s *callController) Shutdown() {
 	s.uaA.Disconnect(nil, "")
 }
 
+// authUA challenges the BYE requests received from the caller. The
+// initial INVITE is authenticated by the call map before the call
+// controller is created.
+type authUA struct {
+	*sippy.Ua
+	auth sippy_types.DigestAuth
+}
+
+func newAuthUA(auth sippy_types.DigestAuth, cc *callController) *authUA {
+	s := &authUA{
+		auth: auth,
+	}
+	s.Ua = sippy.NewUA(cc.cmap.Sip_tm, cc.cmap.config, cc.cmap.config.Nh_addr, cc, cc.lock, s)
+	return s
+}
+
+func (s *authUA) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.UaContext {
+	if req.GetMethod() == "BYE" {
+		if _, resp := s.auth.Authenticate(req); resp != nil {
+			return &sippy_types.UaContext{Response: resp}
+		}
+	}
+	return s.Ua.RecvRequest(req, t)
+}
+
 func (s *callController) String() string {
 	res := "uaA:" + s.uaA.String() + ", uaO: "
 	if s.uaO == nil {
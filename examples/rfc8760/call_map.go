@@ -39,6 +39,7 @@ type callMap struct {
 	logger     sippy_log.ErrorLogger
 	Sip_tm     sippy_types.SipTransactionManager
 	Proxy      sippy_types.StatefulProxy
+	Auth       sippy_types.DigestAuth
 	ccmap      map[int64]*callController
 	ccmap_lock sync.Mutex
 }
@@ -67,6 +68,11 @@ func (s *callMap) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerT
 		// Request within dialog, but no such dialog
 		return nil, nil, req.GenResponse(481, "Call Leg/Transaction Does Not Exist", nil, nil)
 	}
+	if s.Auth != nil && (req.GetMethod() == "INVITE" || req.GetMethod() == "REGISTER") {
+		if _, resp := s.Auth.Authenticate(req); resp != nil {
+			return nil, nil, resp
+		}
+	}
 	if req.GetMethod() == "INVITE" {
 		// New dialog
 		identity_hf := req.GetFirstHF("identity")
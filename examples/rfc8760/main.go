@@ -42,6 +42,8 @@ import (
 	"github.com/egovorukhin/go-b2bua/sippy"
 	"github.com/egovorukhin/go-b2bua/sippy/log"
 	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
 )
 
 func init() {
@@ -67,7 +69,8 @@ func main() {
 
 	var laddr, nh_addr, logfile string
 	var lport int
-	var authname_in, authname_out, passwd_in, passwd_out, hash_alg string
+	var authname_in, authname_out, passwd_in, passwd_out, hash_alg, users_file, realm, qop, nonce_keys string
+	var proxy_auth bool
 
 	flag.StringVar(&laddr, "l", "", "Local addr")
 	flag.IntVar(&lport, "p", 5060, "Local port")
@@ -77,7 +80,13 @@ func main() {
 	flag.StringVar(&passwd_in, "passwd_in", "", "Expected password")
 	flag.StringVar(&authname_out, "authname_out", "", "Outgoing authname")
 	flag.StringVar(&passwd_out, "passwd_out", "", "Ougoing password")
-	flag.StringVar(&hash_alg, "alg", "MD5", "Hash algorithm")
+	flag.StringVar(&hash_alg, "alg", "MD5", "Comma separated list of hash algorithms, the most preferred first")
+	flag.StringVar(&users_file, "users", "", "File with the credentials of the incoming requests in the htdigest format")
+	flag.StringVar(&realm, "realm", "myrealm", "Realm of the incoming requests")
+	flag.StringVar(&qop, "qop", "auth", "Comma separated list of the qop options for the incoming requests")
+	flag.BoolVar(&proxy_auth, "proxy_auth", false, "Challenge the incoming requests with 407 instead of 401")
+	flag.StringVar(&nonce_keys, "nonce_keys", "", "File with the id:hexkey pairs the nonces are encrypted with, "+
+		"the "+sippy_security.NONCE_KEYS_ENV+" environment variable is used if not given")
 	flag.Parse()
 
 	//config.SetIPV6Enabled(false)
@@ -87,12 +96,20 @@ func main() {
 		error_logger.Error(err)
 		return
 	}
+	if err = sippy_security.HashOracle.LoadKeys(nonce_keys); err != nil {
+		error_logger.Error(err)
+		return
+	}
 	config := NewMyConfig(error_logger, sip_logger)
 	config.Authname_in = authname_in
 	config.Authname_out = authname_out
 	config.Passwd_in = passwd_in
 	config.Passwd_out = passwd_out
 	config.Hash_alg = hash_alg
+	config.Users_file = users_file
+	config.Realm = realm
+	config.Qop = qop
+	config.Proxy_auth = proxy_auth
 
 	if nh_addr != "" {
 		var parts []string
@@ -136,6 +153,11 @@ func main() {
 	}
 	cmap.Sip_tm = sip_tm
 	cmap.Proxy = sippy.NewStatefulProxy(sip_tm, config.Nh_addr, config)
+	cmap.Auth, err = newDigestAuth(config)
+	if err != nil {
+		error_logger.Error(err)
+		return
+	}
 	go sip_tm.Run()
 
 	signal_chan := make(chan os.Signal, 1)
@@ -149,3 +171,36 @@ func main() {
 		break
 	}
 }
+
+// newDigestAuth returns nil if the incoming requests are not to be
+// authenticated.
+func newDigestAuth(config *myconfig) (sippy_types.DigestAuth, error) {
+	var store sippy_types.DigestUserStore
+
+	if config.Users_file != "" {
+		file_store, err := sippy.NewDigestFileStore(config.Users_file)
+		if err != nil {
+			return nil, err
+		}
+		store = file_store
+	} else if config.Authname_in != "" {
+		store = sippy.DigestPasswdLookup(func(username string) (string, bool) {
+			return config.Passwd_in, username == config.Authname_in
+		})
+	} else {
+		return nil, nil
+	}
+	auth := sippy.NewDigestAuth(store, config.Realm)
+	auth.SetProxyMode(config.Proxy_auth)
+	if err := auth.SetAlgorithms(strings.Split(config.Hash_alg, ",")); err != nil {
+		return nil, err
+	}
+	qop := []string{}
+	if config.Qop != "" {
+		qop = strings.Split(config.Qop, ",")
+	}
+	if err := auth.SetQop(qop); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
@@ -41,6 +41,10 @@ type myconfig struct {
 	Passwd_in    string
 	Passwd_out   string
 	Hash_alg     string
+	Users_file   string
+	Realm        string
+	Qop          string
+	Proxy_auth   bool
 }
 
 func NewMyConfig(error_logger sippy_log.ErrorLogger, sip_logger sippy_log.SipLogger) *myconfig {
@@ -6,30 +6,30 @@ import (
 
 	"github.com/egovorukhin/go-b2bua/sippy"
 	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/stir_shaken"
 	"github.com/egovorukhin/go-b2bua/sippy/types"
 )
 
 var Next_cc_id chan int64
 
 type CallController struct {
-	uaA         sippy_types.UA
-	uaO         sippy_types.UA
-	lock        *sync.Mutex // this must be a reference to prevent memory leak
-	id          int64
-	cmap        *callMap
-	identity_hf sippy_header.SipHeader
-	date_hf     *sippy_header.SipDate
-	call_id     string
+	uaA     sippy_types.UA
+	uaO     sippy_types.UA
+	lock    *sync.Mutex // this must be a reference to prevent memory leak
+	id      int64
+	cmap    *callMap
+	req     sippy_types.SipRequest
+	call_id string
+	origid  string
 }
 
-func NewCallController(cmap *callMap, identity_hf sippy_header.SipHeader, date_hf *sippy_header.SipDate) *CallController {
+func NewCallController(cmap *callMap, req sippy_types.SipRequest) *CallController {
 	s := &CallController{
-		id:          <-Next_cc_id,
-		uaO:         nil,
-		lock:        new(sync.Mutex),
-		cmap:        cmap,
-		identity_hf: identity_hf,
-		date_hf:     date_hf,
+		id:   <-Next_cc_id,
+		uaO:  nil,
+		lock: new(sync.Mutex),
+		cmap: cmap,
+		req:  req,
 	}
 	s.uaA = sippy.NewUA(cmap.Sip_tm, cmap.config, cmap.config.Nh_addr, s, s.lock, nil)
 	s.uaA.SetDeadCb(s.aDead)
@@ -43,30 +43,15 @@ func (s *CallController) Error(msg string) {
 
 func (s *CallController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA) {
 	if ua == s.uaA {
-		if ev_try, ok := event.(*sippy.CCEventTry); ok {
-			s.call_id = ev_try.GetSipCallId().StringBody()
-			if s.cmap.config.Verify && !s.SshakenVerify(ev_try) {
-				s.uaA.RecvEvent(sippy.NewCCEventFail(438, "Invalid Identity Header", event.GetRtime(), ""))
-				return
-			}
-		}
 		if s.uaO == nil {
 			ev_try, ok := event.(*sippy.CCEventTry)
 			if !ok {
 				s.uaA.RecvEvent(sippy.NewCCEventDisconnect(nil, event.GetRtime(), ""))
 				return
 			}
-			s.uaO = sippy.NewUA(s.cmap.Sip_tm, s.cmap.config, s.cmap.config.Nh_addr, s, s.lock, nil)
-			identity, date, err := s.SshakenAuth(ev_try.GetCLI(), ev_try.GetCLD())
-			if err == nil {
-				extra_headers := []sippy_header.SipHeader{
-					sippy_header.NewSipDate(date),
-					sippy_header.NewSipGenericHF("Identity", identity),
-				}
-				s.uaO.SetExtraHeaders(extra_headers)
-			}
-			s.uaO.SetDeadCb(s.oDead)
-			s.uaO.SetRAddr(s.cmap.config.Nh_addr)
+			s.call_id = ev_try.GetSipCallId().StringBody()
+			s.SshakenVerify(ev_try)
+			return
 		}
 		s.uaO.RecvEvent(event)
 	} else {
@@ -74,30 +59,89 @@ func (s *CallController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA)
 	}
 }
 
-func (s *CallController) SshakenVerify(ev_try *sippy.CCEventTry) bool {
-	if s.identity_hf == nil || s.date_hf == nil {
-		s.Error("Verification failure: no identity provided")
-		return false
+func (s *CallController) placeOriginate(ev_try *sippy.CCEventTry) {
+	s.uaO = sippy.NewUA(s.cmap.Sip_tm, s.cmap.config, s.cmap.config.Nh_addr, s, s.lock, nil)
+	extra_headers, err := s.SshakenAuth(ev_try)
+	if err == nil {
+		s.uaO.SetExtraHeaders(extra_headers)
 	}
-	identity := s.identity_hf.StringBody()
-	date_ts, err := s.date_hf.GetTime()
-	if err != nil {
-		s.Error("Error parsing Date: header: " + err.Error())
-		return false
-	}
-	orig_tn := ev_try.GetCLI()
-	dest_tn := ev_try.GetCLD()
-	err = s.cmap.sshaken.Verify(identity, orig_tn, dest_tn, date_ts)
-	if err != nil {
-		s.Error("Verification failure: " + err.Error())
-	}
-	return err == nil
+	s.uaO.SetDeadCb(s.oDead)
+	s.uaO.SetRAddr(s.cmap.config.Nh_addr)
+	s.uaO.RecvEvent(ev_try)
+}
+
+// SshakenVerify verifies the identity in the background according to the
+// policy for the source of the call and places the outbound call unless
+// the call is to be rejected.
+func (s *CallController) SshakenVerify(ev_try *sippy.CCEventTry) {
+	s.cmap.sshaken.VerifyRequest(s.req, func(res *sippy_sshaken.VerificationResult) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.uaA.GetState() != sippy_types.UAS_STATE_TRYING {
+			// The call has been cancelled meanwhile
+			return
+		}
+		if res.Err != nil {
+			s.Error("Verification failure: " + res.Err.Error())
+		}
+		if res.SCode != 0 {
+			s.uaA.RecvEvent(sippy.NewCCEventFail(res.SCode, res.Reason, ev_try.GetRtime(), ""))
+			return
+		}
+		res.TagEvent(ev_try, s.cmap.config)
+		s.origid = res.Origid()
+		s.placeOriginate(ev_try)
+	})
 }
 
-func (s *CallController) SshakenAuth(cli, cld string) (string, time.Time, error) {
+// SshakenAuth signs the outbound call. The call diverted upstream keeps
+// the PASSporTs it has been received with and gets the "div" PASSporT
+// for the diversion. When the TN assignments are configured the Date and
+// the shaken Identity headers are added to the event by the
+// authentication service.
+func (s *CallController) SshakenAuth(ev_try *sippy.CCEventTry) ([]sippy_header.SipHeader, error) {
 	date_ts := time.Now()
-	identity, err := s.cmap.sshaken.Authenticate(date_ts, cli, cld)
-	return identity, date_ts, err
+	cli, cld := ev_try.GetCLI(), ev_try.GetCLD()
+	identities := []string{}
+	received := s.req.GetHFs("identity")
+	if div_tn := sippy_sshaken.DiversionTN(ev_try, s.cmap.config); div_tn != "" && len(received) > 0 {
+		identity, err := s.cmap.sshaken.AuthenticateDiv(date_ts, cli, cld, div_tn)
+		if err != nil {
+			return nil, err
+		}
+		for _, hf := range received {
+			identities = append(identities, hf.StringBody())
+		}
+		identities = append(identities, identity)
+	} else {
+		if s.cmap.sshaken.auth != nil {
+			_, err := s.cmap.sshaken.auth.AuthenticateCall(ev_try, s.req.GetSource().Host.String(), s.origid)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			identity, err := s.cmap.sshaken.Authenticate(date_ts, cli, cld)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, identity)
+		}
+		if s.cmap.config.Rcd && ev_try.GetCallerName() != "" {
+			identity, err := s.cmap.sshaken.AuthenticateRcd(date_ts, cli, cld, ev_try.GetCallerName())
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, identity)
+		}
+	}
+	extra_headers := []sippy_header.SipHeader{}
+	if s.cmap.sshaken.auth == nil {
+		extra_headers = append(extra_headers, sippy_header.NewSipDate(date_ts))
+	}
+	for _, identity := range identities {
+		extra_headers = append(extra_headers, sippy_header.NewSipGenericHF("Identity", identity))
+	}
+	return extra_headers, nil
 }
 
 func (s *CallController) aDead() {
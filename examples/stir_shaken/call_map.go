@@ -71,9 +71,7 @@ func (s *callMap) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerT
 	}
 	if req.GetMethod() == "INVITE" {
 		// New dialog
-		identity_hf := req.GetFirstHF("identity")
-		date_hf := req.GetSipDate()
-		cc := NewCallController(s, identity_hf, date_hf)
+		cc := NewCallController(s, req)
 		s.ccmap_lock.Lock()
 		s.ccmap[cc.id] = cc
 		s.ccmap_lock.Unlock()
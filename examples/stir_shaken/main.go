@@ -42,7 +42,8 @@ func main() {
 	var crt_roots_file string
 	var lport int
 	var attest, origid, x5u, crt_file, pkey_file string
-	var verify bool
+	var verify, ocsp, rcd bool
+	var x5u_hosts, cert_cache_dir, verify_policies, tn_file string
 
 	flag.StringVar(&laddr, "l", "", "Local addr")
 	flag.IntVar(&lport, "p", 5060, "Local port")
@@ -54,7 +55,13 @@ func main() {
 	flag.StringVar(&crt_file, "c", "", "Certificate file")
 	flag.StringVar(&pkey_file, "k", "", "Private key file")
 	flag.StringVar(&x5u, "x", "", "STIR/SHAKEN x5u")
-	flag.BoolVar(&verify, "vs", false, "Do verification")
+	flag.BoolVar(&verify, "vs", false, "Reject the calls failing verification unless -vp says otherwise")
+	flag.StringVar(&verify_policies, "vp", "", "Comma-separated list of peer=pass|tag|reject verification policies")
+	flag.StringVar(&x5u_hosts, "xh", "", "Comma-separated list of the hosts allowed in x5u")
+	flag.StringVar(&cert_cache_dir, "cd", "", "Directory to cache the retrieved certificates")
+	flag.StringVar(&tn_file, "tn", "", "TN assignments file, the attestation is chosen per call when set")
+	flag.BoolVar(&rcd, "rcd", false, "Add rcd PASSporT with the caller name")
+	flag.BoolVar(&ocsp, "ocsp", false, "Query OCSP responders before falling back to CRLs")
 	flag.Parse()
 
 	error_logger := sippy_log.NewErrorLogger()
@@ -63,7 +70,7 @@ func main() {
 		error_logger.Error(err)
 		return
 	}
-	if crt_roots_file == "" || origid == "" || x5u == "" || crt_file == "" || pkey_file == "" {
+	if crt_roots_file == "" || x5u == "" || crt_file == "" || pkey_file == "" || (tn_file == "" && origid == "") {
 		flag.Usage()
 		return
 	}
@@ -76,6 +83,12 @@ func main() {
 	config.Pkey_file = pkey_file
 	config.Crt_roots_file = crt_roots_file
 	config.Verify = verify
+	config.X5u_hosts = x5u_hosts
+	config.Cert_cache_dir = cert_cache_dir
+	config.Ocsp = ocsp
+	config.Verify_policies = verify_policies
+	config.Rcd = rcd
+	config.Tn_file = tn_file
 
 	if nh_addr != "" {
 		var parts []string
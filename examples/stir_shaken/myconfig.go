@@ -35,14 +35,20 @@ import (
 type myconfig struct {
 	sippy_conf.Config
 
-	Nh_addr        *sippy_net.HostPort
-	Crt_roots_file string
-	Attest         string
-	Origid         string
-	X5u            string
-	Crt_file       string
-	Pkey_file      string
-	Verify         bool
+	Nh_addr         *sippy_net.HostPort
+	Crt_roots_file  string
+	Attest          string
+	Origid          string
+	X5u             string
+	Crt_file        string
+	Pkey_file       string
+	Verify          bool
+	X5u_hosts       string
+	Cert_cache_dir  string
+	Ocsp            bool
+	Verify_policies string
+	Rcd             bool
+	Tn_file         string
 }
 
 func NewMyConfig(error_logger sippy_log.ErrorLogger, sip_logger sippy_log.SipLogger) *myconfig {
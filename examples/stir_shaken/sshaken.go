@@ -28,43 +28,78 @@ package main
 
 import (
 	"errors"
-	"io"
-	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/egovorukhin/go-b2bua/sippy/stir_shaken"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
 )
 
 type StirShaken struct {
-	verifier sippy_sshaken.Verifier
+	service  sippy_sshaken.VerificationService
+	auth     sippy_sshaken.AuthenticationService
 	config   *myconfig
 	cert_buf []byte
 	pkey_buf []byte
 }
 
 func NewStirShaken(config *myconfig) (*StirShaken, error) {
-	chain_buf, err := read_file(config.Crt_roots_file)
+	chain_buf, err := os.ReadFile(config.Crt_roots_file)
 	if err != nil {
 		return nil, err
 	}
-	cert_buf, err := read_file(config.Crt_file)
+	cert_buf, err := os.ReadFile(config.Crt_file)
 	if err != nil {
 		return nil, err
 	}
-	pkey_buf, err := read_file(config.Pkey_file)
+	pkey_buf, err := os.ReadFile(config.Pkey_file)
 	if err != nil {
 		return nil, err
 	}
+	var x5u_hosts []string
+	if config.X5u_hosts != "" {
+		x5u_hosts = strings.Split(config.X5u_hosts, ",")
+	}
 	ret := &StirShaken{
 		config:   config,
 		cert_buf: cert_buf,
 		pkey_buf: pkey_buf,
 	}
-	ret.verifier, err = sippy_sshaken.NewVerifier(chain_buf)
+	verifier, err := sippy_sshaken.NewVerifier(chain_buf)
 	if err != nil {
 		return nil, err
 	}
+	verifier.SetRevocationChecker(sippy_sshaken.NewRevocationChecker(config.Ocsp))
+	fetcher := sippy_sshaken.NewCertFetcher(x5u_hosts, config.Cert_cache_dir)
+	ret.service = sippy_sshaken.NewVerificationService(verifier, fetcher, config)
+	if config.Verify {
+		ret.service.SetDefaultPolicy(sippy_sshaken.VERIFY_POLICY_REJECT)
+	} else {
+		ret.service.SetDefaultPolicy(sippy_sshaken.VERIFY_POLICY_PASS)
+	}
+	// peer=policy,...
+	for _, peer_policy := range strings.Split(config.Verify_policies, ",") {
+		if peer_policy == "" {
+			continue
+		}
+		arr := strings.SplitN(peer_policy, "=", 2)
+		if len(arr) != 2 {
+			return nil, errors.New("bad verification policy: " + peer_policy)
+		}
+		policy, err := sippy_sshaken.ParseVerifyPolicy(arr[1])
+		if err != nil {
+			return nil, err
+		}
+		ret.service.SetPolicy(arr[0], policy)
+	}
+	if config.Tn_file != "" {
+		store, err := sippy_sshaken.NewTNFileStore(config.Tn_file)
+		if err != nil {
+			return nil, err
+		}
+		ret.auth = sippy_sshaken.NewAuthenticationService(store, cert_buf, pkey_buf, config.X5u, config)
+	}
 	return ret, nil
 }
 
@@ -72,54 +107,16 @@ func (s *StirShaken) Authenticate(date_ts time.Time, cli, cld string) (string, e
 	return sippy_sshaken.Authenticate(date_ts, s.config.Attest, s.config.Origid, s.cert_buf, s.pkey_buf, s.config.X5u, cli, cld)
 }
 
-func (s *StirShaken) Verify(identity, orig_tn, dest_tn string, date_ts time.Time) error {
-	passport, err := sippy_sshaken.ParseIdentity(identity)
-	if err != nil {
-		return err
-	}
-	cert_buf, err := s.GetCert(passport.Header.X5u)
-	if err != nil {
-		return err
-	}
-	return s.verifier.Verify(passport, cert_buf, orig_tn, dest_tn, date_ts)
-}
-
-func (s *StirShaken) GetCert(url string) ([]byte, error) {
-	client := &http.Client{
-		Timeout: time.Second,
-	}
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	cert, err := read_all(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	if len(cert) == 0 {
-		return nil, errors.New("Empty certificate retrieved")
-	}
-	return cert, nil
+func (s *StirShaken) AuthenticateDiv(date_ts time.Time, cli, cld, div_tn string) (string, error) {
+	return sippy_sshaken.AuthenticateDiv(date_ts, s.cert_buf, s.pkey_buf, s.config.X5u, cli, cld, div_tn)
 }
 
-func read_all(fd io.Reader) ([]byte, error) {
-	buf := make([]byte, 4096)
-	n, err := fd.Read(buf)
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
-	if n == 0 {
-		return nil, errors.New("Empty certificate retrieved")
-	}
-	return buf[:n], nil
+func (s *StirShaken) AuthenticateRcd(date_ts time.Time, cli, cld, caller_name string) (string, error) {
+	return sippy_sshaken.AuthenticateRcd(date_ts, s.cert_buf, s.pkey_buf, s.config.X5u, cli, cld, caller_name, "", "")
 }
 
-func read_file(fname string) ([]byte, error) {
-	fd, err := os.Open(fname)
-	if err != nil {
-		return nil, err
-	}
-	defer fd.Close()
-	return read_all(fd)
+// VerifyRequest verifies the Identity of the inbound request and calls
+// done with the result. The done is called without any lock held.
+func (s *StirShaken) VerifyRequest(req sippy_types.SipRequest, done func(*sippy_sshaken.VerificationResult)) {
+	s.service.VerifyRequest(req, done)
 }
@@ -99,6 +99,13 @@ type CCEventTry struct {
 	auth_hdr    sippy_header.SipAuthorizationHeader
 	body        sippy_types.MsgBody
 	routes      []*sippy_header.SipRoute
+	pais        []*sippy_header.SipPAssertedIdentity
+	ppis        []*sippy_header.SipPPreferredIdentity
+	privacy     *sippy_header.SipPrivacy
+	diversions  []*sippy_header.SipDiversion
+	hist_infos  []*sippy_header.SipHistoryInfo
+	from_params []string
+	from_host   string
 }
 
 func NewCCEventTry(call_id *sippy_header.SipCallId, cli string, cld string, body sippy_types.MsgBody, auth_hdr sippy_header.SipAuthorizationHeader, caller_name string, rtime *sippy_time.MonoTime, origin string, extra_headers ...sippy_header.SipHeader) (*CCEventTry, error) {
@@ -152,6 +159,73 @@ func (s *CCEventTry) GetCLI() string {
 	return s.cli
 }
 
+// GetAssertedIdentity returns the P-Asserted-Identity headers of the
+// call. It is up to the application to decide whether the source of the
+// call belongs to the trust domain.
+func (s *CCEventTry) GetAssertedIdentity() []*sippy_header.SipPAssertedIdentity {
+	return s.pais
+}
+
+func (s *CCEventTry) SetAssertedIdentity(pais []*sippy_header.SipPAssertedIdentity) {
+	s.pais = pais
+}
+
+func (s *CCEventTry) GetPreferredIdentity() []*sippy_header.SipPPreferredIdentity {
+	return s.ppis
+}
+
+func (s *CCEventTry) SetPreferredIdentity(ppis []*sippy_header.SipPPreferredIdentity) {
+	s.ppis = ppis
+}
+
+func (s *CCEventTry) GetPrivacy() *sippy_header.SipPrivacy {
+	return s.privacy
+}
+
+func (s *CCEventTry) SetPrivacy(privacy *sippy_header.SipPrivacy) {
+	s.privacy = privacy
+}
+
+// GetDiversion returns the Diversion headers of the call in the order
+// they were received, i.e. the most recent redirection first.
+func (s *CCEventTry) GetDiversion() []*sippy_header.SipDiversion {
+	return s.diversions
+}
+
+func (s *CCEventTry) SetDiversion(diversions []*sippy_header.SipDiversion) {
+	s.diversions = diversions
+}
+
+// GetHistoryInfo returns the History-Info entries of the call in the
+// order they were received.
+func (s *CCEventTry) GetHistoryInfo() []*sippy_header.SipHistoryInfo {
+	return s.hist_infos
+}
+
+func (s *CCEventTry) SetHistoryInfo(hist_infos []*sippy_header.SipHistoryInfo) {
+	s.hist_infos = hist_infos
+}
+
+// GetFromUserParams returns the user parameters to be added to the From
+// URI of the outgoing INVITE, e.g. verstat.
+func (s *CCEventTry) GetFromUserParams() []string {
+	return s.from_params
+}
+
+func (s *CCEventTry) SetFromUserParams(from_params []string) {
+	s.from_params = from_params
+}
+
+// GetFromHost returns the host to be used in the From URI of the
+// outgoing INVITE instead of our own address, e.g. anonymous.invalid.
+func (s *CCEventTry) GetFromHost() string {
+	return s.from_host
+}
+
+func (s *CCEventTry) SetFromHost(from_host string) {
+	s.from_host = from_host
+}
+
 func (s *CCEventTry) String() string { return "CCEventTry" }
 
 type CCEventRing struct {
@@ -185,6 +259,7 @@ type CCEventConnect struct {
 
 func (s *CCEventRing) GetScode() int                      { return s.scode }
 func (s *CCEventRing) GetBody() sippy_types.MsgBody       { return s.body }
+func (s *CCEventRing) SetBody(body sippy_types.MsgBody)   { s.body = body }
 func (s *CCEventRing) SetScode(scode int)                 { s.scode = scode }
 func (s *CCEventRing) SetScodeReason(scode_reason string) { s.scode_reason = scode_reason }
 
@@ -203,6 +278,10 @@ func (s *CCEventConnect) GetBody() sippy_types.MsgBody {
 	return s.body
 }
 
+func (s *CCEventConnect) SetBody(body sippy_types.MsgBody) {
+	s.body = body
+}
+
 type CCEventUpdate struct {
 	CCEventGeneric
 	body sippy_types.MsgBody
@@ -269,6 +348,7 @@ type CCEventFail struct {
 	scode        int
 	scode_reason string
 	warning      *sippy_header.SipWarning
+	body         sippy_types.MsgBody
 }
 
 func NewCCEventFail(scode int, scode_reason string, rtime *sippy_time.MonoTime, origin string, extra_headers ...sippy_header.SipHeader) *CCEventFail {
@@ -296,8 +376,14 @@ func (s *CCEventFail) SetWarning(text string) {
 	s.warning = sippy_header.NewSipWarning(text)
 }
 
-func (*CCEventFail) GetBody() sippy_types.MsgBody {
-	return nil
+// GetBody returns the body of the failure response, e.g. the REL of
+// SIP-I/SIP-T.
+func (s *CCEventFail) GetBody() sippy_types.MsgBody {
+	return s.body
+}
+
+func (s *CCEventFail) SetBody(body sippy_types.MsgBody) {
+	s.body = body
 }
 
 type CCEventPreConnect struct {
@@ -316,7 +402,8 @@ func NewCCEventPreConnect(scode int, scode_reason string, body sippy_types.MsgBo
 	}
 }
 
-func (s *CCEventPreConnect) String() string               { return "CCEventPreConnect" }
-func (s *CCEventPreConnect) GetScode() int                { return s.scode }
-func (s *CCEventPreConnect) GetScodeReason() string       { return s.scode_reason }
-func (s *CCEventPreConnect) GetBody() sippy_types.MsgBody { return s.body }
+func (s *CCEventPreConnect) String() string                   { return "CCEventPreConnect" }
+func (s *CCEventPreConnect) GetScode() int                    { return s.scode }
+func (s *CCEventPreConnect) GetScodeReason() string           { return s.scode_reason }
+func (s *CCEventPreConnect) GetBody() sippy_types.MsgBody     { return s.body }
+func (s *CCEventPreConnect) SetBody(body sippy_types.MsgBody) { s.body = body }
@@ -49,6 +49,7 @@ type CLIConnectionManager struct {
 	commandCb      func(clim CLIManagerIface, cmd string)
 	acceptList     map[string]bool
 	acceptListLock sync.RWMutex
+	acceptFilter   func(net.IP) bool
 	logger         sippy_log.ErrorLogger
 }
 
@@ -127,6 +128,10 @@ func (c *CLIConnectionManager) handleAccept(conn net.Conn) {
 				return
 			}
 		}
+		if c.acceptFilter != nil && !c.acceptFilter(net.ParseIP(raddr)) {
+			_ = conn.Close()
+			return
+		}
 	}
 	cm := NewCLIManager(conn, c.commandCb, c.logger)
 	go cm.run()
@@ -159,6 +164,15 @@ func (c *CLIConnectionManager) SetAcceptList(acl []string) {
 	c.acceptListLock.Unlock()
 }
 
+// SetAcceptFilter installs the function that decides whether the TCP
+// connection from the remote IP address is accepted. It is consulted
+// in addition to the accept list.
+func (c *CLIConnectionManager) SetAcceptFilter(filter func(net.IP) bool) {
+	c.acceptListLock.Lock()
+	c.acceptFilter = filter
+	c.acceptListLock.Unlock()
+}
+
 func (c *CLIConnectionManager) AcceptListAppend(ip string) {
 	c.acceptListLock.Lock()
 	if c.acceptList == nil {
@@ -0,0 +1,247 @@
+package sippy
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const (
+	DIGEST_QOP_AUTH     = "auth"
+	DIGEST_QOP_AUTH_INT = "auth-int"
+)
+
+// digestAuth challenges the incoming requests and verifies the digest
+// credentials in them (RFC 3261 section 22, RFC 7616, RFC 8760). The
+// nonce count of every nonce must grow with each request, so a captured
+// request cannot be replayed while its nonce is still valid.
+type digestAuth struct {
+	store      sippy_types.DigestUserStore
+	realm      string
+	proxy      bool
+	algorithms []string
+	qop        []string
+	lock       sync.Mutex
+	nonces     map[string]*digestNonce
+	last_purge time.Time
+	on_failure sippy_types.AuthFailureListener
+}
+
+type digestNonce struct {
+	nc      uint64
+	expires time.Time
+}
+
+func NewDigestAuth(store sippy_types.DigestUserStore, realm string) *digestAuth {
+	return &digestAuth{
+		store:      store,
+		realm:      realm,
+		algorithms: []string{"MD5"},
+		qop:        []string{DIGEST_QOP_AUTH},
+		nonces:     make(map[string]*digestNonce),
+	}
+}
+
+// SetProxyMode makes the requests challenged with 407 and the
+// Proxy-Authenticate header instead of 401 and WWW-Authenticate.
+func (s *digestAuth) SetProxyMode(proxy bool) {
+	s.proxy = proxy
+}
+
+// SetAuthFailureListener makes the listener notified when the request
+// comes with the wrong credentials, i.e. to ban the source.
+func (s *digestAuth) SetAuthFailureListener(listener sippy_types.AuthFailureListener) {
+	s.on_failure = listener
+}
+
+// SetAlgorithms sets the algorithms offered to the client, the most
+// preferred one first. Each of them gets its own challenge as RFC 8760
+// section 2.4 requires.
+func (s *digestAuth) SetAlgorithms(algorithms []string) error {
+	if len(algorithms) == 0 {
+		return errors.New("No digest algorithm given")
+	}
+	for _, name := range algorithms {
+		if sippy_security.GetAlgorithm(name) == nil {
+			return errors.New("Unsupported digest algorithm: " + name)
+		}
+	}
+	s.algorithms = algorithms
+	return nil
+}
+
+// SetQop sets the quality of protection options offered to the client.
+// The empty list makes the challenges RFC 2069 compatible, in that case
+// every nonce can be used only once.
+func (s *digestAuth) SetQop(qop []string) error {
+	for _, q := range qop {
+		if q != DIGEST_QOP_AUTH && q != DIGEST_QOP_AUTH_INT {
+			return errors.New("Unsupported qop: " + q)
+		}
+	}
+	s.qop = qop
+	return nil
+}
+
+// Authenticate returns the name of the authenticated user or the response
+// to be sent if the request has not been authenticated.
+func (s *digestAuth) Authenticate(req sippy_types.SipRequest) (string, sippy_types.SipResponse) {
+	var hf sippy_header.SipAuthorizationHeader
+
+	if s.proxy {
+		if h := req.GetSipProxyAuthorization(); h != nil {
+			hf = h
+		}
+	} else if h := req.GetSipAuthorization(); h != nil {
+		hf = h
+	}
+	if hf == nil {
+		return "", s.challenge(req, false)
+	}
+	auth, err := hf.GetBody()
+	if err != nil {
+		return "", req.GenResponse(400, "Bad Request - bad Authorization", nil, nil)
+	}
+	alg := s.getAlgorithm(auth.GetAlgorithm())
+	if alg == nil || auth.GetRealm() != s.realm || auth.GetUsername() == "" || !s.hasQop(auth.GetQop()) {
+		return "", s.challenge(req, false)
+	}
+	nc := uint64(1)
+	if auth.GetQop() != "" {
+		nc, err = strconv.ParseUint(auth.GetNC(), 16, 64)
+		if err != nil || nc == 0 || auth.GetCNonce() == "" {
+			return "", req.GenResponse(400, "Bad Request - bad Authorization", nil, nil)
+		}
+	}
+	ha1, ok := s.store.GetHA1(auth.GetUsername(), s.realm, digestHashName(auth.GetAlgorithm()))
+	if !ok {
+		s.authFailed(req)
+		return "", s.challenge(req, false)
+	}
+	if strings.HasSuffix(strings.ToLower(auth.GetAlgorithm()), "-sess") {
+		hash := alg.NewHash()
+		hash.Write([]byte(ha1 + ":" + auth.GetNonce() + ":" + auth.GetCNonce()))
+		ha1 = hex.EncodeToString(hash.Sum(nil))
+	}
+	entity_body := ""
+	if auth.GetQop() == DIGEST_QOP_AUTH_INT && req.GetBody() != nil {
+		entity_body = req.GetBody().String()
+	}
+	response := sippy_header.DigestCalcResponse(alg, ha1, auth.GetNonce(), auth.GetNC(), auth.GetCNonce(),
+		auth.GetQop(), req.GetMethod(), auth.GetUri(), entity_body)
+	if subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(auth.GetResponse()))) != 1 {
+		s.authFailed(req)
+		return "", s.challenge(req, false)
+	}
+	// The credentials are right, so if the nonce is not good any more the
+	// client can just retry with the new one.
+	now, _ := sippy_time.NewMonoTime()
+	valid, stale := sippy_security.HashOracle.CheckChallenge(auth.GetNonce(), alg.Mask, now.Realt())
+	if !valid {
+		return "", s.challenge(req, stale)
+	}
+	if !s.checkNonceCount(auth.GetNonce(), nc, now.Monot()) {
+		return "", s.challenge(req, true)
+	}
+	return auth.GetUsername(), nil
+}
+
+func (s *digestAuth) authFailed(req sippy_types.SipRequest) {
+	if s.on_failure != nil && req.GetSource() != nil {
+		now, _ := sippy_time.NewMonoTime()
+		s.on_failure.AuthFailed(req.GetSource(), now.Monot())
+	}
+}
+
+// getAlgorithm returns the algorithm if it is one of those offered. The
+// missing algorithm means MD5.
+func (s *digestAuth) getAlgorithm(name string) *sippy_security.Algorithm {
+	alg := sippy_security.GetAlgorithm(name)
+	if alg == nil {
+		return nil
+	}
+	for _, offered := range s.algorithms {
+		if sippy_security.GetAlgorithm(offered).Mask == alg.Mask {
+			return alg
+		}
+	}
+	return nil
+}
+
+func (s *digestAuth) hasQop(qop string) bool {
+	if len(s.qop) == 0 {
+		return qop == ""
+	}
+	for _, q := range s.qop {
+		if q == qop {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNonceCount makes sure the nonce count is greater than in any
+// request seen with the same nonce before.
+func (s *digestAuth) checkNonceCount(nonce string, nc uint64, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.last_purge) > time.Duration(sippy_security.VTIME)*time.Second {
+		for key, dn := range s.nonces {
+			if now.After(dn.expires) {
+				delete(s.nonces, key)
+			}
+		}
+		s.last_purge = now
+	}
+	dn, ok := s.nonces[nonce]
+	if !ok {
+		// The nonce cannot outlive the validity time counted from now
+		s.nonces[nonce] = &digestNonce{
+			nc:      nc,
+			expires: now.Add(time.Duration(sippy_security.VTIME+1) * time.Second),
+		}
+		return true
+	}
+	if nc <= dn.nc {
+		return false
+	}
+	dn.nc = nc
+	return true
+}
+
+func (s *digestAuth) challenge(req sippy_types.SipRequest, stale bool) sippy_types.SipResponse {
+	var resp sippy_types.SipResponse
+
+	now, _ := sippy_time.NewMonoTime()
+	if s.proxy {
+		resp = req.GenResponse(407, "Proxy Authentication Required", nil, nil)
+	} else {
+		resp = req.GenResponse(401, "Unauthorized", nil, nil)
+	}
+	for _, algorithm := range s.algorithms {
+		var hf sippy_header.SipHeader
+		var www_auth *sippy_header.SipWWWAuthenticate
+
+		if s.proxy {
+			proxy_auth := sippy_header.NewSipProxyAuthenticateWithRealm(s.realm, algorithm, now.Realt())
+			www_auth, hf = proxy_auth.SipWWWAuthenticate, proxy_auth
+		} else {
+			www_auth = sippy_header.NewSipWWWAuthenticateWithRealm(s.realm, algorithm, now.Realt())
+			hf = www_auth
+		}
+		body, _ := www_auth.GetBody()
+		body.SetQop(append([]string{}, s.qop...))
+		body.SetStale(stale)
+		resp.AppendHeader(hf)
+	}
+	return resp
+}
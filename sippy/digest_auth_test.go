@@ -0,0 +1,206 @@
+package sippy
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+)
+
+func testInvite(t *testing.T, config sippy_conf.Config, auth sippy_header.SipHeader) *sipRequest {
+	sdp := strings.Join([]string{
+		"v=0",
+		"o=- 1 1 IN IP4 192.168.1.5",
+		"s=-",
+		"c=IN IP4 192.168.1.5",
+		"t=0 0",
+		"m=audio 16000 RTP/AVP 0",
+		"",
+	}, "\r\n")
+	buf := strings.Join([]string{
+		"INVITE sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.168.1.5:5060;branch=z9hG4bK1",
+		"From: <sip:alice@example.com>;tag=1",
+		"To: <sip:bob@example.com>",
+		"Call-ID: inv1@192.168.1.5",
+		"CSeq: 1 INVITE",
+		"Contact: <sip:alice@192.168.1.5:5060>",
+		"Max-Forwards: 70",
+		"Content-Type: application/sdp",
+		"Content-Length: " + strconv.Itoa(len(sdp)),
+		"",
+		sdp,
+	}, "\r\n")
+	rtime, _ := sippy_time.NewMonoTime()
+	req, err := ParseSipRequest([]byte(buf), rtime, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != nil {
+		req.AppendHeader(auth)
+	}
+	return req
+}
+
+func TestDigestAuth(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	auth := NewDigestAuth(DigestPasswdLookup(func(username string) (string, bool) {
+		return "secret", username == "alice"
+	}), "example.com")
+	if err := auth.SetAlgorithms([]string{"SHA-256", "MD5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, resp := auth.Authenticate(testInvite(t, config, nil))
+	if resp == nil || resp.GetSCodeNum() != 401 {
+		t.Fatal("The request without credentials has not been challenged")
+	}
+	challenges := resp.GetSipWWWAuthenticates()
+	if len(challenges) != 2 {
+		t.Fatalf("Bad number of challenges: %d", len(challenges))
+	}
+	if alg, _ := challenges[0].Algorithm(); alg != "SHA-256" {
+		t.Errorf("Bad algorithm of the first challenge: %s", alg)
+	}
+	for _, challenge := range challenges {
+		hf, err := challenge.GenAuthHF("alice", "secret", "INVITE", "sip:bob@example.com", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		username, resp := auth.Authenticate(testInvite(t, config, hf))
+		if resp != nil || username != "alice" {
+			t.Fatalf("Good credentials have been rejected: %s", challenge.String())
+		}
+		// The same nonce count must not be accepted twice
+		_, resp = auth.Authenticate(testInvite(t, config, hf))
+		if resp == nil || resp.GetSCodeNum() != 401 {
+			t.Fatal("The replayed request has been accepted")
+		}
+		body, _ := resp.GetSipWWWAuthenticates()[0].GetBody()
+		if !body.GetStale() {
+			t.Error("The replayed request has not been challenged with stale=true")
+		}
+	}
+
+	hf, _ := challenges[0].GenAuthHF("alice", "wrong", "INVITE", "sip:bob@example.com", "")
+	_, resp = auth.Authenticate(testInvite(t, config, hf))
+	if resp == nil || resp.GetSCodeNum() != 401 {
+		t.Fatal("Bad credentials have been accepted")
+	}
+	if body, _ := resp.GetSipWWWAuthenticates()[0].GetBody(); body.GetStale() {
+		t.Error("Bad credentials have been challenged with stale=true")
+	}
+
+	// The algorithm that has not been offered
+	hf, _ = challenges[1].GenAuthHF("alice", "secret", "INVITE", "sip:bob@example.com", "")
+	auth.SetAlgorithms([]string{"SHA-512-256"})
+	if _, resp = auth.Authenticate(testInvite(t, config, hf)); resp == nil {
+		t.Error("The request with the algorithm not offered has been accepted")
+	}
+
+	// Expired nonce
+	auth.SetAlgorithms([]string{"MD5"})
+	now, _ := sippy_time.NewMonoTime()
+	nonce := sippy_security.HashOracle.EmitChallenge(sippy_security.DGST_MD5, now.Realt().Add(-40*time.Second))
+	old := sippy_header.CreateSipWWWAuthenticate("Digest realm=\"example.com\",nonce=\"" + nonce + "\",algorithm=MD5,qop=auth")[0]
+	hf, _ = old.(*sippy_header.SipWWWAuthenticate).GenAuthHF("alice", "secret", "INVITE", "sip:bob@example.com", "")
+	_, resp = auth.Authenticate(testInvite(t, config, hf))
+	if resp == nil || resp.GetSCodeNum() != 401 {
+		t.Fatal("The request with the expired nonce has been accepted")
+	}
+	if body, _ := resp.GetSipWWWAuthenticates()[0].GetBody(); !body.GetStale() {
+		t.Error("The expired nonce has not been challenged with stale=true")
+	}
+
+	// Proxy mode with auth-int
+	auth.SetProxyMode(true)
+	auth.SetQop([]string{DIGEST_QOP_AUTH_INT})
+	req := testInvite(t, config, nil)
+	_, resp = auth.Authenticate(req)
+	if resp == nil || resp.GetSCodeNum() != 407 || len(resp.GetSipProxyAuthenticates()) != 1 {
+		t.Fatal("The request has not been challenged with 407")
+	}
+	challenge := resp.GetSipProxyAuthenticates()[0]
+	hf, _ = challenge.GenAuthHF("alice", "secret", "INVITE", "sip:bob@example.com", "")
+	if _, ok := hf.(*sippy_header.SipProxyAuthorization); !ok {
+		t.Fatal("Proxy-Authorization has not been generated")
+	}
+	if _, resp = auth.Authenticate(testInvite(t, config, hf)); resp == nil {
+		t.Error("The request with the body not covered by auth-int has been accepted")
+	}
+	hf, _ = challenge.GenAuthHF("alice", "secret", "INVITE", "sip:bob@example.com", req.GetBody().String())
+	if username, resp := auth.Authenticate(testInvite(t, config, hf)); resp != nil || username != "alice" {
+		t.Error("Good auth-int credentials have been rejected")
+	}
+}
+
+func TestDigestVerify(t *testing.T) {
+	verify := func(nonce_time time.Time, passwd string) bool {
+		challenge := sippy_header.NewSipWWWAuthenticateWithRealm("example.com", "MD5", nonce_time)
+		hf, err := challenge.GenAuthHF("alice", "secret", "REGISTER", "sip:example.com", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := hf.(sippy_header.SipAuthorizationHeader).GetBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		alg := sippy_security.GetAlgorithm(body.GetAlgorithm())
+		HA1 := sippy_header.DigestCalcHA1(alg, body.GetAlgorithm(), "alice", "example.com", passwd, body.GetNonce(), body.GetCNonce())
+		return body.VerifyHA1(HA1, "REGISTER", "") && body.Verify(passwd, "REGISTER", "")
+	}
+	// The nonce has just been issued
+	if !verify(time.Now(), "secret") {
+		t.Error("The fresh nonce has been rejected")
+	}
+	if verify(time.Now(), "wrong") {
+		t.Error("Bad credentials have been accepted")
+	}
+	if verify(time.Now().Add(-40*time.Second), "secret") {
+		t.Error("The expired nonce has been accepted")
+	}
+}
+
+func TestDigestFileStore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "users")
+	alg := sippy_security.GetAlgorithm("SHA-256")
+	ha1 := sippy_header.DigestCalcHA1(alg, "", "alice", "example.com", "secret", "", "")
+	err := os.WriteFile(fname, []byte(strings.Join([]string{
+		"# username:realm[:algorithm]:HA1",
+		"alice:example.com:939e7578ed9e3c518a452acee763bce9",
+		"alice:example.com:SHA-256:" + ha1,
+		"",
+	}, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewDigestFileStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, ok := store.GetHA1("alice", "example.com", "md5"); !ok || h != "939e7578ed9e3c518a452acee763bce9" {
+		t.Errorf("Bad MD5 HA1: %s", h)
+	}
+	if h, ok := store.GetHA1("alice", "example.com", digestHashName("SHA-256-sess")); !ok || h != ha1 {
+		t.Errorf("Bad SHA-256 HA1: %s", h)
+	}
+	if _, ok := store.GetHA1("alice", "example.com", "sha-512-256"); ok {
+		t.Error("HA1 returned for the algorithm not in the file")
+	}
+
+	os.WriteFile(fname, []byte("alice:example.com:MD4:0000\n"), 0644)
+	if err = store.Reload(); err == nil {
+		t.Error("Unsupported algorithm has been accepted")
+	}
+	if _, ok := store.GetHA1("alice", "example.com", "md5"); !ok {
+		t.Error("The credentials have been lost on failed reload")
+	}
+}
@@ -0,0 +1,130 @@
+package sippy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
+)
+
+// digestHashName returns the name of the hash the algorithm is based on
+// in the form the DigestUserStore expects it.
+func digestHashName(alg_name string) string {
+	alg_name = strings.TrimSuffix(strings.ToLower(alg_name), "-sess")
+	if alg_name == "" {
+		alg_name = "md5"
+	}
+	return alg_name
+}
+
+// DigestPasswdLookup adapts the plain text password lookup function to
+// the DigestUserStore interface.
+type DigestPasswdLookup func(username string) (string, bool)
+
+func (f DigestPasswdLookup) GetHA1(username, realm, algorithm string) (string, bool) {
+	alg := sippy_security.GetAlgorithm(algorithm)
+	if alg == nil {
+		return "", false
+	}
+	passwd, ok := f(username)
+	if !ok {
+		return "", false
+	}
+	return sippy_header.DigestCalcHA1(alg, "", username, realm, passwd, "", ""), true
+}
+
+/*
+ * digestFileStore reads the credentials from the file in the htdigest
+ * format. The lines with three fields hold the MD5 HA1, the algorithm
+ * can be given explicitly as the third field of the four. The same user
+ * may have one line per algorithm.
+ *
+ * Example:
+ *
+ *     # username:realm[:algorithm]:HA1
+ *     alice:example.com:939e7578ed9e3c518a452acee763bce9
+ *     alice:example.com:SHA-256:...
+ */
+type digestFileStore struct {
+	fname string
+	lock  sync.Mutex
+	users map[string]string
+}
+
+func NewDigestFileStore(fname string) (*digestFileStore, error) {
+	s := &digestFileStore{
+		fname: fname,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func digestStoreKey(username, realm, algorithm string) string {
+	return username + ":" + realm + ":" + algorithm
+}
+
+// Reload re-reads the file. The credentials in use are kept when the
+// file cannot be parsed.
+func (s *digestFileStore) Reload() error {
+	commit, err := s.PrepareReload()
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareReload parses the file, the returned function replaces the
+// credentials in use with the new ones.
+func (s *digestFileStore) PrepareReload() (func(), error) {
+	fd, err := os.Open(s.fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		arr := strings.Split(line, ":")
+		algorithm := "md5"
+		switch len(arr) {
+		case 3:
+		case 4:
+			algorithm = strings.ToLower(arr[2])
+			if strings.HasSuffix(algorithm, "-sess") || sippy_security.GetAlgorithm(algorithm) == nil {
+				return nil, fmt.Errorf("%s:%d: unsupported algorithm %s", s.fname, lineno, arr[2])
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: bad number of fields", s.fname, lineno)
+		}
+		ha1 := strings.ToLower(arr[len(arr)-1])
+		users[digestStoreKey(arr[0], arr[1], digestHashName(algorithm))] = ha1
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return func() {
+		s.lock.Lock()
+		s.users = users
+		s.lock.Unlock()
+	}, nil
+}
+
+func (s *digestFileStore) GetHA1(username, realm, algorithm string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ha1, ok := s.users[digestStoreKey(username, realm, algorithm)]
+	return ha1, ok
+}
@@ -139,6 +139,42 @@ func (b *SipAuthorizationBody) GetUsername() string {
 	return b.username
 }
 
+func (b *SipAuthorizationBody) GetRealm() string {
+	return b.realm
+}
+
+func (b *SipAuthorizationBody) GetNonce() string {
+	return b.nonce
+}
+
+func (b *SipAuthorizationBody) GetUri() string {
+	return b.uri
+}
+
+func (b *SipAuthorizationBody) GetResponse() string {
+	return b.response
+}
+
+func (b *SipAuthorizationBody) GetAlgorithm() string {
+	return b.algorithm
+}
+
+func (b *SipAuthorizationBody) GetQop() string {
+	return b.qop
+}
+
+func (b *SipAuthorizationBody) GetNC() string {
+	return b.nc
+}
+
+func (b *SipAuthorizationBody) GetCNonce() string {
+	return b.cnonce
+}
+
+func (b *SipAuthorizationBody) GetOpaque() string {
+	return b.opaque
+}
+
 func (b *SipAuthorizationBody) Verify(passwd, method, entityBody string) bool {
 	alg := sippy_security.GetAlgorithm(b.algorithm)
 	if alg == nil {
@@ -157,7 +193,7 @@ func (b *SipAuthorizationBody) VerifyHA1(HA1, method, entityBody string) bool {
 	if b.qop != "" && b.qop != "auth" {
 		return false
 	}
-	if !sippy_security.HashOracle.ValidateChallenge(b.nonce, alg.Mask, now.Monot()) {
+	if !sippy_security.HashOracle.ValidateChallenge(b.nonce, alg.Mask, now.Realt()) {
 		return false
 	}
 	response := DigestCalcResponse(alg, HA1, b.nonce, b.nc, b.cnonce, b.qop, method, b.uri, entityBody)
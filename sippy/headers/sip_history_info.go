@@ -0,0 +1,115 @@
+package sippy_header
+
+import (
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+type SipHistoryInfo struct {
+	normalName
+	*sipAddressHF
+}
+
+var sipHistoryInfoName normalName = newNormalName("History-Info")
+
+func CreateSipHistoryInfo(body string) []SipHeader {
+	addresses := CreateSipAddressHFs(body)
+	rval := make([]SipHeader, len(addresses))
+	for i, addr := range addresses {
+		rval[i] = &SipHistoryInfo{
+			normalName:   sipHistoryInfoName,
+			sipAddressHF: addr,
+		}
+	}
+	return rval
+}
+
+func NewSipHistoryInfo(addr *SipAddress) *SipHistoryInfo {
+	return &SipHistoryInfo{
+		normalName:   sipHistoryInfoName,
+		sipAddressHF: newSipAddressHF(addr),
+	}
+}
+
+func (s *SipHistoryInfo) String() string {
+	return s.LocalStr(nil, false)
+}
+
+func (s *SipHistoryInfo) LocalStr(hostPort *sippy_net.HostPort, compact bool) string {
+	return s.Name() + ": " + s.LocalStringBody(hostPort)
+}
+
+func (s *SipHistoryInfo) GetCopy() *SipHistoryInfo {
+	return &SipHistoryInfo{
+		normalName:   sipHistoryInfoName,
+		sipAddressHF: s.sipAddressHF.getCopy(),
+	}
+}
+
+func (s *SipHistoryInfo) GetCopyAsIface() SipHeader {
+	return s.GetCopy()
+}
+
+// History-Info parameters (RFC 7044)
+const (
+	HI_INDEX = "index"
+	HI_RC    = "rc"
+	HI_MP    = "mp"
+	HI_NP    = "np"
+)
+
+func NewSipHistoryInfoIndexed(addr *SipAddress, index string) *SipHistoryInfo {
+	addr.SetParam(HI_INDEX, index)
+	return NewSipHistoryInfo(addr)
+}
+
+func (s *SipHistoryInfo) GetIndex(config sippy_conf.Config) (string, error) {
+	addr, err := s.GetBody(config)
+	if err != nil {
+		return "", err
+	}
+	return addr.GetParam(HI_INDEX), nil
+}
+
+// GetTargetedFrom returns the index of the entry this one has been
+// retargeted from (the value of the rc, mp or np parameter) along with the
+// name of the parameter.
+func (s *SipHistoryInfo) GetTargetedFrom(config sippy_conf.Config) (string, string, error) {
+	addr, err := s.GetBody(config)
+	if err != nil {
+		return "", "", err
+	}
+	for _, tag := range []string{HI_RC, HI_MP, HI_NP} {
+		if _, ok := addr.GetParams()[tag]; ok {
+			return addr.GetParam(tag), tag, nil
+		}
+	}
+	return "", "", nil
+}
+
+// GetReason returns the Reason embedded into the hi-targeted-to-uri
+// explaining why the request has been retargeted from this entry.
+func (s *SipHistoryInfo) GetReason(config sippy_conf.Config) (*SipReason, error) {
+	addr, err := s.GetBody(config)
+	if err != nil {
+		return nil, err
+	}
+	reason := addr.GetUrl().GetHeader("Reason")
+	if reason == "" {
+		return nil, nil
+	}
+	return CreateSipReason(reason)[0].(*SipReason), nil
+}
+
+func (s *SipHistoryInfo) SetReason(reason *SipReason, config sippy_conf.Config) error {
+	addr, err := s.GetBody(config)
+	if err != nil {
+		return err
+	}
+	if reason == nil {
+		addr.GetUrl().DelHeader("Reason")
+	} else {
+		addr.GetUrl().SetHeader("Reason", reason.StringBody())
+	}
+	return nil
+}
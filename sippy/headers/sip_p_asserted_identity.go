@@ -0,0 +1,50 @@
+package sippy_header
+
+import (
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+type SipPAssertedIdentity struct {
+	normalName
+	*sipAddressHF
+}
+
+var sipPAssertedIdentityName normalName = newNormalName("P-Asserted-Identity")
+
+func CreateSipPAssertedIdentity(body string) []SipHeader {
+	addresses := CreateSipAddressHFs(body)
+	rval := make([]SipHeader, len(addresses))
+	for i, addr := range addresses {
+		rval[i] = &SipPAssertedIdentity{
+			normalName:   sipPAssertedIdentityName,
+			sipAddressHF: addr,
+		}
+	}
+	return rval
+}
+
+func NewSipPAssertedIdentity(addr *SipAddress) *SipPAssertedIdentity {
+	return &SipPAssertedIdentity{
+		normalName:   sipPAssertedIdentityName,
+		sipAddressHF: newSipAddressHF(addr),
+	}
+}
+
+func (s *SipPAssertedIdentity) String() string {
+	return s.LocalStr(nil, false)
+}
+
+func (s *SipPAssertedIdentity) LocalStr(hostPort *sippy_net.HostPort, compact bool) string {
+	return s.Name() + ": " + s.LocalStringBody(hostPort)
+}
+
+func (s *SipPAssertedIdentity) GetCopy() *SipPAssertedIdentity {
+	return &SipPAssertedIdentity{
+		normalName:   sipPAssertedIdentityName,
+		sipAddressHF: s.sipAddressHF.getCopy(),
+	}
+}
+
+func (s *SipPAssertedIdentity) GetCopyAsIface() SipHeader {
+	return s.GetCopy()
+}
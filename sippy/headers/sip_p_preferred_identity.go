@@ -0,0 +1,50 @@
+package sippy_header
+
+import (
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+type SipPPreferredIdentity struct {
+	normalName
+	*sipAddressHF
+}
+
+var sipPPreferredIdentityName normalName = newNormalName("P-Preferred-Identity")
+
+func CreateSipPPreferredIdentity(body string) []SipHeader {
+	addresses := CreateSipAddressHFs(body)
+	rval := make([]SipHeader, len(addresses))
+	for i, addr := range addresses {
+		rval[i] = &SipPPreferredIdentity{
+			normalName:   sipPPreferredIdentityName,
+			sipAddressHF: addr,
+		}
+	}
+	return rval
+}
+
+func NewSipPPreferredIdentity(addr *SipAddress) *SipPPreferredIdentity {
+	return &SipPPreferredIdentity{
+		normalName:   sipPPreferredIdentityName,
+		sipAddressHF: newSipAddressHF(addr),
+	}
+}
+
+func (s *SipPPreferredIdentity) String() string {
+	return s.LocalStr(nil, false)
+}
+
+func (s *SipPPreferredIdentity) LocalStr(hostPort *sippy_net.HostPort, compact bool) string {
+	return s.Name() + ": " + s.LocalStringBody(hostPort)
+}
+
+func (s *SipPPreferredIdentity) GetCopy() *SipPPreferredIdentity {
+	return &SipPPreferredIdentity{
+		normalName:   sipPPreferredIdentityName,
+		sipAddressHF: s.sipAddressHF.getCopy(),
+	}
+}
+
+func (s *SipPPreferredIdentity) GetCopyAsIface() SipHeader {
+	return s.GetCopy()
+}
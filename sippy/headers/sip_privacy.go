@@ -0,0 +1,90 @@
+package sippy_header
+
+import (
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+// Privacy header field values (RFC 3323, RFC 3325)
+const (
+	PRIVACY_HEADER   = "header"
+	PRIVACY_SESSION  = "session"
+	PRIVACY_USER     = "user"
+	PRIVACY_NONE     = "none"
+	PRIVACY_CRITICAL = "critical"
+	PRIVACY_ID       = "id"
+)
+
+type SipPrivacy struct {
+	normalName
+	stringBody string
+	values     []string
+}
+
+var sipPrivacyName normalName = newNormalName("Privacy")
+
+func CreateSipPrivacy(body string) []SipHeader {
+	return []SipHeader{
+		&SipPrivacy{
+			normalName: sipPrivacyName,
+			stringBody: body,
+		},
+	}
+}
+
+func NewSipPrivacy(values ...string) *SipPrivacy {
+	return &SipPrivacy{
+		normalName: sipPrivacyName,
+		values:     values,
+	}
+}
+
+func (s *SipPrivacy) GetValues() []string {
+	if s.values == nil {
+		s.values = make([]string, 0)
+		for _, v := range strings.Split(s.stringBody, ";") {
+			v = strings.ToLower(strings.TrimSpace(v))
+			if v != "" {
+				s.values = append(s.values, v)
+			}
+		}
+	}
+	return s.values
+}
+
+func (s *SipPrivacy) HasValue(value string) bool {
+	for _, v := range s.GetValues() {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SipPrivacy) StringBody() string {
+	if s.values != nil {
+		return strings.Join(s.values, ";")
+	}
+	return s.stringBody
+}
+
+func (s *SipPrivacy) String() string {
+	return s.Name() + ": " + s.StringBody()
+}
+
+func (s *SipPrivacy) LocalStr(*sippy_net.HostPort, bool) string {
+	return s.String()
+}
+
+func (s *SipPrivacy) GetCopy() *SipPrivacy {
+	tmp := *s
+	if s.values != nil {
+		tmp.values = append([]string{}, s.values...)
+	}
+	return &tmp
+}
+
+func (s *SipPrivacy) GetCopyAsIface() SipHeader {
+	return s.GetCopy()
+}
@@ -1,5 +1,9 @@
 package sippy_header
 
+import (
+	"time"
+)
+
 type SipProxyAuthenticate struct {
 	*SipWWWAuthenticate
 }
@@ -17,6 +21,15 @@ func CreateSipProxyAuthenticate(body string) []SipHeader {
 	}
 }
 
+func NewSipProxyAuthenticateWithRealm(realm, algorithm string, now time.Time) *SipProxyAuthenticate {
+	super := NewSipWWWAuthenticateWithRealm(realm, algorithm, now)
+	super.normalName = sipProxyAuthenticateName
+	super.aClass = func(body *SipAuthorizationBody) SipHeader { return NewSipProxyAuthorizationWithBody(body) }
+	return &SipProxyAuthenticate{
+		SipWWWAuthenticate: super,
+	}
+}
+
 func (s *SipProxyAuthenticate) GetCopy() *SipProxyAuthenticate {
 	cself := &SipProxyAuthenticate{
 		SipWWWAuthenticate: s.SipWWWAuthenticate.GetCopy(),
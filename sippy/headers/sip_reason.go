@@ -104,3 +104,26 @@ func (s *SipReason) GetCopy() *SipReason {
 func (s *SipReason) GetCopyAsIface() SipHeader {
 	return s.GetCopy()
 }
+
+func (s *SipReason) getBody() *sipReasonBody {
+	if s.body == nil {
+		if err := s.parse(); err != nil {
+			return &sipReasonBody{}
+		}
+	}
+	return s.body
+}
+
+// GetProtocol returns the protocol of the Reason (e.g. "SIP" or "Q.850"),
+// the empty string is returned if the header cannot be parsed.
+func (s *SipReason) GetProtocol() string {
+	return s.getBody().protocol
+}
+
+func (s *SipReason) GetCause() string {
+	return s.getBody().cause
+}
+
+func (s *SipReason) GetText() string {
+	return s.getBody().reason
+}
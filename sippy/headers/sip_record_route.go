@@ -11,6 +11,13 @@ type SipRecordRoute struct {
 
 var sipRecordRouteName normalName = newNormalName("Record-Route")
 
+func NewSipRecordRoute(addr *SipAddress) *SipRecordRoute {
+	return &SipRecordRoute{
+		normalName:   sipRecordRouteName,
+		sipAddressHF: newSipAddressHF(addr),
+	}
+}
+
 func CreateSipRecordRoute(body string) []SipHeader {
 	addresses := CreateSipAddressHFs(body)
 	rval := make([]SipHeader, len(addresses))
@@ -0,0 +1,154 @@
+package sippy_header
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+// The UUID that is used when the actual value is not known yet (RFC 7989)
+const NULL_SESSION_UUID = "00000000000000000000000000000000"
+
+type SipSessionIdBody struct {
+	Local  string
+	Remote string
+	params []string
+}
+
+func (s *SipSessionIdBody) String() string {
+	ret := s.Local
+	if s.Remote != "" {
+		ret += ";remote=" + s.Remote
+	}
+	for _, param := range s.params {
+		ret += ";" + param
+	}
+	return ret
+}
+
+type SipSessionId struct {
+	normalName
+	stringBody string
+	body       *SipSessionIdBody
+}
+
+var sipSessionIdName normalName = newNormalName("Session-ID")
+
+func CreateSipSessionId(body string) []SipHeader {
+	return []SipHeader{
+		&SipSessionId{
+			normalName: sipSessionIdName,
+			stringBody: body,
+		},
+	}
+}
+
+func NewSipSessionId(local, remote string) *SipSessionId {
+	if local == "" {
+		local = NULL_SESSION_UUID
+	}
+	if remote == "" {
+		remote = NULL_SESSION_UUID
+	}
+	return &SipSessionId{
+		normalName: sipSessionIdName,
+		body: &SipSessionIdBody{
+			Local:  local,
+			Remote: remote,
+		},
+	}
+}
+
+// GenerateSessionUUID returns the version 4 UUID in the form required
+// by the RFC 7989, i.e. 32 lowercase hex digits without dashes.
+func GenerateSessionUUID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	buf[6] = (buf[6] & 0x0f) | 0x40
+	buf[8] = (buf[8] & 0x3f) | 0x80
+	return hex.EncodeToString(buf)
+}
+
+func isSessionUUID(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func (s *SipSessionId) parse() error {
+	arr := strings.Split(s.stringBody, ";")
+	body := &SipSessionIdBody{
+		Local: strings.ToLower(strings.TrimSpace(arr[0])),
+	}
+	if !isSessionUUID(body.Local) {
+		return errors.New("Error parsing Session-ID: bad local UUID")
+	}
+	for _, param := range arr[1:] {
+		param = strings.TrimSpace(param)
+		nv := strings.SplitN(param, "=", 2)
+		if len(nv) == 2 && strings.ToLower(strings.TrimSpace(nv[0])) == "remote" {
+			body.Remote = strings.ToLower(strings.TrimSpace(nv[1]))
+			if !isSessionUUID(body.Remote) {
+				return errors.New("Error parsing Session-ID: bad remote UUID")
+			}
+			continue
+		}
+		body.params = append(body.params, param)
+	}
+	s.body = body
+	return nil
+}
+
+func (s *SipSessionId) GetBody() (*SipSessionIdBody, error) {
+	if s.body == nil {
+		if err := s.parse(); err != nil {
+			return nil, err
+		}
+	}
+	return s.body, nil
+}
+
+// GetSwapped returns the Session-ID with the local and remote UUIDs
+// swapped, as it should appear in the messages sent in the opposite
+// direction.
+func (s *SipSessionId) GetSwapped() (*SipSessionId, error) {
+	body, err := s.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	return NewSipSessionId(body.Remote, body.Local), nil
+}
+
+func (s *SipSessionId) StringBody() string {
+	if s.body != nil {
+		return s.body.String()
+	}
+	return s.stringBody
+}
+
+func (s *SipSessionId) String() string {
+	return s.Name() + ": " + s.StringBody()
+}
+
+func (s *SipSessionId) LocalStr(*sippy_net.HostPort, bool) string {
+	return s.String()
+}
+
+func (s *SipSessionId) GetCopy() *SipSessionId {
+	tmp := *s
+	if s.body != nil {
+		body := *s.body
+		body.params = append([]string{}, s.body.params...)
+		tmp.body = &body
+	}
+	return &tmp
+}
+
+func (s *SipSessionId) GetCopyAsIface() SipHeader {
+	return s.GetCopy()
+}
@@ -349,9 +349,30 @@ func (s *SipURL) GetParams() []string {
 
 func (s *SipURL) GetCopy() *SipURL {
 	ret := *s
+	ret.headers = make(map[string]string, len(s.headers))
+	for k, v := range s.headers {
+		ret.headers[k] = v
+	}
 	return &ret
 }
 
+// GetHeader returns the value of the header embedded into the URI
+// (e.g. sip:bob@example.com?Reason=...), the name is case-insensitive.
+func (s *SipURL) GetHeader(name string) string {
+	return s.headers[strings.ToLower(name)]
+}
+
+func (s *SipURL) SetHeader(name, value string) {
+	if s.headers == nil {
+		s.headers = make(map[string]string)
+	}
+	s.headers[strings.ToLower(name)] = value
+}
+
+func (s *SipURL) DelHeader(name string) {
+	delete(s.headers, strings.ToLower(name))
+}
+
 func (s *SipURL) GetAddr(config sippy_conf.Config) *sippy_net.HostPort {
 	if s.Port != nil {
 		return sippy_net.NewHostPort(s.Host.String(), s.Port.String())
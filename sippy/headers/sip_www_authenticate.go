@@ -19,6 +19,7 @@ type SipWWWAuthenticateBody struct {
 	qop         []string
 	otherParams []string
 	opaque      string
+	stale       bool
 }
 
 type SipWWWAuthenticate struct {
@@ -34,15 +35,15 @@ func CreateSipWWWAuthenticate(body string) []SipHeader {
 	return []SipHeader{createSipWWWAuthenticateObj(body)}
 }
 
-func NewSipWWWAuthenticateWithRealm(realm, algorithm string, nowMono time.Time) *SipWWWAuthenticate {
+func NewSipWWWAuthenticateWithRealm(realm, algorithm string, now time.Time) *SipWWWAuthenticate {
 	return &SipWWWAuthenticate{
 		normalName: sipWwwAuthenticateName,
-		body:       newSipWWWAuthenticateBody(realm, algorithm, nowMono),
+		body:       newSipWWWAuthenticateBody(realm, algorithm, now),
 		aClass:     func(body *SipAuthorizationBody) SipHeader { return NewSipAuthorizationWithBody(body) },
 	}
 }
 
-func newSipWWWAuthenticateBody(realm, algorithm string, nowMono time.Time) *SipWWWAuthenticateBody {
+func newSipWWWAuthenticateBody(realm, algorithm string, now time.Time) *SipWWWAuthenticateBody {
 	s := &SipWWWAuthenticateBody{
 		algorithm: algorithm,
 		realm:     sippy_net.NewMyAddress(realm),
@@ -57,7 +58,7 @@ func newSipWWWAuthenticateBody(realm, algorithm string, nowMono time.Time) *SipW
 		_, _ = rand.Read(buf)
 		s.nonce = hex.EncodeToString(buf)
 	} else {
-		s.nonce = sippy_security.HashOracle.EmitChallenge(alg.Mask, nowMono)
+		s.nonce = sippy_security.HashOracle.EmitChallenge(alg.Mask, now)
 	}
 	return s
 }
@@ -93,6 +94,8 @@ func (s *SipWWWAuthenticate) parse() error {
 		case "qop":
 			qops := strings.Trim(arr[1], "\"")
 			body.qop = strings.Split(qops, ",")
+		case "stale":
+			body.stale = strings.EqualFold(strings.Trim(arr[1], "\""), "true")
 		default:
 			body.otherParams = append(body.otherParams, part)
 		}
@@ -146,6 +149,9 @@ func (s *SipWWWAuthenticateBody) localString(hostPort *sippy_net.HostPort) strin
 	} else if len(s.qop) > 1 {
 		ret += ",qop=\"" + strings.Join(s.qop, ",") + "\""
 	}
+	if s.stale {
+		ret += ",stale=true"
+	}
 	if len(s.otherParams) > 0 {
 		ret += "," + strings.Join(s.otherParams, ",")
 	}
@@ -160,6 +166,28 @@ func (s *SipWWWAuthenticateBody) GetNonce() string {
 	return s.nonce
 }
 
+func (s *SipWWWAuthenticateBody) GetAlgorithm() string {
+	return s.algorithm
+}
+
+func (s *SipWWWAuthenticateBody) GetQop() []string {
+	return s.qop
+}
+
+func (s *SipWWWAuthenticateBody) SetQop(qop []string) {
+	s.qop = qop
+}
+
+// GetStale tells if the previous request has been rejected only because
+// its nonce has expired (RFC 7616 section 3.3).
+func (s *SipWWWAuthenticateBody) GetStale() bool {
+	return s.stale
+}
+
+func (s *SipWWWAuthenticateBody) SetStale(stale bool) {
+	s.stale = stale
+}
+
 func (s *SipWWWAuthenticate) GetCopy() *SipWWWAuthenticate {
 	tmp := *s
 	if s.body != nil {
@@ -0,0 +1,132 @@
+package sippy_isup
+
+import (
+	"errors"
+)
+
+// Location values of the cause indicators
+const (
+	LOCATION_USER                = 0x00
+	LOCATION_PRIVATE_LOCAL       = 0x01
+	LOCATION_PUBLIC_LOCAL        = 0x02
+	LOCATION_TRANSIT             = 0x03
+	LOCATION_PUBLIC_REMOTE       = 0x04
+	LOCATION_PRIVATE_REMOTE      = 0x05
+	LOCATION_INTERNATIONAL       = 0x07
+	LOCATION_BEYOND_INTERWORKING = 0x0a
+)
+
+// Cause is the cause indicators parameter (ITU-T Q.850)
+type Cause struct {
+	CodingStandard byte
+	Location       byte
+	Value          byte
+	Diagnostics    []byte
+}
+
+func NewCause(value byte) *Cause {
+	return &Cause{
+		Location: LOCATION_BEYOND_INTERWORKING,
+		Value:    value,
+	}
+}
+
+func ParseCause(data []byte) (*Cause, error) {
+	if len(data) < 2 {
+		return nil, errors.New("ISUP cause indicators are too short")
+	}
+	s := &Cause{
+		CodingStandard: (data[0] >> 5) & 0x03,
+		Location:       data[0] & 0x0f,
+	}
+	pos := 1
+	if data[0]&0x80 == 0 {
+		// the recommendation octet is present
+		pos++
+	}
+	if pos >= len(data) {
+		return nil, errors.New("ISUP cause indicators are too short")
+	}
+	s.Value = data[pos] & 0x7f
+	s.Diagnostics = append([]byte{}, data[pos+1:]...)
+	return s, nil
+}
+
+func (s *Cause) Encode() []byte {
+	ret := []byte{0x80 | (s.CodingStandard&0x03)<<5 | s.Location&0x0f, 0x80 | s.Value&0x7f}
+	return append(ret, s.Diagnostics...)
+}
+
+/*
+Mapping between the ISUP causes and the SIP response codes (RFC 3398)
+*/
+var isupCauseToSipErr = map[int]struct {
+	code   int
+	reason string
+}{
+	1:   {404, "Not Found"},
+	2:   {404, "Not Found"},
+	3:   {404, "Not Found"},
+	17:  {486, "Busy Here"},
+	18:  {408, "Request Timeout"},
+	19:  {480, "Temporarily Unavailable"},
+	20:  {480, "Temporarily Unavailable"},
+	21:  {403, "Forbidden"},
+	22:  {410, "Gone"},
+	23:  {410, "Gone"},
+	26:  {404, "Not Found"},
+	27:  {502, "Bad Gateway"},
+	28:  {484, "Address Incomplete"},
+	29:  {501, "Not Implemented"},
+	31:  {480, "Temporarily Unavailable"},
+	34:  {503, "Service Unavailable"},
+	38:  {503, "Service Unavailable"},
+	41:  {503, "Service Unavailable"},
+	42:  {503, "Service Unavailable"},
+	47:  {503, "Service Unavailable"},
+	55:  {403, "Forbidden"},
+	57:  {403, "Forbidden"},
+	58:  {503, "Service Unavailable"},
+	65:  {488, "Not Acceptable Here"},
+	70:  {488, "Not Acceptable Here"},
+	79:  {501, "Not Implemented"},
+	87:  {403, "Forbidden"},
+	88:  {503, "Service Unavailable"},
+	102: {504, "Server Time-out"},
+	111: {500, "Server Internal Error"},
+	127: {500, "Server Internal Error"},
+}
+
+var sipErrToIsupCause = map[int]int{
+	400: 41, 401: 21, 402: 21, 403: 21, 404: 1, 405: 63, 406: 79, 407: 21, 408: 102, 410: 22,
+	413: 127, 414: 127, 415: 79, 416: 127, 420: 127, 480: 18, 481: 41, 482: 25, 483: 25,
+	484: 28, 485: 1, 486: 17, 487: 31, 488: 127, 500: 41, 501: 79, 502: 38, 503: 41, 504: 102,
+	505: 127, 513: 127, 600: 17, 603: 21, 604: 1, 606: 58,
+}
+
+// CauseToSip maps the ISUP cause value to the SIP response code and
+// reason phrase. The causes not listed in the RFC 3398 map to the class
+// defaults.
+func CauseToSip(cause int) (int, string) {
+	if res, ok := isupCauseToSipErr[cause]; ok {
+		return res.code, res.reason
+	}
+	switch {
+	case cause < 32:
+		return 480, "Temporarily Unavailable"
+	case cause < 64:
+		return 503, "Service Unavailable"
+	case cause < 80:
+		return 488, "Not Acceptable Here"
+	}
+	return 500, "Server Internal Error"
+}
+
+// SipToCause maps the SIP response code to the ISUP cause value, 31
+// "normal, unspecified" is used for the codes not listed in the RFC 3398.
+func SipToCause(code int) int {
+	if cause, ok := sipErrToIsupCause[code]; ok {
+		return cause
+	}
+	return 31
+}
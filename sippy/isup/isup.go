@@ -0,0 +1,384 @@
+package sippy_isup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Message type codes (ITU-T Q.763 table 4)
+const (
+	MSG_IAM = 0x01 // Initial address
+	MSG_SAM = 0x02 // Subsequent address
+	MSG_ACM = 0x06 // Address complete
+	MSG_CON = 0x07 // Connect
+	MSG_ANM = 0x09 // Answer
+	MSG_REL = 0x0c // Release
+	MSG_RLC = 0x10 // Release complete
+	MSG_CPG = 0x2c // Call progress
+)
+
+// Parameter codes (ITU-T Q.763 table 5)
+const (
+	PARAM_END_OF_OPTIONAL     = 0x00
+	PARAM_TMR                 = 0x02 // Transmission medium requirement
+	PARAM_ACCESS_TRANSPORT    = 0x03
+	PARAM_CALLED_PARTY_NUMBER = 0x04
+	PARAM_SUBSEQUENT_NUMBER   = 0x05
+	PARAM_NCI                 = 0x06 // Nature of connection indicators
+	PARAM_FCI                 = 0x07 // Forward call indicators
+	PARAM_OFCI                = 0x08 // Optional forward call indicators
+	PARAM_CPC                 = 0x09 // Calling party's category
+	PARAM_CALLING_PARTY_NUM   = 0x0a
+	PARAM_REDIRECTING_NUMBER  = 0x0b
+	PARAM_BCI                 = 0x11 // Backward call indicators
+	PARAM_CAUSE_INDICATORS    = 0x12
+	PARAM_REDIRECTION_INFO    = 0x13
+	PARAM_USI                 = 0x1d // User service information
+	PARAM_EVENT_INFORMATION   = 0x24
+	PARAM_ORIG_CALLED_NUMBER  = 0x28
+	PARAM_OBCI                = 0x29 // Optional backward call indicators
+	PARAM_GENERIC_NUMBER      = 0xc0
+)
+
+// Calling party's category values
+const (
+	CPC_UNKNOWN  = 0x00
+	CPC_ORDINARY = 0x0a
+	CPC_PRIORITY = 0x0b
+	CPC_DATA     = 0x0c
+	CPC_TEST     = 0x0d
+	CPC_PAYPHONE = 0x0f
+)
+
+// Event information values of the CPG
+const (
+	EVENT_ALERTING = 0x01
+	EVENT_PROGRESS = 0x02
+)
+
+type Variant int
+
+const (
+	// ITU-T Q.763, also the base of the ETSI, UK and most of the other
+	// national variants as far as the messages supported here concerned.
+	VARIANT_ITU Variant = iota
+	// ANSI T1.113
+	VARIANT_ANSI
+)
+
+// ParseVariant maps the version parameter of the application/isup
+// content type (RFC 3204) to the variant.
+func ParseVariant(version string) Variant {
+	if strings.HasPrefix(strings.ToLower(version), "ansi") {
+		return VARIANT_ANSI
+	}
+	return VARIANT_ITU
+}
+
+// Version returns the value of the version parameter of the
+// application/isup content type.
+func (v Variant) Version() string {
+	if v == VARIANT_ANSI {
+		return "ansi92"
+	}
+	return "itu-t92+"
+}
+
+// paramSpec describes the mandatory parameter, the zero length means
+// that the parameter belongs to the mandatory variable part.
+type paramSpec struct {
+	code   byte
+	length int
+}
+
+var itu_formats = map[byte][]paramSpec{
+	MSG_IAM: {{PARAM_NCI, 1}, {PARAM_FCI, 2}, {PARAM_CPC, 1}, {PARAM_TMR, 1}, {PARAM_CALLED_PARTY_NUMBER, 0}},
+	MSG_SAM: {{PARAM_SUBSEQUENT_NUMBER, 0}},
+	MSG_ACM: {{PARAM_BCI, 2}},
+	MSG_CON: {{PARAM_BCI, 2}},
+	MSG_ANM: {},
+	MSG_REL: {{PARAM_CAUSE_INDICATORS, 0}},
+	MSG_RLC: {},
+	MSG_CPG: {{PARAM_EVENT_INFORMATION, 1}},
+}
+
+var ansi_formats = map[byte][]paramSpec{
+	MSG_IAM: {{PARAM_NCI, 1}, {PARAM_FCI, 2}, {PARAM_CPC, 1}, {PARAM_USI, 0}, {PARAM_CALLED_PARTY_NUMBER, 0}},
+	MSG_ACM: {{PARAM_BCI, 2}},
+	MSG_CON: {{PARAM_BCI, 2}},
+	MSG_ANM: {},
+	MSG_REL: {{PARAM_CAUSE_INDICATORS, 0}},
+	MSG_RLC: {},
+	MSG_CPG: {{PARAM_EVENT_INFORMATION, 1}},
+}
+
+func (v Variant) formats() map[byte][]paramSpec {
+	if v == VARIANT_ANSI {
+		return ansi_formats
+	}
+	return itu_formats
+}
+
+type Parameter struct {
+	Code byte
+	Data []byte
+}
+
+// Message is the ISUP message as it is carried in the SIP body, i.e.
+// without the routing label and the CIC (RFC 3204).
+type Message struct {
+	Type      byte
+	Mandatory []*Parameter
+	Optional  []*Parameter
+}
+
+// NewMessage creates the message of the given type with the mandatory
+// parameters zeroed.
+func NewMessage(mtype byte, variant Variant) (*Message, error) {
+	format, ok := variant.formats()[mtype]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ISUP message type 0x%02x", mtype)
+	}
+	s := &Message{
+		Type:      mtype,
+		Mandatory: make([]*Parameter, len(format)),
+		Optional:  make([]*Parameter, 0),
+	}
+	for i, spec := range format {
+		s.Mandatory[i] = &Parameter{Code: spec.code, Data: make([]byte, spec.length)}
+	}
+	return s, nil
+}
+
+func Decode(data []byte, variant Variant) (*Message, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty ISUP message")
+	}
+	s, err := NewMessage(data[0], variant)
+	if err != nil {
+		return nil, err
+	}
+	format := variant.formats()[s.Type]
+	pos := 1
+	nvar := 0
+	for i, spec := range format {
+		if spec.length == 0 {
+			nvar++
+			continue
+		}
+		if pos+spec.length > len(data) {
+			return nil, errors.New("truncated ISUP message")
+		}
+		s.Mandatory[i].Data = append([]byte{}, data[pos:pos+spec.length]...)
+		pos += spec.length
+	}
+	// Each mandatory variable parameter and the optional part are
+	// referenced by the pointers relative to the pointer position
+	// itself. All messages supported here allow the optional part.
+	if pos+nvar+1 > len(data) {
+		return nil, errors.New("truncated ISUP message")
+	}
+	for i, spec := range format {
+		if spec.length != 0 {
+			continue
+		}
+		ptr := pos + int(data[pos])
+		if data[pos] == 0 || ptr >= len(data) || ptr+1+int(data[ptr]) > len(data) {
+			return nil, errors.New("bad mandatory variable parameter pointer in ISUP message")
+		}
+		s.Mandatory[i].Data = append([]byte{}, data[ptr+1:ptr+1+int(data[ptr])]...)
+		pos++
+	}
+	if data[pos] == 0 {
+		return s, nil
+	}
+	for ptr := pos + int(data[pos]); ; {
+		if ptr >= len(data) {
+			return nil, errors.New("missing end of optional parameters in ISUP message")
+		}
+		code := data[ptr]
+		if code == PARAM_END_OF_OPTIONAL {
+			break
+		}
+		if ptr+2 > len(data) || ptr+2+int(data[ptr+1]) > len(data) {
+			return nil, errors.New("truncated optional parameter in ISUP message")
+		}
+		s.Optional = append(s.Optional, &Parameter{Code: code, Data: append([]byte{}, data[ptr+2:ptr+2+int(data[ptr+1])]...)})
+		ptr += 2 + int(data[ptr+1])
+	}
+	return s, nil
+}
+
+func (s *Message) Encode(variant Variant) ([]byte, error) {
+	format, ok := variant.formats()[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ISUP message type 0x%02x", s.Type)
+	}
+	if len(format) != len(s.Mandatory) {
+		return nil, errors.New("bad number of mandatory parameters in ISUP message")
+	}
+	ret := []byte{s.Type}
+	vparams := []*Parameter{}
+	for i, spec := range format {
+		if spec.length == 0 {
+			vparams = append(vparams, s.Mandatory[i])
+			continue
+		}
+		if len(s.Mandatory[i].Data) != spec.length {
+			return nil, fmt.Errorf("bad length of the mandatory ISUP parameter 0x%02x", spec.code)
+		}
+		ret = append(ret, s.Mandatory[i].Data...)
+	}
+	// pointers and then the mandatory variable parameters
+	ptrs := len(ret)
+	ret = append(ret, make([]byte, len(vparams)+1)...)
+	for i, p := range vparams {
+		if len(p.Data) > 255 {
+			return nil, fmt.Errorf("ISUP parameter 0x%02x is too long", p.Code)
+		}
+		ret[ptrs+i] = byte(len(ret) - ptrs - i)
+		ret = append(ret, byte(len(p.Data)))
+		ret = append(ret, p.Data...)
+	}
+	if len(s.Optional) == 0 {
+		return ret, nil
+	}
+	ret[ptrs+len(vparams)] = byte(len(ret) - ptrs - len(vparams))
+	for _, p := range s.Optional {
+		if len(p.Data) > 255 {
+			return nil, fmt.Errorf("ISUP parameter 0x%02x is too long", p.Code)
+		}
+		ret = append(ret, p.Code, byte(len(p.Data)))
+		ret = append(ret, p.Data...)
+	}
+	return append(ret, PARAM_END_OF_OPTIONAL), nil
+}
+
+// GetParam returns the mandatory or optional parameter or nil if the
+// message does not have it.
+func (s *Message) GetParam(code byte) *Parameter {
+	for _, p := range s.Mandatory {
+		if p.Code == code {
+			return p
+		}
+	}
+	for _, p := range s.Optional {
+		if p.Code == code {
+			return p
+		}
+	}
+	return nil
+}
+
+// SetParam replaces the value of the parameter or adds it to the optional
+// part.
+func (s *Message) SetParam(code byte, data []byte) {
+	if p := s.GetParam(code); p != nil {
+		p.Data = data
+		return
+	}
+	s.Optional = append(s.Optional, &Parameter{Code: code, Data: data})
+}
+
+// DelParam removes the optional parameter.
+func (s *Message) DelParam(code byte) {
+	for i, p := range s.Optional {
+		if p.Code == code {
+			s.Optional = append(s.Optional[:i], s.Optional[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Message) GetCopy() *Message {
+	ret := &Message{
+		Type:      s.Type,
+		Mandatory: make([]*Parameter, len(s.Mandatory)),
+		Optional:  make([]*Parameter, len(s.Optional)),
+	}
+	for i, p := range s.Mandatory {
+		ret.Mandatory[i] = &Parameter{Code: p.Code, Data: append([]byte{}, p.Data...)}
+	}
+	for i, p := range s.Optional {
+		ret.Optional[i] = &Parameter{Code: p.Code, Data: append([]byte{}, p.Data...)}
+	}
+	return ret
+}
+
+func (s *Message) GetNumber(code byte) (*Number, error) {
+	p := s.GetParam(code)
+	if p == nil {
+		return nil, nil
+	}
+	return ParseNumber(p.Data)
+}
+
+func (s *Message) GetCause() (*Cause, error) {
+	p := s.GetParam(PARAM_CAUSE_INDICATORS)
+	if p == nil {
+		return nil, nil
+	}
+	return ParseCause(p.Data)
+}
+
+// NewIAM creates the initial address message. The calling party number
+// is optional.
+func NewIAM(called, calling *Number, variant Variant) *Message {
+	s, _ := NewMessage(MSG_IAM, variant)
+	// no satellite, continuity check not required, no echo control
+	s.GetParam(PARAM_NCI).Data = []byte{0x00}
+	// international call indicator cleared, interworking encountered,
+	// ISDN user part not used all the way, ISDN access
+	s.GetParam(PARAM_FCI).Data = []byte{0x08, 0x01}
+	s.GetParam(PARAM_CPC).Data = []byte{CPC_ORDINARY}
+	if variant == VARIANT_ANSI {
+		// speech, CCITT coding, circuit mode, 64 kbit/s, G.711 mu-law
+		s.GetParam(PARAM_USI).Data = []byte{0x80, 0x90, 0xa2}
+	} else {
+		// speech
+		s.GetParam(PARAM_TMR).Data = []byte{0x00}
+	}
+	s.GetParam(PARAM_CALLED_PARTY_NUMBER).Data = called.Encode()
+	if calling != nil {
+		s.SetParam(PARAM_CALLING_PARTY_NUM, calling.Encode())
+	}
+	return s
+}
+
+// NewACM creates the address complete message, the alerting indicates
+// whether the called party is being alerted (180) or not (183).
+func NewACM(alerting bool, variant Variant) *Message {
+	s, _ := NewMessage(MSG_ACM, variant)
+	// charge, ordinary subscriber, interworking encountered
+	s.GetParam(PARAM_BCI).Data = []byte{0x12, 0x14}
+	if alerting {
+		s.GetParam(PARAM_BCI).Data[0] |= 0x04
+	}
+	return s
+}
+
+func NewCPG(event byte, variant Variant) *Message {
+	s, _ := NewMessage(MSG_CPG, variant)
+	s.GetParam(PARAM_EVENT_INFORMATION).Data = []byte{event}
+	return s
+}
+
+func NewANM(variant Variant) *Message {
+	s, _ := NewMessage(MSG_ANM, variant)
+	return s
+}
+
+// NewCON creates the connect message, which is sent instead of the ACM
+// and the ANM when the call is answered immediately.
+func NewCON(variant Variant) *Message {
+	s, _ := NewMessage(MSG_CON, variant)
+	s.GetParam(PARAM_BCI).Data = []byte{0x16, 0x14}
+	return s
+}
+
+func NewREL(cause *Cause, variant Variant) *Message {
+	s, _ := NewMessage(MSG_REL, variant)
+	s.GetParam(PARAM_CAUSE_INDICATORS).Data = cause.Encode()
+	return s
+}
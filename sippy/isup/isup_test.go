@@ -0,0 +1,66 @@
+package sippy_isup
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIAM(t *testing.T) {
+	iam := []byte{0x01, 0x00, 0x60, 0x01, 0x0a, 0x00, 0x02, 0x08,
+		0x06, 0x83, 0x10, 0x21, 0x43, 0x65, 0x07,
+		0x0a, 0x05, 0x03, 0x13, 0x21, 0x43, 0x65, 0x00}
+	msg, err := Decode(iam, VARIANT_ITU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	called, err := msg.GetNumber(PARAM_CALLED_PARTY_NUMBER)
+	if err != nil || called.Digits != "1234567" || called.Nai != NAI_NATIONAL || called.Npi != NPI_ISDN {
+		t.Fatalf("Bad called party number: %+v (%v)", called, err)
+	}
+	calling, err := msg.GetNumber(PARAM_CALLING_PARTY_NUM)
+	if err != nil || calling.Digits != "123456" || calling.Screening != SCREENING_NETWORK {
+		t.Fatalf("Bad calling party number: %+v (%v)", calling, err)
+	}
+	data, err := msg.Encode(VARIANT_ITU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, iam) {
+		t.Errorf("Bad encoded IAM: % x", data)
+	}
+}
+
+func TestGeneratedMessages(t *testing.T) {
+	for _, variant := range []Variant{VARIANT_ITU, VARIANT_ANSI} {
+		msgs := []*Message{
+			NewIAM(NewNumber("+12125551234"), NewNumber("5551000"), variant),
+			NewACM(true, variant),
+			NewCPG(EVENT_PROGRESS, variant),
+			NewANM(variant),
+			NewCON(variant),
+			NewREL(NewCause(byte(SipToCause(486))), variant),
+		}
+		for _, msg := range msgs {
+			data, err := msg.Encode(variant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg2, err := Decode(data, variant)
+			if err != nil {
+				t.Fatalf("Cannot decode message 0x%02x: %s", msg.Type, err.Error())
+			}
+			data2, _ := msg2.Encode(variant)
+			if !bytes.Equal(data, data2) {
+				t.Errorf("Message 0x%02x differs after decoding: % x != % x", msg.Type, data, data2)
+			}
+		}
+		called, _ := msgs[0].GetNumber(PARAM_CALLED_PARTY_NUMBER)
+		if called.E164() != "+12125551234" {
+			t.Errorf("Bad called party number: %s", called.E164())
+		}
+		cause, _ := msgs[5].GetCause()
+		if code, _ := CauseToSip(int(cause.Value)); code != 486 {
+			t.Errorf("Bad cause mapping: %d", code)
+		}
+	}
+}
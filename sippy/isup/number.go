@@ -0,0 +1,118 @@
+package sippy_isup
+
+import (
+	"errors"
+	"strings"
+)
+
+// Nature of address indicator values
+const (
+	NAI_SUBSCRIBER    = 0x01
+	NAI_UNKNOWN       = 0x02
+	NAI_NATIONAL      = 0x03
+	NAI_INTERNATIONAL = 0x04
+)
+
+// Numbering plan indicator values
+const (
+	NPI_ISDN = 0x01
+	NPI_DATA = 0x03
+)
+
+// Address presentation restricted indicator values
+const (
+	APRI_ALLOWED     = 0x00
+	APRI_RESTRICTED  = 0x01
+	APRI_UNAVAILABLE = 0x02
+)
+
+// Screening indicator values
+const (
+	SCREENING_USER_PROVIDED = 0x01
+	SCREENING_NETWORK       = 0x03
+)
+
+const isup_digits = "0123456789ABCDEF"
+
+// Number is the called, calling, redirecting or the original called
+// party number. The Inn is the internal network number indicator for
+// the called party and the number incomplete indicator for the calling
+// party. The presentation and screening are only meaningful for the
+// calling party type numbers.
+type Number struct {
+	Nai          byte
+	Npi          byte
+	Inn          byte
+	Presentation byte
+	Screening    byte
+	Digits       string
+}
+
+// NewNumber creates the ISDN number with the nature of address derived
+// from the E.164 digits: the international one if the number starts
+// with "+" and the unknown otherwise.
+func NewNumber(digits string) *Number {
+	nai := byte(NAI_UNKNOWN)
+	if strings.HasPrefix(digits, "+") {
+		nai = NAI_INTERNATIONAL
+		digits = digits[1:]
+	}
+	return &Number{
+		Nai:    nai,
+		Npi:    NPI_ISDN,
+		Digits: strings.ToUpper(digits),
+	}
+}
+
+func ParseNumber(data []byte) (*Number, error) {
+	if len(data) < 2 {
+		return nil, errors.New("ISUP number is too short")
+	}
+	s := &Number{
+		Nai:          data[0] & 0x7f,
+		Inn:          data[1] >> 7,
+		Npi:          (data[1] >> 4) & 0x07,
+		Presentation: (data[1] >> 2) & 0x03,
+		Screening:    data[1] & 0x03,
+	}
+	digits := make([]byte, 0, (len(data)-2)*2)
+	for _, b := range data[2:] {
+		digits = append(digits, isup_digits[b&0x0f], isup_digits[b>>4])
+	}
+	if data[0]&0x80 != 0 && len(digits) > 0 {
+		// odd number of address signals
+		digits = digits[:len(digits)-1]
+	}
+	s.Digits = string(digits)
+	return s, nil
+}
+
+func (s *Number) Encode() []byte {
+	digits := s.Digits
+	ret := []byte{s.Nai & 0x7f, (s.Inn&0x01)<<7 | (s.Npi&0x07)<<4 | (s.Presentation&0x03)<<2 | s.Screening&0x03}
+	if len(digits)%2 != 0 {
+		ret[0] |= 0x80
+		digits += "0"
+	}
+	for i := 0; i < len(digits); i += 2 {
+		lo := strings.IndexByte(isup_digits, digits[i])
+		hi := strings.IndexByte(isup_digits, digits[i+1])
+		if lo < 0 {
+			lo = 0
+		}
+		if hi < 0 {
+			hi = 0
+		}
+		ret = append(ret, byte(hi<<4|lo))
+	}
+	return ret
+}
+
+// E164 returns the number with the "+" prefix for the international
+// numbers.
+func (s *Number) E164() string {
+	if s.Nai == NAI_INTERNATIONAL {
+		return "+" + s.Digits
+	}
+	return s.Digits
+}
@@ -0,0 +1,83 @@
+package sippy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+type test_no_local_ua_call_map struct {
+	test_call_map
+}
+
+func (s *test_no_local_ua_call_map) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerTransaction) (sippy_types.UA, sippy_types.RequestReceiver, sippy_types.SipResponse) {
+	s.ua = NewUA(s.sip_tm, s.config, sippy_net.NewHostPort("1.1.1.1", "5060"), s, &s.lock, nil)
+	s.ua.SetLocalUA(sippy_header.NewSipUserAgent("Secret B2BUA 1.0"))
+	s.ua.SetNoLocalUA(true)
+	s.msg_body = req.GetBody()
+	return s.ua, s.ua, nil
+}
+
+func Test_NoLocalUA(t *testing.T) {
+	var err error
+
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+	config.SetSipAddress(config.GetMyAddress())
+	config.SetSipPort(config.GetMyPort())
+	cmap := &test_no_local_ua_call_map{test_call_map{config: config}}
+	tfactory := NewTestSipTransportFactory()
+	config.SetSipTransportFactory(tfactory)
+	cmap.sip_tm, err = NewSipTransactionManager(config, cmap)
+	if err != nil {
+		t.Fatal("Cannot create SIP transaction manager: " + err.Error())
+	}
+	go cmap.sip_tm.Run()
+	defer cmap.sip_tm.Shutdown()
+	check := func(what string) {
+		res := string(tfactory.get())
+		if !strings.HasPrefix(res, what) && !strings.HasPrefix(res, "SIP/2.0 "+what) {
+			t.Fatalf("Got %s while expecting %s", strings.SplitN(res, "\r\n", 2)[0], what)
+		}
+		if strings.Contains(res, "User-Agent:") || strings.Contains(res, "Server:") {
+			t.Errorf("The B2BUA identity has been sent in %s:\n%s", what, res)
+		}
+	}
+
+	// The incoming call
+	tfactory.feed([]string{
+		"INVITE sip:bob@10.20.30.40 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK776asdhds",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=1928301774",
+		"To: <sip:bob@example.com>",
+		"Contact: <sip:alice@1.1.1.1:5060>",
+		"Call-ID: a84b4c76e66710@1.1.1.1",
+		"CSeq: 314159 INVITE",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	check("100 Trying")
+	cmap.answer()
+	check("200 OK")
+	cmap.disconnect()
+	check("BYE")
+
+	// The outgoing call
+	ua := NewUA(cmap.sip_tm, config, sippy_net.NewHostPort("2.2.2.2", "5060"), cmap, &cmap.lock, nil)
+	ua.SetNoLocalUA(true)
+	event, _ := NewCCEventTry(nil, "alice", "bob", nil, nil, "", nil, "")
+	ua.RecvEvent(event)
+	inv := getTestRequest(t, tfactory, config, "INVITE")
+	if inv.GetFirstHF("User-Agent") != nil {
+		t.Errorf("The B2BUA identity has been sent in INVITE:\n%s", inv.LocalStr(nil, false))
+	}
+	tfactory.feed([]string{inv.GenResponse(180, "Ringing", nil, nil).LocalStr(nil, false)})
+	ua.RecvEvent(NewCCEventDisconnect(nil, nil, ""))
+	check("CANCEL")
+}
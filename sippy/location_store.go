@@ -0,0 +1,99 @@
+package sippy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+// memoryLocationStore is the default LocationStore that keeps the
+// bindings in memory, so they are lost on restart.
+type memoryLocationStore struct {
+	lock     sync.Mutex
+	bindings map[string]map[string]*sippy_types.Binding
+}
+
+func NewMemoryLocationStore() *memoryLocationStore {
+	return &memoryLocationStore{
+		bindings: make(map[string]map[string]*sippy_types.Binding),
+	}
+}
+
+// Lookup returns copies of the live bindings of the AOR, the most
+// preferred one first.
+func (s *memoryLocationStore) Lookup(aor string, now time.Time) ([]*sippy_types.Binding, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(aor, now)
+	ret := []*sippy_types.Binding{}
+	for _, binding := range s.bindings[aor] {
+		ret = append(ret, binding.GetCopy())
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Q != ret[j].Q {
+			return ret[i].Q > ret[j].Q
+		}
+		return ret[i].Expires.After(ret[j].Expires)
+	})
+	return ret, nil
+}
+
+func (s *memoryLocationStore) Update(binding *sippy_types.Binding) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(binding.Aor, time.Now())
+	bindings, ok := s.bindings[binding.Aor]
+	if !ok {
+		bindings = make(map[string]*sippy_types.Binding)
+		s.bindings[binding.Aor] = bindings
+	}
+	bindings[binding.Contact] = binding.GetCopy()
+	return nil
+}
+
+func (s *memoryLocationStore) Remove(aor, contact string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if bindings, ok := s.bindings[aor]; ok {
+		delete(bindings, contact)
+		if len(bindings) == 0 {
+			delete(s.bindings, aor)
+		}
+	}
+	return nil
+}
+
+func (s *memoryLocationStore) RemoveAll(aor string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.bindings, aor)
+	return nil
+}
+
+// Purge drops all expired bindings. The store does that for an AOR every
+// time it is accessed, so calling Purge periodically only makes sense
+// when there are many AORs that do not re-register.
+func (s *memoryLocationStore) Purge(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for aor := range s.bindings {
+		s.expire(aor, now)
+	}
+}
+
+func (s *memoryLocationStore) expire(aor string, now time.Time) {
+	bindings, ok := s.bindings[aor]
+	if !ok {
+		return
+	}
+	for contact, binding := range bindings {
+		if !binding.Expires.After(now) {
+			delete(bindings, contact)
+		}
+	}
+	if len(bindings) == 0 {
+		delete(s.bindings, aor)
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
 	"github.com/egovorukhin/go-b2bua/sippy/net"
 	"github.com/egovorukhin/go-b2bua/sippy/types"
+	"github.com/egovorukhin/go-b2bua/sippy/utils"
 )
 
 type msgBody struct {
 	mtype          string
 	sdp            sippy_types.Sdp
+	parts          []sippy_types.MsgBodyPart
+	boundary       string
 	string_content string
 	needs_update   bool
 	parsed         bool
@@ -19,7 +23,7 @@ type msgBody struct {
 
 func NewMsgBody(content, mtype string) *msgBody {
 	return &msgBody{
-		mtype:          mtype,
+		mtype:          normalizeMtype(mtype),
 		sdp:            nil,
 		string_content: content,
 		needs_update:   true,
@@ -27,11 +31,57 @@ func NewMsgBody(content, mtype string) *msgBody {
 	}
 }
 
+// NewMultipartMsgBody creates the multipart/mixed body (RFC 5621) out of
+// the parts provided.
+func NewMultipartMsgBody(parts ...sippy_types.MsgBodyPart) *msgBody {
+	boundary := "unique-boundary-" + sippy_utils.GenTag()
+	return &msgBody{
+		mtype:        "multipart/mixed;boundary=" + boundary,
+		parts:        parts,
+		boundary:     boundary,
+		needs_update: true,
+		parsed:       true,
+	}
+}
+
+// normalizeMtype converts the media type to the lower case leaving the
+// parameters intact as the multipart boundary is case sensitive.
+func normalizeMtype(mtype string) string {
+	arr := strings.SplitN(mtype, ";", 2)
+	arr[0] = strings.ToLower(strings.TrimSpace(arr[0]))
+	return strings.Join(arr, ";")
+}
+
+// mediaType returns the media type without parameters.
+func mediaType(mtype string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(mtype, ";", 2)[0]))
+}
+
+// mtypeParam returns the value of the media type parameter or "" if
+// there is no such parameter.
+func mtypeParam(mtype, name string) string {
+	arr := strings.Split(mtype, ";")
+	for _, param := range arr[1:] {
+		nv := strings.SplitN(param, "=", 2)
+		if len(nv) == 2 && strings.ToLower(strings.TrimSpace(nv[0])) == name {
+			return strings.Trim(strings.TrimSpace(nv[1]), "\"")
+		}
+	}
+	return ""
+}
+
 func (s *msgBody) GetSdp() (sippy_types.Sdp, error) {
 	err := s.parse()
 	if err != nil {
 		return nil, err
 	}
+	if s.parts != nil {
+		part := s.GetPart("application/sdp")
+		if part == nil {
+			return nil, errors.New("Not an SDP message")
+		}
+		return part.GetBody().GetSdp()
+	}
 	if s.sdp == nil {
 		return nil, errors.New("Not an SDP message")
 	}
@@ -42,56 +92,18 @@ func (s *msgBody) parse() error {
 	if s.parsed {
 		return nil
 	}
-	if strings.HasPrefix(s.mtype, "multipart/mixed;") {
-		arr := strings.SplitN(s.mtype, ";", 2)
-		mtheaders := arr[1]
-		var mth_boundary *string = nil
-		for _, s := range strings.Split(mtheaders, ";") {
-			arr = strings.SplitN(s, "=", 2)
-			if arr[0] == "boundary" && len(arr) == 2 {
-				mth_boundary = &arr[1]
-				break
-			}
-		}
-		if mth_boundary == nil {
+	if strings.HasPrefix(mediaType(s.mtype), "multipart/") {
+		boundary := mtypeParam(s.mtype, "boundary")
+		if boundary == "" {
 			return errors.New("Error parsing the multipart message")
 		}
-		boundary := "--" + *mth_boundary
-		for _, subsection := range strings.Split(s.string_content, boundary) {
-			subsection = strings.TrimSpace(subsection)
-			if subsection == "" {
-				continue
-			}
-			boff, bdel := -1, ""
-			for _, bdel = range []string{"\r\n\r\n", "\r\r", "\n\n"} {
-				boff = strings.Index(subsection, bdel)
-				if boff != -1 {
-					break
-				}
-			}
-			if boff == -1 {
-				continue
-			}
-			mbody := subsection[boff+len(bdel):]
-			mtype := ""
-			for _, line := range strings.FieldsFunc(subsection[:boff], func(c rune) bool { return c == '\n' || c == '\r' }) {
-				tmp := strings.ToLower(strings.TrimSpace(line))
-				if strings.HasPrefix(tmp, "content-type:") {
-					arr = strings.SplitN(tmp, ":", 2)
-					mtype = strings.TrimSpace(arr[1])
-				}
-			}
-			if mtype == "" {
-				continue
-			}
-			if mtype == "application/sdp" {
-				s.mtype = mtype
-				s.string_content = mbody
-				break
-			}
+		parts, err := parseMultipart(s.string_content, boundary)
+		if err != nil {
+			return err
 		}
-	}
-	if s.mtype == "application/sdp" {
+		s.parts = parts
+		s.boundary = boundary
+	} else if mediaType(s.mtype) == "application/sdp" {
 		sdp, err := ParseSdpBody(s.string_content)
 		if err == nil {
 			s.sdp = sdp
@@ -104,13 +116,18 @@ func (s *msgBody) parse() error {
 }
 
 func (s *msgBody) String() string {
-	if s.sdp != nil {
+	if s.parts != nil {
+		s.string_content = s.multipartStr(nil)
+	} else if s.sdp != nil {
 		s.string_content = s.sdp.String()
 	}
 	return s.string_content
 }
 
 func (s *msgBody) LocalStr(local_hostport *sippy_net.HostPort) string {
+	if s.parts != nil {
+		return s.multipartStr(local_hostport)
+	}
 	if s.sdp != nil {
 		return s.sdp.LocalStr(local_hostport)
 	}
@@ -125,9 +142,18 @@ func (s *msgBody) GetCopy() sippy_types.MsgBody {
 	if s.sdp != nil {
 		sdp = s.sdp.GetCopy()
 	}
+	var parts []sippy_types.MsgBodyPart
+	if s.parts != nil {
+		parts = make([]sippy_types.MsgBodyPart, len(s.parts))
+		for i, part := range s.parts {
+			parts[i] = part.GetCopy()
+		}
+	}
 	return &msgBody{
 		mtype:          s.mtype,
 		sdp:            sdp,
+		parts:          parts,
+		boundary:       s.boundary,
 		string_content: s.string_content,
 		needs_update:   true,
 		parsed:         s.parsed,
@@ -147,9 +173,197 @@ func (s *msgBody) SetNeedsUpdate(v bool) {
 }
 
 func (s *msgBody) AppendAHeader(hdr string) {
-	if s.sdp != nil {
+	if s.parts != nil {
+		if part := s.GetPart("application/sdp"); part != nil {
+			part.GetBody().AppendAHeader(hdr)
+		}
+	} else if s.sdp != nil {
 		s.sdp.AppendAHeader(hdr)
 	} else {
 		s.string_content += "a=" + hdr + "\r\n"
 	}
 }
+
+func (s *msgBody) IsMultipart() bool {
+	return strings.HasPrefix(mediaType(s.mtype), "multipart/")
+}
+
+// GetParts returns the parts of the multipart body or nil if the body is
+// not a multipart one.
+func (s *msgBody) GetParts() ([]sippy_types.MsgBodyPart, error) {
+	if err := s.parse(); err != nil {
+		return nil, err
+	}
+	return s.parts, nil
+}
+
+// GetPart returns the first part of the given media type or nil if there
+// is no such part.
+func (s *msgBody) GetPart(mtype string) sippy_types.MsgBodyPart {
+	if s.parse() != nil {
+		return nil
+	}
+	mtype = mediaType(mtype)
+	for _, part := range s.parts {
+		if mediaType(part.GetMtype()) == mtype {
+			return part
+		}
+	}
+	return nil
+}
+
+// AddPart appends the part to the multipart body. The single part body
+// is converted to the multipart/mixed one beforehand.
+func (s *msgBody) AddPart(part sippy_types.MsgBodyPart) error {
+	if err := s.parse(); err != nil {
+		return err
+	}
+	if s.parts == nil {
+		if s.IsMultipart() {
+			return errors.New("Error parsing the multipart message")
+		}
+		first := &msgBodyPart{
+			headers: make([]sippy_header.SipHeader, 0),
+			body: &msgBody{
+				mtype:          s.mtype,
+				sdp:            s.sdp,
+				string_content: s.string_content,
+				needs_update:   s.needs_update,
+				parsed:         true,
+			},
+		}
+		s.boundary = "unique-boundary-" + sippy_utils.GenTag()
+		s.mtype = "multipart/mixed;boundary=" + s.boundary
+		s.sdp = nil
+		s.parts = []sippy_types.MsgBodyPart{first}
+	}
+	s.parts = append(s.parts, part)
+	return nil
+}
+
+// ReplacePart replaces the first part of the given media type. Returns
+// false if there is no such part.
+func (s *msgBody) ReplacePart(mtype string, part sippy_types.MsgBodyPart) bool {
+	if s.parse() != nil {
+		return false
+	}
+	mtype = mediaType(mtype)
+	for i, p := range s.parts {
+		if mediaType(p.GetMtype()) == mtype {
+			s.parts[i] = part
+			return true
+		}
+	}
+	return false
+}
+
+// RemovePart removes the first part of the given media type. Returns
+// false if there is no such part.
+func (s *msgBody) RemovePart(mtype string) bool {
+	if s.parse() != nil {
+		return false
+	}
+	mtype = mediaType(mtype)
+	for i, p := range s.parts {
+		if mediaType(p.GetMtype()) == mtype {
+			s.parts = append(s.parts[:i], s.parts[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *msgBody) multipartStr(local_hostport *sippy_net.HostPort) string {
+	ret := ""
+	for _, part := range s.parts {
+		ret += "--" + s.boundary + "\r\n"
+		ret += "Content-Type: " + part.GetMtype() + "\r\n"
+		for _, hf := range part.GetHeaders() {
+			ret += hf.String() + "\r\n"
+		}
+		ret += "\r\n"
+		if local_hostport != nil {
+			ret += part.GetBody().LocalStr(local_hostport)
+		} else {
+			ret += part.GetBody().String()
+		}
+		// The CRLF preceding the boundary delimiter belongs to the delimiter
+		ret += "\r\n"
+	}
+	return ret + "--" + s.boundary + "--\r\n"
+}
+
+// parseMultipart splits the multipart body (RFC 2046) into the parts.
+// The content of each part is kept intact as it can be binary (e.g.
+// the ISUP message).
+func parseMultipart(content, boundary string) ([]sippy_types.MsgBodyPart, error) {
+	delim := "--" + boundary
+	idx := strings.Index(content, delim)
+	if idx == -1 {
+		return nil, errors.New("Error parsing the multipart message: no boundary found")
+	}
+	parts := make([]sippy_types.MsgBodyPart, 0)
+	rest := content[idx+len(delim):]
+	for !strings.HasPrefix(rest, "--") {
+		// skip the transport padding
+		eol := strings.IndexByte(rest, '\n')
+		if eol == -1 {
+			break
+		}
+		rest = rest[eol+1:]
+		raw := rest
+		next := strings.Index(rest, "\n"+delim)
+		if next == -1 {
+			rest = "--"
+		} else {
+			raw = strings.TrimSuffix(rest[:next], "\r")
+			rest = rest[next+1+len(delim):]
+		}
+		part, err := parseMsgBodyPart(raw)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func parseMsgBodyPart(raw string) (*msgBodyPart, error) {
+	hdrs, content := "", raw
+	if strings.HasPrefix(raw, "\r\n") {
+		content = raw[2:]
+	} else if strings.HasPrefix(raw, "\n") {
+		content = raw[1:]
+	} else {
+		boff, bdel := -1, ""
+		for _, bdel = range []string{"\r\n\r\n", "\n\n"} {
+			boff = strings.Index(raw, bdel)
+			if boff != -1 {
+				break
+			}
+		}
+		if boff == -1 {
+			return nil, errors.New("Error parsing the multipart message: malformed body part")
+		}
+		hdrs, content = raw[:boff], raw[boff+len(bdel):]
+	}
+	// RFC 2046: the default content type is text/plain
+	mtype := "text/plain"
+	headers := make([]sippy_header.SipHeader, 0)
+	for _, line := range strings.FieldsFunc(hdrs, func(c rune) bool { return c == '\n' || c == '\r' }) {
+		arr := strings.SplitN(line, ":", 2)
+		if len(arr) != 2 {
+			return nil, errors.New("Error parsing the multipart message: malformed header " + line)
+		}
+		name, value := strings.TrimSpace(arr[0]), strings.TrimSpace(arr[1])
+		if strings.ToLower(name) == "content-type" {
+			mtype = value
+			continue
+		}
+		headers = append(headers, sippy_header.NewSipGenericHF(name, value))
+	}
+	return &msgBodyPart{
+		headers: headers,
+		body:    NewMsgBody(content, mtype),
+	}, nil
+}
@@ -0,0 +1,71 @@
+package sippy
+
+import (
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+type msgBodyPart struct {
+	headers []sippy_header.SipHeader
+	body    sippy_types.MsgBody
+}
+
+// NewMsgBodyPart creates the body part of the multipart body. The headers
+// are the MIME headers of the part other than the Content-Type.
+func NewMsgBodyPart(content, mtype string, headers ...sippy_header.SipHeader) *msgBodyPart {
+	return &msgBodyPart{
+		headers: headers,
+		body:    NewMsgBody(content, mtype),
+	}
+}
+
+// NewIsupBodyPart creates the part carrying the encapsulated ISUP message
+// (RFC 3204). The handling is "required" for SIP-I and "optional" for
+// SIP-T.
+func NewIsupBodyPart(isup []byte, version string, required bool) *msgBodyPart {
+	handling := "optional"
+	if required {
+		handling = "required"
+	}
+	return NewMsgBodyPart(string(isup), "application/isup;version="+version,
+		sippy_header.NewSipGenericHF("Content-Disposition", "signal;handling="+handling))
+}
+
+// NewPidfBodyPart creates the part carrying the PIDF-LO location object
+// (RFC 6442). The content_id is referenced from the Geolocation header.
+func NewPidfBodyPart(pidf, content_id string) *msgBodyPart {
+	headers := []sippy_header.SipHeader{}
+	if content_id != "" {
+		headers = append(headers, sippy_header.NewSipGenericHF("Content-ID", "<"+content_id+">"))
+	}
+	return NewMsgBodyPart(pidf, "application/pidf+xml", headers...)
+}
+
+func (s *msgBodyPart) GetMtype() string {
+	return s.body.GetMtype()
+}
+
+func (s *msgBodyPart) GetHeaders() []sippy_header.SipHeader {
+	return s.headers
+}
+
+func (s *msgBodyPart) AppendHeader(hf sippy_header.SipHeader) {
+	s.headers = append(s.headers, hf)
+}
+
+// GetBody returns the content of the part, the SDP part can be parsed and
+// modified the same way as the SDP body of the message.
+func (s *msgBodyPart) GetBody() sippy_types.MsgBody {
+	return s.body
+}
+
+func (s *msgBodyPart) GetCopy() sippy_types.MsgBodyPart {
+	headers := make([]sippy_header.SipHeader, len(s.headers))
+	for i, hf := range s.headers {
+		headers[i] = hf.GetCopyAsIface()
+	}
+	return &msgBodyPart{
+		headers: headers,
+		body:    s.body.GetCopy(),
+	}
+}
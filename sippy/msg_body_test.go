@@ -0,0 +1,81 @@
+package sippy
+
+import (
+	"strings"
+	"testing"
+)
+
+var test_sdp = "v=0\r\n" +
+	"o=- 12345 12345 IN IP4 192.168.0.1\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.168.0.1\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 10000 RTP/AVP 0\r\n"
+
+func TestMultipartBody(t *testing.T) {
+	isup := "\x01\x00\x49\x00\x00\x03\x02\x00\x07\x04\x10\x00\x33\x63\x21\x43\x00\x00\r\n"
+	content := "--Uniq\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		test_sdp +
+		"\r\n--Uniq\r\n" +
+		"Content-Type: application/isup;version=itu-t92+\r\n" +
+		"Content-Disposition: signal;handling=required\r\n" +
+		"\r\n" +
+		isup +
+		"\r\n--Uniq--\r\n"
+	body := NewMsgBody(content, "Multipart/Mixed;boundary=Uniq")
+	parts, err := body.GetParts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Bad number of parts: %d", len(parts))
+	}
+	if parts[1].GetBody().String() != isup {
+		t.Errorf("The ISUP part is damaged: %q", parts[1].GetBody().String())
+	}
+	if len(parts[1].GetHeaders()) != 1 || parts[1].GetHeaders()[0].Name() != "Content-Disposition" {
+		t.Errorf("Bad headers of the ISUP part")
+	}
+	sdp, err := body.GetSdp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdp.SetCHeaderAddr("10.0.0.1")
+	if body.String() != strings.Replace(content, "c=IN IP4 192.168.0.1", "c=IN IP4 10.0.0.1", 1) {
+		t.Errorf("Bad multipart body:\n%q", body.String())
+	}
+
+	if !body.RemovePart("application/isup") || body.GetPart("application/isup") != nil {
+		t.Errorf("The ISUP part has not been removed")
+	}
+	if !body.ReplacePart("application/sdp", NewPidfBodyPart("<presence/>", "target@example.com")) {
+		t.Errorf("The SDP part has not been replaced")
+	}
+	if _, err = body.GetSdp(); err == nil {
+		t.Errorf("The SDP part is still there")
+	}
+}
+
+func TestAddBodyPart(t *testing.T) {
+	body := NewMsgBody(test_sdp, "application/sdp")
+	if err := body.AddPart(NewIsupBodyPart([]byte{0x01, 0x00}, "itu-t92+", true)); err != nil {
+		t.Fatal(err)
+	}
+	if !body.IsMultipart() {
+		t.Fatalf("The body has not been converted: %s", body.GetMtype())
+	}
+	// Parse the result back
+	body = NewMsgBody(body.String(), body.GetMtype())
+	parts, err := body.GetParts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || parts[0].GetMtype() != "application/sdp" || parts[1].GetBody().String() != "\x01\x00" {
+		t.Fatalf("Bad multipart body:\n%q", body.String())
+	}
+	if _, err = body.GetSdp(); err != nil {
+		t.Error(err)
+	}
+}
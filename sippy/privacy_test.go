@@ -0,0 +1,103 @@
+package sippy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+)
+
+func Test_PrivacyHeaders(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	buf := strings.Join([]string{
+		"INVITE sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK776asdhds",
+		"From: <sip:alice@example.org>;tag=1928301774",
+		"To: <sip:bob@example.com>",
+		"Call-ID: a84b4c76e66710@1.1.1.1",
+		"CSeq: 314159 INVITE",
+		"P-Asserted-Identity: \"Alice\" <sip:+14155551000@example.org>, <sip:alice@example.org>",
+		"P-Preferred-Identity: <sip:+14155552000@example.org>",
+		"Privacy: id; Critical",
+		"Content-Length: 0",
+		"", "",
+	}, "\r\n")
+	rtime, _ := sippy_time.NewMonoTime()
+	req, err := ParseSipRequest([]byte(buf), rtime, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pais := req.GetPAIs()
+	if len(pais) != 2 {
+		t.Fatalf("Bad number of P-Asserted-Identity: %d", len(pais))
+	}
+	for i, user := range []string{"+14155551000", "alice"} {
+		addr, err := pais[i].GetBody(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.GetUrl().Username != user {
+			t.Errorf("Bad P-Asserted-Identity user: %s (want %s)", addr.GetUrl().Username, user)
+		}
+	}
+	if addr, _ := pais[0].GetBody(config); addr.GetName() != "Alice" {
+		t.Errorf("Bad P-Asserted-Identity display name: %s", addr.GetName())
+	}
+	ppis := req.GetPPIs()
+	if len(ppis) != 1 {
+		t.Fatalf("Bad number of P-Preferred-Identity: %d", len(ppis))
+	}
+	if ppis[0].String() != "P-Preferred-Identity: <sip:+14155552000@example.org>" {
+		t.Errorf("Bad P-Preferred-Identity: %s", ppis[0].String())
+	}
+	privacy := req.GetPrivacy()
+	if privacy == nil {
+		t.Fatal("No Privacy")
+	}
+	if !privacy.HasValue(sippy_header.PRIVACY_ID) || !privacy.HasValue(sippy_header.PRIVACY_CRITICAL) || privacy.HasValue(sippy_header.PRIVACY_HEADER) {
+		t.Errorf("Bad Privacy values: %v", privacy.GetValues())
+	}
+	if res := privacy.GetCopy().String(); res != "Privacy: id;critical" {
+		t.Errorf("Bad Privacy: %s", res)
+	}
+	if res := sippy_header.NewSipPrivacy(sippy_header.PRIVACY_NONE).String(); res != "Privacy: none" {
+		t.Errorf("Bad Privacy: %s", res)
+	}
+}
+
+func Test_AnonymousFrom(t *testing.T) {
+	var err error
+
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+	config.SetSipAddress(config.GetMyAddress())
+	config.SetSipPort(config.GetMyPort())
+	cmap := NewTestCallMap(config)
+	tfactory := NewTestSipTransportFactory()
+	config.SetSipTransportFactory(tfactory)
+	cmap.sip_tm, err = NewSipTransactionManager(config, cmap)
+	if err != nil {
+		t.Fatal("Cannot create SIP transaction manager: " + err.Error())
+	}
+	go cmap.sip_tm.Run()
+	defer cmap.sip_tm.Shutdown()
+	cmap.ua = NewUA(cmap.sip_tm, config, sippy_net.NewHostPort("2.2.2.2", "5060"), cmap, &cmap.lock, nil)
+	event, _ := NewCCEventTry(nil, "anonymous", "bob", nil, nil, "Anonymous", nil, "")
+	event.SetFromHost("anonymous.invalid")
+	event.SetPrivacy(sippy_header.NewSipPrivacy(sippy_header.PRIVACY_ID))
+	cmap.ua.RecvEvent(event)
+	inv := getTestRequest(t, tfactory, config, "INVITE")
+	from, err := inv.GetFrom().GetBody(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url := from.GetUrl(); url.Username != "anonymous" || url.Host.String() != "anonymous.invalid" {
+		t.Errorf("The From reveals the caller: %s", inv.GetFrom().String())
+	}
+	if inv.GetPrivacy() == nil || !inv.GetPrivacy().HasValue(sippy_header.PRIVACY_ID) {
+		t.Error("The Privacy has not been sent")
+	}
+}
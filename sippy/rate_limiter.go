@@ -0,0 +1,322 @@
+package sippy
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const (
+	RATE_LIMITER_RETRY_AFTER = 30 * time.Second
+	RATE_LIMITER_IDLE_TIME   = 5 * time.Minute
+)
+
+// RateLimit allows Rate requests per second on average with up to Burst
+// requests at once.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses the limit in the form "rate[/burst]". The burst
+// defaults to the rate rounded up.
+func ParseRateLimit(s string) (*RateLimit, error) {
+	arr := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	rate, err := strconv.ParseFloat(arr[0], 64)
+	if err != nil || rate <= 0 {
+		return nil, errors.New("Bad rate limit: " + s)
+	}
+	burst := int(math.Ceil(rate))
+	if len(arr) == 2 {
+		burst, err = strconv.Atoi(arr[1])
+		if err != nil || burst <= 0 {
+			return nil, errors.New("Bad burst of the rate limit: " + s)
+		}
+	}
+	return &RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit *RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+func (s *tokenBucket) take(limit *RateLimit, now time.Time) bool {
+	if now.After(s.last) {
+		s.tokens = math.Min(float64(limit.Burst), s.tokens+now.Sub(s.last).Seconds()*limit.Rate)
+		s.last = now
+	}
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+type rateLimiterSource struct {
+	total    *tokenBucket
+	methods  map[string]*tokenBucket
+	failures []time.Time
+	last     time.Time
+}
+
+/*
+ * rateLimiter protects the transaction manager from the request floods.
+ * The requests are limited per source IP address, per source and method
+ * and the new INVITEs are also limited globally. The sources failing the
+ * authentication too often are banned for a while. The ACKs are never
+ * limited since they do not create the transactions. The in-dialog
+ * requests and the CANCELs are not limited either so that the calls
+ * already established or in progress can always be torn down, they are
+ * only dropped from the banned sources.
+ */
+type rateLimiter struct {
+	lock          sync.Mutex
+	source_limit  *RateLimit
+	method_limits map[string]*RateLimit
+	invite_limit  *RateLimit
+	invite_bucket *tokenBucket
+	reject        bool
+	retry_after   time.Duration
+	ban_failures  int
+	ban_window    time.Duration
+	ban_time      time.Duration
+	sources       map[string]*rateLimiterSource
+	bans          map[string]*sippy_types.BanEntry
+	last_purge    time.Time
+}
+
+func NewRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		method_limits: make(map[string]*RateLimit),
+		retry_after:   RATE_LIMITER_RETRY_AFTER,
+		sources:       make(map[string]*rateLimiterSource),
+		bans:          make(map[string]*sippy_types.BanEntry),
+	}
+}
+
+// SetSourceLimit limits the requests of any method from the same IP
+// address. The nil limit removes the limit.
+func (s *rateLimiter) SetSourceLimit(limit *RateLimit) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.source_limit = limit
+	for _, src := range s.sources {
+		src.total = nil
+	}
+}
+
+// SetMethodLimit limits the requests of the method from the same IP
+// address.
+func (s *rateLimiter) SetMethodLimit(method string, limit *RateLimit) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	method = strings.ToUpper(method)
+	if limit == nil {
+		delete(s.method_limits, method)
+	} else {
+		s.method_limits[method] = limit
+	}
+	for _, src := range s.sources {
+		delete(src.methods, method)
+	}
+}
+
+// SetInviteLimit caps the rate of the new INVITE transactions from all
+// sources together.
+func (s *rateLimiter) SetInviteLimit(limit *RateLimit) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.invite_limit = limit
+	s.invite_bucket = nil
+}
+
+// SetReject makes the requests over the limits rejected with 503 and the
+// Retry-After instead of being silently dropped. The banned sources are
+// always dropped.
+func (s *rateLimiter) SetReject(reject bool, retry_after time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reject = reject
+	s.retry_after = retry_after
+}
+
+// SetBanPolicy bans the source for the ban_time once it fails the
+// authentication the given number of times within the window. The zero
+// number of failures disables the automatic bans.
+func (s *rateLimiter) SetBanPolicy(failures int, window, ban_time time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ban_failures = failures
+	s.ban_window = window
+	s.ban_time = ban_time
+}
+
+func (s *rateLimiter) FilterRequest(source *sippy_net.HostPort, method string, in_dialog bool, now time.Time) (int, time.Duration) {
+	if method == "ACK" {
+		return sippy_types.FILTER_PASS, 0
+	}
+	ip := normalizeIP(source.Host.String())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.purge(now)
+	if ban, ok := s.bans[ip]; ok {
+		if now.Before(ban.Until) {
+			return sippy_types.FILTER_DROP, 0
+		}
+		delete(s.bans, ip)
+	}
+	if in_dialog || method == "CANCEL" {
+		return sippy_types.FILTER_PASS, 0
+	}
+	src := s.getSource(ip, now)
+	passed := true
+	if s.source_limit != nil {
+		if src.total == nil {
+			src.total = newTokenBucket(s.source_limit, now)
+		}
+		passed = src.total.take(s.source_limit, now)
+	}
+	if limit, ok := s.method_limits[method]; ok && passed {
+		bucket, ok := src.methods[method]
+		if !ok {
+			bucket = newTokenBucket(limit, now)
+			src.methods[method] = bucket
+		}
+		passed = bucket.take(limit, now)
+	}
+	if method == "INVITE" && s.invite_limit != nil && passed {
+		if s.invite_bucket == nil {
+			s.invite_bucket = newTokenBucket(s.invite_limit, now)
+		}
+		passed = s.invite_bucket.take(s.invite_limit, now)
+	}
+	switch {
+	case passed:
+		return sippy_types.FILTER_PASS, 0
+	case s.reject:
+		return sippy_types.FILTER_REJECT, s.retry_after
+	}
+	return sippy_types.FILTER_DROP, 0
+}
+
+func (s *rateLimiter) getSource(ip string, now time.Time) *rateLimiterSource {
+	src, ok := s.sources[ip]
+	if !ok {
+		src = &rateLimiterSource{
+			methods: make(map[string]*tokenBucket),
+		}
+		s.sources[ip] = src
+	}
+	src.last = now
+	return src
+}
+
+func (s *rateLimiter) AuthFailed(source *sippy_net.HostPort, now time.Time) {
+	ip := normalizeIP(source.Host.String())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ban_failures <= 0 {
+		return
+	}
+	src := s.getSource(ip, now)
+	failures := []time.Time{}
+	for _, ts := range src.failures {
+		if now.Sub(ts) < s.ban_window {
+			failures = append(failures, ts)
+		}
+	}
+	src.failures = append(failures, now)
+	if len(src.failures) >= s.ban_failures {
+		src.failures = nil
+		s.bans[ip] = &sippy_types.BanEntry{
+			Ip:     ip,
+			Until:  now.Add(s.ban_time),
+			Reason: "authentication failures",
+		}
+	}
+}
+
+// Ban drops the requests from the IP address for the given time.
+func (s *rateLimiter) Ban(ip string, duration time.Duration, reason string, now time.Time) {
+	ip = normalizeIP(ip)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bans[ip] = &sippy_types.BanEntry{
+		Ip:     ip,
+		Until:  now.Add(duration),
+		Reason: reason,
+	}
+}
+
+// Unban returns false if the IP address has not been banned.
+func (s *rateLimiter) Unban(ip string) bool {
+	ip = normalizeIP(ip)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.bans[ip]
+	delete(s.bans, ip)
+	if src, ok := s.sources[ip]; ok {
+		src.failures = nil
+	}
+	return ok
+}
+
+// Bans returns copies of the active bans sorted by the IP address.
+func (s *rateLimiter) Bans(now time.Time) []*sippy_types.BanEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := []*sippy_types.BanEntry{}
+	for _, ban := range s.bans {
+		if now.Before(ban.Until) {
+			tmp := *ban
+			ret = append(ret, &tmp)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Ip < ret[j].Ip })
+	return ret
+}
+
+// normalizeIP returns the IP address in the canonical form, so that the
+// IPv6 address of the source, which comes in brackets, and the one given
+// in the command refer to the same entry.
+func normalizeIP(ip string) string {
+	if addr := net.ParseIP(strings.Trim(ip, "[]")); addr != nil {
+		return addr.String()
+	}
+	return ip
+}
+
+// purge forgets the sources that have not been seen for a while and the
+// expired bans.
+func (s *rateLimiter) purge(now time.Time) {
+	if now.Sub(s.last_purge) < RATE_LIMITER_IDLE_TIME {
+		return
+	}
+	s.last_purge = now
+	for ip, src := range s.sources {
+		if now.Sub(src.last) > RATE_LIMITER_IDLE_TIME {
+			delete(s.sources, ip)
+		}
+	}
+	for ip, ban := range s.bans {
+		if !now.Before(ban.Until) {
+			delete(s.bans, ip)
+		}
+	}
+}
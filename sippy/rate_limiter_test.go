@@ -0,0 +1,128 @@
+package sippy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if _, err := ParseRateLimit("0"); err == nil {
+		t.Error("Zero rate has been accepted")
+	}
+	if _, err := ParseRateLimit("5/x"); err == nil {
+		t.Error("Bad burst has been accepted")
+	}
+	limit, err := ParseRateLimit("2.5")
+	if err != nil || limit.Rate != 2.5 || limit.Burst != 3 {
+		t.Fatalf("Bad rate limit parsed: %v %v", limit, err)
+	}
+	if m := requestMethod([]byte("REGISTER sip:example.com SIP/2.0\r\n")); m != "REGISTER" {
+		t.Errorf("Bad method: %s", m)
+	}
+	for to, expected := range map[string]bool{
+		"To: <sip:bob@example.com>":                   false,
+		"To: <sip:bob@example.com;tag=1>":             false,
+		"To: <sip:bob@example.com>;tag=1":             true,
+		"t: sip:bob@example.com ; TAG = 1":            true,
+		"to :Bob <sip:bob@example.com>;tag=1;foo=bar": true,
+		"Tox: <sip:bob@example.com>;tag=1":            false,
+	} {
+		data := "BYE sip:bob@example.com SIP/2.0\r\nFrom: <sip:alice@example.com>;tag=2\r\n" + to + "\r\n\r\nTo: ;tag=3"
+		if requestInDialog([]byte(data)) != expected {
+			t.Errorf("%q: expected in dialog %v", to, expected)
+		}
+	}
+
+	src1 := sippy_net.NewHostPort("203.0.113.1", "5060")
+	src2 := sippy_net.NewHostPort("203.0.113.2", "5060")
+	now := time.Now()
+	rl := NewRateLimiter()
+	rl.SetSourceLimit(&RateLimit{Rate: 10, Burst: 10})
+	rl.SetMethodLimit("register", &RateLimit{Rate: 1, Burst: 2})
+	rl.SetInviteLimit(&RateLimit{Rate: 1, Burst: 3})
+
+	check := func(src *sippy_net.HostPort, method string, expected int) {
+		t.Helper()
+		if action, _ := rl.FilterRequest(src, method, false, now); action != expected {
+			t.Errorf("%s from %s: expected %d, got %d", method, src.String(), expected, action)
+		}
+	}
+	check(src1, "REGISTER", sippy_types.FILTER_PASS)
+	check(src1, "REGISTER", sippy_types.FILTER_PASS)
+	check(src1, "REGISTER", sippy_types.FILTER_DROP)
+	check(src2, "REGISTER", sippy_types.FILTER_PASS)
+	// The global INVITE cap is shared by the sources
+	check(src1, "INVITE", sippy_types.FILTER_PASS)
+	check(src2, "INVITE", sippy_types.FILTER_PASS)
+	check(src1, "INVITE", sippy_types.FILTER_PASS)
+	check(src2, "INVITE", sippy_types.FILTER_DROP)
+	for i := 0; i < 10; i++ {
+		check(src1, "ACK", sippy_types.FILTER_PASS)
+	}
+	// The in-dialog requests and the CANCELs are not limited
+	for i := 0; i < 20; i++ {
+		check(src2, "CANCEL", sippy_types.FILTER_PASS)
+		for _, method := range []string{"INVITE", "BYE"} {
+			if action, _ := rl.FilterRequest(src2, method, true, now); action != sippy_types.FILTER_PASS {
+				t.Errorf("In-dialog %s has not passed: %d", method, action)
+			}
+		}
+	}
+	check(src2, "INVITE", sippy_types.FILTER_DROP)
+	rl.SetReject(true, 10*time.Second)
+	if action, retry_after := rl.FilterRequest(src2, "INVITE", false, now); action != sippy_types.FILTER_REJECT || retry_after != 10*time.Second {
+		t.Errorf("The request has not been rejected: %d %s", action, retry_after)
+	}
+	// The buckets are refilled over time
+	now = now.Add(time.Second)
+	check(src1, "REGISTER", sippy_types.FILTER_PASS)
+	check(src2, "INVITE", sippy_types.FILTER_PASS)
+	for i := 0; i < 9; i++ {
+		check(src1, "OPTIONS", sippy_types.FILTER_PASS)
+	}
+	check(src1, "OPTIONS", sippy_types.FILTER_REJECT)
+
+	// Automatic ban
+	rl.SetBanPolicy(3, time.Minute, time.Hour)
+	rl.AuthFailed(src2, now)
+	rl.AuthFailed(src2, now.Add(2*time.Minute))
+	rl.AuthFailed(src2, now.Add(2*time.Minute))
+	now = now.Add(2 * time.Minute)
+	check(src2, "OPTIONS", sippy_types.FILTER_PASS)
+	rl.AuthFailed(src2, now)
+	check(src2, "OPTIONS", sippy_types.FILTER_DROP)
+	if action, _ := rl.FilterRequest(src2, "BYE", true, now); action != sippy_types.FILTER_DROP {
+		t.Errorf("In-dialog request from the banned source has not been dropped: %d", action)
+	}
+	bans := rl.Bans(now)
+	if len(bans) != 1 || bans[0].Ip != "203.0.113.2" || !bans[0].Until.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Bad bans: %v", bans)
+	}
+	if !rl.Unban("203.0.113.2") || rl.Unban("203.0.113.2") {
+		t.Error("Bad result of unban")
+	}
+	check(src2, "OPTIONS", sippy_types.FILTER_PASS)
+
+	rl.Ban("203.0.113.1", time.Minute, "manual", now)
+	check(src1, "OPTIONS", sippy_types.FILTER_DROP)
+	now = now.Add(2 * time.Minute)
+	check(src1, "OPTIONS", sippy_types.FILTER_PASS)
+	if len(rl.Bans(now)) != 0 {
+		t.Error("The expired ban is still listed")
+	}
+
+	// The IPv6 source comes in brackets
+	src3 := sippy_net.NewHostPort("[2001:db8::1]", "5060")
+	rl.Ban("2001:db8:0::1", time.Minute, "manual", now)
+	check(src3, "OPTIONS", sippy_types.FILTER_DROP)
+	if bans := rl.Bans(now); len(bans) != 1 || bans[0].Ip != "2001:db8::1" {
+		t.Fatalf("Bad bans: %v", bans)
+	}
+	if !rl.Unban("2001:DB8::1") {
+		t.Error("The IPv6 address has not been unbanned")
+	}
+	check(src3, "OPTIONS", sippy_types.FILTER_PASS)
+}
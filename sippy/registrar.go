@@ -0,0 +1,329 @@
+package sippy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/security"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const (
+	REGISTRAR_DEFAULT_EXPIRES = 3600
+	REGISTRAR_MIN_EXPIRES     = 60
+	REGISTRAR_MAX_EXPIRES     = 7200
+)
+
+// registrar handles REGISTER requests (RFC 3261 section 10.3) and keeps
+// the bindings in the location store.
+type registrar struct {
+	config          sippy_conf.Config
+	store           sippy_types.LocationStore
+	domains         map[string]bool
+	realm           string
+	algorithm       string
+	users           sippy_types.DigestUserStore
+	auths           map[string]*digestAuth
+	auths_lock      sync.Mutex
+	min_expires     int
+	max_expires     int
+	default_expires int
+	on_failure      sippy_types.AuthFailureListener
+}
+
+func NewRegistrar(store sippy_types.LocationStore, config sippy_conf.Config) *registrar {
+	if store == nil {
+		store = NewMemoryLocationStore()
+	}
+	return &registrar{
+		config:          config,
+		store:           store,
+		domains:         make(map[string]bool),
+		auths:           make(map[string]*digestAuth),
+		min_expires:     REGISTRAR_MIN_EXPIRES,
+		max_expires:     REGISTRAR_MAX_EXPIRES,
+		default_expires: REGISTRAR_DEFAULT_EXPIRES,
+	}
+}
+
+// SetDomains limits the domains the registrar is responsible for. The
+// registrations for any domain are accepted if the list is empty.
+func (s *registrar) SetDomains(domains []string) {
+	s.domains = make(map[string]bool)
+	for _, domain := range domains {
+		s.domains[strings.ToLower(domain)] = true
+	}
+}
+
+// SetAuth makes the registrar challenge the REGISTER requests. The realm
+// defaults to the domain of the AOR being registered, in which case the
+// domains must be set with SetDomains() first. The nil lookup function
+// turns the authentication off.
+func (s *registrar) SetAuth(realm, algorithm string, passwd_lookup func(username string) (string, bool)) error {
+	if passwd_lookup == nil {
+		return s.SetUserStore(realm, algorithm, nil)
+	}
+	return s.SetUserStore(realm, algorithm, DigestPasswdLookup(passwd_lookup))
+}
+
+// SetUserStore is the same as SetAuth() but takes the credentials from
+// the digest user store.
+func (s *registrar) SetUserStore(realm, algorithm string, users sippy_types.DigestUserStore) error {
+	if algorithm != "" && sippy_security.GetAlgorithm(algorithm) == nil {
+		return errors.New("Unsupported digest algorithm: " + algorithm)
+	}
+	if users != nil && realm == "" && len(s.domains) == 0 {
+		// Otherwise anyone could make us keep the state of as many
+		// realms as there are domains in the requests
+		return errors.New("Either the realm or the domains are required for the authentication")
+	}
+	s.auths_lock.Lock()
+	defer s.auths_lock.Unlock()
+	s.realm = realm
+	s.algorithm = algorithm
+	s.users = users
+	s.auths = make(map[string]*digestAuth)
+	return nil
+}
+
+// SetAuthFailureListener makes the listener notified when the REGISTER
+// comes with the wrong credentials.
+func (s *registrar) SetAuthFailureListener(listener sippy_types.AuthFailureListener) {
+	s.auths_lock.Lock()
+	defer s.auths_lock.Unlock()
+	s.on_failure = listener
+	for _, auth := range s.auths {
+		auth.SetAuthFailureListener(listener)
+	}
+}
+
+func (s *registrar) SetExpires(min_expires, max_expires, default_expires int) {
+	s.min_expires = min_expires
+	s.max_expires = max_expires
+	s.default_expires = default_expires
+}
+
+func (s *registrar) GetStore() sippy_types.LocationStore {
+	return s.store
+}
+
+// MakeAor returns the address-of-record in the form the bindings are
+// stored under.
+func MakeAor(user, domain string) string {
+	return "sip:" + user + "@" + strings.ToLower(domain)
+}
+
+// Lookup returns the live bindings of the AOR, the most preferred one
+// first.
+func (s *registrar) Lookup(aor string) []*sippy_types.Binding {
+	bindings, err := s.store.Lookup(aor, time.Now())
+	if err != nil {
+		s.config.ErrorLogger().Error("Registrar: cannot look up " + aor + ": " + err.Error())
+		return nil
+	}
+	return bindings
+}
+
+func (s *registrar) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.UaContext {
+	return &sippy_types.UaContext{Response: s.register(req)}
+}
+
+func (s *registrar) register(req sippy_types.SipRequest) sippy_types.SipResponse {
+	if req.GetMethod() != "REGISTER" {
+		return req.GenResponse(405, "Method Not Allowed", nil, nil)
+	}
+	to, err := req.GetTo().GetBody(s.config)
+	if err != nil {
+		return req.GenResponse(400, "Bad Request - bad To", nil, nil)
+	}
+	domain := to.GetUrl().Host.String()
+	if len(s.domains) > 0 && !s.domains[strings.ToLower(domain)] {
+		return req.GenResponse(404, "Not Found", nil, nil)
+	}
+	aor := MakeAor(to.GetUrl().Username, domain)
+	if s.users != nil {
+		if resp := s.authenticate(req, to.GetUrl().Username, domain); resp != nil {
+			return resp
+		}
+	}
+	call_id := req.GetCallId().CallId
+	cseq, err := req.GetCSeq().GetBody()
+	if err != nil {
+		return req.GenResponse(400, "Bad Request - bad CSeq", nil, nil)
+	}
+	expires := s.default_expires
+	if hf, ok := req.GetFirstHF("expires").(*sippy_header.SipExpires); ok {
+		if body, err := hf.GetBody(); err == nil {
+			expires = body.Number
+		}
+	}
+	now := time.Now()
+	current, err := s.store.Lookup(aor, now)
+	if err != nil {
+		s.config.ErrorLogger().Error("Registrar: cannot look up " + aor + ": " + err.Error())
+		return req.GenResponse(500, "Server Internal Error", nil, nil)
+	}
+	contacts := req.GetContacts()
+	if req.HasContactWildcard() {
+		// RFC 3261 10.3 step 6
+		if len(contacts) > 0 || expires != 0 {
+			return req.GenResponse(400, "Bad Request - bad wildcard Contact", nil, nil)
+		}
+		for _, binding := range current {
+			if binding.CallId == call_id && cseq.CSeq <= binding.CSeq {
+				return req.GenResponse(500, "Server Internal Error - out of order request", nil, nil)
+			}
+		}
+		if err = s.store.RemoveAll(aor); err != nil {
+			s.config.ErrorLogger().Error("Registrar: cannot remove " + aor + ": " + err.Error())
+			return req.GenResponse(500, "Server Internal Error", nil, nil)
+		}
+		return s.genOk(req, nil, now)
+	}
+	path := []string{}
+	for _, hf := range req.GetHFs("path") {
+		path = append(path, hf.StringBody())
+	}
+	var user_agent string
+	if ua := req.GetSipUserAgent(); ua != nil {
+		user_agent = ua.StringBody()
+	}
+	updates := []*sippy_types.Binding{}
+	for _, contact := range contacts {
+		addr, err := contact.GetBody(s.config)
+		if err != nil {
+			return req.GenResponse(400, "Bad Request - bad Contact", nil, nil)
+		}
+		binding := &sippy_types.Binding{
+			Aor:       aor,
+			Contact:   addr.GetUrl().String(),
+			Path:      path,
+			CallId:    call_id,
+			CSeq:      cseq.CSeq,
+			Q:         addr.GetQ(),
+			UserAgent: user_agent,
+		}
+		binding_expires := expires
+		if v := addr.GetParam("expires"); v != "" {
+			if binding_expires, err = strconv.Atoi(v); err != nil {
+				return req.GenResponse(400, "Bad Request - bad expires", nil, nil)
+			}
+		}
+		if binding_expires > 0 && binding_expires < s.min_expires {
+			resp := req.GenResponse(423, "Interval Too Brief", nil, nil)
+			resp.AppendHeader(sippy_header.NewSipGenericHF("Min-Expires", strconv.Itoa(s.min_expires)))
+			return resp
+		}
+		if binding_expires > s.max_expires {
+			binding_expires = s.max_expires
+		}
+		binding.Expires = now.Add(time.Duration(binding_expires) * time.Second)
+		if binding.Q < 0 || binding.Q > 1 {
+			return req.GenResponse(400, "Bad Request - bad q", nil, nil)
+		}
+		if len(path) == 0 {
+			binding.Received = receivedAddress(req.GetSource(), addr.GetUrl().GetAddr(s.config))
+		}
+		for _, old := range current {
+			if old.Contact == binding.Contact && old.CallId == call_id && cseq.CSeq <= old.CSeq {
+				return req.GenResponse(500, "Server Internal Error - out of order request", nil, nil)
+			}
+		}
+		updates = append(updates, binding)
+	}
+	for _, binding := range updates {
+		if binding.Expires.After(now) {
+			err = s.store.Update(binding)
+		} else {
+			err = s.store.Remove(aor, binding.Contact)
+		}
+		if err != nil {
+			s.config.ErrorLogger().Error("Registrar: cannot update " + aor + ": " + err.Error())
+			return req.GenResponse(500, "Server Internal Error", nil, nil)
+		}
+	}
+	if current, err = s.store.Lookup(aor, now); err != nil {
+		s.config.ErrorLogger().Error("Registrar: cannot look up " + aor + ": " + err.Error())
+		return req.GenResponse(500, "Server Internal Error", nil, nil)
+	}
+	resp := s.genOk(req, current, now)
+	for _, p := range path {
+		resp.AppendHeader(sippy_header.NewSipGenericHF("Path", p))
+	}
+	return resp
+}
+
+// authenticate returns the response to be sent if the request has not
+// been authenticated.
+func (s *registrar) authenticate(req sippy_types.SipRequest, user, domain string) sippy_types.SipResponse {
+	auth := s.getAuth(domain)
+	if auth == nil {
+		return req.GenResponse(404, "Not Found", nil, nil)
+	}
+	username, resp := auth.Authenticate(req)
+	if resp != nil {
+		return resp
+	}
+	if username != user {
+		// The user is not allowed to register the AOR
+		return req.GenResponse(403, "Forbidden", nil, nil)
+	}
+	return nil
+}
+
+// getAuth returns the authenticator of the realm the AOR belongs to. The
+// nonce counts are tracked by each of them separately. Returns nil if
+// the domain is not served.
+func (s *registrar) getAuth(domain string) *digestAuth {
+	s.auths_lock.Lock()
+	defer s.auths_lock.Unlock()
+	realm := s.realm
+	if realm == "" {
+		realm = strings.ToLower(domain)
+		if !s.domains[realm] {
+			return nil
+		}
+	}
+	auth, ok := s.auths[realm]
+	if !ok {
+		auth = NewDigestAuth(s.users, realm)
+		if s.algorithm != "" {
+			_ = auth.SetAlgorithms([]string{s.algorithm})
+		}
+		if s.on_failure != nil {
+			auth.SetAuthFailureListener(s.on_failure)
+		}
+		s.auths[realm] = auth
+	}
+	return auth
+}
+
+func (s *registrar) genOk(req sippy_types.SipRequest, bindings []*sippy_types.Binding, now time.Time) sippy_types.SipResponse {
+	resp := req.GenResponse(200, "OK", nil, nil)
+	for _, binding := range bindings {
+		url, err := sippy_header.ParseSipURL(binding.Contact, true /* relaxedparser */, s.config)
+		if err != nil {
+			continue
+		}
+		addr := sippy_header.NewSipAddress("", url)
+		addr.SetParam("expires", strconv.Itoa(int(binding.Expires.Sub(now).Seconds())))
+		resp.AppendHeader(sippy_header.NewSipContactFromAddress(addr))
+	}
+	resp.AppendHeader(sippy_header.NewSipDate(now))
+	return resp
+}
+
+// receivedAddress returns the source address of the request if it does
+// not match the address in the Contact.
+func receivedAddress(source, contact *sippy_net.HostPort) *sippy_net.HostPort {
+	if source == nil || source.String() == contact.String() {
+		return nil
+	}
+	return source.GetCopy()
+}
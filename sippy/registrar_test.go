@@ -0,0 +1,131 @@
+package sippy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+)
+
+func testRegister(t *testing.T, config sippy_conf.Config, cseq, contact, expires string, auth sippy_header.SipHeader) *sipRequest {
+	buf := strings.Join([]string{
+		"REGISTER sip:example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.168.1.5:5060;branch=z9hG4bK" + cseq,
+		"From: <sip:alice@example.com>;tag=1",
+		"To: <sip:alice@example.com>",
+		"Call-ID: reg1@192.168.1.5",
+		"CSeq: " + cseq + " REGISTER",
+		"Contact: " + contact,
+		"Expires: " + expires,
+		"Max-Forwards: 70",
+		"Content-Length: 0",
+		"", "",
+	}, "\r\n")
+	rtime, _ := sippy_time.NewMonoTime()
+	req, err := ParseSipRequest([]byte(buf), rtime, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.source = sippy_net.NewHostPort("203.0.113.1", "40000")
+	if auth != nil {
+		req.AppendHeader(auth)
+	}
+	return req
+}
+
+func TestRegistrar(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	reg := NewRegistrar(nil, config)
+	if reg.SetAuth("", "", func(string) (string, bool) { return "", false }) == nil {
+		t.Error("The authentication without the realm and the domains has been set")
+	}
+	reg.SetDomains([]string{"example.com"})
+	reg.SetAuth("", "", func(username string) (string, bool) {
+		return "secret", username == "alice"
+	})
+
+	resp := reg.register(testRegister(t, config, "1", "<sip:alice@192.168.1.5:5060>", "600", nil))
+	if resp.GetSCodeNum() != 401 || len(resp.GetSipWWWAuthenticates()) != 1 {
+		t.Fatalf("Bad response to unauthenticated REGISTER: %d", resp.GetSCodeNum())
+	}
+	auth, err := resp.GetSipWWWAuthenticates()[0].GenAuthHF("alice", "secret", "REGISTER", "sip:example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = reg.register(testRegister(t, config, "2", "<sip:alice@192.168.1.5:5060>", "600", auth))
+	if resp.GetSCodeNum() != 200 {
+		t.Fatalf("Bad response to authenticated REGISTER: %d", resp.GetSCodeNum())
+	}
+	if len(resp.GetContacts()) != 1 {
+		t.Errorf("Bad number of Contacts in 200 OK: %d", len(resp.GetContacts()))
+	}
+	bindings := reg.Lookup(MakeAor("alice", "EXAMPLE.com"))
+	if len(bindings) != 1 {
+		t.Fatalf("Bad number of bindings: %d", len(bindings))
+	}
+	if bindings[0].Received == nil || bindings[0].Received.String() != "203.0.113.1:40000" {
+		t.Errorf("Bad received address: %v", bindings[0].Received)
+	}
+
+	// The captured request cannot be replayed with another Contact
+	resp = reg.register(testRegister(t, config, "3", "<sip:mallory@198.51.100.1:5060>", "600", auth))
+	if resp.GetSCodeNum() != 401 || len(resp.GetSipWWWAuthenticates()) != 1 {
+		t.Fatalf("Bad response to the replayed REGISTER: %d", resp.GetSCodeNum())
+	}
+	if body, _ := resp.GetSipWWWAuthenticates()[0].GetBody(); !body.GetStale() {
+		t.Error("The replayed REGISTER has not been challenged with stale=true")
+	}
+	if len(reg.Lookup(MakeAor("alice", "example.com"))) != 1 {
+		t.Fatal("The replayed REGISTER has updated the bindings")
+	}
+
+	// Out of order request
+	auth, err = resp.GetSipWWWAuthenticates()[0].GenAuthHF("alice", "secret", "REGISTER", "sip:example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = reg.register(testRegister(t, config, "2", "<sip:alice@192.168.1.5:5060>", "600", auth))
+	if resp.GetSCodeNum() != 500 {
+		t.Errorf("Bad response to out of order REGISTER: %d", resp.GetSCodeNum())
+	}
+
+	// No state is kept for the domains that are not served
+	reg.SetDomains(nil)
+	req := testRegister(t, config, "3", "<sip:alice@192.168.1.5:5060>", "600", nil)
+	if to, _ := req.GetTo().GetBody(config); to != nil {
+		to.GetUrl().Host = sippy_net.NewMyAddress("example.net")
+	}
+	if resp = reg.register(req); resp.GetSCodeNum() != 404 || len(reg.auths) != 1 {
+		t.Errorf("Bad response to REGISTER for the unknown domain: %d", resp.GetSCodeNum())
+	}
+
+	reg.SetAuth("", "", nil)
+	resp = reg.register(testRegister(t, config, "3", "<sip:alice@192.168.1.5:5060>;expires=10", "600", nil))
+	if resp.GetSCodeNum() != 423 || resp.GetFirstHF("Min-Expires") == nil {
+		t.Errorf("Bad response to REGISTER with too brief expires: %d", resp.GetSCodeNum())
+	}
+	resp = reg.register(testRegister(t, config, "4", "<sip:alice@10.0.0.1>;q=0.5", "600", nil))
+	if resp.GetSCodeNum() != 200 || len(resp.GetContacts()) != 2 {
+		t.Fatalf("Bad response to the second REGISTER: %d", resp.GetSCodeNum())
+	}
+	bindings = reg.Lookup(MakeAor("alice", "example.com"))
+	if len(bindings) != 2 || bindings[1].Contact != "sip:alice@10.0.0.1" {
+		t.Errorf("The bindings are not ordered by q")
+	}
+	resp = reg.register(testRegister(t, config, "5", "<sip:alice@192.168.1.5:5060>;expires=0", "600", nil))
+	if resp.GetSCodeNum() != 200 || len(reg.Lookup(MakeAor("alice", "example.com"))) != 1 {
+		t.Errorf("The binding has not been removed")
+	}
+	resp = reg.register(testRegister(t, config, "6", "*", "600", nil))
+	if resp.GetSCodeNum() != 400 {
+		t.Errorf("The wildcard Contact with non-zero Expires accepted")
+	}
+	resp = reg.register(testRegister(t, config, "7", "*", "0", nil))
+	if resp.GetSCodeNum() != 200 || len(reg.Lookup(MakeAor("alice", "example.com"))) != 0 {
+		t.Errorf("The bindings have not been removed with the wildcard Contact")
+	}
+}
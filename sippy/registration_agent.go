@@ -0,0 +1,273 @@
+package sippy
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+	"github.com/egovorukhin/go-b2bua/sippy/utils"
+)
+
+// Registration agent states
+const (
+	REG_STATE_IDLE         = "idle"
+	REG_STATE_REGISTERING  = "registering"
+	REG_STATE_REGISTERED   = "registered"
+	REG_STATE_FAILED       = "failed"
+	REG_STATE_UNREGISTERED = "unregistered"
+)
+
+const (
+	REG_RETRY_MIN = 30 * time.Second
+	REG_RETRY_MAX = 600 * time.Second
+	// Number of the consecutive challenges answered before giving up
+	REG_MAX_AUTH_TRIES = 3
+)
+
+// sipRegistrationAgent keeps the AOR registered at the remote registrar.
+// The registration is refreshed before it expires and retried with the
+// exponential backoff on failure.
+type sipRegistrationAgent struct {
+	sip_tm     sippy_types.SipTransactionManager
+	config     sippy_conf.Config
+	lock       sync.Mutex
+	ruri       *sippy_header.SipURL
+	aor        *sippy_header.SipURL
+	contact    *sippy_header.SipURL
+	target     *sippy_net.HostPort
+	user       string
+	passw      string
+	expires    time.Duration
+	call_id    *sippy_header.SipCallId
+	from_tag   string
+	cseq       int
+	atries     int
+	auth       sippy_header.SipHeader
+	state      string
+	expires_at time.Time
+	last_error string
+	backoff    time.Duration
+	timer      *Timeout
+	unregister bool
+	rok_cb     func(time.Duration)
+	rfail_cb   func(string)
+}
+
+// NewSipRegistrationAgent creates the agent that registers the contact
+// for the AOR. The REGISTER is sent to the target or to the domain of the
+// AOR if the target is nil.
+func NewSipRegistrationAgent(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, aor, contact *sippy_header.SipURL,
+	target *sippy_net.HostPort, user, passw string, expires time.Duration) *sipRegistrationAgent {
+	ruri := sippy_header.NewSipURL("", aor.Host, aor.Port, false)
+	if target == nil {
+		target = ruri.GetAddr(config)
+	}
+	return &sipRegistrationAgent{
+		sip_tm:   sip_tm,
+		config:   config,
+		ruri:     ruri,
+		aor:      aor,
+		contact:  contact,
+		target:   target,
+		user:     user,
+		passw:    passw,
+		expires:  expires,
+		call_id:  sippy_header.GenerateSipCallId(config),
+		from_tag: sippy_utils.GenTag(),
+		cseq:     1,
+		state:    REG_STATE_IDLE,
+		backoff:  REG_RETRY_MIN,
+	}
+}
+
+// SetCallbacks sets the functions called with the granted expiration
+// time on successful registration or with the reason on failure.
+func (s *sipRegistrationAgent) SetCallbacks(rok_cb func(time.Duration), rfail_cb func(string)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rok_cb = rok_cb
+	s.rfail_cb = rfail_cb
+}
+
+func (s *sipRegistrationAgent) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.unregister = false
+	s.doRegister()
+}
+
+// Stop removes the registration from the registrar.
+func (s *sipRegistrationAgent) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancelTimer()
+	if s.unregister {
+		return
+	}
+	s.unregister = true
+	if s.state == REG_STATE_IDLE || s.state == REG_STATE_UNREGISTERED {
+		return
+	}
+	s.atries = 0
+	s.doRegister()
+}
+
+// GetStatus returns the state, the time the current registration
+// expires at and the reason of the last failure.
+func (s *sipRegistrationAgent) GetStatus() (string, time.Time, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state, s.expires_at, s.last_error
+}
+
+func (s *sipRegistrationAgent) IsRegistered() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state == REG_STATE_REGISTERED && s.expires_at.After(time.Now())
+}
+
+func (s *sipRegistrationAgent) cancelTimer() {
+	if s.timer != nil {
+		s.timer.Cancel()
+		s.timer = nil
+	}
+}
+
+func (s *sipRegistrationAgent) startTimer(timeout time.Duration) {
+	s.cancelTimer()
+	s.timer = StartTimeout(func() {
+		s.timer = nil
+		s.doRegister()
+	}, &s.lock, timeout, 1, s.config.ErrorLogger())
+}
+
+func (s *sipRegistrationAgent) genRequest() (sippy_types.SipRequest, error) {
+	expires := sippy_header.NewSipExpires()
+	expires.Number = int(s.expires.Seconds())
+	if s.unregister {
+		expires.Number = 0
+	}
+	to := sippy_header.NewSipTo(sippy_header.NewSipAddress("", s.aor.GetCopy()), s.config)
+	from_addr := sippy_header.NewSipAddress("", s.aor.GetCopy())
+	from_addr.SetTag(s.from_tag)
+	from := sippy_header.NewSipFrom(from_addr, s.config)
+	contact := sippy_header.NewSipContactFromAddress(sippy_header.NewSipAddress("", s.contact.GetCopy()))
+	req, err := NewSipRequest("REGISTER", s.ruri.GetCopy(), "", to, from, nil, s.cseq, s.call_id.GetCopy(),
+		nil, nil, contact, nil, s.target, nil, expires, s.config)
+	if err != nil {
+		return nil, err
+	}
+	s.cseq++
+	if s.auth != nil {
+		req.AppendHeader(s.auth)
+		s.auth = nil
+	}
+	return req, nil
+}
+
+func (s *sipRegistrationAgent) doRegister() {
+	if s.state != REG_STATE_REGISTERED || s.unregister {
+		s.state = REG_STATE_REGISTERING
+	}
+	req, err := s.genRequest()
+	if err != nil {
+		s.failed("cannot create REGISTER: " + err.Error())
+		return
+	}
+	s.sip_tm.BeginNewClientTransaction(req, s, &s.lock, nil, nil, nil)
+}
+
+func (s *sipRegistrationAgent) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
+	code := resp.GetSCodeNum()
+	if code < 200 {
+		return
+	}
+	if code < 300 {
+		s.atries = 0
+		s.backoff = REG_RETRY_MIN
+		s.last_error = ""
+		if s.unregister {
+			s.state = REG_STATE_UNREGISTERED
+			s.expires_at = time.Time{}
+			return
+		}
+		granted := s.grantedExpires(resp)
+		s.state = REG_STATE_REGISTERED
+		s.expires_at = time.Now().Add(granted)
+		// Refresh when 80% of the interval has passed
+		s.startTimer(granted * 4 / 5)
+		if s.rok_cb != nil {
+			s.rok_cb(granted)
+		}
+		return
+	}
+	var challenge sippy_types.Challenge
+	if code == 401 && len(resp.GetSipWWWAuthenticates()) > 0 {
+		challenge = resp.GetSipWWWAuthenticates()[0]
+	} else if code == 407 && len(resp.GetSipProxyAuthenticates()) > 0 {
+		challenge = resp.GetSipProxyAuthenticates()[0]
+	}
+	if challenge != nil && s.user != "" && s.atries < REG_MAX_AUTH_TRIES {
+		auth, err := challenge.GenAuthHF(s.user, s.passw, "REGISTER", s.ruri.String(), "")
+		if err == nil {
+			s.atries++
+			s.auth = auth
+			s.doRegister()
+			return
+		}
+		s.config.ErrorLogger().Error("Cannot answer the challenge: " + err.Error())
+	}
+	if code == 423 && !s.unregister {
+		if hf := resp.GetFirstHF("min-expires"); hf != nil {
+			if min_expires, err := strconv.Atoi(hf.StringBody()); err == nil && time.Duration(min_expires)*time.Second > s.expires {
+				s.expires = time.Duration(min_expires) * time.Second
+				s.doRegister()
+				return
+			}
+		}
+	}
+	s.atries = 0
+	s.failed(resp.GetSL())
+}
+
+func (s *sipRegistrationAgent) failed(reason string) {
+	s.last_error = reason
+	if s.unregister {
+		s.state = REG_STATE_UNREGISTERED
+		return
+	}
+	s.state = REG_STATE_FAILED
+	s.expires_at = time.Time{}
+	s.startTimer(s.backoff)
+	s.backoff *= 2
+	if s.backoff > REG_RETRY_MAX {
+		s.backoff = REG_RETRY_MAX
+	}
+	if s.rfail_cb != nil {
+		s.rfail_cb(reason)
+	}
+}
+
+// grantedExpires returns the expiration interval the registrar has
+// granted to our contact.
+func (s *sipRegistrationAgent) grantedExpires(resp sippy_types.SipResponse) time.Duration {
+	for _, contact := range resp.GetContacts() {
+		addr, err := contact.GetBody(s.config)
+		if err != nil || addr.GetUrl().Host.String() != s.contact.Host.String() || addr.GetUrl().Username != s.contact.Username {
+			continue
+		}
+		if expires, err := strconv.Atoi(addr.GetParam("expires")); err == nil && expires > 0 {
+			return time.Duration(expires) * time.Second
+		}
+	}
+	if hf, ok := resp.GetFirstHF("expires").(*sippy_header.SipExpires); ok {
+		if body, err := hf.GetBody(); err == nil && body.Number > 0 {
+			return time.Duration(body.Number) * time.Second
+		}
+	}
+	return s.expires
+}
@@ -0,0 +1,91 @@
+package sippy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+// regTestTM captures the requests instead of sending them
+type regTestTM struct {
+	reqs []sippy_types.SipRequest
+}
+
+func (s *regTestTM) RegConsumer(sippy_types.UA, string)   {}
+func (s *regTestTM) UnregConsumer(sippy_types.UA, string) {}
+func (s *regTestTM) BeginNewClientTransaction(req sippy_types.SipRequest, _ sippy_types.ResponseReceiver, _ sync.Locker, _ *sippy_net.HostPort, _ sippy_net.Transport, _ func(sippy_types.SipRequest)) {
+	s.reqs = append(s.reqs, req)
+}
+func (s *regTestTM) CreateClientTransaction(sippy_types.SipRequest, sippy_types.ResponseReceiver, sync.Locker, *sippy_net.HostPort,
+	sippy_net.Transport, []sippy_header.SipHeader, func(sippy_types.SipRequest)) (sippy_types.ClientTransaction, error) {
+	return nil, nil
+}
+func (s *regTestTM) BeginClientTransaction(sippy_types.SipRequest, sippy_types.ClientTransaction) {}
+func (s *regTestTM) SendResponse(sippy_types.SipResponse, bool, func(sippy_types.SipRequest))     {}
+func (s *regTestTM) SendResponseWithLossEmul(sippy_types.SipResponse, bool, func(sippy_types.SipRequest), int) {
+}
+func (s *regTestTM) Run()      {}
+func (s *regTestTM) Shutdown() {}
+
+func (s *regTestTM) last(t *testing.T, config sippy_conf.Config) *sipRequest {
+	rtime, _ := sippy_time.NewMonoTime()
+	req, err := ParseSipRequest([]byte(s.reqs[len(s.reqs)-1].LocalStr(nil, false)), rtime, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestRegistrationAgent(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	sip_tm := &regTestTM{}
+	aor, _ := sippy_header.ParseSipURL("sip:alice@127.0.0.1", false, config)
+	contact, _ := sippy_header.ParseSipURL("sip:alice@127.0.0.2", false, config)
+	agent := NewSipRegistrationAgent(sip_tm, config, aor, contact, nil, "alice", "secret", time.Hour)
+	reg := NewRegistrar(nil, config)
+	reg.SetAuth("127.0.0.1", "", func(username string) (string, bool) { return "secret", true })
+	granted := time.Duration(0)
+	agent.SetCallbacks(func(expires time.Duration) { granted = expires }, nil)
+
+	agent.Start()
+	for i := 0; i < 3 && len(sip_tm.reqs) == i+1; i++ {
+		resp := reg.register(sip_tm.last(t, config))
+		agent.lock.Lock()
+		agent.RecvResponse(resp, nil)
+		agent.lock.Unlock()
+	}
+	if len(sip_tm.reqs) != 2 {
+		t.Fatalf("Bad number of REGISTERs sent: %d", len(sip_tm.reqs))
+	}
+	if !agent.IsRegistered() || granted != time.Hour {
+		t.Fatalf("Not registered: granted %s", granted)
+	}
+	if len(reg.Lookup(MakeAor("alice", "127.0.0.1"))) != 1 {
+		t.Fatal("No binding at the registrar")
+	}
+
+	agent.Stop()
+	resp := reg.register(sip_tm.last(t, config))
+	agent.lock.Lock()
+	agent.RecvResponse(resp, nil)
+	agent.lock.Unlock()
+	for resp.GetSCodeNum() == 401 && len(sip_tm.reqs) < 5 {
+		resp = reg.register(sip_tm.last(t, config))
+		agent.lock.Lock()
+		agent.RecvResponse(resp, nil)
+		agent.lock.Unlock()
+	}
+	if state, _, _ := agent.GetStatus(); state != REG_STATE_UNREGISTERED {
+		t.Errorf("Bad state after Stop(): %s", state)
+	}
+	if len(reg.Lookup(MakeAor("alice", "127.0.0.1"))) != 0 {
+		t.Error("The binding has not been removed")
+	}
+}
@@ -30,6 +30,12 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/egovorukhin/go-b2bua/sippy/utils"
@@ -37,16 +43,37 @@ import (
 
 const (
 	VTIME = int64(32)
+
+	// CLOCK_SKEW is how far the clocks of the nodes sharing the keys may
+	// differ in seconds.
+	CLOCK_SKEW = int64(2)
+
+	// NONCE_KEYS_ENV is the environment variable the oracle keys are read
+	// from when no key file is given.
+	NONCE_KEYS_ENV = "SIPPY_NONCE_KEYS"
 )
 
+/*
+ * hashOracle emits the nonces and validates them later. The nonce is the
+ * encrypted timestamp prefixed with the ID of the key used, so the nodes
+ * sharing the same keys accept the nonces emitted by each other.
+ */
 type hashOracle struct {
-	ac *AESCipher
+	lock    sync.RWMutex
+	ciphers map[uint8]*AESCipher
+	current uint8
 }
 
 type AESCipher struct {
 	cipher cipher.Block
 }
 
+// OracleKey is the AES-128, AES-192 or AES-256 key of the oracle.
+type OracleKey struct {
+	Id  uint8
+	Key []byte
+}
+
 var _key []byte
 var HashOracle *hashOracle
 
@@ -67,31 +94,166 @@ func newHashOracle() (*hashOracle, error) {
 		return nil, err
 	}
 	return &hashOracle{
-		ac: ac,
+		ciphers: map[uint8]*AESCipher{0: ac},
+	}, nil
+}
+
+// SetKeys replaces the keys of the oracle. The first key is used for the
+// new nonces, the nonces emitted with any of the keys are accepted. To
+// rotate the keys without rejecting the nonces in flight, first add the
+// new key after the current one on every node, then move it to the first
+// place and drop the old key once VTIME has passed.
+func (s *hashOracle) SetKeys(keys []*OracleKey) error {
+	commit, err := s.prepareKeys(keys)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+func (s *hashOracle) prepareKeys(keys []*OracleKey) (func(), error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No oracle keys given")
+	}
+	ciphers := make(map[uint8]*AESCipher)
+	for _, key := range keys {
+		if _, ok := ciphers[key.Id]; ok {
+			return nil, fmt.Errorf("Duplicate oracle key ID %d", key.Id)
+		}
+		ac, err := newAESCipherWithKey(key.Key)
+		if err != nil {
+			return nil, err
+		}
+		ciphers[key.Id] = ac
+	}
+	return func() {
+		s.lock.Lock()
+		s.ciphers = ciphers
+		s.current = keys[0].Id
+		s.lock.Unlock()
 	}, nil
 }
 
-func (s *hashOracle) EmitChallenge(cmask int64, now_mono time.Time) string {
-	ts64 := (now_mono.Unix() << NUM_OF_DGSTS) | cmask
-	return s.ac.Encrypt(ts64)
+// LoadKeys reads the keys from the file or, if the file name is empty,
+// from the NONCE_KEYS_ENV environment variable. The random key generated
+// on start remains in use when neither is set.
+func (s *hashOracle) LoadKeys(fname string) error {
+	commit, err := s.PrepareKeys(fname)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareKeys reads and checks the keys the way LoadKeys does, the keys
+// are put in use by the returned function.
+func (s *hashOracle) PrepareKeys(fname string) (func(), error) {
+	var buf string
+
+	if fname != "" {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		buf = string(data)
+	} else if buf = os.Getenv(NONCE_KEYS_ENV); buf == "" {
+		return func() {}, nil
+	}
+	keys, err := ParseOracleKeys(buf)
+	if err != nil {
+		return nil, err
+	}
+	return s.prepareKeys(keys)
+}
+
+// ParseOracleKeys parses the list of keys in the form "id:hexkey", one
+// per line or separated with commas. The lines starting with '#' are
+// ignored.
+func ParseOracleKeys(buf string) ([]*OracleKey, error) {
+	keys := []*OracleKey{}
+	for _, line := range strings.Split(buf, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			arr := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+			if len(arr) != 2 {
+				return nil, errors.New("Bad oracle key: " + entry)
+			}
+			id, err := strconv.ParseUint(arr[0], 10, 8)
+			if err != nil {
+				return nil, errors.New("Bad oracle key ID: " + arr[0])
+			}
+			key, err := hex.DecodeString(arr[1])
+			if err != nil {
+				return nil, fmt.Errorf("Bad oracle key %d: %s", id, err.Error())
+			}
+			keys = append(keys, &OracleKey{Id: uint8(id), Key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No oracle keys found")
+	}
+	return keys, nil
+}
+
+// EmitChallenge returns the new nonce. The time has to be the wall clock
+// time as the nonces must remain valid on the other nodes and after the
+// restart.
+func (s *hashOracle) EmitChallenge(cmask int64, now time.Time) string {
+	ts64 := (now.Unix() << NUM_OF_DGSTS) | cmask
+	s.lock.RLock()
+	id, ac := s.current, s.ciphers[s.current]
+	s.lock.RUnlock()
+	return sippy_utils.B64EncodeNoPad(append([]byte{id}, ac.seal(ts64)...))
+}
+
+func (s *hashOracle) ValidateChallenge(cryptic string, cmask int64, now time.Time) bool {
+	valid, _ := s.CheckChallenge(cryptic, cmask, now)
+	return valid
 }
 
-func (s *hashOracle) ValidateChallenge(cryptic string, cmask int64, now_mono time.Time) bool {
-	new_ts := now_mono.Unix()
-	decryptic, err := s.ac.Decrypt(cryptic)
+// CheckChallenge works like ValidateChallenge, but it also tells if the
+// challenge has been emitted by us and has only expired, so that the
+// client can be asked to retry with a fresh nonce (stale=true). The
+// challenge encrypted with the key that is not in use any more is
+// considered expired as well.
+func (s *hashOracle) CheckChallenge(cryptic string, cmask int64, now time.Time) (valid, stale bool) {
+	new_ts := now.Unix()
+	raw, err := sippy_utils.B64DecodeNoPad(cryptic)
+	if err != nil || len(raw) == 0 {
+		return false, false
+	}
+	s.lock.RLock()
+	ac, ok := s.ciphers[raw[0]]
+	s.lock.RUnlock()
+	if !ok {
+		return false, true
+	}
+	decryptic, err := ac.open(raw[1:])
 	if err != nil || (cmask&decryptic) == 0 {
-		return false
+		return false, false
 	}
 	orig_ts := decryptic >> NUM_OF_DGSTS
 	tsdiff := new_ts - orig_ts
-	if tsdiff < 0 || tsdiff > VTIME {
-		return false
+	if tsdiff < -CLOCK_SKEW {
+		return false, false
+	}
+	if tsdiff > VTIME {
+		return false, true
 	}
-	return true
+	return true, false
 }
 
 func NewAESCipher() (*AESCipher, error) {
-	cipher, err := aes.NewCipher(_key)
+	return newAESCipherWithKey(_key)
+}
+
+func newAESCipherWithKey(key []byte) (*AESCipher, error) {
+	cipher, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +263,10 @@ func NewAESCipher() (*AESCipher, error) {
 }
 
 func (s *AESCipher) Encrypt(ts64 int64) string {
+	return sippy_utils.B64EncodeNoPad(s.seal(ts64))
+}
+
+func (s *AESCipher) seal(ts64 int64) []byte {
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, uint64(ts64))
 	raw := make([]byte, 16)
@@ -110,7 +276,7 @@ func (s *AESCipher) Encrypt(ts64 int64) string {
 	rand.Read(iv)
 	stream := cipher.NewOFB(s.cipher, iv)
 	stream.XORKeyStream(ciphertext[aes.BlockSize:], raw)
-	return sippy_utils.B64EncodeNoPad(ciphertext)
+	return ciphertext
 }
 
 func (s *AESCipher) Decrypt(enc string) (int64, error) {
@@ -118,6 +284,13 @@ func (s *AESCipher) Decrypt(enc string) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return s.open(raw)
+}
+
+func (s *AESCipher) open(raw []byte) (int64, error) {
+	if len(raw) != aes.BlockSize+16 {
+		return 0, errors.New("Bad length of the encrypted challenge")
+	}
 	iv := raw[:aes.BlockSize]
 	stream := cipher.NewOFB(s.cipher, iv)
 	decrypted := make([]byte, 16)
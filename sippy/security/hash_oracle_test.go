@@ -1,10 +1,11 @@
 package sippy_security
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
-
-	"github.com/egovorukhin/go-b2bua/sippy/time"
 )
 
 func TestWrongAlgo(t *testing.T) {
@@ -13,7 +14,7 @@ func TestWrongAlgo(t *testing.T) {
 			if alg1.Mask == alg2.Mask {
 				continue
 			}
-			now, _ := sippy_time.ClockGettime(sippy_time.CLOCK_MONOTONIC)
+			now := time.Now()
 			nonce := HashOracle.EmitChallenge(alg1.Mask, now)
 			if HashOracle.ValidateChallenge(nonce, alg2.Mask, now) {
 				t.Errorf("The validation should fail for pair (%s, %s)", name1, name2)
@@ -25,7 +26,7 @@ func TestWrongAlgo(t *testing.T) {
 
 func TestExpiration(t *testing.T) {
 	for name, alg := range algorithms {
-		now, _ := sippy_time.ClockGettime(sippy_time.CLOCK_MONOTONIC)
+		now := time.Now()
 		nonce := HashOracle.EmitChallenge(alg.Mask, now)
 		if !HashOracle.ValidateChallenge(nonce, alg.Mask, now) {
 			t.Errorf("Expiration Test #1 failed for %s", name)
@@ -44,7 +45,7 @@ func TestExpiration(t *testing.T) {
 func TestHashOracle(t *testing.T) {
 	for name, alg := range algorithms {
 		for i := 0; i < 10000; i++ {
-			now, _ := sippy_time.ClockGettime(sippy_time.CLOCK_MONOTONIC)
+			now := time.Now()
 			cryptic := HashOracle.EmitChallenge(alg.Mask, now)
 			if !HashOracle.ValidateChallenge(cryptic, alg.Mask, now) {
 				t.Errorf("Algorithm %s failed", name)
@@ -52,3 +53,104 @@ func TestHashOracle(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckChallenge(t *testing.T) {
+	now := time.Now()
+	nonce := HashOracle.EmitChallenge(DGST_MD5, now)
+	if valid, stale := HashOracle.CheckChallenge(nonce, DGST_MD5, now.Add(33*time.Second)); valid || !stale {
+		t.Errorf("Expired challenge is not stale: valid=%v stale=%v", valid, stale)
+	}
+	// The clock of the node checking the nonce may be slightly behind
+	if !HashOracle.ValidateChallenge(nonce, DGST_MD5, now.Add(-time.Second)) {
+		t.Error("Challenge emitted by the node with the clock ahead has been rejected")
+	}
+	if HashOracle.ValidateChallenge(nonce, DGST_MD5, now.Add(-10*time.Second)) {
+		t.Error("Challenge from the future has been accepted")
+	}
+	if valid, stale := HashOracle.CheckChallenge(nonce, DGST_SHA256, now); valid || stale {
+		t.Errorf("Challenge for the wrong algorithm is stale: valid=%v stale=%v", valid, stale)
+	}
+	for _, cryptic := range []string{"", "abcd", nonce + nonce} {
+		if HashOracle.ValidateChallenge(cryptic, DGST_MD5, now) {
+			t.Errorf("Garbage challenge %q has been accepted", cryptic)
+		}
+	}
+}
+
+func TestOracleKeys(t *testing.T) {
+	keys, err := ParseOracleKeys("# id:key\n1:000102030405060708090a0b0c0d0e0f, 2:" + strings.Repeat("ab", 32) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Id != 1 || keys[1].Id != 2 || len(keys[1].Key) != 32 {
+		t.Fatalf("Bad keys parsed: %v", keys)
+	}
+	for _, buf := range []string{"", "1", "x:00", "256:00", "1:zz", "1:0001"} {
+		if keys, err := ParseOracleKeys(buf); err == nil {
+			if err = newTestOracle(t).SetKeys(keys); err == nil {
+				t.Errorf("Bad keys %q have been accepted", buf)
+			}
+		}
+	}
+	if err = newTestOracle(t).SetKeys([]*OracleKey{keys[0], keys[0]}); err == nil {
+		t.Error("Duplicate key IDs have been accepted")
+	}
+
+	// The nodes sharing the keys accept the nonces of each other
+	node_a, node_b := newTestOracle(t), newTestOracle(t)
+	node_a.SetKeys(keys)
+	node_b.SetKeys(keys)
+	now := time.Now()
+	nonce_a := node_a.EmitChallenge(DGST_SHA256, now)
+	if !node_b.ValidateChallenge(nonce_a, DGST_SHA256, now) {
+		t.Fatal("The nonce has not been accepted by the other node")
+	}
+	if HashOracle.ValidateChallenge(nonce_a, DGST_SHA256, now) {
+		t.Fatal("The nonce has been accepted by the node with another key")
+	}
+
+	// Rotation: the new key becomes current, the old nonce remains valid
+	node_b.SetKeys([]*OracleKey{keys[1], keys[0]})
+	nonce_b := node_b.EmitChallenge(DGST_SHA256, now)
+	if !node_a.ValidateChallenge(nonce_b, DGST_SHA256, now) || !node_b.ValidateChallenge(nonce_a, DGST_SHA256, now) {
+		t.Fatal("The nonce has been rejected during the key rotation")
+	}
+	node_b.SetKeys([]*OracleKey{keys[1]})
+	if valid, stale := node_b.CheckChallenge(nonce_a, DGST_SHA256, now); valid || !stale {
+		t.Errorf("The nonce of the retired key is not stale: valid=%v stale=%v", valid, stale)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	oracle := newTestOracle(t)
+	now := time.Now()
+	nonce := oracle.EmitChallenge(DGST_MD5, now)
+	t.Setenv(NONCE_KEYS_ENV, "")
+	if err := oracle.LoadKeys(""); err != nil || !oracle.ValidateChallenge(nonce, DGST_MD5, now) {
+		t.Fatal("The random key has been replaced")
+	}
+	t.Setenv(NONCE_KEYS_ENV, "7:"+strings.Repeat("01", 16))
+	if err := oracle.LoadKeys(""); err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(fname, []byte("7:"+strings.Repeat("01", 16)+"\n"), 0600)
+	other := newTestOracle(t)
+	if err := other.LoadKeys(fname); err != nil {
+		t.Fatal(err)
+	}
+	if !other.ValidateChallenge(oracle.EmitChallenge(DGST_MD5, now), DGST_MD5, now) {
+		t.Error("The key from the file does not match the one from the environment")
+	}
+	if err := other.LoadKeys(fname + ".none"); err == nil {
+		t.Error("Missing key file has been accepted")
+	}
+}
+
+func newTestOracle(t *testing.T) *hashOracle {
+	oracle, err := newHashOracle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oracle
+}
@@ -156,6 +156,14 @@ func (s *serverTransaction) SetCancelCB(cancel_cb func(*sippy_time.MonoTime, sip
 	s.cancel_cb = cancel_cb
 }
 
+// SetCancelResponse sets the final response sent when the request is
+// cancelled or expires. The nil response leaves sending the final
+// response to the cancel callback, i.e. the proxy forwards the one it
+// gets from downstream.
+func (s *serverTransaction) SetCancelResponse(resp sippy_types.SipResponse) {
+	s.r487 = resp
+}
+
 func (s *serverTransaction) SetNoackCB(noack_cb func(*sippy_time.MonoTime)) {
 	s.noack_cb = noack_cb
 }
@@ -311,6 +319,9 @@ func (s *serverTransaction) SendResponseWithLossEmul(resp sippy_types.SipRespons
 		sip_tm.rtid_put(rtid, tid)
 	}
 	sip_tm.beforeResponseSent(resp)
+	if s.before_response_sent != nil {
+		s.before_response_sent(resp)
+	}
 	s.data = []byte(resp.LocalStr(s.userv.GetLAddress() /*compact*/, false))
 	via0, err = resp.GetVias()[0].GetBody()
 	if err != nil {
@@ -360,9 +371,6 @@ func (s *serverTransaction) SendResponseWithLossEmul(resp sippy_types.SipRespons
 			need_cleanup = true
 		}
 	}
-	if s.before_response_sent != nil {
-		s.before_response_sent(resp)
-	}
 	sip_tm.transmitData(s.userv, s.data, s.address, s.checksum, s.tid.CallId, lossemul)
 	if need_cleanup {
 		s.cleanup()
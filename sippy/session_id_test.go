@@ -0,0 +1,77 @@
+package sippy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const (
+	test_caller_uuid = "ab30317f1a784dc48ff824d0d3715d86"
+	test_callee_uuid = "47755a9de7794ba387653f2099600ef2"
+)
+
+type test_session_id_call_map struct {
+	test_call_map
+}
+
+func (s *test_session_id_call_map) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerTransaction) (sippy_types.UA, sippy_types.RequestReceiver, sippy_types.SipResponse) {
+	s.ua = NewUA(s.sip_tm, s.config, sippy_net.NewHostPort("1.1.1.1", "5060"), s, &s.lock, nil)
+	s.ua.SetSessionUUIDs(sippy_types.NewSessionUUIDs("", test_callee_uuid))
+	s.msg_body = req.GetBody()
+	return s.ua, s.ua, nil
+}
+
+func Test_SessionIdOnTheWire(t *testing.T) {
+	var err error
+
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+	config.SetSipAddress(config.GetMyAddress())
+	config.SetSipPort(config.GetMyPort())
+	cmap := &test_session_id_call_map{test_call_map{config: config}}
+	tfactory := NewTestSipTransportFactory()
+	config.SetSipTransportFactory(tfactory)
+	cmap.sip_tm, err = NewSipTransactionManager(config, cmap)
+	if err != nil {
+		t.Fatal("Cannot create SIP transaction manager: " + err.Error())
+	}
+	go cmap.sip_tm.Run()
+	defer cmap.sip_tm.Shutdown()
+	tfactory.feed([]string{
+		"INVITE sip:905399232076@10.20.30.40 SIP/2.0",
+		"Via: SIP/2.0/UDP 10.164.244.209:5060;received=10.164.244.209;branch=z9hG4bK0b5aac35;rport=5060",
+		"Max-Forwards: 69",
+		"From: \"John Smith\" <sip:testcli@sip.test.com>;tag=as57b03f0f",
+		"To: <sip:905399232076@sip-carriers.local>",
+		"Contact: <sip:908502729000@10.164.244.209:5060>",
+		"Call-ID: 5a0e8fe41c3c7e8bdad9b2b9e0c3c4a1@sip.test.com",
+		"CSeq: 102 INVITE",
+		"Session-ID: " + test_caller_uuid + ";remote=00000000000000000000000000000000",
+		"Content-Type: application/sdp",
+		"Content-Length: 126",
+		"",
+		"v=0",
+		"o=user1 53655765 2353687637 IN IP4 1.1.1.1",
+		"s=-",
+		"c=IN IP4 1.1.1.1",
+		"t=0 0",
+		"m=audio 11111 RTP/AVP 0",
+		"a=rtpmap:0 PCMU/8000",
+		"",
+	})
+	tfactory.get() // 100 Trying
+	cmap.answer()
+	// The UAS sends its own UUID as the local one
+	expected := "Session-ID: " + test_callee_uuid + ";remote=" + test_caller_uuid + "\r\n"
+	if res := string(tfactory.get()); !strings.HasPrefix(res, "SIP/2.0 200 ") || strings.Count(res, expected) != 1 {
+		t.Fatalf("The Session-ID has not been sent in 200 OK:\n%s", res)
+	}
+	cmap.disconnect()
+	if res := string(tfactory.get()); !strings.HasPrefix(res, "BYE ") || strings.Count(res, expected) != 1 {
+		t.Fatalf("The Session-ID has not been sent in BYE:\n%s", res)
+	}
+}
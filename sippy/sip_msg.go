@@ -20,6 +20,7 @@ type sipMsg struct {
 	startline               string
 	vias                    []*sippy_header.SipVia
 	contacts                []*sippy_header.SipContact
+	contact_wildcard        bool
 	to                      *sippy_header.SipTo
 	from                    *sippy_header.SipFrom
 	cseq                    *sippy_header.SipCSeq
@@ -50,6 +51,12 @@ type sipMsg struct {
 	sip_require             []*sippy_header.SipRequire
 	sip_supported           []*sippy_header.SipSupported
 	sip_date                *sippy_header.SipDate
+	sip_pais                []*sippy_header.SipPAssertedIdentity
+	sip_ppis                []*sippy_header.SipPPreferredIdentity
+	sip_privacy             *sippy_header.SipPrivacy
+	sip_diversions          []*sippy_header.SipDiversion
+	sip_history_infos       []*sippy_header.SipHistoryInfo
+	sip_session_id          *sippy_header.SipSessionId
 	config                  sippy_conf.Config
 }
 
@@ -114,6 +121,7 @@ func ParseSipMsg(_buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Conf
 		for _, header := range headers {
 			if contact, ok := header.(*sippy_header.SipContact); ok {
 				if contact.Asterisk {
+					s.contact_wildcard = true
 					continue
 				}
 			}
@@ -218,12 +226,80 @@ func (m *sipMsg) AppendHeader(hdr sippy_header.SipHeader) {
 		m.sip_supported = append(m.sip_supported, t)
 	case *sippy_header.SipDate:
 		m.sip_date = t
+	case *sippy_header.SipPAssertedIdentity:
+		m.sip_pais = append(m.sip_pais, t)
+	case *sippy_header.SipPPreferredIdentity:
+		m.sip_ppis = append(m.sip_ppis, t)
+	case *sippy_header.SipPrivacy:
+		m.sip_privacy = t
+	case *sippy_header.SipDiversion:
+		m.sip_diversions = append(m.sip_diversions, t)
+	case *sippy_header.SipHistoryInfo:
+		m.sip_history_infos = append(m.sip_history_infos, t)
+	case *sippy_header.SipSessionId:
+		if m.sip_session_id != nil {
+			// there can be only one Session-ID, replace it
+			for i, h := range m.headers {
+				if h == sippy_header.SipHeader(m.sip_session_id) {
+					m.headers[i] = t
+				}
+			}
+			m.sip_session_id = t
+			return
+		}
+		m.sip_session_id = t
 	case nil:
 		return
 	}
 	m.headers = append(m.headers, hdr)
 }
 
+// RemoveHeaders removes all headers with the given name except the ones
+// that are managed by the transaction layer (Via, Route, Max-Forwards,
+// Content-Length and Content-Type).
+func (m *sipMsg) RemoveHeaders(name string) {
+	headers := make([]sippy_header.SipHeader, 0, len(m.headers))
+	for _, hf := range m.headers {
+		if !match_name(name, hf) {
+			headers = append(headers, hf)
+		}
+	}
+	if len(headers) != len(m.headers) {
+		m.headers = headers
+		m.reindexHeaders()
+	}
+}
+
+// ReplaceHeader puts the new header in place of the old one. The new
+// header is appended if the old one is not found.
+func (m *sipMsg) ReplaceHeader(old, hdr sippy_header.SipHeader) {
+	for i, hf := range m.headers {
+		if hf == old {
+			m.headers[i] = hdr
+			m.reindexHeaders()
+			return
+		}
+	}
+	m.AppendHeader(hdr)
+}
+
+// reindexHeaders rebuilds the typed references to the headers after the
+// list of headers has been modified.
+func (m *sipMsg) reindexHeaders() {
+	headers := m.headers
+	m.headers = make([]sippy_header.SipHeader, 0, len(headers))
+	m.cseq, m.rseq, m.rack, m.call_id, m.from, m.to = nil, nil, nil, nil, nil, nil
+	m.record_routes, m.contacts, m.also, m.refer_to = nil, nil, nil, nil
+	m.sip_www_authenticates, m.sip_proxy_authenticates = nil, nil
+	m.sip_server, m.sip_user_agent, m.sip_cisco_guid, m.sip_h323_conf_id = nil, nil, nil, nil
+	m.reason_hf, m.sip_warning, m.sip_require, m.sip_supported, m.sip_date = nil, nil, nil, nil, nil
+	m.sip_pais, m.sip_ppis, m.sip_privacy, m.sip_diversions, m.sip_history_infos = nil, nil, nil, nil, nil
+	m.sip_session_id = nil
+	for _, hf := range headers {
+		m.AppendHeader(hf)
+	}
+}
+
 func (m *sipMsg) init_body(logger sippy_log.ErrorLogger) error {
 	var blen_hf *sippy_header.SipNumericHF
 	if m.content_length != nil {
@@ -275,7 +351,7 @@ func (m *sipMsg) init_body(logger sippy_log.ErrorLogger) error {
 	}
 	if m.__mbody != nil {
 		if m.content_type != nil {
-			m.body = NewMsgBody(*m.__mbody, strings.ToLower(m.content_type.StringBody()))
+			m.body = NewMsgBody(*m.__mbody, m.content_type.StringBody())
 		} else {
 			m.body = NewMsgBody(*m.__mbody, "application/sdp")
 		}
@@ -463,6 +539,14 @@ func (m *sipMsg) getCopy() *sipMsg {
 	for _, header := range m.headers {
 		cself.AppendHeader(header.GetCopyAsIface())
 	}
+	if m.maxforwards != nil {
+		cself.maxforwards = m.maxforwards.GetCopy()
+	}
+	if m.sip_authorization != nil {
+		cself.AppendHeader(m.sip_authorization.GetCopyAsIface())
+	} else if m.sip_proxy_authorization != nil {
+		cself.AppendHeader(&sippy_header.SipProxyAuthorization{SipAuthorization: m.sip_proxy_authorization.GetCopy()})
+	}
 	if m.body != nil {
 		cself.body = m.body.GetCopy()
 	}
@@ -532,6 +616,10 @@ func (m *sipMsg) RemoveFirstVia() {
 	m.vias = m.vias[1:]
 }
 
+func (m *sipMsg) GetRoutes() []*sippy_header.SipRoute {
+	return m.routes
+}
+
 func (m *sipMsg) SetRoutes(routes []*sippy_header.SipRoute) {
 	m.routes = routes
 }
@@ -556,10 +644,35 @@ func (m *sipMsg) GetContacts() []*sippy_header.SipContact {
 	return m.contacts
 }
 
+// HasContactWildcard tells whether the message contained "Contact: *".
+// The wildcard is not included in the GetContacts() list.
+func (m *sipMsg) HasContactWildcard() bool {
+	return m.contact_wildcard
+}
+
 func (m *sipMsg) GetRecordRoutes() []*sippy_header.SipRecordRoute {
 	return m.record_routes
 }
 
+// InsertFirstRecordRoute puts the Record-Route header on top of the
+// existing ones.
+func (m *sipMsg) InsertFirstRecordRoute(rr *sippy_header.SipRecordRoute) {
+	headers := make([]sippy_header.SipHeader, 0, len(m.headers)+1)
+	inserted := false
+	for _, hf := range m.headers {
+		if _, ok := hf.(*sippy_header.SipRecordRoute); ok && !inserted {
+			headers = append(headers, rr)
+			inserted = true
+		}
+		headers = append(headers, hf)
+	}
+	if !inserted {
+		headers = append(headers, rr)
+	}
+	m.headers = headers
+	m.reindexHeaders()
+}
+
 func (m *sipMsg) GetCGUID() *sippy_header.SipCiscoGUID {
 	return m.sip_cisco_guid
 }
@@ -643,3 +756,27 @@ func (m *sipMsg) GetSipSupported() []*sippy_header.SipSupported {
 func (m *sipMsg) GetSipDate() *sippy_header.SipDate {
 	return m.sip_date
 }
+
+func (m *sipMsg) GetPAIs() []*sippy_header.SipPAssertedIdentity {
+	return m.sip_pais
+}
+
+func (m *sipMsg) GetPPIs() []*sippy_header.SipPPreferredIdentity {
+	return m.sip_ppis
+}
+
+func (m *sipMsg) GetPrivacy() *sippy_header.SipPrivacy {
+	return m.sip_privacy
+}
+
+func (m *sipMsg) GetDiversions() []*sippy_header.SipDiversion {
+	return m.sip_diversions
+}
+
+func (m *sipMsg) GetHistoryInfos() []*sippy_header.SipHistoryInfo {
+	return m.sip_history_infos
+}
+
+func (m *sipMsg) GetSessionId() *sippy_header.SipSessionId {
+	return m.sip_session_id
+}
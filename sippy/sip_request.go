@@ -19,6 +19,8 @@ type sipRequest struct {
 	expires    *sippy_header.SipExpires
 	user_agent *sippy_header.SipUserAgent
 	nated      bool
+	// The User-Agent is not sent in the request and its ACK or CANCEL
+	no_user_agent bool
 }
 
 func ParseSipRequest(buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Config) (*sipRequest, error) {
@@ -130,6 +132,19 @@ func (s *sipRequest) LocalStr(hostPort *sippy_net.HostPort, compact bool /*= Fal
 	return s.GetSL() + "\r\n" + s.localStr(hostPort, compact)
 }
 
+func (s *sipRequest) GetCopy() sippy_types.SipRequest {
+	rval := &sipRequest{
+		method:        s.method,
+		sipver:        s.sipver,
+		ruri:          s.ruri.GetCopy(),
+		user_agent:    s.user_agent,
+		nated:         s.nated,
+		no_user_agent: s.no_user_agent,
+	}
+	rval.sipMsg = s.sipMsg.getCopy()
+	return rval
+}
+
 func (s *sipRequest) GetTo() *sippy_header.SipTo {
 	return s.to
 }
@@ -181,12 +196,19 @@ func (s *sipRequest) GenACK(to *sippy_header.SipTo) (sippy_types.SipRequest, err
 	if err != nil {
 		return nil, err
 	}
-	return NewSipRequest("ACK", s.ruri.GetCopy(), s.sipver,
+	req, err := NewSipRequest("ACK", s.ruri.GetCopy(), s.sipver,
 		to, s.from.GetCopy(), s.vias[0].GetCopy(),
 		cseq.CSeq, s.call_id.GetCopy(),
 		maxforwards /*body*/, nil /*contact*/, nil,
 		/*routes*/ nil /*target*/, nil, s.user_agent,
 		/*expires*/ nil, s.config)
+	if err != nil {
+		return nil, err
+	}
+	if s.no_user_agent {
+		req.SetNoUserAgent()
+	}
+	return req, nil
 }
 
 func (s *sipRequest) GenCANCEL() (sippy_types.SipRequest, error) {
@@ -203,11 +225,26 @@ func (s *sipRequest) GenCANCEL() (sippy_types.SipRequest, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewSipRequest("CANCEL", s.ruri.GetCopy(), s.sipver,
+	req, err := NewSipRequest("CANCEL", s.ruri.GetCopy(), s.sipver,
 		s.to.GetCopy(), s.from.GetCopy(), s.vias[0].GetCopy(),
 		cseq.CSeq, s.call_id.GetCopy(), maxforwards /*body*/, nil,
 		/*contact*/ nil, routes, s.GetTarget(), s.user_agent,
 		/*expires*/ nil, s.config)
+	if err != nil {
+		return nil, err
+	}
+	if s.no_user_agent {
+		req.SetNoUserAgent()
+	}
+	return req, nil
+}
+
+// SetNoUserAgent removes the User-Agent from the request and keeps it
+// off the ACK and the CANCEL generated out of it.
+func (s *sipRequest) SetNoUserAgent() {
+	s.no_user_agent = true
+	s.user_agent = nil
+	s.RemoveHeaders("User-Agent")
 }
 
 func (s *sipRequest) GetExpires() *sippy_header.SipExpires {
@@ -1,10 +1,12 @@
 package sippy
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +38,7 @@ type sipTransactionManager struct {
 	before_response_sent func(sippy_types.SipResponse)
 	rtid2tid             map[sippy_header.RTID]*sippy_header.TID
 	rtid2tid_lock        sync.Mutex
+	req_filter           sippy_types.RequestFilter
 }
 
 type sipTMRetransmitO struct {
@@ -182,19 +185,79 @@ func (s *sipTransactionManager) handleIncoming(data []byte, address *sippy_net.H
 		s.transmitData(retrans.userv, retrans.data, retrans.address, "", retrans.call_id, 0)
 		return
 	}
+	is_response := string(data[:7]) == "SIP/2.0"
+	if s.req_filter != nil && !is_response {
+		// The request that has not passed is not cached, so that its
+		// retransmissions are filtered again
+		action, retry_after := s.req_filter.FilterRequest(address, requestMethod(data), requestInDialog(data), rtime.Monot())
+		if action != sippy_types.FILTER_PASS {
+			s.rcache_lock.Unlock()
+			if action == sippy_types.FILTER_REJECT {
+				s.rejectRequest(rtime, data, address, server, retry_after)
+			}
+			return
+		}
+	}
 	s.rcache_put_no_lock(checksum, &sipTMRetransmitO{
 		userv:   nil,
 		data:    nil,
 		address: nil,
 	})
 	s.rcache_lock.Unlock()
-	if string(data[:7]) == "SIP/2.0" {
+	if is_response {
 		s.process_response(rtime, data, checksum, address, server)
 	} else {
 		s.process_request(rtime, data, checksum, address, server)
 	}
 }
 
+// requestMethod returns the method from the request line without parsing
+// the request.
+func requestMethod(data []byte) string {
+	idx := bytes.IndexByte(data, ' ')
+	if idx < 0 {
+		return ""
+	}
+	return string(data[:idx])
+}
+
+// requestInDialog tells whether the To of the request carries the tag
+// without parsing the request.
+func requestInDialog(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		idx := bytes.IndexByte(line, ':')
+		if idx < 0 {
+			continue
+		}
+		name := string(bytes.TrimSpace(line[:idx]))
+		if !strings.EqualFold(name, "To") && !strings.EqualFold(name, "t") {
+			continue
+		}
+		value := line[idx+1:]
+		// skip the parameters of the URI in the angle brackets
+		if idx = bytes.LastIndexByte(value, '>'); idx >= 0 {
+			value = value[idx+1:]
+		}
+		value = bytes.ToLower(bytes.ReplaceAll(value, []byte(" "), nil))
+		return bytes.Contains(value, []byte(";tag="))
+	}
+	return false
+}
+
+func (s *sipTransactionManager) rejectRequest(rtime *sippy_time.MonoTime, data []byte, address *sippy_net.HostPort, server sippy_net.Transport, retry_after time.Duration) {
+	req, err := ParseSipRequest(data, rtime, s.config)
+	if err != nil || req.GetMethod() == "ACK" {
+		return
+	}
+	resp := req.GenResponse(503, "Service Unavailable", nil, nil)
+	resp.AppendHeader(sippy_header.NewSipGenericHF("Retry-After", strconv.Itoa(int(retry_after.Seconds()))))
+	s.transmitMsg(server, resp, address, "", req.GetCallId().CallId)
+}
+
 func (s *sipTransactionManager) process_response(rtime *sippy_time.MonoTime, data []byte, checksum string, address *sippy_net.HostPort, server sippy_net.Transport) {
 	var resp *sipResponse
 	var err error
@@ -392,8 +455,13 @@ func (s *sipTransactionManager) CreateClientTransaction(req sippy_types.SipReque
 }
 
 func (s *sipTransactionManager) BeginClientTransaction(req sippy_types.SipRequest, tr sippy_types.ClientTransaction) {
-	tr.StartTimers()
 	tr.BeforeRequestSent(req)
+	if t, ok := tr.(*clientTransaction); ok {
+		// The callback may have altered the request after it has been
+		// serialized in CreateClientTransaction()
+		t.data = []byte(req.LocalStr(t.userv.GetLAddress(), false /* compact */))
+	}
+	tr.StartTimers()
 	tr.TransmitData()
 }
 
@@ -720,6 +788,12 @@ func (s *sipTransactionManager) SetBeforeResponseSent(cb func(sippy_types.SipRes
 	s.before_response_sent = cb
 }
 
+// SetRequestFilter installs the filter consulted for every new incoming
+// request before it is parsed, i.e. the rate limiter.
+func (s *sipTransactionManager) SetRequestFilter(filter sippy_types.RequestFilter) {
+	s.req_filter = filter
+}
+
 func (s *sipTransactionManager) rtid_replace(ik *sippy_header.RTID, old_tid, new_tid *sippy_header.TID) {
 	if saved_tid, ok := s.rtid2tid[*ik]; ok && *saved_tid == *old_tid {
 		s.rtid2tid_lock.Lock()
@@ -6,35 +6,343 @@ import (
 	"github.com/egovorukhin/go-b2bua/sippy/conf"
 	"github.com/egovorukhin/go-b2bua/sippy/headers"
 	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
 	"github.com/egovorukhin/go-b2bua/sippy/types"
 )
 
+// statefulProxy is the RFC 3261 transaction-stateful proxy. The requests
+// carrying the Route set are loose-routed, the out-of-dialog requests are
+// forwarded to the destinations picked by the router. The destinations
+// are tried one after another until the final response that is not an
+// error is received.
 type statefulProxy struct {
-	sip_tm      sippy_types.SipTransactionManager
-	destination *sippy_net.HostPort
-	config      sippy_conf.Config
+	sip_tm       sippy_types.SipTransactionManager
+	destination  *sippy_net.HostPort
+	config       sippy_conf.Config
+	router       func(sippy_types.SipRequest) []*sippy_net.HostPort
+	record_route bool
 }
 
 func NewStatefulProxy(sip_tm sippy_types.SipTransactionManager, destination *sippy_net.HostPort, config sippy_conf.Config) *statefulProxy {
 	return &statefulProxy{
-		sip_tm:      sip_tm,
-		destination: destination,
-		config:      config,
+		sip_tm:       sip_tm,
+		destination:  destination,
+		config:       config,
+		record_route: true,
 	}
 }
 
+// SetRouter sets the function that returns the list of the destinations
+// for the out-of-dialog request. The request is forwarded to the fixed
+// destination or to the host of the Request-URI by default. The empty
+// list makes the request to be rejected with 404.
+func (s *statefulProxy) SetRouter(router func(sippy_types.SipRequest) []*sippy_net.HostPort) {
+	s.router = router
+}
+
+// SetRecordRoute enables or disables the Record-Route insertion into the
+// dialog creating requests. It is enabled by default.
+func (s *statefulProxy) SetRecordRoute(record_route bool) {
+	s.record_route = record_route
+}
+
+// HasOurRoute tells whether the topmost Route of the request points to
+// the proxy, i.e. the request belongs to the dialog we have record-routed.
+func (s *statefulProxy) HasOurRoute(req sippy_types.SipRequest) bool {
+	routes := req.GetRoutes()
+	if len(routes) == 0 {
+		return false
+	}
+	r0, err := routes[0].GetBody(s.config)
+	if err != nil {
+		return false
+	}
+	return s.isOurURI(r0.GetUrl())
+}
+
+func (s *statefulProxy) isOurURI(url *sippy_header.SipURL) bool {
+	port := s.config.DefaultPort().String()
+	if url.Port != nil {
+		port = url.Port.String()
+	}
+	host := url.Host.String()
+	return (host == s.config.SipAddress().String() || host == s.config.GetMyAddress().String()) &&
+		(port == s.config.SipPort().String() || port == s.config.GetMyPort().String())
+}
+
 func (s *statefulProxy) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.UaContext {
-	via0 := sippy_header.NewSipVia(s.config)
-	via0_body, _ := via0.GetBody()
-	via0_body.GenBranch()
-	req.InsertFirstVia(via0)
-	req.SetTarget(s.destination)
-	//print req
-	s.sip_tm.BeginNewClientTransaction(req, s, new(sync.Mutex), nil, nil, nil)
-	return &sippy_types.UaContext{}
+	if mf := req.GetMaxForwards(); mf == nil {
+		req.SetMaxForwards(sippy_header.NewSipMaxForwardsDefault())
+	} else if mf_body, err := mf.GetBody(); err != nil {
+		return &sippy_types.UaContext{Response: req.GenResponse(400, "Bad Max-Forwards", nil, nil)}
+	} else if mf_body.Number <= 0 {
+		return &sippy_types.UaContext{Response: req.GenResponse(483, "Too Many Hops", nil, nil)}
+	} else {
+		mf_body.Number--
+	}
+	targets, err := s.getTargets(req)
+	if err != nil {
+		s.config.ErrorLogger().Error("statefulProxy: cannot route the request: " + err.Error())
+		return &sippy_types.UaContext{Response: req.GenResponse(400, "Bad Route", nil, nil)}
+	}
+	if len(targets) == 0 {
+		return &sippy_types.UaContext{Response: req.GenResponse(404, "Not Found", nil, nil)}
+	}
+	upstream_rrs := len(req.GetRecordRoutes())
+	if s.record_route && s.isDialogCreating(req) {
+		rr_url := sippy_header.NewSipURL("", s.config.GetMyAddress(), s.config.GetMyPort(), true /* lr */)
+		req.InsertFirstRecordRoute(sippy_header.NewSipRecordRoute(sippy_header.NewSipAddress("", rr_url)))
+	}
+	pt := &proxyTransaction{
+		proxy:        s,
+		req:          req,
+		t:            t,
+		targets:      targets,
+		upstream_rrs: upstream_rrs,
+	}
+	t.UpgradeToSessionLock(&pt.lock)
+	if req.GetMethod() == "INVITE" {
+		// RFC 3261 16.10: the final response to the cancelled request
+		// comes from downstream, it may even be 2xx
+		t.SetCancelResponse(nil)
+		t.SendResponse(req.GenResponse(100, "Trying", nil, nil), false, nil)
+	}
+	pt.nextBranch()
+	return &sippy_types.UaContext{
+		CancelCB: pt.cancel,
+		NoAckCB:  pt.noAck,
+	}
+}
+
+// getTargets processes the Route set of the request as described in the
+// RFC 3261 section 16.4 and returns the next hops for the request.
+func (s *statefulProxy) getTargets(req sippy_types.SipRequest) ([]*sippy_net.HostPort, error) {
+	routes := req.GetRoutes()
+	if len(routes) > 0 && s.isOurURI(req.GetRURI()) {
+		// The previous hop is a strict router that has put our
+		// Record-Route into the Request-URI.
+		last, err := routes[len(routes)-1].GetBody(s.config)
+		if err != nil {
+			return nil, err
+		}
+		req.SetRURI(last.GetUrl().GetCopy())
+		routes = routes[:len(routes)-1]
+	}
+	if len(routes) > 0 {
+		r0, err := routes[0].GetBody(s.config)
+		if err != nil {
+			return nil, err
+		}
+		if s.isOurURI(r0.GetUrl()) {
+			routes = routes[1:]
+		}
+	}
+	req.SetRoutes(routes)
+	if len(routes) > 0 {
+		r0, err := routes[0].GetBody(s.config)
+		if err != nil {
+			return nil, err
+		}
+		if !r0.GetUrl().Lr {
+			// The next hop is a strict router
+			routes = append(routes[1:], sippy_header.NewSipRoute(sippy_header.NewSipAddress("", req.GetRURI())))
+			req.SetRURI(r0.GetUrl().GetCopy())
+			req.SetRoutes(routes)
+		}
+		return []*sippy_net.HostPort{r0.GetUrl().GetAddr(s.config)}, nil
+	}
+	to_body, err := req.GetTo().GetBody(s.config)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case to_body.GetTag() != "":
+		// In-dialog request without the Route set
+	case s.router != nil:
+		return s.router(req), nil
+	case s.destination != nil:
+		return []*sippy_net.HostPort{s.destination}, nil
+	}
+	return []*sippy_net.HostPort{req.GetRURI().GetAddr(s.config)}, nil
+}
+
+func (s *statefulProxy) isDialogCreating(req sippy_types.SipRequest) bool {
+	switch req.GetMethod() {
+	case "INVITE", "SUBSCRIBE", "REFER":
+	default:
+		return false
+	}
+	to_body, err := req.GetTo().GetBody(s.config)
+	return err == nil && to_body.GetTag() == ""
 }
 
-func (s *statefulProxy) RecvResponse(resp sippy_types.SipResponse, t sippy_types.ClientTransaction) {
+// proxyTransaction binds the server transaction to the client transaction
+// of the branch currently tried.
+type proxyTransaction struct {
+	proxy        *statefulProxy
+	lock         sync.Mutex
+	req          sippy_types.SipRequest
+	t            sippy_types.ServerTransaction
+	targets      []*sippy_net.HostPort
+	upstream_rrs int
+	branch       sippy_types.ClientTransaction
+	best         sippy_types.SipResponse
+	ack_tr       sippy_types.ClientTransaction
+	cancelled    bool
+	done         bool
+}
+
+func (s *proxyTransaction) nextBranch() {
+	for len(s.targets) > 0 && !s.cancelled {
+		target := s.targets[0]
+		s.targets = s.targets[1:]
+		breq := s.req.GetCopy()
+		via0 := sippy_header.NewSipVia(s.proxy.config)
+		via0_body, _ := via0.GetBody()
+		via0_body.GenBranch()
+		breq.InsertFirstVia(via0)
+		breq.SetTarget(target)
+		tr, err := s.proxy.sip_tm.CreateClientTransaction(breq, s, &s.lock, nil, nil, nil, nil)
+		if err != nil {
+			s.proxy.config.ErrorLogger().Error("statefulProxy: cannot forward the request to " + target.String() + ": " + err.Error())
+			continue
+		}
+		if breq.GetMethod() == "INVITE" {
+			// The ACK to 2xx is sent when the one from the UAC is received
+			tr.SetUAck(true)
+		}
+		s.branch = tr
+		s.proxy.sip_tm.BeginClientTransaction(breq, tr)
+		return
+	}
+	s.done = true
+	resp := s.best
+	if resp == nil && s.cancelled {
+		resp = s.req.GenResponse(487, "Request Terminated", nil, nil)
+	} else if resp == nil {
+		resp = s.req.GenResponse(500, "Server Internal Error", nil, nil)
+	} else if resp.GetSCodeNum() == 503 {
+		// RFC 3261 16.7: the proxy should not forward 503
+		resp.SetSCode(500, "Server Internal Error")
+	}
+	s.t.SendResponse(resp, false, nil)
+}
+
+func (s *proxyTransaction) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
+	code := resp.GetSCodeNum()
+	if s.done || tr != s.branch || code == 100 {
+		return
+	}
 	resp.RemoveFirstVia()
-	s.sip_tm.SendResponse(resp /*lock*/, true, nil)
+	if code < 200 {
+		if !s.cancelled {
+			s.t.SendResponse(resp, false, nil)
+		}
+		return
+	}
+	s.branch = nil
+	if code < 300 {
+		s.done = true
+		if s.req.GetMethod() != "INVITE" {
+			s.t.SendResponse(resp, false, nil)
+			return
+		}
+		if err := s.setAckRoute(resp, tr); err != nil {
+			s.proxy.config.ErrorLogger().Error("statefulProxy: cannot route ACK: " + err.Error())
+		}
+		// RFC 3261 16.7: the 2xx is forwarded even if the request has
+		// been cancelled, the UAC sends BYE then
+		s.ack_tr = tr
+		s.t.SendResponse(resp, false, s.sendAck)
+		return
+	}
+	// The client transaction ACKs the non-2xx by itself
+	tr.SetUAck(false)
+	if s.best == nil || code/100 < s.best.GetSCodeNum()/100 || code >= 600 {
+		s.best = resp
+	}
+	if code >= 600 {
+		s.targets = nil
+	}
+	s.nextBranch()
+}
+
+// setAckRoute makes the ACK to 2xx to follow the route set of the dialog
+// downstream of the proxy.
+func (s *proxyTransaction) setAckRoute(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) error {
+	config := s.proxy.config
+	var rTarget *sippy_header.SipURL
+	if len(resp.GetContacts()) > 0 {
+		contact, err := resp.GetContacts()[0].GetBody(config)
+		if err != nil {
+			return err
+		}
+		rTarget = contact.GetUrl().GetCopy()
+	} else {
+		rTarget = s.req.GetRURI().GetCopy()
+	}
+	// The Record-Routes above ours have been added by the downstream proxies
+	rrs := resp.GetRecordRoutes()
+	ndown := len(rrs) - s.upstream_rrs
+	if s.proxy.record_route && s.proxy.isDialogCreating(s.req) {
+		ndown--
+	}
+	routes := []*sippy_header.SipRoute{}
+	for i := ndown - 1; i >= 0; i-- {
+		routes = append(routes, rrs[i].AsSipRoute())
+	}
+	rAddr := rTarget.GetAddr(config)
+	if len(routes) > 0 {
+		r0, err := routes[0].GetBody(config)
+		if err != nil {
+			return err
+		}
+		if !r0.GetUrl().Lr {
+			routes = append(routes[1:], sippy_header.NewSipRoute(sippy_header.NewSipAddress("", rTarget)))
+			rTarget = r0.GetUrl()
+		}
+		rAddr = r0.GetUrl().GetAddr(config)
+	}
+	ack := tr.GetACK()
+	ack.SetRURI(rTarget)
+	ack.SetRoutes(routes)
+	tr.SetAckRparams(rAddr, rTarget, routes)
+	return nil
+}
+
+func (s *proxyTransaction) sendAck(req sippy_types.SipRequest) {
+	tr := s.ack_tr
+	if tr == nil {
+		return
+	}
+	s.ack_tr = nil
+	if req != nil && req.GetBody() != nil {
+		tr.GetACK().SetBody(req.GetBody().GetCopy())
+	}
+	tr.SendACK()
+}
+
+func (s *proxyTransaction) cancel(rtime *sippy_time.MonoTime, req sippy_types.SipRequest) {
+	if s.req.GetMethod() != "INVITE" {
+		// RFC 3261 9.2: CANCEL has no effect on the other requests
+		return
+	}
+	s.cancelled = true
+	s.targets = nil
+	if s.branch == nil {
+		if !s.done {
+			s.nextBranch()
+		}
+		return
+	}
+	if req != nil && req.GetReason() != nil {
+		s.branch.Cancel(req.GetReason().GetCopy())
+	} else {
+		s.branch.Cancel()
+	}
+}
+
+func (s *proxyTransaction) noAck(rtime *sippy_time.MonoTime) {
+	// Release the UAS anyway
+	s.sendAck(nil)
 }
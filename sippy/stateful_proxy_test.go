@@ -0,0 +1,319 @@
+package sippy
+
+import (
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+type test_proxy_call_map struct {
+	proxy *statefulProxy
+}
+
+func (s *test_proxy_call_map) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerTransaction) (sippy_types.UA, sippy_types.RequestReceiver, sippy_types.SipResponse) {
+	return nil, s.proxy, nil
+}
+
+func newTestProxy(t *testing.T) (*statefulProxy, *TestSipTransportFactory, sippy_conf.Config, func()) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+	config.SetSipAddress(config.GetMyAddress())
+	config.SetSipPort(config.GetMyPort())
+	tfactory := NewTestSipTransportFactory()
+	config.SetSipTransportFactory(tfactory)
+	cmap := &test_proxy_call_map{}
+	sip_tm, err := NewSipTransactionManager(config, cmap)
+	if err != nil {
+		t.Fatal("Cannot create SIP transaction manager: " + err.Error())
+	}
+	go sip_tm.Run()
+	cmap.proxy = NewStatefulProxy(sip_tm, nil, config)
+	return cmap.proxy, tfactory, config, sip_tm.Shutdown
+}
+
+func getTestRequest(t *testing.T, tfactory *TestSipTransportFactory, config sippy_conf.Config, method string) *sipRequest {
+	rtime, _ := sippy_time.NewMonoTime()
+	req, err := ParseSipRequest(tfactory.get(), rtime, config)
+	if err != nil {
+		t.Fatal("Cannot parse request: " + err.Error())
+	}
+	if req.GetMethod() != method {
+		t.Fatalf("Got %s while expecting %s", req.GetMethod(), method)
+	}
+	return req
+}
+
+func getTestResponse(t *testing.T, tfactory *TestSipTransportFactory, config sippy_conf.Config, scode int) *sipResponse {
+	rtime, _ := sippy_time.NewMonoTime()
+	resp, err := ParseSipResponse(tfactory.get(), rtime, config)
+	if err != nil {
+		t.Fatal("Cannot parse response: " + err.Error())
+	}
+	if resp.GetSCodeNum() != scode {
+		t.Fatalf("Got %s while expecting %d", resp.GetSL(), scode)
+	}
+	return resp
+}
+
+func getTestBranch(t *testing.T, msg sippy_types.SipMsg) string {
+	via0, err := msg.GetVias()[0].GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return via0.GetBranch()
+}
+
+func Test_StatefulProxyForking(t *testing.T) {
+	proxy, tfactory, config, shutdown := newTestProxy(t)
+	defer shutdown()
+	proxy.SetRouter(func(sippy_types.SipRequest) []*sippy_net.HostPort {
+		return []*sippy_net.HostPort{sippy_net.NewHostPort("2.2.2.2", "5060"), sippy_net.NewHostPort("3.3.3.3", "5060")}
+	})
+	tfactory.feed([]string{
+		"INVITE sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK776asdhds",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=1928301774",
+		"To: <sip:bob@example.com>",
+		"Contact: <sip:alice@1.1.1.1:5060>",
+		"Call-ID: a84b4c76e66710@1.1.1.1",
+		"CSeq: 314159 INVITE",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	getTestResponse(t, tfactory, config, 100)
+	inv1 := getTestRequest(t, tfactory, config, "INVITE")
+	if len(inv1.GetVias()) != 2 {
+		t.Fatalf("Bad number of Vias: %d", len(inv1.GetVias()))
+	}
+	if mf, _ := inv1.GetMaxForwards().GetBody(); mf.Number != 69 {
+		t.Errorf("Bad Max-Forwards: %d", mf.Number)
+	}
+	if len(inv1.GetRecordRoutes()) != 1 {
+		t.Fatal("No Record-Route inserted")
+	}
+	if rr, _ := inv1.GetRecordRoutes()[0].GetBody(config); !rr.GetUrl().Lr {
+		t.Error("The Record-Route has no lr parameter")
+	}
+
+	// The first destination fails, the request is forwarded to the second one
+	tfactory.feed([]string{inv1.GenResponse(503, "Service Unavailable", nil, nil).LocalStr(nil, false)})
+	inv2 := getTestRequest(t, tfactory, config, "INVITE")
+	getTestRequest(t, tfactory, config, "ACK")
+	if getTestBranch(t, inv1) == getTestBranch(t, inv2) {
+		t.Error("The same branch is used for both destinations")
+	}
+
+	tfactory.feed([]string{inv2.GenResponse(180, "Ringing", nil, nil).LocalStr(nil, false)})
+	ringing := getTestResponse(t, tfactory, config, 180)
+	if len(ringing.GetVias()) != 1 || getTestBranch(t, ringing) != "z9hG4bK776asdhds" {
+		t.Error("The proxy Via has not been removed from the response")
+	}
+
+	// CANCEL goes to the outstanding branch
+	tfactory.feed([]string{
+		"CANCEL sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK776asdhds",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=1928301774",
+		"To: <sip:bob@example.com>",
+		"Call-ID: a84b4c76e66710@1.1.1.1",
+		"CSeq: 314159 CANCEL",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	getTestResponse(t, tfactory, config, 200)
+	cancel := getTestRequest(t, tfactory, config, "CANCEL")
+	if getTestBranch(t, cancel) != getTestBranch(t, inv2) {
+		t.Error("CANCEL does not match the outstanding branch")
+	}
+	// The 487 comes from downstream
+	tfactory.feed([]string{inv2.GenResponse(487, "Request Terminated", nil, nil).LocalStr(nil, false)})
+	getTestResponse(t, tfactory, config, 487)
+	getTestRequest(t, tfactory, config, "ACK")
+}
+
+func Test_StatefulProxy2xxAfterCancel(t *testing.T) {
+	_, tfactory, config, shutdown := newTestProxy(t)
+	defer shutdown()
+	tfactory.feed([]string{
+		"INVITE sip:bob@2.2.2.2 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK5e2c7",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=77ab1c",
+		"To: <sip:bob@example.com>",
+		"Contact: <sip:alice@1.1.1.1:5060>",
+		"Call-ID: 9a8b7c6d5e@1.1.1.1",
+		"CSeq: 1 INVITE",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	getTestResponse(t, tfactory, config, 100)
+	inv := getTestRequest(t, tfactory, config, "INVITE")
+	tfactory.feed([]string{inv.GenResponse(180, "Ringing", nil, nil).LocalStr(nil, false)})
+	getTestResponse(t, tfactory, config, 180)
+	tfactory.feed([]string{
+		"CANCEL sip:bob@2.2.2.2 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK5e2c7",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=77ab1c",
+		"To: <sip:bob@example.com>",
+		"Call-ID: 9a8b7c6d5e@1.1.1.1",
+		"CSeq: 1 CANCEL",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	getTestResponse(t, tfactory, config, 200)
+	getTestRequest(t, tfactory, config, "CANCEL")
+
+	// The callee has answered before the CANCEL reached it, the 2xx is
+	// forwarded for the caller to end the call with BYE
+	resp := inv.GenResponse(200, "OK", nil, nil)
+	to, _ := resp.GetTo().GetBody(config)
+	to.SetTag("271828")
+	resp.AppendHeader(sippy_header.CreateSipContact("<sip:bob@2.2.2.2:5060>")[0])
+	tfactory.feed([]string{resp.LocalStr(nil, false)})
+	getTestResponse(t, tfactory, config, 200)
+	tfactory.feed([]string{
+		"ACK sip:bob@2.2.2.2:5060 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK5e2c8",
+		"Route: <sip:" + config.GetMyAddress().String() + ":" + config.GetMyPort().String() + ";lr>",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=77ab1c",
+		"To: <sip:bob@example.com>;tag=271828",
+		"Call-ID: 9a8b7c6d5e@1.1.1.1",
+		"CSeq: 1 ACK",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	ack := getTestRequest(t, tfactory, config, "ACK")
+	assertStringEqual(ack.GetRURI().Host.String(), "2.2.2.2", t)
+}
+
+func Test_StatefulProxyLooseRouting(t *testing.T) {
+	proxy, tfactory, config, shutdown := newTestProxy(t)
+	defer shutdown()
+	bye := func(max_forwards string) []string {
+		return []string{
+			"BYE sip:bob@4.4.4.5:5060 SIP/2.0",
+			"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKnashds7" + max_forwards,
+			"Route: <sip:" + config.GetMyAddress().String() + ":" + config.GetMyPort().String() + ";lr>, <sip:4.4.4.4;lr>",
+			"Max-Forwards: " + max_forwards,
+			"From: <sip:alice@example.org>;tag=1928301774",
+			"To: <sip:bob@example.com>;tag=a6c85cf",
+			"Call-ID: a84b4c76e66710@1.1.1.1",
+			"CSeq: 231 BYE",
+			"Content-Length: 0",
+			"",
+			"",
+		}
+	}
+	tfactory.feed(bye("1"))
+	req := getTestRequest(t, tfactory, config, "BYE")
+	if proxy.HasOurRoute(req) {
+		t.Error("Our Route has not been removed")
+	}
+	if len(req.GetRoutes()) != 1 || len(req.GetRecordRoutes()) != 0 {
+		t.Fatalf("Bad number of routes: %d", len(req.GetRoutes()))
+	}
+	assertStringEqual(req.GetRURI().Host.String(), "4.4.4.5", t)
+
+	tfactory.feed(bye("0"))
+	getTestResponse(t, tfactory, config, 483)
+}
+
+func Test_StatefulProxyAck(t *testing.T) {
+	_, tfactory, config, shutdown := newTestProxy(t)
+	defer shutdown()
+	tfactory.feed([]string{
+		"INVITE sip:bob@2.2.2.2 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK74bf9",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=9fxced76sl",
+		"To: <sip:bob@example.com>",
+		"Contact: <sip:alice@1.1.1.1:5060>",
+		"Call-ID: 3848276298220188511@1.1.1.1",
+		"CSeq: 1 INVITE",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	getTestResponse(t, tfactory, config, 100)
+	inv := getTestRequest(t, tfactory, config, "INVITE")
+	resp := inv.GenResponse(200, "OK", nil, nil)
+	to, _ := resp.GetTo().GetBody(config)
+	to.SetTag("314159")
+	resp.AppendHeader(sippy_header.CreateSipContact("<sip:bob@2.2.2.3:5062>")[0])
+	resp.InsertFirstRecordRoute(sippy_header.CreateSipRecordRoute("<sip:5.5.5.5;lr>")[0].(*sippy_header.SipRecordRoute))
+	tfactory.feed([]string{resp.LocalStr(nil, false)})
+	ok := getTestResponse(t, tfactory, config, 200)
+	if len(ok.GetRecordRoutes()) != 2 {
+		t.Fatalf("Bad number of Record-Routes: %d", len(ok.GetRecordRoutes()))
+	}
+
+	// The ACK to 2xx follows the route set downstream of the proxy
+	tfactory.feed([]string{
+		"ACK sip:bob@2.2.2.3:5062 SIP/2.0",
+		"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK74bfa",
+		"Route: <sip:" + config.GetMyAddress().String() + ":" + config.GetMyPort().String() + ";lr>, <sip:5.5.5.5;lr>",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.org>;tag=9fxced76sl",
+		"To: <sip:bob@example.com>;tag=314159",
+		"Call-ID: 3848276298220188511@1.1.1.1",
+		"CSeq: 1 ACK",
+		"Content-Length: 0",
+		"",
+		"",
+	})
+	ack := getTestRequest(t, tfactory, config, "ACK")
+	assertStringEqual(ack.GetRURI().Host.String(), "2.2.2.3", t)
+	if len(ack.GetRoutes()) != 1 {
+		t.Fatalf("Bad number of routes in ACK: %d", len(ack.GetRoutes()))
+	}
+	route, _ := ack.GetRoutes()[0].GetBody(config)
+	assertStringEqual(route.GetUrl().Host.String(), "5.5.5.5", t)
+}
+
+func Test_StatefulProxyMergedRequest(t *testing.T) {
+	proxy, tfactory, config, shutdown := newTestProxy(t)
+	defer shutdown()
+	proxy.SetRouter(func(sippy_types.SipRequest) []*sippy_net.HostPort {
+		return []*sippy_net.HostPort{sippy_net.NewHostPort("2.2.2.2", "5060")}
+	})
+	invite := func(branch string) []string {
+		return []string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 1.1.1.1:5060;branch=" + branch,
+			"Max-Forwards: 70",
+			"From: <sip:alice@example.org>;tag=1928301774",
+			"To: <sip:bob@example.com>",
+			"Contact: <sip:alice@1.1.1.1:5060>",
+			"Call-ID: a84b4c76e66710@1.1.1.1",
+			"CSeq: 314159 INVITE",
+			"Content-Length: 0",
+			"",
+			"",
+		}
+	}
+	tfactory.feed(invite("z9hG4bK776asdhds"))
+	getTestResponse(t, tfactory, config, 100)
+	inv1 := getTestRequest(t, tfactory, config, "INVITE")
+	// The same request arrives via a different path, e.g. it has been
+	// forked upstream. Only the UAS may reject it with 482, the proxy
+	// forwards it as any other request.
+	tfactory.feed(invite("z9hG4bK2d4790"))
+	getTestResponse(t, tfactory, config, 100)
+	inv2 := getTestRequest(t, tfactory, config, "INVITE")
+	if getTestBranch(t, inv1) == getTestBranch(t, inv2) {
+		t.Error("The same branch is used for both requests")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2020-2021 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_sshaken
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+)
+
+const (
+	ATTEST_FULL    = "A"
+	ATTEST_PARTIAL = "B"
+	ATTEST_GATEWAY = "C"
+)
+
+// TNStore tells which TNs are assigned to the customers. The TNs are
+// passed in the digits only form.
+type TNStore interface {
+	HasCustomer(customer string) bool
+	OwnsTN(customer, tn string) bool
+}
+
+type sshaken_tn_entry struct {
+	first  string
+	last   string
+	prefix bool
+}
+
+func (s *sshaken_tn_entry) matches(tn string) bool {
+	switch {
+	case s.prefix:
+		return strings.HasPrefix(tn, s.first)
+	case s.last != "":
+		return len(tn) == len(s.first) && tn >= s.first && tn <= s.last
+	}
+	return tn == s.first
+}
+
+/*
+ * sshaken_tn_file_store reads the TN assignments from the file. Each line
+ * holds the customer followed by the TNs assigned to it. The TN is either
+ * the number, the range of numbers of the same length or the prefix
+ * followed by '*'. The customer may span several lines.
+ *
+ * Example:
+ *
+ *     # customer  TNs
+ *     trunk1  12125551000-12125551999  12125550100
+ *     trunk2  1415555*
+ */
+type sshaken_tn_file_store struct {
+	fname     string
+	lock      sync.Mutex
+	customers map[string][]*sshaken_tn_entry
+}
+
+func NewTNFileStore(fname string) (*sshaken_tn_file_store, error) {
+	s := &sshaken_tn_file_store{
+		fname: fname,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the file. The assignments in use are kept when the file
+// cannot be parsed.
+func (s *sshaken_tn_file_store) Reload() error {
+	fd, err := os.Open(s.fname)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	customers := make(map[string][]*sshaken_tn_entry)
+	scanner := bufio.NewScanner(fd)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		arr := strings.Fields(line)
+		if len(arr) < 2 {
+			return fmt.Errorf("%s:%d: no TNs assigned to %s", s.fname, lineno, arr[0])
+		}
+		for _, tn := range arr[1:] {
+			entry, err := parse_tn_entry(tn)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", s.fname, lineno, err.Error())
+			}
+			customers[arr[0]] = append(customers[arr[0]], entry)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.customers = customers
+	s.lock.Unlock()
+	return nil
+}
+
+func parse_tn_entry(tn string) (*sshaken_tn_entry, error) {
+	entry := &sshaken_tn_entry{}
+	if strings.HasSuffix(tn, "*") {
+		entry.first, entry.prefix = cleanup(tn[:len(tn)-1]), true
+	} else if arr := strings.SplitN(tn, "-", 2); len(arr) == 2 {
+		entry.first, entry.last = cleanup(arr[0]), cleanup(arr[1])
+		if len(entry.first) != len(entry.last) || entry.first > entry.last {
+			return nil, fmt.Errorf("bad TN range %s", tn)
+		}
+	} else {
+		entry.first = cleanup(tn)
+	}
+	if entry.first == "" {
+		return nil, fmt.Errorf("bad TN %s", tn)
+	}
+	return entry, nil
+}
+
+func (s *sshaken_tn_file_store) HasCustomer(customer string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.customers[customer]
+	return ok
+}
+
+func (s *sshaken_tn_file_store) OwnsTN(customer, tn string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entry := range s.customers[customer] {
+		if entry.matches(tn) {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateOrigid returns the random (version 4) UUID in the canonical form.
+func GenerateOrigid() string {
+	hbuf := sippy_header.GenerateSessionUUID()
+	return hbuf[:8] + "-" + hbuf[8:12] + "-" + hbuf[12:16] + "-" + hbuf[16:20] + "-" + hbuf[20:]
+}
+
+type AuthenticationService interface {
+	Attestation(customer, tn string) string
+	AuthenticateCall(event *sippy.CCEventTry, customer, origid string) (string, error)
+}
+
+// sshaken_auth_service signs the outbound calls with the attestation
+// level depending on whether the customer the call comes from owns the
+// calling number.
+type sshaken_auth_service struct {
+	store    TNStore
+	cert_buf []byte
+	pkey_buf []byte
+	x5u      string
+	config   sippy_conf.Config
+}
+
+func NewAuthenticationService(store TNStore, cert_buf, pkey_buf []byte, x5u string, config sippy_conf.Config) *sshaken_auth_service {
+	return &sshaken_auth_service{
+		store:    store,
+		cert_buf: cert_buf,
+		pkey_buf: pkey_buf,
+		x5u:      x5u,
+		config:   config,
+	}
+}
+
+// Attestation returns the full attestation when the customer owns the
+// TN, the partial one when the customer is known but the TN is not
+// assigned to it and the gateway attestation otherwise.
+func (s *sshaken_auth_service) Attestation(customer, tn string) string {
+	if customer == "" || !s.store.HasCustomer(customer) {
+		return ATTEST_GATEWAY
+	}
+	if s.store.OwnsTN(customer, cleanup(tn)) {
+		return ATTEST_FULL
+	}
+	return ATTEST_PARTIAL
+}
+
+// AuthenticateCall adds the Date and the Identity headers to the outbound
+// call. The origid received with the call should be passed to be
+// propagated, the new one is generated when it is empty. The origid used
+// is returned.
+func (s *sshaken_auth_service) AuthenticateCall(event *sippy.CCEventTry, customer, origid string) (string, error) {
+	orig_tn := event.GetCLI()
+	for _, pai := range event.GetAssertedIdentity() {
+		if addr, err := pai.GetBody(s.config); err == nil && addr.GetUrl().Username != "" {
+			orig_tn = addr.GetUrl().Username
+			break
+		}
+	}
+	if origid == "" {
+		origid = GenerateOrigid()
+	}
+	date_ts := time.Now()
+	identity, err := Authenticate(date_ts, s.Attestation(customer, orig_tn), origid, s.cert_buf, s.pkey_buf, s.x5u, orig_tn, event.GetCLD())
+	if err != nil {
+		return "", err
+	}
+	event.AppendExtraHeader(sippy_header.NewSipDate(date_ts))
+	event.AppendExtraHeader(sippy_header.NewSipGenericHF("Identity", identity))
+	return origid, nil
+}
@@ -0,0 +1,87 @@
+package sippy_sshaken
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+)
+
+func TestAuthenticationService(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "tns")
+	conf := `# customer  TNs
+trunk1  12125551000-12125551999  12125550100
+trunk2  1415555*
+trunk1  +16465550000
+`
+	if err := os.WriteFile(fname, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewTNFileStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	root := newTestCert(t, "Root", nil, true)
+	leaf := newTestCert(t, "Leaf", root, false)
+	auth := NewAuthenticationService(store, leaf.pem(), leaf.pkey_pem(t), "https://certs.example.org/cert.pem", config)
+	for _, tc := range []struct {
+		customer string
+		tn       string
+		attest   string
+	}{
+		{"trunk1", "12125551234", ATTEST_FULL},
+		{"trunk1", "+1-212-555-0100", ATTEST_FULL},
+		{"trunk1", "16465550000", ATTEST_FULL},
+		{"trunk1", "121255512345", ATTEST_PARTIAL},
+		{"trunk1", "14155550000", ATTEST_PARTIAL},
+		{"trunk2", "14155550000", ATTEST_FULL},
+		{"trunk3", "14155550000", ATTEST_GATEWAY},
+		{"", "12125551234", ATTEST_GATEWAY},
+	} {
+		if attest := auth.Attestation(tc.customer, tc.tn); attest != tc.attest {
+			t.Errorf("%s/%s: got %s attestation instead of %s", tc.customer, tc.tn, attest, tc.attest)
+		}
+	}
+
+	event, _ := sippy.NewCCEventTry(nil, "12125551234", "14155550000", nil, nil, "", nil, "")
+	origid, err := auth.AuthenticateCall(event, "trunk1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(origid) {
+		t.Errorf("Bad origid: %s", origid)
+	}
+	var identity string
+	for _, eh := range event.GetExtraHeaders() {
+		if eh.Name() == "Identity" {
+			identity = eh.StringBody()
+		}
+	}
+	passport, err := ParseIdentity(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passport.Attest() != ATTEST_FULL || passport.Origid() != origid || passport.OrigTN() != "12125551234" {
+		t.Errorf("Bad PASSporT claims: %v", passport.Payload)
+	}
+	if origid, _ = auth.AuthenticateCall(event, "trunk1", "cafdc332-e152-11ea-b360-080027e00f8a"); origid != "cafdc332-e152-11ea-b360-080027e00f8a" {
+		t.Errorf("The origid has not been propagated: %s", origid)
+	}
+
+	for _, bad := range []string{"trunk1", "trunk1 5-12", "trunk1 *"} {
+		if err = os.WriteFile(fname, []byte(bad+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Reload(); err == nil {
+			t.Errorf("Bad TN assignment accepted: %s", bad)
+		}
+	}
+	if !store.HasCustomer("trunk2") {
+		t.Error("The assignments have been lost after the failed reload")
+	}
+}
@@ -34,29 +34,114 @@ import (
 	"errors"
 	"time"
 
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
 	"github.com/egovorukhin/go-b2bua/sippy/utils"
 )
 
 func Authenticate(date_ts time.Time, attest, origid string, cert_buf, pkey_buf []byte, cr_url, orig_tn, dest_tn string) (string, error) {
+	pkey, err := load_signing_key(date_ts, cert_buf, pkey_buf)
+	if err != nil {
+		return "", err
+	}
+	return gen_identity(pkey, date_ts, attest, cr_url, orig_tn, dest_tn, origid)
+}
+
+// AuthenticateDiv creates the "div" PASSporT (RFC 8946) for the call
+// diverted from div_tn to dest_tn. It is to be added to the Identity
+// headers received with the call.
+func AuthenticateDiv(date_ts time.Time, cert_buf, pkey_buf []byte, cr_url, orig_tn, dest_tn, div_tn string) (string, error) {
+	pkey, err := load_signing_key(date_ts, cert_buf, pkey_buf)
+	if err != nil {
+		return "", err
+	}
+	payload := sshaken_payload{
+		Dest: sshaken_dest{
+			TN: []string{cleanup(dest_tn)},
+		},
+		Div: &sshaken_div{
+			TN: cleanup(div_tn),
+		},
+		Iat: date_ts.Unix(),
+		Orig: sshaken_orig{
+			TN: cleanup(orig_tn),
+		},
+	}
+	return sign_passport(pkey, PPT_DIV, cr_url, payload)
+}
+
+// AuthenticateRcd creates the "rcd" PASSporT carrying the caller name and
+// optionally the URL of the logo and the call reason.
+func AuthenticateRcd(date_ts time.Time, cert_buf, pkey_buf []byte, cr_url, orig_tn, dest_tn, nam, icn, crn string) (string, error) {
+	pkey, err := load_signing_key(date_ts, cert_buf, pkey_buf)
+	if err != nil {
+		return "", err
+	}
+	payload := sshaken_payload{
+		Crn: crn,
+		Dest: sshaken_dest{
+			TN: []string{cleanup(dest_tn)},
+		},
+		Iat: date_ts.Unix(),
+		Orig: sshaken_orig{
+			TN: cleanup(orig_tn),
+		},
+		Rcd: &sshaken_rcd{
+			Icn: icn,
+			Nam: nam,
+		},
+	}
+	return sign_passport(pkey, PPT_RCD, cr_url, payload)
+}
+
+// DiversionTN returns the TN the call has been diverted from, i.e. the
+// user of the most recent Diversion or of the History-Info entry the
+// current target has been retargeted from. Empty string is returned when
+// the call has not been diverted.
+func DiversionTN(event *sippy.CCEventTry, config sippy_conf.Config) string {
+	for _, diversion := range event.GetDiversion() {
+		if addr, err := diversion.GetBody(config); err == nil {
+			return addr.GetUrl().Username
+		}
+	}
+	hist_infos := event.GetHistoryInfo()
+	if len(hist_infos) == 0 {
+		return ""
+	}
+	from_index, _, err := hist_infos[len(hist_infos)-1].GetTargetedFrom(config)
+	if err != nil || from_index == "" {
+		return ""
+	}
+	for _, hi := range hist_infos {
+		if index, err := hi.GetIndex(config); err == nil && index == from_index {
+			if addr, err := hi.GetBody(config); err == nil {
+				return addr.GetUrl().Username
+			}
+		}
+	}
+	return ""
+}
+
+func load_signing_key(date_ts time.Time, cert_buf, pkey_buf []byte) (*ecdsa.PrivateKey, error) {
 	now := time.Now()
 	if now.Sub(date_ts) > AUTH_DATE_FRESHNESS {
-		return "", errors.New("Date header value is older than local policy")
+		return nil, errors.New("Date header value is older than local policy")
 	}
 	cert, err := load_certificate(cert_buf)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	pkey, err := load_privatekey(pkey_buf)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if err = check_cert_validity(cert, now); err != nil {
-		return "", err
+		return nil, err
 	}
 	if err = check_cert_validity(cert, date_ts); err != nil {
-		return "", err
+		return nil, err
 	}
-	return gen_identity(pkey, date_ts, attest, cr_url, orig_tn, dest_tn, origid)
+	return pkey, nil
 }
 
 func load_certificate(cert_buf []byte) (*x509.Certificate, error) {
@@ -103,7 +188,7 @@ func load_privatekey(pkey_buf []byte) (*ecdsa.PrivateKey, error) {
 
 func check_cert_validity(cert *x509.Certificate, date_ts time.Time) error {
 	if date_ts.Before(cert.NotBefore) || date_ts.After(cert.NotAfter) {
-		return errors.New("Date is outside the certificate validity")
+		return &ECertValidity{NotBefore: cert.NotBefore, NotAfter: cert.NotAfter, Date: date_ts}
 	}
 	return nil
 }
@@ -112,6 +197,20 @@ func gen_identity(pkey *ecdsa.PrivateKey, date_ts time.Time, attest, cr_url, ori
 	orig_tn = cleanup(orig_tn)
 	dest_tn = cleanup(dest_tn)
 	unsigned_buf := build_unsigned_pport(date_ts, attest, cr_url, orig_tn, dest_tn, origid)
+	return sign_unsigned_pport(pkey, unsigned_buf, cr_url, PPT_SHAKEN)
+}
+
+func sign_passport(pkey *ecdsa.PrivateKey, ppt, cr_url string, payload sshaken_payload) (string, error) {
+	hdr := sshaken_header{
+		Alg: "ES256",
+		Ppt: ppt,
+		Typ: "passport",
+		X5u: cr_url,
+	}
+	return sign_unsigned_pport(pkey, encode_unsigned_pport(hdr, payload), cr_url, ppt)
+}
+
+func sign_unsigned_pport(pkey *ecdsa.PrivateKey, unsigned_buf, cr_url, ppt string) (string, error) {
 	hash := sha256.Sum256([]byte(unsigned_buf))
 	r, s, err := ecdsa.Sign(rand.Reader, pkey, hash[:])
 	if err != nil {
@@ -122,6 +221,6 @@ func gen_identity(pkey *ecdsa.PrivateKey, date_ts time.Time, attest, cr_url, ori
 	s_padded := make([]byte, 32)
 	copy(s_padded[32-len(s.Bytes()):], s.Bytes())
 	buf := sippy_utils.B64EncodeNoPad(append(r_padded, s_padded...))
-	identity := unsigned_buf + "." + buf + ";info=<" + cr_url + ">;ppt=shaken"
+	identity := unsigned_buf + "." + buf + ";info=<" + cr_url + ">;ppt=" + ppt
 	return identity, nil
 }
@@ -0,0 +1,357 @@
+// Copyright (c) 2020-2021 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_sshaken
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CERT_FETCH_TIMEOUT = 5 * time.Second
+	CERT_MAX_SIZE      = 64 * 1024
+	CERT_DEFAULT_TTL   = time.Hour
+	CERT_MAX_TTL       = 24 * time.Hour
+)
+
+type CertFetcher interface {
+	GetCert(x5u string) ([]byte, error)
+	FetchCert(x5u string, done func([]byte, error))
+}
+
+type sshaken_cert_entry struct {
+	cert_buf []byte
+	expires  time.Time
+}
+
+type sshaken_cert_fetch struct {
+	done     chan struct{}
+	cert_buf []byte
+	err      error
+}
+
+// sshaken_cert_fetcher retrieves the certificates referenced by the x5u
+// claim from the certificate repositories. The certificates are cached in
+// memory and optionally on disk for the time allowed by the repository.
+// Concurrent requests for the same x5u share one HTTP request.
+type sshaken_cert_fetcher struct {
+	client        *http.Client
+	lock          sync.Mutex
+	cache         map[string]*sshaken_cert_entry
+	pending       map[string]*sshaken_cert_fetch
+	allowed_hosts map[string]bool
+	cache_dir     string
+	default_ttl   time.Duration
+	max_ttl       time.Duration
+}
+
+// NewCertFetcher creates the fetcher that accepts x5u pointing to any of
+// the allowed hosts or to any host if the list is empty. The disk cache is
+// not used when cache_dir is empty.
+func NewCertFetcher(allowed_hosts []string, cache_dir string) *sshaken_cert_fetcher {
+	s := &sshaken_cert_fetcher{
+		client: &http.Client{
+			Timeout: CERT_FETCH_TIMEOUT,
+		},
+		cache:         make(map[string]*sshaken_cert_entry),
+		pending:       make(map[string]*sshaken_cert_fetch),
+		allowed_hosts: make(map[string]bool),
+		cache_dir:     cache_dir,
+		default_ttl:   CERT_DEFAULT_TTL,
+		max_ttl:       CERT_MAX_TTL,
+	}
+	for _, host := range allowed_hosts {
+		s.allowed_hosts[strings.ToLower(host)] = true
+	}
+	return s
+}
+
+func (s *sshaken_cert_fetcher) SetHTTPClient(client *http.Client) {
+	s.client = client
+}
+
+// SetTTL sets how long the certificate is cached when the repository
+// does not tell it and the upper limit of the caching time.
+func (s *sshaken_cert_fetcher) SetTTL(default_ttl, max_ttl time.Duration) {
+	s.default_ttl = default_ttl
+	s.max_ttl = max_ttl
+}
+
+// FetchCert retrieves the certificate in the background and calls done
+// with the PEM encoded chain. The caller's locks are not held while the
+// certificate is being retrieved.
+func (s *sshaken_cert_fetcher) FetchCert(x5u string, done func([]byte, error)) {
+	go func() {
+		done(s.GetCert(x5u))
+	}()
+}
+
+// GetCert returns the PEM encoded certificate chain referenced by the x5u.
+func (s *sshaken_cert_fetcher) GetCert(x5u string) ([]byte, error) {
+	if err := s.check_url(x5u); err != nil {
+		return nil, &ECertRetrieval{X5u: x5u, Err: err}
+	}
+	now := time.Now()
+	s.lock.Lock()
+	if entry, ok := s.cache[x5u]; ok {
+		if entry.expires.After(now) {
+			s.lock.Unlock()
+			return entry.cert_buf, nil
+		}
+		delete(s.cache, x5u)
+	}
+	if fetch, ok := s.pending[x5u]; ok {
+		s.lock.Unlock()
+		<-fetch.done
+		return fetch.cert_buf, fetch.err
+	}
+	fetch := &sshaken_cert_fetch{
+		done: make(chan struct{}),
+	}
+	s.pending[x5u] = fetch
+	s.lock.Unlock()
+
+	var expires time.Time
+	fetch.cert_buf, expires = s.load_cached(x5u, now)
+	if fetch.cert_buf == nil {
+		fetch.cert_buf, expires, fetch.err = s.download(x5u, now)
+		if fetch.err != nil {
+			fetch.err = &ECertRetrieval{X5u: x5u, Err: fetch.err}
+		} else if expires.After(now) {
+			s.save_cached(x5u, fetch.cert_buf, expires)
+		}
+	}
+
+	s.lock.Lock()
+	delete(s.pending, x5u)
+	if fetch.err == nil && expires.After(now) {
+		s.cache[x5u] = &sshaken_cert_entry{
+			cert_buf: fetch.cert_buf,
+			expires:  expires,
+		}
+	}
+	s.lock.Unlock()
+	close(fetch.done)
+	return fetch.cert_buf, fetch.err
+}
+
+func (s *sshaken_cert_fetcher) check_url(x5u string) error {
+	u, err := url.Parse(x5u)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return errors.New("x5u should use the https scheme: " + x5u)
+	}
+	if len(s.allowed_hosts) > 0 && !s.allowed_hosts[strings.ToLower(u.Hostname())] {
+		return errors.New("x5u host is not allowed: " + u.Hostname())
+	}
+	return nil
+}
+
+func (s *sshaken_cert_fetcher) download(x5u string, now time.Time) ([]byte, time.Time, error) {
+	resp, err := s.client.Get(x5u)
+	if err != nil {
+		return nil, now, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, now, fmt.Errorf("cannot retrieve %s: %s", x5u, resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, CERT_MAX_SIZE+1))
+	if err != nil {
+		return nil, now, err
+	}
+	if len(buf) > CERT_MAX_SIZE {
+		return nil, now, errors.New("the certificate retrieved is too large")
+	}
+	chain, err := ParseCertChain(buf)
+	if err != nil {
+		return nil, now, err
+	}
+	expires := now.Add(s.cache_ttl(resp.Header, now))
+	if chain[0].NotAfter.Before(expires) {
+		expires = chain[0].NotAfter
+	}
+	return encode_cert_chain(chain), expires, nil
+}
+
+// cache_ttl returns the caching time allowed by the Cache-Control or the
+// Expires header of the response.
+func (s *sshaken_cert_fetcher) cache_ttl(hdr http.Header, now time.Time) time.Duration {
+	ttl := s.default_ttl
+	max_age_found := false
+	for _, directive := range strings.Split(hdr.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			if secs, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+				ttl = time.Duration(secs) * time.Second
+				max_age_found = true
+			}
+		}
+	}
+	if !max_age_found && hdr.Get("Expires") != "" {
+		expires, err := http.ParseTime(hdr.Get("Expires"))
+		if err != nil {
+			// RFC 7234: invalid date means "already expired"
+			return 0
+		}
+		date := now
+		if hdr.Get("Date") != "" {
+			if d, err := http.ParseTime(hdr.Get("Date")); err == nil {
+				date = d
+			}
+		}
+		ttl = expires.Sub(date)
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	if ttl > s.max_ttl {
+		ttl = s.max_ttl
+	}
+	return ttl
+}
+
+func (s *sshaken_cert_fetcher) cache_file(x5u string) string {
+	hash := sha256.Sum256([]byte(x5u))
+	return filepath.Join(s.cache_dir, hex.EncodeToString(hash[:])+".pem")
+}
+
+// The disk cache file starts with the x5u and the expiration time
+// followed by the PEM encoded chain:
+//
+//	x5u: https://cr.example.com/cert.pem
+//	expires: 1600000000
+//	-----BEGIN CERTIFICATE-----
+//	...
+func (s *sshaken_cert_fetcher) load_cached(x5u string, now time.Time) ([]byte, time.Time) {
+	if s.cache_dir == "" {
+		return nil, now
+	}
+	buf, err := os.ReadFile(s.cache_file(x5u))
+	if err != nil {
+		return nil, now
+	}
+	var expires time.Time
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for i := 0; i < 2 && scanner.Scan(); i++ {
+		arr := strings.SplitN(scanner.Text(), ": ", 2)
+		if len(arr) != 2 {
+			return nil, now
+		}
+		switch arr[0] {
+		case "x5u":
+			if arr[1] != x5u {
+				return nil, now
+			}
+		case "expires":
+			ts, err := strconv.ParseInt(arr[1], 10, 64)
+			if err != nil {
+				return nil, now
+			}
+			expires = time.Unix(ts, 0)
+		}
+	}
+	if !expires.After(now) {
+		return nil, now
+	}
+	chain, err := ParseCertChain(buf)
+	if err != nil {
+		return nil, now
+	}
+	return encode_cert_chain(chain), expires
+}
+
+func (s *sshaken_cert_fetcher) save_cached(x5u string, cert_buf []byte, expires time.Time) {
+	if s.cache_dir == "" {
+		return
+	}
+	buf := fmt.Sprintf("x5u: %s\nexpires: %d\n", x5u, expires.Unix())
+	fname := s.cache_file(x5u)
+	// Write to the temporary file first so that the concurrent reader
+	// never sees the partial file.
+	if err := os.WriteFile(fname+".tmp", append([]byte(buf), cert_buf...), 0644); err == nil {
+		os.Rename(fname+".tmp", fname)
+	}
+}
+
+// ParseCertChain decodes the leaf certificate followed by the
+// intermediates. Both PEM and DER encodings are accepted.
+func ParseCertChain(buf []byte) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{}
+	rest := buf
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		var err error
+		if chain, err = x509.ParseCertificates(buf); err != nil {
+			return nil, errors.New("error decoding a certificate")
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("empty certificate")
+	}
+	return chain, nil
+}
+
+func encode_cert_chain(chain []*x509.Certificate) []byte {
+	buf := []byte{}
+	for _, cert := range chain {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return buf
+}
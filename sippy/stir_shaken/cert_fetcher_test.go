@@ -0,0 +1,194 @@
+package sippy_sshaken
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type test_ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestTnAuthList encodes the TnAuthList with the SPC and the TNs.
+func newTestTnAuthList(t *testing.T, spc string, tns ...string) []byte {
+	entries := []asn1.RawValue{}
+	add := func(tag int, val interface{}, params string) {
+		buf, err := asn1.MarshalWithParams(val, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: buf})
+	}
+	if spc != "" {
+		add(0, spc, "ia5")
+	}
+	for _, tn := range tns {
+		add(2, tn, "ia5")
+	}
+	buf, err := asn1.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func newTestCert(t *testing.T, cn string, parent *test_ca, is_ca bool, tweaks ...func(*x509.Certificate)) *test_ca {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  is_ca,
+	}
+	if is_ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, pkix.Extension{Id: TNAUTHLIST_EXT, Value: newTestTnAuthList(t, "1234")})
+	}
+	for _, tweak := range tweaks {
+		tweak(tmpl)
+	}
+	parent_cert, parent_key := tmpl, key
+	if parent != nil {
+		parent_cert, parent_key = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent_cert, &key.PublicKey, parent_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &test_ca{cert: cert, key: key}
+}
+
+func (s *test_ca) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw})
+}
+
+func TestCertFetcher(t *testing.T) {
+	root := newTestCert(t, "Root", nil, true)
+	intermediate := newTestCert(t, "Intermediate", root, true)
+	leaf := newTestCert(t, "Leaf", intermediate, false)
+	chain_buf := append(leaf.pem(), intermediate.pem()...)
+
+	var hits int32
+	release := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/slow.pem":
+			<-release
+		case "/nostore.pem":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/missing.pem":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		default:
+			w.Header().Set("Cache-Control", "max-age=600")
+		}
+		w.Write(chain_buf)
+	}))
+	defer srv.Close()
+	srv_url, _ := url.Parse(srv.URL)
+
+	cache_dir := t.TempDir()
+	fetcher := NewCertFetcher([]string{srv_url.Hostname()}, cache_dir)
+	fetcher.SetHTTPClient(srv.Client())
+
+	// The chain is cached
+	for i := 0; i < 2; i++ {
+		buf, err := fetcher.GetCert(srv.URL + "/cert.pem")
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := ParseCertChain(buf)
+		if err != nil || len(chain) != 2 {
+			t.Fatalf("Bad chain: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("The certificate has been retrieved %d times", hits)
+	}
+
+	// The chain builds up to the root through the intermediate
+	verifier, err := NewVerifier(root.pem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, _ := ParseCertChain(chain_buf)
+	if err = verifier.validate_certificate(chain[0], chain[1:]); err != nil {
+		t.Errorf("Cannot validate the chain: %s", err.Error())
+	}
+
+	atomic.StoreInt32(&hits, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := fetcher.GetCert(srv.URL + "/nostore.pem"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("no-store has not been honoured: %d", hits)
+	}
+
+	// Concurrent fetches are coalesced
+	atomic.StoreInt32(&hits, 0)
+	var wg sync.WaitGroup
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		fetcher.FetchCert(srv.URL+"/slow.pem", func(buf []byte, err error) {
+			results <- err
+			wg.Done()
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for i := 0; i < 5; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("Concurrent fetches are not coalesced: %d", hits)
+	}
+
+	if _, err = fetcher.GetCert(srv.URL + "/missing.pem"); err == nil {
+		t.Error("404 has not been reported")
+	}
+	if _, err = fetcher.GetCert("http://" + srv_url.Host + "/cert.pem"); err == nil {
+		t.Error("Plain http x5u has been accepted")
+	}
+	if _, err = fetcher.GetCert("https://cr.example.com/cert.pem"); err == nil {
+		t.Error("The x5u host outside the allow-list has been accepted")
+	}
+
+	// The disk cache survives the restart
+	srv.Close()
+	fetcher = NewCertFetcher(nil, cache_dir)
+	if _, err = fetcher.GetCert(srv.URL + "/cert.pem"); err != nil {
+		t.Errorf("The certificate has not been cached on disk: %s", err.Error())
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2020-2021 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_sshaken
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+// ECertRetrieval is returned when the certificate referenced by the x5u
+// cannot be retrieved or decoded.
+type ECertRetrieval struct {
+	X5u string
+	Err error
+}
+
+func (s *ECertRetrieval) Error() string {
+	return "cannot retrieve the certificate " + s.X5u + ": " + s.Err.Error()
+}
+
+func (s *ECertRetrieval) Unwrap() error {
+	return s.Err
+}
+
+// ECertValidity is returned when the date is outside the certificate
+// validity window.
+type ECertValidity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+	Date      time.Time
+}
+
+func (s *ECertValidity) Error() string {
+	return "Date is outside the certificate validity: " + s.Date.UTC().Format(time.RFC3339) +
+		" is not within " + s.NotBefore.UTC().Format(time.RFC3339) + " - " + s.NotAfter.UTC().Format(time.RFC3339)
+}
+
+// ECertUntrusted is returned when the certificate does not chain up to
+// a trusted root, misses the mandatory extensions or its revocation status
+// cannot be determined.
+type ECertUntrusted struct {
+	Reason string
+}
+
+func (s *ECertUntrusted) Error() string {
+	return "untrusted certificate: " + s.Reason
+}
+
+// ECertRevoked is returned when the certificate is found in the CRL or
+// reported revoked by the OCSP responder.
+type ECertRevoked struct {
+	Serial    *big.Int
+	RevokedAt time.Time
+}
+
+func (s *ECertRevoked) Error() string {
+	return "the certificate " + s.Serial.String() + " has been revoked at " + s.RevokedAt.UTC().Format(time.RFC3339)
+}
+
+// ETNNotAuthorized is returned when the TnAuthList of the certificate
+// does not cover the originating TN.
+type ETNNotAuthorized struct {
+	TN string
+}
+
+func (s *ETNNotAuthorized) Error() string {
+	return "the certificate is not authorized for the TN " + s.TN
+}
+
+// SipResponseCode maps the verification failure to the SIP response code
+// and the reason phrase defined by RFC 8224. Any error not listed above
+// is treated as an invalid Identity header.
+func SipResponseCode(err error) (int, string) {
+	var e_retrieval *ECertRetrieval
+	var e_validity *ECertValidity
+	var e_untrusted *ECertUntrusted
+	var e_revoked *ECertRevoked
+
+	switch {
+	case errors.As(err, &e_retrieval):
+		return 436, "Bad Identity Info"
+	case errors.As(err, &e_validity), errors.As(err, &e_untrusted), errors.As(err, &e_revoked):
+		return 437, "Unsupported Credential"
+	}
+	return 438, "Invalid Identity Header"
+}
@@ -29,9 +29,16 @@ import (
 	"time"
 )
 
+const (
+	PPT_SHAKEN = "shaken"
+	PPT_DIV    = "div"
+	PPT_RCD    = "rcd"
+)
+
 type sshaken_passport struct {
 	ppt_hdr_param string
 	alg_hdr_param string
+	signed_buf    string
 	signature     []byte
 	Header        sshaken_header
 	Payload       sshaken_payload
@@ -44,12 +51,17 @@ type sshaken_header struct {
 	X5u string `json:"x5u"`
 }
 
+// The claims are listed in the lexicographic order as required by
+// RFC 8225 for the canonical form.
 type sshaken_payload struct {
-	Attest string       `json:"attest"`
+	Attest string       `json:"attest,omitempty"`
+	Crn    string       `json:"crn,omitempty"`
 	Dest   sshaken_dest `json:"dest"`
+	Div    *sshaken_div `json:"div,omitempty"`
 	Iat    int64        `json:"iat"`
 	Orig   sshaken_orig `json:"orig"`
-	Origid string       `json:"origid"`
+	Origid string       `json:"origid,omitempty"`
+	Rcd    *sshaken_rcd `json:"rcd,omitempty"`
 }
 
 type sshaken_dest struct {
@@ -60,6 +72,21 @@ type sshaken_orig struct {
 	TN string `json:"tn"`
 }
 
+// RFC 8946
+type sshaken_div struct {
+	TN string `json:"tn"`
+}
+
+// Rich Call Data (RFC 9795)
+type sshaken_rcd struct {
+	Icn string `json:"icn,omitempty"`
+	Nam string `json:"nam"`
+}
+
+func (s *sshaken_passport) Ppt() string {
+	return s.Header.Ppt
+}
+
 func (s *sshaken_passport) Origid() string {
 	return s.Payload.Origid
 }
@@ -87,22 +114,44 @@ func (s *sshaken_passport) Iat() time.Time {
 	return time.Unix(s.Payload.Iat, 0)
 }
 
+// DivTN returns the TN the call has been diverted from.
+func (s *sshaken_passport) DivTN() string {
+	if s.Payload.Div == nil {
+		return ""
+	}
+	return s.Payload.Div.TN
+}
+
+func (s *sshaken_passport) CallerName() string {
+	if s.Payload.Rcd == nil {
+		return ""
+	}
+	return s.Payload.Rcd.Nam
+}
+
+// CallerLogo returns the URL of the caller's logo.
+func (s *sshaken_passport) CallerLogo() string {
+	if s.Payload.Rcd == nil {
+		return ""
+	}
+	return s.Payload.Rcd.Icn
+}
+
+// CallReason returns the call reason (crn claim).
+func (s *sshaken_passport) CallReason() string {
+	return s.Payload.Crn
+}
+
 func (s *sshaken_passport) check_claims() error {
 	if s.Header.Alg != "ES256" {
 		return errors.New("'alg' value should be 'ES256'")
 	}
-	if s.Header.Ppt != "shaken" {
-		return errors.New("'ppt' value should be 'shaken'")
-	}
 	if s.Header.Typ != "passport" {
 		return errors.New("'typ' value should be 'passport'")
 	}
 	if s.Header.X5u == "" {
 		return errors.New("'x5u' value should not be empty")
 	}
-	if s.Payload.Attest == "" {
-		return errors.New("'attest' value should not be empty")
-	}
 	if len(s.Payload.Dest.TN) == 0 {
 		return errors.New("dest tn value should not be empty")
 	}
@@ -112,8 +161,24 @@ func (s *sshaken_passport) check_claims() error {
 	if s.Payload.Orig.TN == "" {
 		return errors.New("orig tn value should not be empty")
 	}
-	if s.Payload.Origid == "" {
-		return errors.New("'origid' value should not be empty")
+	switch s.Header.Ppt {
+	case PPT_SHAKEN:
+		if s.Payload.Attest == "" {
+			return errors.New("'attest' value should not be empty")
+		}
+		if s.Payload.Origid == "" {
+			return errors.New("'origid' value should not be empty")
+		}
+	case PPT_DIV:
+		if s.Payload.Div == nil || s.Payload.Div.TN == "" {
+			return errors.New("div tn value should not be empty")
+		}
+	case PPT_RCD:
+		if s.Payload.Rcd == nil || s.Payload.Rcd.Nam == "" {
+			return errors.New("'nam' value should not be empty")
+		}
+	default:
+		return errors.New("'ppt' value should be 'shaken', 'div' or 'rcd'")
 	}
 	return nil
 }
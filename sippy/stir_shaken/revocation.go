@@ -0,0 +1,412 @@
+// Copyright (c) 2020-2021 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_sshaken
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	REVOCATION_FETCH_TIMEOUT = 5 * time.Second
+	CRL_MAX_SIZE             = 4 * 1024 * 1024
+	OCSP_MAX_SIZE            = 64 * 1024
+	OCSP_DEFAULT_TTL         = 10 * time.Minute
+	OCSP_CLOCK_SKEW          = 5 * time.Minute
+)
+
+var (
+	OID_SHA1       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	OID_OCSP_BASIC = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+var ocsp_sig_algs = map[string]x509.SignatureAlgorithm{
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+}
+
+type RevocationChecker interface {
+	CheckRevocation(cert, issuer *x509.Certificate, now time.Time) error
+}
+
+// RFC 6960 structures
+type ocsp_cert_id struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocsp_single_request struct {
+	Cert ocsp_cert_id
+}
+
+type ocsp_tbs_request struct {
+	RequestList []ocsp_single_request
+}
+
+type ocsp_request struct {
+	TBSRequest ocsp_tbs_request
+}
+
+type ocsp_response_bytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocsp_response struct {
+	Status   asn1.Enumerated
+	Response ocsp_response_bytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocsp_revoked_info struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocsp_single_response struct {
+	CertID           ocsp_cert_id
+	Good             asn1.Flag         `asn1:"tag:0,optional"`
+	Revoked          ocsp_revoked_info `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag         `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time         `asn1:"generalized"`
+	NextUpdate       time.Time         `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension  `asn1:"explicit,tag:1,optional"`
+}
+
+type ocsp_response_data struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocsp_single_response
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocsp_basic_response struct {
+	TBSResponseData    ocsp_response_data
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type sshaken_crl_entry struct {
+	revoked     map[string]time.Time
+	next_update time.Time
+}
+
+type sshaken_ocsp_entry struct {
+	revoked     bool
+	revoked_at  time.Time
+	next_update time.Time
+}
+
+// sshaken_revocation_checker checks the certificate against the CRLs
+// listed in its CRL Distribution Points and optionally asks the OCSP
+// responder first. Both the CRLs and the OCSP responses are cached until
+// their nextUpdate. The certificate is not trusted when its revocation
+// status cannot be determined.
+type sshaken_revocation_checker struct {
+	client   *http.Client
+	lock     sync.Mutex
+	crls     map[string]*sshaken_crl_entry
+	ocsp     map[string]*sshaken_ocsp_entry
+	use_ocsp bool
+}
+
+func NewRevocationChecker(use_ocsp bool) *sshaken_revocation_checker {
+	return &sshaken_revocation_checker{
+		client: &http.Client{
+			Timeout: REVOCATION_FETCH_TIMEOUT,
+		},
+		crls:     make(map[string]*sshaken_crl_entry),
+		ocsp:     make(map[string]*sshaken_ocsp_entry),
+		use_ocsp: use_ocsp,
+	}
+}
+
+func (s *sshaken_revocation_checker) SetHTTPClient(client *http.Client) {
+	s.client = client
+}
+
+func (s *sshaken_revocation_checker) CheckRevocation(cert, issuer *x509.Certificate, now time.Time) error {
+	var err error
+	var e_revoked *ECertRevoked
+
+	if s.use_ocsp && len(cert.OCSPServer) > 0 {
+		err = s.check_ocsp(cert, issuer, now)
+		if err == nil || errors.As(err, &e_revoked) {
+			return err
+		}
+		// fall back to the CRL when the responder is not available
+	}
+	for _, crl_url := range cert.CRLDistributionPoints {
+		err = s.check_crl(crl_url, cert, issuer, now)
+		if err == nil || errors.As(err, &e_revoked) {
+			return err
+		}
+	}
+	if err != nil {
+		return &ECertUntrusted{Reason: "cannot determine the revocation status: " + err.Error()}
+	}
+	return nil
+}
+
+func (s *sshaken_revocation_checker) check_crl(crl_url string, cert, issuer *x509.Certificate, now time.Time) error {
+	s.lock.Lock()
+	entry, ok := s.crls[crl_url]
+	if ok && !entry.next_update.After(now) {
+		delete(s.crls, crl_url)
+		ok = false
+	}
+	s.lock.Unlock()
+	if !ok {
+		var err error
+		if entry, err = s.download_crl(crl_url, issuer, now); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.crls[crl_url] = entry
+		s.lock.Unlock()
+	}
+	if revoked_at, ok := entry.revoked[cert.SerialNumber.String()]; ok {
+		return &ECertRevoked{Serial: cert.SerialNumber, RevokedAt: revoked_at}
+	}
+	return nil
+}
+
+func (s *sshaken_revocation_checker) download_crl(crl_url string, issuer *x509.Certificate, now time.Time) (*sshaken_crl_entry, error) {
+	resp, err := s.client.Get(crl_url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot retrieve %s: %s", crl_url, resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, CRL_MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > CRL_MAX_SIZE {
+		return nil, errors.New("the CRL retrieved is too large")
+	}
+	if block, _ := pem.Decode(buf); block != nil && block.Type == "X509 CRL" {
+		buf = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err = crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, errors.New("bad CRL signature: " + err.Error())
+	}
+	if crl.NextUpdate.IsZero() || !crl.NextUpdate.After(now) {
+		return nil, errors.New("the CRL is outdated: " + crl_url)
+	}
+	entry := &sshaken_crl_entry{
+		revoked:     make(map[string]time.Time),
+		next_update: crl.NextUpdate,
+	}
+	for _, rc := range crl.RevokedCertificates {
+		entry.revoked[rc.SerialNumber.String()] = rc.RevocationTime
+	}
+	return entry, nil
+}
+
+func (s *sshaken_revocation_checker) check_ocsp(cert, issuer *x509.Certificate, now time.Time) error {
+	cert_id, err := new_ocsp_cert_id(cert, issuer)
+	if err != nil {
+		return err
+	}
+	key := hex.EncodeToString(cert_id.IssuerKeyHash) + ":" + cert.SerialNumber.String()
+	s.lock.Lock()
+	entry, ok := s.ocsp[key]
+	if ok && !entry.next_update.After(now) {
+		delete(s.ocsp, key)
+		ok = false
+	}
+	s.lock.Unlock()
+	if !ok {
+		if entry, err = s.query_ocsp(cert.OCSPServer[0], cert_id, issuer, now); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.ocsp[key] = entry
+		s.lock.Unlock()
+	}
+	if entry.revoked {
+		return &ECertRevoked{Serial: cert.SerialNumber, RevokedAt: entry.revoked_at}
+	}
+	return nil
+}
+
+func new_ocsp_cert_id(cert, issuer *x509.Certificate) (*ocsp_cert_id, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	name_hash := sha1.Sum(issuer.RawSubject)
+	key_hash := sha1.Sum(spki.PublicKey.RightAlign())
+	return &ocsp_cert_id{
+		HashAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  OID_SHA1,
+			Parameters: asn1.NullRawValue,
+		},
+		IssuerNameHash: name_hash[:],
+		IssuerKeyHash:  key_hash[:],
+		SerialNumber:   cert.SerialNumber,
+	}, nil
+}
+
+func (s *sshaken_revocation_checker) query_ocsp(ocsp_url string, cert_id *ocsp_cert_id, issuer *x509.Certificate, now time.Time) (*sshaken_ocsp_entry, error) {
+	req_buf, err := asn1.Marshal(ocsp_request{
+		TBSRequest: ocsp_tbs_request{
+			RequestList: []ocsp_single_request{{Cert: *cert_id}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Post(ocsp_url, "application/ocsp-request", bytes.NewReader(req_buf))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP request to %s failed: %s", ocsp_url, resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, OCSP_MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > OCSP_MAX_SIZE {
+		return nil, errors.New("the OCSP response is too large")
+	}
+	return parse_ocsp_response(buf, cert_id, issuer, now)
+}
+
+func parse_ocsp_response(buf []byte, cert_id *ocsp_cert_id, issuer *x509.Certificate, now time.Time) (*sshaken_ocsp_entry, error) {
+	var oresp ocsp_response
+	if _, err := asn1.Unmarshal(buf, &oresp); err != nil {
+		return nil, errors.New("error decoding the OCSP response: " + err.Error())
+	}
+	if oresp.Status != 0 {
+		return nil, fmt.Errorf("OCSP responder returned status %d", oresp.Status)
+	}
+	if !oresp.Response.ResponseType.Equal(OID_OCSP_BASIC) {
+		return nil, errors.New("unsupported OCSP response type")
+	}
+	var basic ocsp_basic_response
+	if _, err := asn1.Unmarshal(oresp.Response.Response, &basic); err != nil {
+		return nil, errors.New("error decoding the OCSP response: " + err.Error())
+	}
+	if err := check_ocsp_signature(&basic, issuer); err != nil {
+		return nil, err
+	}
+	for _, sresp := range basic.TBSResponseData.Responses {
+		if !bytes.Equal(sresp.CertID.IssuerKeyHash, cert_id.IssuerKeyHash) ||
+			!bytes.Equal(sresp.CertID.IssuerNameHash, cert_id.IssuerNameHash) ||
+			sresp.CertID.SerialNumber.Cmp(cert_id.SerialNumber) != 0 {
+			continue
+		}
+		if sresp.ThisUpdate.After(now.Add(OCSP_CLOCK_SKEW)) {
+			return nil, errors.New("the OCSP response is not yet valid")
+		}
+		entry := &sshaken_ocsp_entry{
+			next_update: sresp.NextUpdate,
+		}
+		if entry.next_update.IsZero() {
+			entry.next_update = now.Add(OCSP_DEFAULT_TTL)
+		} else if !entry.next_update.After(now) {
+			return nil, errors.New("the OCSP response is outdated")
+		}
+		switch {
+		case bool(sresp.Good):
+		case bool(sresp.Unknown):
+			return nil, errors.New("the OCSP responder does not know the certificate")
+		default:
+			entry.revoked = true
+			entry.revoked_at = sresp.Revoked.RevocationTime
+		}
+		return entry, nil
+	}
+	return nil, errors.New("the OCSP response does not cover the certificate")
+}
+
+// check_ocsp_signature verifies that the response is signed either by the
+// issuer itself or by the responder the issuer has delegated OCSP signing
+// to.
+func check_ocsp_signature(basic *ocsp_basic_response, issuer *x509.Certificate) error {
+	algo, ok := ocsp_sig_algs[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return errors.New("unsupported OCSP signature algorithm")
+	}
+	signers := []*x509.Certificate{issuer}
+	for _, raw := range basic.Certificates {
+		responder, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return err
+		}
+		if responder.CheckSignatureFrom(issuer) != nil || !is_ocsp_signer(responder) {
+			continue
+		}
+		signers = append(signers, responder)
+	}
+	for _, signer := range signers {
+		if signer.CheckSignature(algo, basic.TBSResponseData.Raw, basic.Signature.RightAlign()) == nil {
+			return nil
+		}
+	}
+	return errors.New("bad OCSP response signature")
+}
+
+func is_ocsp_signer(cert *x509.Certificate) bool {
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
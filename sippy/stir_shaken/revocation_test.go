@@ -0,0 +1,175 @@
+package sippy_sshaken
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestOCSPResponse(t *testing.T, req_buf []byte, issuer *test_ca, revoked map[string]bool) []byte {
+	var req ocsp_request
+	if _, err := asn1.Unmarshal(req_buf, &req); err != nil {
+		t.Error(err)
+		return nil
+	}
+	now := time.Now()
+	cert_id := req.TBSRequest.RequestList[0].Cert
+	sresp := ocsp_single_response{
+		CertID:     cert_id,
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(time.Hour),
+	}
+	if revoked[cert_id.SerialNumber.String()] {
+		sresp.Revoked = ocsp_revoked_info{RevocationTime: now.Add(-time.Hour)}
+	} else {
+		sresp.Good = true
+	}
+	key_id, _ := asn1.Marshal(cert_id.IssuerKeyHash)
+	tbs, err := asn1.Marshal(ocsp_response_data{
+		RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: key_id},
+		ProducedAt:     now,
+		Responses:      []ocsp_single_response{sresp},
+	})
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	hash := sha256.Sum256(tbs)
+	sig, err := ecdsa.SignASN1(rand.Reader, issuer.key, hash[:])
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	basic, err := asn1.Marshal(ocsp_basic_response{
+		TBSResponseData:    ocsp_response_data{Raw: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	buf, err := asn1.Marshal(ocsp_response{
+		Response: ocsp_response_bytes{ResponseType: OID_OCSP_BASIC, Response: basic},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	return buf
+}
+
+func TestRevocation(t *testing.T) {
+	root := newTestCert(t, "Root", nil, true)
+	intermediate := newTestCert(t, "Intermediate", root, true)
+
+	var crl_hits, ocsp_hits int32
+	var ocsp_down int32
+	revoked := map[string]bool{}
+	var crl_buf []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/crl":
+			atomic.AddInt32(&crl_hits, 1)
+			w.Write(crl_buf)
+		case "/ocsp":
+			atomic.AddInt32(&ocsp_hits, 1)
+			if atomic.LoadInt32(&ocsp_down) != 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			req_buf, _ := io.ReadAll(r.Body)
+			w.Write(newTestOCSPResponse(t, req_buf, intermediate, revoked))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	with_crl := func(path string) func(*x509.Certificate) {
+		return func(tmpl *x509.Certificate) {
+			tmpl.CRLDistributionPoints = []string{srv.URL + path}
+			tmpl.OCSPServer = []string{srv.URL + "/ocsp"}
+		}
+	}
+	good := newTestCert(t, "Good", intermediate, false, with_crl("/crl"))
+	bad := newTestCert(t, "Bad", intermediate, false, with_crl("/crl"))
+	lost := newTestCert(t, "Lost", intermediate, false, with_crl("/missing"))
+	revoked[bad.cert.SerialNumber.String()] = true
+
+	now := time.Now()
+	var err error
+	crl_buf, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: bad.cert.SerialNumber, RevocationTime: now.Add(-time.Hour)},
+		},
+	}, intermediate.cert, intermediate.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CRL is retrieved once and cached until its nextUpdate
+	checker := NewRevocationChecker(false)
+	for i := 0; i < 2; i++ {
+		if err = checker.CheckRevocation(good.cert, intermediate.cert, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var e_revoked *ECertRevoked
+	if err = checker.CheckRevocation(bad.cert, intermediate.cert, now); !errors.As(err, &e_revoked) {
+		t.Errorf("Revoked certificate has not been detected: %v", err)
+	}
+	if atomic.LoadInt32(&crl_hits) != 1 {
+		t.Errorf("The CRL has been retrieved %d times", crl_hits)
+	}
+	if atomic.LoadInt32(&ocsp_hits) != 0 {
+		t.Error("OCSP responder has been queried while OCSP is disabled")
+	}
+
+	// The CRL signed by the other CA is rejected
+	var e_untrusted *ECertUntrusted
+	if err = checker.CheckRevocation(good.cert, root.cert, now.Add(2*time.Hour)); !errors.As(err, &e_untrusted) {
+		t.Errorf("The CRL with bad signature has been accepted: %v", err)
+	}
+	if err = checker.CheckRevocation(lost.cert, intermediate.cert, now); !errors.As(err, &e_untrusted) {
+		t.Errorf("Unknown revocation status has been accepted: %v", err)
+	}
+
+	// OCSP
+	checker = NewRevocationChecker(true)
+	atomic.StoreInt32(&crl_hits, 0)
+	for i := 0; i < 2; i++ {
+		if err = checker.CheckRevocation(good.cert, intermediate.cert, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = checker.CheckRevocation(bad.cert, intermediate.cert, now); !errors.As(err, &e_revoked) {
+		t.Errorf("Revoked certificate has not been detected by OCSP: %v", err)
+	}
+	if atomic.LoadInt32(&ocsp_hits) != 2 || atomic.LoadInt32(&crl_hits) != 0 {
+		t.Errorf("Unexpected number of requests: OCSP %d, CRL %d", ocsp_hits, crl_hits)
+	}
+
+	// The CRL is used when the OCSP responder is down
+	atomic.StoreInt32(&ocsp_down, 1)
+	checker = NewRevocationChecker(true)
+	if err = checker.CheckRevocation(bad.cert, intermediate.cert, now); !errors.As(err, &e_revoked) {
+		t.Errorf("Revoked certificate has not been detected by CRL: %v", err)
+	}
+	if err = checker.CheckRevocation(good.cert, intermediate.cert, now.Add(2*time.Hour)); !errors.As(err, &e_untrusted) {
+		t.Errorf("Outdated CRL has been accepted: %v", err)
+	}
+}
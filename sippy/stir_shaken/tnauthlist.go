@@ -0,0 +1,151 @@
+// Copyright (c) 2020-2021 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_sshaken
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type sshaken_tn_range struct {
+	Start string
+	Count int
+}
+
+// sshaken_tn_auth_list is the decoded TNAuthorizationList extension
+// (RFC 8226):
+//
+//	TNAuthorizationList ::= SEQUENCE SIZE (1..MAX) OF TNEntry
+//	TNEntry ::= CHOICE {
+//		spc   [0] ServiceProviderCode,
+//		range [1] TelephoneNumberRange,
+//		one   [2] TelephoneNumber
+//	}
+type sshaken_tn_auth_list struct {
+	SPCs   []string
+	Ranges []sshaken_tn_range
+	TNs    []string
+}
+
+// ParseTnAuthList decodes the TnAuthList extension of the certificate.
+func ParseTnAuthList(cert *x509.Certificate) (*sshaken_tn_auth_list, error) {
+	var value []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(TNAUTHLIST_EXT) {
+			value = ext.Value
+			break
+		}
+	}
+	if value == nil {
+		return nil, errors.New("The certificate misses TnAuthList extension")
+	}
+	var entries []asn1.RawValue
+	rest, err := asn1.Unmarshal(value, &entries)
+	if err != nil {
+		return nil, errors.New("error decoding TnAuthList: " + err.Error())
+	}
+	if len(rest) > 0 || len(entries) == 0 {
+		return nil, errors.New("malformed TnAuthList")
+	}
+	s := &sshaken_tn_auth_list{}
+	for _, entry := range entries {
+		if entry.Class != asn1.ClassContextSpecific || !entry.IsCompound {
+			return nil, errors.New("malformed TnAuthList entry")
+		}
+		switch entry.Tag {
+		case 0:
+			var spc string
+			if _, err = asn1.UnmarshalWithParams(entry.Bytes, &spc, "ia5"); err != nil {
+				return nil, errors.New("error decoding SPC: " + err.Error())
+			}
+			s.SPCs = append(s.SPCs, spc)
+		case 1:
+			var tn_range struct {
+				Start string `asn1:"ia5"`
+				Count int
+			}
+			if _, err = asn1.Unmarshal(entry.Bytes, &tn_range); err != nil {
+				return nil, errors.New("error decoding TN range: " + err.Error())
+			}
+			if tn_range.Count < 2 {
+				return nil, fmt.Errorf("bad TN range count %d", tn_range.Count)
+			}
+			s.Ranges = append(s.Ranges, sshaken_tn_range{Start: tn_range.Start, Count: tn_range.Count})
+		case 2:
+			var tn string
+			if _, err = asn1.UnmarshalWithParams(entry.Bytes, &tn, "ia5"); err != nil {
+				return nil, errors.New("error decoding TN: " + err.Error())
+			}
+			s.TNs = append(s.TNs, tn)
+		default:
+			return nil, fmt.Errorf("unknown TnAuthList entry %d", entry.Tag)
+		}
+	}
+	return s, nil
+}
+
+// CoversTN reports whether the TN is listed explicitly or falls into one
+// of the ranges.
+func (s *sshaken_tn_auth_list) CoversTN(tn string) bool {
+	tn = cleanup(tn)
+	for _, one := range s.TNs {
+		if cleanup(one) == tn {
+			return true
+		}
+	}
+	num, err := strconv.ParseUint(tn, 10, 64)
+	if err != nil {
+		return false
+	}
+	for _, tn_range := range s.Ranges {
+		start_str := cleanup(tn_range.Start)
+		if len(start_str) != len(tn) {
+			continue
+		}
+		start, err := strconv.ParseUint(start_str, 10, 64)
+		if err != nil {
+			continue
+		}
+		if num >= start && num-start < uint64(tn_range.Count) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSPC reports whether the SPC is listed. The SPCs are compared case
+// insensitively.
+func (s *sshaken_tn_auth_list) HasSPC(spc string) bool {
+	for _, our_spc := range s.SPCs {
+		if strings.EqualFold(our_spc, spc) {
+			return true
+		}
+	}
+	return false
+}
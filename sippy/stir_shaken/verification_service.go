@@ -0,0 +1,349 @@
+// Copyright (c) 2020-2021 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_sshaken
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/types"
+)
+
+const (
+	VERSTAT_PASSED        = "TN-Validation-Passed"
+	VERSTAT_FAILED        = "TN-Validation-Failed"
+	VERSTAT_NO_VALIDATION = "No-TN-Validation"
+)
+
+type VerifyPolicy int
+
+const (
+	// The call is passed as is, no verification is done
+	VERIFY_POLICY_PASS = VerifyPolicy(iota)
+	// The result of the verification is passed downstream as verstat
+	VERIFY_POLICY_TAG
+	// The call failing the verification is rejected
+	VERIFY_POLICY_REJECT
+)
+
+func ParseVerifyPolicy(s string) (VerifyPolicy, error) {
+	switch strings.ToLower(s) {
+	case "pass":
+		return VERIFY_POLICY_PASS, nil
+	case "tag":
+		return VERIFY_POLICY_TAG, nil
+	case "reject":
+		return VERIFY_POLICY_REJECT, nil
+	}
+	return VERIFY_POLICY_PASS, errors.New("unknown verification policy: " + s)
+}
+
+func (s VerifyPolicy) String() string {
+	switch s {
+	case VERIFY_POLICY_TAG:
+		return "tag"
+	case VERIFY_POLICY_REJECT:
+		return "reject"
+	}
+	return "pass"
+}
+
+// VerificationResult is the outcome of the inbound request verification.
+// The request should be rejected with SCode and Reason when SCode is not
+// zero, otherwise the Verstat is to be passed to the outbound leg.
+type VerificationResult struct {
+	Verstat    string
+	SCode      int
+	Reason     string
+	Err        error
+	Identities []*IdentityResult
+	// The claims of the first valid "rcd" PASSporT
+	CallerName string
+	CallerLogo string
+	CallReason string
+}
+
+// Origid returns the origid of the valid "shaken" PASSporT to be
+// propagated downstream.
+func (s *VerificationResult) Origid() string {
+	if s.Err != nil {
+		return ""
+	}
+	for _, ir := range s.Identities {
+		if ir.Err == nil && ir.Passport.Ppt() == PPT_SHAKEN {
+			return ir.Passport.Origid()
+		}
+	}
+	return ""
+}
+
+// IdentityResult is the outcome of the verification of one Identity
+// header. The Passport is nil when the header cannot be decoded.
+type IdentityResult struct {
+	Passport *sshaken_passport
+	Err      error
+}
+
+// TagEvent adds the verstat to the P-Asserted-Identity of the outbound
+// INVITE or to the From URI when there is no P-Asserted-Identity. The
+// verstat received from upstream is replaced.
+func (s *VerificationResult) TagEvent(event *sippy.CCEventTry, config sippy_conf.Config) {
+	if s.Verstat == "" {
+		return
+	}
+	pais := event.GetAssertedIdentity()
+	if len(pais) == 0 {
+		event.SetFromUserParams(set_verstat(event.GetFromUserParams(), s.Verstat))
+		return
+	}
+	tagged := make([]*sippy_header.SipPAssertedIdentity, 0, len(pais))
+	for _, pai := range pais {
+		// The headers may be shared with the inbound leg
+		pai = pai.GetCopy()
+		if addr, err := pai.GetBody(config); err == nil {
+			url := addr.GetUrl()
+			url.SetUserParams(set_verstat(url.GetUserParams(), s.Verstat))
+		}
+		tagged = append(tagged, pai)
+	}
+	event.SetAssertedIdentity(tagged)
+}
+
+func set_verstat(params []string, verstat string) []string {
+	ret := []string{}
+	for _, param := range params {
+		if !strings.HasPrefix(strings.ToLower(param), "verstat=") {
+			ret = append(ret, param)
+		}
+	}
+	return append(ret, "verstat="+verstat)
+}
+
+type VerificationService interface {
+	SetPolicy(peer string, policy VerifyPolicy)
+	SetDefaultPolicy(policy VerifyPolicy)
+	VerifyRequest(req sippy_types.SipRequest, done func(*VerificationResult))
+}
+
+// sshaken_verification_service verifies the Identity of the inbound
+// requests according to the policy configured for the source peer.
+type sshaken_verification_service struct {
+	verifier       Verifier
+	fetcher        CertFetcher
+	config         sippy_conf.Config
+	lock           sync.Mutex
+	policies       map[string]VerifyPolicy
+	default_policy VerifyPolicy
+}
+
+func NewVerificationService(verifier Verifier, fetcher CertFetcher, config sippy_conf.Config) *sshaken_verification_service {
+	return &sshaken_verification_service{
+		verifier:       verifier,
+		fetcher:        fetcher,
+		config:         config,
+		policies:       make(map[string]VerifyPolicy),
+		default_policy: VERIFY_POLICY_REJECT,
+	}
+}
+
+// SetPolicy sets the policy for the requests coming from the peer
+// address.
+func (s *sshaken_verification_service) SetPolicy(peer string, policy VerifyPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policies[peer] = policy
+}
+
+func (s *sshaken_verification_service) SetDefaultPolicy(policy VerifyPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.default_policy = policy
+}
+
+func (s *sshaken_verification_service) GetPolicy(peer string) VerifyPolicy {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if policy, ok := s.policies[peer]; ok {
+		return policy
+	}
+	return s.default_policy
+}
+
+// VerifyRequest verifies the Identity of the request in the background.
+// The done is always called asynchronously without any lock held, so that
+// the caller may invoke VerifyRequest with its own lock held.
+func (s *sshaken_verification_service) VerifyRequest(req sippy_types.SipRequest, done func(*VerificationResult)) {
+	peer := ""
+	if req.GetSource() != nil {
+		peer = req.GetSource().Host.String()
+	}
+	policy := s.GetPolicy(peer)
+	if policy == VERIFY_POLICY_PASS {
+		go done(&VerificationResult{})
+		return
+	}
+	identity_hfs := req.GetHFs("identity")
+	if len(identity_hfs) == 0 {
+		res := &VerificationResult{Verstat: VERSTAT_NO_VALIDATION}
+		if policy == VERIFY_POLICY_REJECT {
+			res.SCode, res.Reason = 428, "Use Identity Header"
+		}
+		go done(res)
+		return
+	}
+	identities := make([]string, len(identity_hfs))
+	for i, identity_hf := range identity_hfs {
+		identities[i] = identity_hf.StringBody()
+	}
+	go func() {
+		res := s.verify(req, identities)
+		res.Verstat = VERSTAT_PASSED
+		if res.Err != nil {
+			res.Verstat = VERSTAT_FAILED
+			if policy == VERIFY_POLICY_REJECT {
+				res.SCode, res.Reason = SipResponseCode(res.Err)
+			}
+		}
+		done(res)
+	}()
+}
+
+// verify checks each Identity header independently. The "div" PASSporTs
+// are followed back from the current destination to the TN the call has
+// originally been placed to, the "shaken" and "rcd" PASSporTs should
+// match that TN. The call passes when there is a valid "shaken" PASSporT
+// and all the diversions on the way are valid.
+func (s *sshaken_verification_service) verify(req sippy_types.SipRequest, identities []string) *VerificationResult {
+	res := &VerificationResult{}
+	for _, identity := range identities {
+		passport, err := ParseIdentity(identity)
+		res.Identities = append(res.Identities, &IdentityResult{Passport: passport, Err: err})
+	}
+	orig_tn, err := s.origTN(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	to, err := req.GetTo().GetBody(s.config)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	var date_ts *time.Time
+	if req.GetSipDate() != nil {
+		ts, err := req.GetSipDate().GetTime()
+		if err != nil {
+			res.Err = errors.New("error parsing Date: header: " + err.Error())
+			return res
+		}
+		date_ts = &ts
+	}
+	checked := make(map[*IdentityResult]bool)
+	dest_tn := cleanup(to.GetUrl().Username)
+	for {
+		var div *IdentityResult
+		for _, ir := range res.Identities {
+			if ir.Err == nil && !checked[ir] && ir.Passport.Ppt() == PPT_DIV && cleanup(ir.Passport.DestTN()) == dest_tn {
+				div = ir
+				break
+			}
+		}
+		if div == nil {
+			break
+		}
+		checked[div] = true
+		if div.Err = s.verify_passport(div.Passport, orig_tn, dest_tn, date_ts); div.Err != nil {
+			res.Err = div.Err
+			return res
+		}
+		dest_tn = cleanup(div.Passport.DivTN())
+	}
+	res.Err = errors.New("no valid shaken PASSporT")
+	shaken_found := false
+	for _, ir := range res.Identities {
+		if checked[ir] {
+			continue
+		}
+		if ir.Err != nil {
+			if !shaken_found {
+				res.Err = ir.Err
+			}
+			continue
+		}
+		switch ir.Passport.Ppt() {
+		case PPT_DIV:
+			ir.Err = errors.New("the div PASSporT does not match the call")
+		case PPT_SHAKEN:
+			ir.Err = s.verify_passport(ir.Passport, orig_tn, dest_tn, date_ts)
+			if ir.Err == nil {
+				res.Err = nil
+			} else if !shaken_found {
+				res.Err = ir.Err
+			}
+			shaken_found = true
+		case PPT_RCD:
+			ir.Err = s.verify_passport(ir.Passport, orig_tn, dest_tn, date_ts)
+			if ir.Err == nil && res.CallerName == "" {
+				res.CallerName = ir.Passport.CallerName()
+				res.CallerLogo = ir.Passport.CallerLogo()
+				res.CallReason = ir.Passport.CallReason()
+			}
+		}
+	}
+	return res
+}
+
+func (s *sshaken_verification_service) verify_passport(passport *sshaken_passport, orig_tn, dest_tn string, date_ts *time.Time) error {
+	// RFC 8224: the iat is used when the Date header is absent
+	ts := passport.Iat()
+	if date_ts != nil {
+		ts = *date_ts
+	}
+	cert_buf, err := s.fetcher.GetCert(passport.X5u())
+	if err != nil {
+		return err
+	}
+	return s.verifier.Verify(passport, cert_buf, orig_tn, dest_tn, ts)
+}
+
+// origTN returns the originating TN taken from the P-Asserted-Identity
+// if present or from the From otherwise.
+func (s *sshaken_verification_service) origTN(req sippy_types.SipRequest) (string, error) {
+	for _, pai := range req.GetPAIs() {
+		if addr, err := pai.GetBody(s.config); err == nil && addr.GetUrl().Username != "" {
+			return addr.GetUrl().Username, nil
+		}
+	}
+	from, err := req.GetFrom().GetBody(s.config)
+	if err != nil {
+		return "", err
+	}
+	return from.GetUrl().Username, nil
+}
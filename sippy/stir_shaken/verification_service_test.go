@@ -0,0 +1,156 @@
+package sippy_sshaken
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy"
+	"github.com/egovorukhin/go-b2bua/sippy/conf"
+	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/log"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+	"github.com/egovorukhin/go-b2bua/sippy/time"
+)
+
+type test_fetcher struct {
+	certs map[string][]byte
+}
+
+func (s *test_fetcher) GetCert(x5u string) ([]byte, error) {
+	return s.certs[x5u], nil
+}
+
+func (s *test_fetcher) FetchCert(x5u string, done func([]byte, error)) {
+	go done(s.GetCert(x5u))
+}
+
+func TestVerificationService(t *testing.T) {
+	config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+	root := newTestCert(t, "Root", nil, true)
+	leaf := newTestCert(t, "Leaf", root, false)
+	verifier, err := NewVerifier(root.pem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	div_leaf := newTestCert(t, "Diverter", root, false, func(tmpl *x509.Certificate) {
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: TNAUTHLIST_EXT, Value: newTestTnAuthList(t, "", "12345678902")}}
+	})
+	identity, err := Authenticate(time.Now(), "A", "origid", leaf.pem(), leaf.pkey_pem(t), "https://certs.example.org/cert.pem", "12345678901", "12345678902")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &test_fetcher{certs: map[string][]byte{
+		"https://certs.example.org/cert.pem": leaf.pem(),
+		"https://certs.example.net/cert.pem": div_leaf.pem(),
+	}}
+	vs := NewVerificationService(verifier, fetcher, config)
+
+	verify_to := func(from, to string, identity_hfs ...string) *VerificationResult {
+		msg := []string{
+			"INVITE sip:" + to + "@192.0.2.1 SIP/2.0",
+			"Via: SIP/2.0/UDP 192.0.2.2:5060;branch=z9hG4bK776asdhds",
+			"Max-Forwards: 70",
+			"From: <sip:" + from + "@192.0.2.2>;tag=1928301774",
+			"To: <sip:" + to + "@192.0.2.1>",
+			"Call-ID: a84b4c76e66710@192.0.2.2",
+			"CSeq: 1 INVITE",
+		}
+		for _, identity_hf := range identity_hfs {
+			msg = append(msg, "Identity: "+identity_hf)
+		}
+		msg = append(msg, "Content-Length: 0", "", "")
+		rtime, _ := sippy_time.NewMonoTime()
+		req, err := sippy.ParseSipRequest([]byte(strings.Join(msg, "\r\n")), rtime, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan *VerificationResult, 1)
+		vs.VerifyRequest(req, func(res *VerificationResult) { ch <- res })
+		return <-ch
+	}
+	verify := func(from string, identity_hf string) *VerificationResult {
+		if identity_hf == "" {
+			return verify_to(from, "12345678902")
+		}
+		return verify_to(from, "12345678902", identity_hf)
+	}
+
+	if res := verify("12345678901", identity); res.SCode != 0 || res.Verstat != VERSTAT_PASSED {
+		t.Errorf("Valid identity has not been verified: %d %v", res.SCode, res.Err)
+	}
+	if res := verify("12345678903", identity); res.SCode != 438 || res.Verstat != VERSTAT_FAILED {
+		t.Errorf("Spoofed identity has been accepted: %d %s", res.SCode, res.Verstat)
+	}
+	if res := verify("12345678901", ""); res.SCode != 428 || res.Verstat != VERSTAT_NO_VALIDATION {
+		t.Errorf("Missing identity has been accepted: %d %s", res.SCode, res.Verstat)
+	}
+
+	// The diverted call carries the original PASSporT along with the div
+	// and the rcd ones
+	div, err := AuthenticateDiv(time.Now(), div_leaf.pem(), div_leaf.pkey_pem(t), "https://certs.example.net/cert.pem", "12345678901", "12345678909", "12345678902")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcd, err := AuthenticateRcd(time.Now(), leaf.pem(), leaf.pkey_pem(t), "https://certs.example.org/cert.pem", "12345678901", "12345678902", "Alice", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := verify_to("12345678901", "12345678909", rcd, identity, div)
+	if res.SCode != 0 || res.Verstat != VERSTAT_PASSED {
+		t.Errorf("Diverted call has not been verified: %d %v", res.SCode, res.Err)
+	}
+	if len(res.Identities) != 3 || res.CallerName != "Alice" {
+		t.Errorf("Bad identity results: %d %s", len(res.Identities), res.CallerName)
+	}
+	for _, ir := range res.Identities {
+		if ir.Err != nil {
+			t.Errorf("%s PASSporT has not been verified: %s", ir.Passport.Ppt(), ir.Err.Error())
+		}
+	}
+	if res = verify_to("12345678901", "12345678909", identity); res.SCode == 0 {
+		t.Error("Diverted call without div PASSporT has been accepted")
+	}
+	if res = verify_to("12345678901", "12345678909", div); res.SCode == 0 {
+		t.Error("Call without shaken PASSporT has been accepted")
+	}
+
+	vs.SetDefaultPolicy(VERIFY_POLICY_TAG)
+	res = verify("12345678903", identity)
+	if res.SCode != 0 || res.Verstat != VERSTAT_FAILED {
+		t.Errorf("Bad result in tag mode: %d %s", res.SCode, res.Verstat)
+	}
+	event, _ := sippy.NewCCEventTry(nil, "12345678903", "12345678902", nil, nil, "", nil, "")
+	event.SetFromUserParams([]string{"verstat=" + VERSTAT_PASSED})
+	res.TagEvent(event, config)
+	if params := event.GetFromUserParams(); len(params) != 1 || params[0] != "verstat="+VERSTAT_FAILED {
+		t.Errorf("From has not been tagged: %v", params)
+	}
+	url := sippy_header.NewSipURL("12345678903", sippy_net.NewMyAddress("192.0.2.2"), nil, false)
+	pai := sippy_header.NewSipPAssertedIdentity(sippy_header.NewSipAddress("", url))
+	event.SetAssertedIdentity([]*sippy_header.SipPAssertedIdentity{pai})
+	res.TagEvent(event, config)
+	assertion := event.GetAssertedIdentity()[0].StringBody()
+	if !strings.Contains(assertion, "12345678903;verstat="+VERSTAT_FAILED+"@") {
+		t.Errorf("P-Asserted-Identity has not been tagged: %s", assertion)
+	}
+	if pai.StringBody() == assertion {
+		t.Error("The original P-Asserted-Identity has been modified")
+	}
+
+	vs.SetPolicy("", VERIFY_POLICY_PASS)
+	if res := verify("12345678903", identity); res.SCode != 0 || res.Verstat != "" {
+		t.Errorf("Bad result in pass mode: %d %s", res.SCode, res.Verstat)
+	}
+
+	if tn := DiversionTN(event, config); tn != "" {
+		t.Errorf("The call has not been diverted: %s", tn)
+	}
+	diversion := sippy_header.CreateSipDiversion("<sip:12345678902@192.0.2.1>;reason=unconditional")[0].(*sippy_header.SipDiversion)
+	event.SetDiversion([]*sippy_header.SipDiversion{diversion})
+	if tn := DiversionTN(event, config); tn != "12345678902" {
+		t.Errorf("Bad diverting TN: %s", tn)
+	}
+}
@@ -29,7 +29,6 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"math/big"
@@ -44,12 +43,18 @@ type Verifier interface {
 }
 
 type sshaken_verifier struct {
-	roots *x509.CertPool
+	roots      *x509.CertPool
+	revocation RevocationChecker
+	spc_lookup func(tn string) (string, bool)
 }
 
+// NewVerifier creates the verifier trusting the root certificates. The
+// revocation status of the chain is checked against the CRLs, use
+// SetRevocationChecker to enable OCSP or to disable the check.
 func NewVerifier(chain_buf []byte) (*sshaken_verifier, error) {
 	s := &sshaken_verifier{
-		roots: x509.NewCertPool(),
+		roots:      x509.NewCertPool(),
+		revocation: NewRevocationChecker(false),
 	}
 	if !s.roots.AppendCertsFromPEM(chain_buf) {
 		return nil, errors.New("error parsing the root certificates")
@@ -57,8 +62,19 @@ func NewVerifier(chain_buf []byte) (*sshaken_verifier, error) {
 	return s, nil
 }
 
+func (s *sshaken_verifier) SetRevocationChecker(revocation RevocationChecker) {
+	s.revocation = revocation
+}
+
+// SetSPCLookup sets the function returning the SPC of the service provider
+// the TN belongs to. When it is not set the certificates carrying only the
+// SPC in their TnAuthList are accepted for any TN.
+func (s *sshaken_verifier) SetSPCLookup(spc_lookup func(tn string) (string, bool)) {
+	s.spc_lookup = spc_lookup
+}
+
 func (s *sshaken_verifier) Verify(passport *sshaken_passport, cert_buf []byte, orig_tn_p, dest_tn_p string, date_ts time.Time) error {
-	if passport.ppt_hdr_param != "shaken" {
+	if passport.ppt_hdr_param != passport.Header.Ppt {
 		return errors.New("Unsupported 'ppt' extension")
 	}
 	if passport.alg_hdr_param != "" && passport.alg_hdr_param != "ES256" {
@@ -77,59 +93,107 @@ func (s *sshaken_verifier) Verify(passport *sshaken_passport, cert_buf []byte, o
 	if passport.OrigTN() != orig_tn_p || passport.DestTN() != dest_tn_p {
 		return errors.New("Signature would not verify successfully")
 	}
-	cert, err := load_cert(cert_buf)
+	chain, err := ParseCertChain(cert_buf)
 	if err != nil {
+		return &ECertRetrieval{X5u: passport.X5u(), Err: err}
+	}
+	cert := chain[0]
+	if err = check_cert_validity(cert, now); err != nil {
+		return err
+	}
+	if err = check_cert_validity(cert, date_ts); err != nil {
 		return err
 	}
-	check_cert_validity(cert, date_ts)
-	err = s.validate_certificate(cert)
+	err = s.validate_certificate(cert, chain[1:])
 	if err != nil {
 		return err
 	}
+	// The credential of the diverting party should cover the TN the
+	// call has been diverted from
+	auth_tn := orig_tn_p
+	if passport.Ppt() == PPT_DIV {
+		auth_tn = cleanup(passport.DivTN())
+	}
+	if err = s.check_tn_authorization(cert, auth_tn); err != nil {
+		return err
+	}
 	iat_ts := passport.Iat()
 	diff := now.Sub(iat_ts)
 	if diff < 0 {
 		diff = -diff
 	}
+	if passport.Ppt() != PPT_SHAKEN {
+		// The signature covers the 'iat' as it is, so the stale
+		// PASSporT would verify successfully
+		if diff > VERIFY_DATE_FRESHNESS {
+			return errors.New("'iat' value is older than local policy")
+		}
+		return verify_raw_signature(cert, passport)
+	}
 	if !iat_ts.Equal(date_ts) && diff > VERIFY_DATE_FRESHNESS {
 		iat_ts = date_ts
 	}
 	return verify_signature(cert, passport, iat_ts, orig_tn_p, dest_tn_p)
 }
 
-func (s *sshaken_verifier) validate_certificate(cert *x509.Certificate) error {
-	tn_ext_found := false
-	for _, ext := range cert.Extensions {
-		if ext.Id.Equal(TNAUTHLIST_EXT) {
-			tn_ext_found = true
-			break
-		}
-	}
-	if !tn_ext_found {
-		return errors.New("The certificate misses TnAuthList extension")
+func (s *sshaken_verifier) validate_certificate(cert *x509.Certificate, intermediates []*x509.Certificate) error {
+	if _, err := ParseTnAuthList(cert); err != nil {
+		return &ECertUntrusted{Reason: err.Error()}
 	}
 	opts := x509.VerifyOptions{
-		Roots: s.roots,
+		Roots:         s.roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, icert := range intermediates {
+		opts.Intermediates.AddCert(icert)
 	}
 	chains, err := cert.Verify(opts)
 	if err != nil {
-		return err
+		return &ECertUntrusted{Reason: err.Error()}
 	}
 	if len(chains) == 0 {
-		return errors.New("no matching root certificate")
+		return &ECertUntrusted{Reason: "no matching root certificate"}
+	}
+	if s.revocation == nil {
+		return nil
+	}
+	// The root is trusted as configured, check everything below it
+	now := time.Now()
+	chain := chains[0]
+	for i := 0; i < len(chain)-1; i++ {
+		if err = s.revocation.CheckRevocation(chain[i], chain[i+1], now); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func (s *sshaken_verifier) check_tn_authorization(cert *x509.Certificate, orig_tn string) error {
+	tn_auth, err := ParseTnAuthList(cert)
+	if err != nil {
+		return &ECertUntrusted{Reason: err.Error()}
+	}
+	if tn_auth.CoversTN(orig_tn) {
+		return nil
+	}
+	if len(tn_auth.SPCs) > 0 {
+		if s.spc_lookup == nil {
+			return nil
+		}
+		if spc, ok := s.spc_lookup(orig_tn); ok && tn_auth.HasSPC(spc) {
+			return nil
+		}
+	}
+	return &ETNNotAuthorized{TN: orig_tn}
+}
+
 func build_unsigned_pport(iat_ts time.Time, attest, cr_url, orig_tn, dest_tn, origid string) string {
 	hdr := sshaken_header{
 		Alg: "ES256",
-		Ppt: "shaken",
+		Ppt: PPT_SHAKEN,
 		Typ: "passport",
 		X5u: cr_url,
 	}
-	hdr_json_str, _ := json.Marshal(hdr)
-
 	payload := sshaken_payload{
 		Attest: attest,
 		Dest: sshaken_dest{
@@ -141,15 +205,31 @@ func build_unsigned_pport(iat_ts time.Time, attest, cr_url, orig_tn, dest_tn, or
 		},
 		Origid: origid,
 	}
+	return encode_unsigned_pport(hdr, payload)
+}
+
+func encode_unsigned_pport(hdr sshaken_header, payload sshaken_payload) string {
+	hdr_json_str, _ := json.Marshal(hdr)
 	payload_json_str, _ := json.Marshal(payload)
 	return sippy_utils.B64EncodeNoPad(hdr_json_str) + "." + sippy_utils.B64EncodeNoPad(payload_json_str)
 }
 
 func verify_signature(cert *x509.Certificate, passport *sshaken_passport, iat_ts time.Time, orig_tn, dest_tn string) error {
+	unsigned_buf := build_unsigned_pport(iat_ts, passport.Attest(), passport.X5u(), orig_tn, dest_tn, passport.Origid())
+	return check_signature(cert, passport, unsigned_buf)
+}
+
+// verify_raw_signature checks the signature over the header and the
+// payload as received. The claims of "div" and "rcd" PASSporTs are not
+// reconstructed.
+func verify_raw_signature(cert *x509.Certificate, passport *sshaken_passport) error {
+	return check_signature(cert, passport, passport.signed_buf)
+}
+
+func check_signature(cert *x509.Certificate, passport *sshaken_passport, unsigned_buf string) error {
 	if len(passport.signature) != 64 {
 		return fmt.Errorf("Bad raw signature length %d, should be 64", len(passport.signature))
 	}
-	unsigned_buf := build_unsigned_pport(iat_ts, passport.Attest(), passport.X5u(), orig_tn, dest_tn, passport.Origid())
 	r := big.NewInt(0).SetBytes(passport.signature[:32])
 	s := big.NewInt(0).SetBytes(passport.signature[32:])
 	hash := sha256.Sum256([]byte(unsigned_buf))
@@ -163,21 +243,6 @@ func verify_signature(cert *x509.Certificate, passport *sshaken_passport, iat_ts
 	return nil
 }
 
-func load_cert(cert_buf []byte) (*x509.Certificate, error) {
-	if len(cert_buf) == 0 {
-		return nil, errors.New("empty certificate")
-	}
-	block, _ := pem.Decode(cert_buf)
-	if block == nil {
-		return nil, errors.New("error decoding a certificate")
-	}
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	return cert, nil
-}
-
 func ParseIdentity(hdr_buf string) (*sshaken_passport, error) {
 	arr := strings.SplitN(hdr_buf, ";", 2)
 	if len(arr) != 2 {
@@ -191,7 +256,9 @@ func ParseIdentity(hdr_buf string) (*sshaken_passport, error) {
 	if len(params_arr) == 0 {
 		return nil, errors.New("Header parameters missing")
 	}
-	passport := &sshaken_passport{}
+	passport := &sshaken_passport{
+		signed_buf: arr[0][:strings.LastIndexByte(arr[0], '.')],
+	}
 
 	for _, param := range params_arr {
 		p_arr := strings.SplitN(param, "=", 2)
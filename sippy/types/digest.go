@@ -0,0 +1,16 @@
+package sippy_types
+
+// DigestUserStore provides the credentials for the digest authentication
+// of the incoming requests. The algorithm is the lower case name of the
+// hash without the "-sess" suffix, i.e. "md5", "sha-256" or "sha-512-256",
+// and the HA1 is the hex encoded H(username ":" realm ":" password).
+type DigestUserStore interface {
+	GetHA1(username, realm, algorithm string) (string, bool)
+}
+
+// DigestAuth authenticates the incoming requests. It returns the name of
+// the user or the challenge to be sent back if the request has not been
+// authenticated.
+type DigestAuth interface {
+	Authenticate(req SipRequest) (string, SipResponse)
+}
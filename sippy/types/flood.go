@@ -0,0 +1,45 @@
+package sippy_types
+
+import (
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+const (
+	FILTER_PASS = iota
+	FILTER_DROP
+	FILTER_REJECT
+)
+
+// RequestFilter is consulted by the transaction manager for every new
+// incoming request before the request is parsed. The method is taken
+// from the request line as is and the in_dialog tells whether the To
+// carries the tag. The FILTER_REJECT verdict makes the request rejected
+// with 503 and the Retry-After returned.
+type RequestFilter interface {
+	FilterRequest(source *sippy_net.HostPort, method string, in_dialog bool, now time.Time) (int, time.Duration)
+}
+
+// AuthFailureListener is notified every time the source sends the
+// credentials that fail the digest authentication.
+type AuthFailureListener interface {
+	AuthFailed(source *sippy_net.HostPort, now time.Time)
+}
+
+// BanEntry is the source the requests of which are dropped.
+type BanEntry struct {
+	Ip     string
+	Until  time.Time
+	Reason string
+}
+
+// RateLimiter is the RequestFilter that bans the sources failing the
+// authentication. The bans can also be managed manually.
+type RateLimiter interface {
+	RequestFilter
+	AuthFailureListener
+	Ban(ip string, duration time.Duration, reason string, now time.Time)
+	Unban(ip string) bool
+	Bans(now time.Time) []*BanEntry
+}
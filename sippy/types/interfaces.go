@@ -44,6 +44,7 @@ type SipMsg interface {
 	SetTarget(address *sippy_net.HostPort)
 	InsertFirstVia(*sippy_header.SipVia)
 	RemoveFirstVia()
+	GetRoutes() []*sippy_header.SipRoute
 	SetRoutes([]*sippy_header.SipRoute)
 	GetFrom() *sippy_header.SipFrom
 	GetRtime() *sippy_time.MonoTime
@@ -51,7 +52,9 @@ type SipMsg interface {
 	GetBody() MsgBody
 	SetBody(MsgBody)
 	GetContacts() []*sippy_header.SipContact
+	HasContactWildcard() bool
 	GetRecordRoutes() []*sippy_header.SipRecordRoute
+	InsertFirstRecordRoute(*sippy_header.SipRecordRoute)
 	GetCGUID() *sippy_header.SipCiscoGUID
 	GetH323ConfId() *sippy_header.SipH323ConfId
 	GetSource() *sippy_net.HostPort
@@ -64,6 +67,14 @@ type SipMsg interface {
 	GetSipRequire() []*sippy_header.SipRequire
 	GetSipSupported() []*sippy_header.SipSupported
 	GetSipDate() *sippy_header.SipDate
+	GetPAIs() []*sippy_header.SipPAssertedIdentity
+	GetPPIs() []*sippy_header.SipPPreferredIdentity
+	GetPrivacy() *sippy_header.SipPrivacy
+	GetDiversions() []*sippy_header.SipDiversion
+	GetHistoryInfos() []*sippy_header.SipHistoryInfo
+	GetSessionId() *sippy_header.SipSessionId
+	RemoveHeaders(name string)
+	ReplaceHeader(old, hdr sippy_header.SipHeader)
 }
 
 type SipRequest interface {
@@ -75,11 +86,13 @@ type SipRequest interface {
 	GetMethod() string
 	GetExpires() *sippy_header.SipExpires
 	GenACK(to *sippy_header.SipTo) (SipRequest, error)
+	SetNoUserAgent()
 	GenCANCEL() (SipRequest, error)
 	GetRURI() *sippy_header.SipURL
 	SetRURI(ruri *sippy_header.SipURL)
 	GetReferTo() *sippy_header.SipReferTo
 	GetNated() bool
+	GetCopy() SipRequest
 }
 
 type SipResponse interface {
@@ -104,6 +117,20 @@ type MsgBody interface {
 	SetNeedsUpdate(bool)
 	GetSdp() (Sdp, error)
 	AppendAHeader(string)
+	IsMultipart() bool
+	GetParts() ([]MsgBodyPart, error)
+	GetPart(mtype string) MsgBodyPart
+	AddPart(MsgBodyPart) error
+	ReplacePart(mtype string, part MsgBodyPart) bool
+	RemovePart(mtype string) bool
+}
+
+type MsgBodyPart interface {
+	GetMtype() string
+	GetHeaders() []sippy_header.SipHeader
+	AppendHeader(sippy_header.SipHeader)
+	GetBody() MsgBody
+	GetCopy() MsgBodyPart
 }
 
 type Sdp interface {
@@ -198,6 +225,9 @@ type UA interface {
 	IsYours(SipRequest, bool) bool
 	GetLocalUA() *sippy_header.SipUserAgent
 	SetLocalUA(*sippy_header.SipUserAgent)
+	SetNoLocalUA(bool)
+	GetSessionUUIDs() *SessionUUIDs
+	SetSessionUUIDs(*SessionUUIDs)
 	Enqueue(CCEvent)
 	GetUasResp() SipResponse
 	SetUasResp(SipResponse)
@@ -302,6 +332,7 @@ type ServerTransaction interface {
 	IncomingRequest(req SipRequest, checksum string)
 	TimersAreActive() bool
 	SetCancelCB(func(*sippy_time.MonoTime, SipRequest))
+	SetCancelResponse(SipResponse)
 	SetNoackCB(func(*sippy_time.MonoTime))
 	SendResponse(resp SipResponse, retrans bool, ack_cb func(SipRequest))
 	SendResponseWithLossEmul(resp SipResponse, retrans bool, ack_cb func(SipRequest), lossemul int)
@@ -356,6 +387,23 @@ type CCEvent interface {
 
 type StatefulProxy interface {
 	RequestReceiver
+	SetRouter(func(SipRequest) []*sippy_net.HostPort)
+	SetRecordRoute(bool)
+	HasOurRoute(SipRequest) bool
+}
+
+type Registrar interface {
+	RequestReceiver
+	Lookup(aor string) []*Binding
+}
+
+type RegistrationAgent interface {
+	ResponseReceiver
+	SetCallbacks(func(time.Duration), func(string))
+	Start()
+	Stop()
+	GetStatus() (string, time.Time, string)
+	IsRegistered() bool
 }
 
 type OnRingingListener func(*sippy_time.MonoTime, string, int)
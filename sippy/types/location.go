@@ -0,0 +1,39 @@
+package sippy_types
+
+import (
+	"time"
+
+	"github.com/egovorukhin/go-b2bua/sippy/net"
+)
+
+// Binding is the contact address registered for the address-of-record
+// (RFC 3261 section 10).
+type Binding struct {
+	Aor     string
+	Contact string
+	// Source address of the REGISTER if it differs from the address in
+	// the Contact, i.e. the UA is behind NAT.
+	Received *sippy_net.HostPort
+	// The Path header field values (RFC 3327) in the order received
+	Path      []string
+	CallId    string
+	CSeq      int
+	Q         float64
+	Expires   time.Time
+	UserAgent string
+}
+
+func (s *Binding) GetCopy() *Binding {
+	tmp := *s
+	tmp.Path = append([]string{}, s.Path...)
+	return &tmp
+}
+
+// LocationStore keeps the bindings created by the registrar. The
+// implementations should never return bindings that have expired.
+type LocationStore interface {
+	Lookup(aor string, now time.Time) ([]*Binding, error)
+	Update(binding *Binding) error
+	Remove(aor, contact string) error
+	RemoveAll(aor string) error
+}
@@ -0,0 +1,45 @@
+package sippy_types
+
+import (
+	"sync"
+)
+
+// SessionUUIDs keeps the UUIDs of the both ends of the communication
+// session (RFC 7989). The B2BUA shares the same instance between the
+// call legs so that the Session-ID passes through it unchanged.
+type SessionUUIDs struct {
+	lock   sync.Mutex
+	caller string
+	callee string
+}
+
+func NewSessionUUIDs(caller, callee string) *SessionUUIDs {
+	return &SessionUUIDs{
+		caller: caller,
+		callee: callee,
+	}
+}
+
+func (s *SessionUUIDs) GetCaller() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.caller
+}
+
+func (s *SessionUUIDs) SetCaller(uuid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.caller = uuid
+}
+
+func (s *SessionUUIDs) GetCallee() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.callee
+}
+
+func (s *SessionUUIDs) SetCallee(uuid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.callee = uuid
+}
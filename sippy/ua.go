@@ -43,6 +43,8 @@ type Ua struct {
 	outbound_proxy         *sippy_net.HostPort
 	rAddr                  *sippy_net.HostPort
 	local_ua               *sippy_header.SipUserAgent
+	no_local_ua            bool
+	session_uuids          *sippy_types.SessionUUIDs
 	username               string
 	password               string
 	extra_headers          []sippy_header.SipHeader
@@ -145,6 +147,7 @@ func (s *Ua) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransac
 	if s.remote_ua == "" {
 		s.update_ua(req)
 	}
+	s.updateSessionUUIDs(req, s.origin != "callee")
 	cseq_body, err := req.GetCSeq().GetBody()
 	if err != nil || (s.rCSeq != -1 && s.rCSeq >= cseq_body.CSeq) {
 		return &sippy_types.UaContext{
@@ -219,6 +222,7 @@ func (s *Ua) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTra
 		return
 	}
 	s.update_ua(resp)
+	s.updateSessionUUIDs(resp, s.origin == "caller")
 	code, _ := resp.GetSCode()
 	orig_req, cseq_found := s.reqs[cseq_body.CSeq]
 	if cseq_body.Method == "INVITE" && !s.pass_auth && cseq_found {
@@ -366,6 +370,9 @@ func (s *Ua) GenRequest(method string, body sippy_types.MsgBody, challenge sippy
 	if err != nil {
 		return nil, err
 	}
+	if s.no_local_ua {
+		req.SetNoUserAgent()
+	}
 	if challenge != nil {
 		entity_body := ""
 		if body != nil {
@@ -506,6 +513,40 @@ func (s *Ua) update_ua(msg sippy_types.SipMsg) {
 	}
 }
 
+// updateSessionUUIDs learns the UUID of the remote party from the
+// Session-ID (RFC 7989) of the incoming message.
+func (s *Ua) updateSessionUUIDs(msg sippy_types.SipMsg, from_caller bool) {
+	if s.session_uuids == nil || msg.GetSessionId() == nil {
+		return
+	}
+	body, err := msg.GetSessionId().GetBody()
+	if err != nil || body.Local == sippy_header.NULL_SESSION_UUID {
+		return
+	}
+	if from_caller {
+		s.session_uuids.SetCaller(body.Local)
+	} else {
+		s.session_uuids.SetCallee(body.Local)
+	}
+}
+
+// sessionId returns the Session-ID for the outgoing message, the local
+// UUID of the UAS side of the dialog is the one of the callee.
+func (s *Ua) sessionId(from_caller bool) *sippy_header.SipSessionId {
+	if from_caller {
+		return sippy_header.NewSipSessionId(s.session_uuids.GetCaller(), s.session_uuids.GetCallee())
+	}
+	return sippy_header.NewSipSessionId(s.session_uuids.GetCallee(), s.session_uuids.GetCaller())
+}
+
+func (s *Ua) GetSessionUUIDs() *sippy_types.SessionUUIDs {
+	return s.session_uuids
+}
+
+func (s *Ua) SetSessionUUIDs(session_uuids *sippy_types.SessionUUIDs) {
+	s.session_uuids = session_uuids
+}
+
 func (s *Ua) CancelCreditTimer() {
 	//print("UA::cancelCreditTimer()")
 	if s.credit_timer != nil {
@@ -853,6 +894,15 @@ func (s *Ua) SetLocalUA(ua *sippy_header.SipUserAgent) {
 	s.local_ua = ua
 }
 
+// SetNoLocalUA makes the UA send neither the User-Agent in the requests
+// nor the Server in the responses, e.g. for the topology hiding.
+func (s *Ua) SetNoLocalUA(no_local_ua bool) {
+	s.no_local_ua = no_local_ua
+	if no_local_ua {
+		s.local_ua = nil
+	}
+}
+
 func (s *Ua) Enqueue(event sippy_types.CCEvent) {
 	s.equeue = append(s.equeue, event)
 }
@@ -1174,10 +1224,16 @@ func (s *Ua) Config() sippy_conf.Config {
 	return s.config
 }
 
-func (s *Ua) BeforeResponseSent(sippy_types.SipResponse) {
+func (s *Ua) BeforeResponseSent(resp sippy_types.SipResponse) {
+	if s.session_uuids != nil {
+		resp.AppendHeader(s.sessionId(s.origin == "callee"))
+	}
 }
 
-func (s *Ua) BeforeRequestSent(sippy_types.SipRequest) {
+func (s *Ua) BeforeRequestSent(req sippy_types.SipRequest) {
+	if s.session_uuids != nil {
+		req.AppendHeader(s.sessionId(s.origin != "caller"))
+	}
 }
 
 func (s *Ua) OnUacSetupComplete() {
@@ -49,7 +49,7 @@ func (s *UaStateConnected) RecvRequest(req sippy_types.SipRequest, t sippy_types
 	}
 	if req.GetMethod() == "INVITE" {
 		s.ua.SetUasResp(req.GenResponse(100, "Trying", nil, s.ua.GetLocalUA().AsSipServer()))
-		t.SendResponse(s.ua.GetUasResp(), false, nil)
+		t.SendResponse(s.ua.GetUasResp().GetCopy(), false, nil)
 		body := req.GetBody()
 		rsdp := s.ua.GetRSDP()
 		if body != nil && rsdp != nil && rsdp.String() == body.String() {
@@ -5,6 +5,7 @@ import (
 
 	"github.com/egovorukhin/go-b2bua/sippy/conf"
 	"github.com/egovorukhin/go-b2bua/sippy/headers"
+	"github.com/egovorukhin/go-b2bua/sippy/net"
 	"github.com/egovorukhin/go-b2bua/sippy/time"
 	"github.com/egovorukhin/go-b2bua/sippy/types"
 )
@@ -60,13 +61,21 @@ func (s *UacStateIdle) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaStat
 			return nil, nil, err
 		}
 		rUri.GetUrl().Port = nil
-		s.ua.SetLUri(sippy_header.NewSipFrom(sippy_header.NewSipAddress(event.GetCallerName(), sippy_header.NewSipURL(event.GetCLI(), s.config.GetMyAddress(), s.config.GetMyPort(), false)), s.config))
+		from_host, from_port := s.config.GetMyAddress(), s.config.GetMyPort()
+		if event.GetFromHost() != "" {
+			// The From does not point to us, i.e. the anonymous one
+			from_host, from_port = sippy_net.NewMyAddress(event.GetFromHost()), nil
+		}
+		s.ua.SetLUri(sippy_header.NewSipFrom(sippy_header.NewSipAddress(event.GetCallerName(), sippy_header.NewSipURL(event.GetCLI(), from_host, from_port, false)), s.config))
 		s.ua.RegConsumer(s.ua, s.ua.GetCallId().CallId)
 		lUri, err = s.ua.GetLUri().GetBody(s.config)
 		if err != nil {
 			return nil, nil, err
 		}
 		lUri.GetUrl().Port = nil
+		if len(event.GetFromUserParams()) > 0 {
+			lUri.GetUrl().SetUserParams(event.GetFromUserParams())
+		}
 		lUri.SetTag(s.ua.GetLTag())
 		s.ua.SetLCSeq(200)
 		if s.ua.GetLContact() == nil {
@@ -87,6 +96,21 @@ func (s *UacStateIdle) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaStat
 		if event.GetMaxForwards() != nil {
 			eh = append(eh, event.GetMaxForwards())
 		}
+		for _, pai := range event.GetAssertedIdentity() {
+			eh = append(eh, pai)
+		}
+		for _, ppi := range event.GetPreferredIdentity() {
+			eh = append(eh, ppi)
+		}
+		if event.GetPrivacy() != nil {
+			eh = append(eh, event.GetPrivacy())
+		}
+		for _, diversion := range event.GetDiversion() {
+			eh = append(eh, diversion)
+		}
+		for _, hist_info := range event.GetHistoryInfo() {
+			eh = append(eh, hist_info)
+		}
 		s.ua.OnUacSetupComplete()
 		req, err = s.ua.GenRequest("INVITE", body /*Challenge*/, nil, eh...)
 		if err != nil {
@@ -52,7 +52,9 @@ func (s *UasStateIdle) RecvRequest(req sippy_types.SipRequest, t sippy_types.Ser
 	s.ua.SetRTarget(contact.GetUrl().GetCopy())
 	s.ua.UpdateRouting(s.ua.GetUasResp() /*update_rtarget*/, false /*reverse_routes*/, false)
 	s.ua.SetRAddr0(s.ua.GetRAddr())
-	t.SendResponseWithLossEmul(s.ua.GetUasResp(), false, nil, s.ua.GetUasLossEmul())
+	// Send a copy, the response may be altered by the hooks and the
+	// later responses are built from the original
+	t.SendResponseWithLossEmul(s.ua.GetUasResp().GetCopy(), false, nil, s.ua.GetUasLossEmul())
 	to_body, err = s.ua.GetUasResp().GetTo().GetBody(s.config)
 	if err != nil {
 		s.config.ErrorLogger().Error("UasStateIdle::RecvRequest: #2: " + err.Error())
@@ -84,6 +86,11 @@ func (s *UasStateIdle) RecvRequest(req sippy_types.SipRequest, t sippy_types.Ser
 	}
 	event.SetReason(req.GetReason())
 	event.SetMaxForwards(req.GetMaxForwards())
+	event.SetAssertedIdentity(req.GetPAIs())
+	event.SetPreferredIdentity(req.GetPPIs())
+	event.SetPrivacy(req.GetPrivacy())
+	event.SetDiversion(req.GetDiversions())
+	event.SetHistoryInfo(req.GetHistoryInfos())
 	if s.ua.GetExpireTime() > 0 {
 		s.ua.SetExMtime(event.GetRtime().Add(s.ua.GetExpireTime()))
 	}
@@ -75,7 +75,7 @@ func (s *UasStateRinging) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaS
 		if code == 0 {
 			code, reason = 500, "Failed"
 		}
-		s.ua.SendUasResponse(nil, code, reason, nil, nil, false, eh...)
+		s.ua.SendUasResponse(nil, code, reason, event.body, nil, false, eh...)
 		s.ua.CancelExpireTimer()
 		s.ua.SetDisconnectTs(event.GetRtime())
 		return NewUaStateFailed(s.ua, s.config), func() { s.ua.FailCb(event.GetRtime(), event.GetOrigin(), code) }, nil
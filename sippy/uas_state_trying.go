@@ -85,7 +85,7 @@ func (s *UasStateTrying) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaSt
 		if code == 0 {
 			code, reason = 500, "Failed"
 		}
-		s.ua.SendUasResponse(nil, code, reason, nil, nil, false, eh...)
+		s.ua.SendUasResponse(nil, code, reason, event.body, nil, false, eh...)
 		s.ua.CancelExpireTimer()
 		s.ua.CancelNoProgressTimer()
 		s.ua.SetDisconnectTs(event.GetRtime())